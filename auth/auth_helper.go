@@ -2,6 +2,7 @@ package dockerauth
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
 	"strings"
 
@@ -25,6 +26,10 @@ type CheckAccessOptions struct {
 	AzureSubscriptionID    string `yaml:"azure-subscription-id"`
 	AzureTenantID          string `yaml:"azure-tenant-id"`
 	AzureResourceGroupName string `yaml:"azure-resource-group"`
+	GCPServiceAccountKey   string `yaml:"gcp-service-account-key"`
+	GCPRegistry            string `yaml:"gcp-registry"`
+	InsecureRegistry       bool   `yaml:"insecure-registry"`
+	RegistryCACert         string `yaml:"registry-ca-cert"`
 }
 
 func (a *CheckAccessOptions) Interpolate(env *util.Environment) {
@@ -42,6 +47,9 @@ func (a *CheckAccessOptions) Interpolate(env *util.Environment) {
 	a.AzureSubscriptionID = env.Interpolate(a.AzureSubscriptionID)
 	a.AzureTenantID = env.Interpolate(a.AzureTenantID)
 	a.AzureResourceGroupName = env.Interpolate(a.AzureResourceGroupName)
+	a.GCPServiceAccountKey = env.Interpolate(a.GCPServiceAccountKey)
+	a.GCPRegistry = env.Interpolate(a.GCPRegistry)
+	a.RegistryCACert = env.Interpolate(a.RegistryCACert)
 }
 
 const (
@@ -51,20 +59,34 @@ const (
 var ErrNoAuthenticator = errors.New("Unable to make authenticator for this registry")
 
 func NormalizeRegistry(address string) string {
+	return normalizeRegistry(address, "https")
+}
+
+// NormalizeInsecureRegistry is like NormalizeRegistry but addresses the
+// registry over plain http, for self-hosted registries without TLS.
+func NormalizeInsecureRegistry(address string) string {
+	return normalizeRegistry(address, "http")
+}
+
+func normalizeRegistry(address string, scheme string) string {
 	logger := util.RootLogger().WithField("Logger", "Docker")
 	if address == "" {
 		logger.Debugln("No registry address provided, using https://registry.hub.docker.com")
 		return DockerRegistryV2
 	}
 
+	// host:port/prefix doesn't parse as a url without a scheme
+	if !strings.Contains(address, "://") {
+		address = scheme + "://" + address
+	}
 	parsed, err := url.Parse(address)
 	if err != nil {
 		logger.Errorln("Registry address is invalid, this will probably fail:", address)
 		return address
 	}
-	if parsed.Scheme != "https" {
-		logger.Warnln("Registry address is expected to begin with 'https://', forcing it to use https")
-		parsed.Scheme = "https"
+	if parsed.Scheme != scheme {
+		logger.Warnf("Registry address is expected to begin with '%s://', forcing it to use %s", scheme, scheme)
+		parsed.Scheme = scheme
 		address = parsed.String()
 	}
 	if strings.HasSuffix(address, "/") {
@@ -74,17 +96,81 @@ func NormalizeRegistry(address string) string {
 	parts := strings.Split(address, "/")
 	possiblyAPIVersionStr := parts[len(parts)-1]
 
-	// send them a v1 registry if they don't specify
+	// send them a v1 registry if they don't specify, unless the registry is
+	// served under a path prefix, which only v2 registries like Harbor and
+	// Nexus are
 	if possiblyAPIVersionStr != "v1" && possiblyAPIVersionStr != "v2" {
-		newParts := append(parts, "v1")
+		version := "v1"
+		if strings.Trim(parsed.Path, "/") != "" {
+			version = "v2"
+		}
+		newParts := append(parts, version)
 		address = strings.Join(newParts, "/")
 	}
 	return address + "/"
 }
 
+// credentialField is a setting of a cloud registry and the name of the
+// property it is set with
+type credentialField struct {
+	name  string
+	value string
+}
+
+// missingCredentials returns the names of the fields without a value, if at
+// least one of fields has one
+func missingCredentials(fields []credentialField) []string {
+	missing := []string{}
+	set := false
+	for _, field := range fields {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		} else {
+			set = true
+		}
+	}
+	if !set {
+		return nil
+	}
+	return missing
+}
+
+// ValidateCloudCredentials checks that the AWS and Azure settings of opts
+// are complete when any of them is set. GetRegistryAuthenticator only uses
+// them if they all are, otherwise the push fails later with an
+// authentication error that doesn't say what is wrong.
+func ValidateCloudCredentials(opts CheckAccessOptions) error {
+	missing := missingCredentials([]credentialField{
+		{"aws-access-key", opts.AwsAccessKey},
+		{"aws-secret-key", opts.AwsSecretKey},
+		{"aws-region", opts.AwsRegion},
+		{"aws-registry-id", opts.AwsRegistryID},
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("Incomplete Amazon ECR settings, missing %s", strings.Join(missing, ", "))
+	}
+
+	missing = missingCredentials([]credentialField{
+		{"azure-client-id", opts.AzureClientID},
+		{"azure-client-secret", opts.AzureClientSecret},
+		{"azure-tenant-id", opts.AzureTenantID},
+		{"azure-subscription-id", opts.AzureSubscriptionID},
+		{"azure-resource-group", opts.AzureResourceGroupName},
+		{"azure-registry-name", opts.AzureRegistryName},
+		{"azure-login-server", opts.AzureLoginServer},
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("Incomplete Azure Container Registry settings, missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 func GetRegistryAuthenticator(opts CheckAccessOptions) (auth.Authenticator, error) {
 	//calls to this function probably already have normalized registries, but call it again jic
 	reg := NormalizeRegistry(opts.Registry)
+	if opts.InsecureRegistry {
+		reg = NormalizeInsecureRegistry(opts.Registry)
+	}
 
 	//try to get domain and check if you're pushing to ecr, so you can make an ecr auth checker
 	if opts.AwsAccessKey != "" && opts.AwsSecretKey != "" && opts.AwsRegion != "" && opts.AwsRegistryID != "" {
@@ -95,6 +181,14 @@ func GetRegistryAuthenticator(opts CheckAccessOptions) (auth.Authenticator, erro
 		return auth.NewAzure(opts.AzureClientID, opts.AzureClientSecret, opts.AzureSubscriptionID, opts.AzureTenantID, opts.AzureResourceGroupName, opts.AzureRegistryName, opts.AzureLoginServer)
 	}
 
+	if opts.GCPServiceAccountKey != "" {
+		token, err := GCPAccessToken(GCPTokenOptions{ServiceAccountKey: opts.GCPServiceAccountKey})
+		if err != nil {
+			return nil, err
+		}
+		return auth.NewDockerAuth(GCPRegistryURL(opts.GCPRegistry), GCPRegistryUsername, token), nil
+	}
+
 	parts := strings.Split(reg, "/")
 	apiVersion := parts[len(parts)-2]
 	if apiVersion == "v1" {
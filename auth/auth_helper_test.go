@@ -26,6 +26,39 @@ func (a *AuthHelperSuite) TestNormalizeRegistry() {
 	a.Equal(dockv1, NormalizeRegistry("http://index.docker.io"))
 	a.Equal(dockv1, NormalizeRegistry("index.docker.io"))
 	a.Equal("https://quay.io/v2/", NormalizeRegistry("quay.io/v2/"))
+
+	// Registries under a path prefix are v2 registries
+	prefixed := "https://registry.example.com:8443/docker/v2/"
+	a.Equal(prefixed, NormalizeRegistry("https://registry.example.com:8443/docker/"))
+	a.Equal(prefixed, NormalizeRegistry("registry.example.com:8443/docker"))
+	a.Equal(prefixed, NormalizeRegistry("https://registry.example.com:8443/docker/v2"))
+}
+
+func (a *AuthHelperSuite) TestNormalizeInsecureRegistry() {
+	local := "http://registry.local:5000/v2/"
+	a.Equal(local, NormalizeInsecureRegistry("http://registry.local:5000/v2"))
+	a.Equal(local, NormalizeInsecureRegistry("https://registry.local:5000/v2/"))
+	a.Equal("http://registry.local:5000/v1/", NormalizeInsecureRegistry("http://registry.local:5000"))
+}
+
+func (a *AuthHelperSuite) TestValidateCloudCredentials() {
+	a.NoError(ValidateCloudCredentials(CheckAccessOptions{Username: "user", Password: "secret"}))
+	a.NoError(ValidateCloudCredentials(CheckAccessOptions{
+		AwsAccessKey:  "key",
+		AwsSecretKey:  "secret",
+		AwsRegion:     "us-east-1",
+		AwsRegistryID: "12345",
+	}))
+
+	err := ValidateCloudCredentials(CheckAccessOptions{AwsAccessKey: "key", AwsSecretKey: "secret"})
+	a.EqualError(err, "Incomplete Amazon ECR settings, missing aws-region, aws-registry-id")
+
+	err = ValidateCloudCredentials(CheckAccessOptions{
+		AzureClientID:     "client",
+		AzureClientSecret: "secret",
+		AzureLoginServer:  "app.azurecr.io",
+	})
+	a.EqualError(err, "Incomplete Azure Container Registry settings, missing azure-tenant-id, azure-subscription-id, azure-resource-group, azure-registry-name")
 }
 
 func TestExampleTestSuite(t *testing.T) {
@@ -0,0 +1,182 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// DeviceFlowOptions configures an OAuth 2.0 device authorization grant
+// (RFC 8628) used to obtain a registry token for interactive pushes.
+type DeviceFlowOptions struct {
+	DeviceAuthURL string
+	TokenURL      string
+	ClientID      string
+	Scope         string
+
+	// Interactive should be true only if a user is around to open the
+	// verification URL, the flow fails right away otherwise
+	Interactive bool
+
+	// Prompt is called with the verification URL and user code the user
+	// has to enter there
+	Prompt func(verificationURI, userCode string)
+
+	// Client is used for the requests, defaults to http.DefaultClient
+	Client *http.Client
+
+	// sleep waits between polls until ctx is done, overridden in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+var (
+	// ErrDeviceFlowNotInteractive is returned when the device flow is
+	// requested without a terminal to show the user code on.
+	ErrDeviceFlowNotInteractive = errors.New("auth-mode device requires an interactive terminal, configure a username and password for non-interactive pushes")
+
+	// ErrDeviceFlowExpired is returned when the user did not complete the
+	// authorization before the device code expired.
+	ErrDeviceFlowExpired = errors.New("device code expired before authorization was completed")
+)
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// DeviceFlowToken runs the device authorization grant: it requests a device
+// code, passes the verification URL and user code to opts.Prompt and polls
+// the token endpoint until the user has authorized the request or ctx is
+// done. The resulting access token can be used as the registry password.
+func DeviceFlowToken(ctx context.Context, opts DeviceFlowOptions) (string, error) {
+	if !opts.Interactive {
+		return "", ErrDeviceFlowNotInteractive
+	}
+	if opts.DeviceAuthURL == "" || opts.TokenURL == "" || opts.ClientID == "" {
+		return "", errors.New("auth-mode device requires device-auth-url, device-token-url and device-client-id")
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.sleep == nil {
+		opts.sleep = sleepContext
+	}
+
+	form := url.Values{"client_id": {opts.ClientID}}
+	if opts.Scope != "" {
+		form.Set("scope", opts.Scope)
+	}
+	resp, err := ctxhttp.PostForm(ctx, opts.Client, opts.DeviceAuthURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to request device code from %s (%d)", opts.DeviceAuthURL, resp.StatusCode)
+	}
+	var code deviceCodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return "", err
+	}
+	if code.DeviceCode == "" {
+		return "", fmt.Errorf("No device code returned by %s", opts.DeviceAuthURL)
+	}
+
+	if opts.Prompt != nil {
+		verificationURI := code.VerificationURI
+		if code.VerificationURIComplete != "" {
+			verificationURI = code.VerificationURIComplete
+		}
+		opts.Prompt(verificationURI, code.UserCode)
+	}
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	expiresIn := time.Duration(code.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 15 * time.Minute
+	}
+
+	form = url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {code.DeviceCode},
+		"client_id":   {opts.ClientID},
+	}
+	for waited := time.Duration(0); waited < expiresIn; waited += interval {
+		if err := opts.sleep(ctx, interval); err != nil {
+			return "", err
+		}
+
+		token, err := pollDeviceToken(ctx, opts, form)
+		if err != nil {
+			return "", err
+		}
+		switch token.Error {
+		case "":
+			if token.AccessToken == "" {
+				return "", fmt.Errorf("No access token returned by %s", opts.TokenURL)
+			}
+			return token.AccessToken, nil
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		case "expired_token":
+			return "", ErrDeviceFlowExpired
+		default:
+			if token.ErrorDescription != "" {
+				return "", fmt.Errorf("Device authorization failed: %s: %s", token.Error, token.ErrorDescription)
+			}
+			return "", fmt.Errorf("Device authorization failed: %s", token.Error)
+		}
+	}
+	return "", ErrDeviceFlowExpired
+}
+
+// sleepContext waits for d, or returns the error of ctx once it is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func pollDeviceToken(ctx context.Context, opts DeviceFlowOptions, form url.Values) (*deviceTokenResponse, error) {
+	resp, err := ctxhttp.PostForm(ctx, opts.Client, opts.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	token := &deviceTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return nil, fmt.Errorf("Unable to parse token response from %s (%d): %v", opts.TokenURL, resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK && token.Error == "" {
+		return nil, fmt.Errorf("Unable to request token from %s (%d)", opts.TokenURL, resp.StatusCode)
+	}
+	token.Error = strings.TrimSpace(token.Error)
+	return token, nil
+}
@@ -0,0 +1,122 @@
+package dockerauth
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+type DeviceFlowSuite struct {
+	*util.TestSuite
+}
+
+func TestDeviceFlowSuite(t *testing.T) {
+	suiteTester := &DeviceFlowSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// deviceFlowServer mocks the device authorization and token endpoints, the
+// token endpoint reports pending until it has been polled pending times
+func deviceFlowServer(pending int, tokenError string) *httptest.Server {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "wercker" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"device_code":"dev123","user_code":"ABCD-EFGH","verification_uri":"https://example.com/device","expires_in":60,"interval":1}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("device_code") != "dev123" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		polls++
+		if polls <= pending {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"authorization_pending"}`)
+			return
+		}
+		if tokenError != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":%q}`, tokenError)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"s3cr3t","token_type":"bearer"}`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func deviceFlowTestOptions(server *httptest.Server, out *bytes.Buffer) DeviceFlowOptions {
+	return DeviceFlowOptions{
+		DeviceAuthURL: server.URL + "/device",
+		TokenURL:      server.URL + "/token",
+		ClientID:      "wercker",
+		Interactive:   true,
+		Prompt: func(verificationURI, userCode string) {
+			fmt.Fprintln(out, verificationURI, userCode)
+		},
+		sleep: func(ctx context.Context, d time.Duration) error { return ctx.Err() },
+	}
+}
+
+func (s *DeviceFlowSuite) TestDeviceFlowToken() {
+	server := deviceFlowServer(2, "")
+	defer server.Close()
+
+	out := new(bytes.Buffer)
+	token, err := DeviceFlowToken(context.Background(), deviceFlowTestOptions(server, out))
+	s.Nil(err)
+	s.Equal("s3cr3t", token)
+	s.Contains(out.String(), "https://example.com/device")
+	s.Contains(out.String(), "ABCD-EFGH")
+}
+
+func (s *DeviceFlowSuite) TestDeviceFlowDenied() {
+	server := deviceFlowServer(1, "access_denied")
+	defer server.Close()
+
+	_, err := DeviceFlowToken(context.Background(), deviceFlowTestOptions(server, new(bytes.Buffer)))
+	s.NotNil(err)
+	s.Contains(err.Error(), "access_denied")
+}
+
+func (s *DeviceFlowSuite) TestDeviceFlowExpired() {
+	server := deviceFlowServer(1000, "")
+	defer server.Close()
+
+	_, err := DeviceFlowToken(context.Background(), deviceFlowTestOptions(server, new(bytes.Buffer)))
+	s.Equal(ErrDeviceFlowExpired, err)
+}
+
+func (s *DeviceFlowSuite) TestDeviceFlowNotInteractive() {
+	server := deviceFlowServer(0, "")
+	defer server.Close()
+
+	opts := deviceFlowTestOptions(server, new(bytes.Buffer))
+	opts.Interactive = false
+	_, err := DeviceFlowToken(context.Background(), opts)
+	s.Equal(ErrDeviceFlowNotInteractive, err)
+}
+
+func (s *DeviceFlowSuite) TestDeviceFlowCanceled() {
+	server := deviceFlowServer(1000, "")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := deviceFlowTestOptions(server, new(bytes.Buffer))
+	opts.Prompt = func(string, string) { cancel() }
+	_, err := DeviceFlowToken(ctx, opts)
+	s.Equal(context.Canceled, err)
+}
@@ -0,0 +1,125 @@
+package dockerauth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubHosts are the names docker uses for the docker hub, its
+// credentials are stored under any of them
+var dockerHubHosts = []string{"https://index.docker.io/v1/", "index.docker.io", "docker.io", "registry-1.docker.io"}
+
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+	CredsStore  string                      `json:"credsStore"`
+}
+
+type dockerConfigAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// DockerConfigPath returns the path of the docker config file, in
+// $DOCKER_CONFIG or ~/.docker.
+func DockerConfigPath() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// DockerConfigCredentials looks up the credentials for the registry host in
+// the docker config file at path, using the credential helper configured
+// for the host or the default credentials store if there is one. Empty
+// credentials are returned if the file doesn't exist or has none for host.
+func DockerConfigCredentials(path, host string) (username, password string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	config := &dockerConfigFile{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return "", "", fmt.Errorf("Invalid docker config %s: %v", path, err)
+	}
+
+	keys := []string{host, "https://" + host, "http://" + host}
+	if isDockerHub(host) {
+		keys = dockerHubHosts
+	}
+
+	for _, key := range keys {
+		if helper, ok := config.CredHelpers[key]; ok {
+			return credentialHelperGet(helper, key)
+		}
+	}
+	if config.CredsStore != "" {
+		return credentialHelperGet(config.CredsStore, keys[0])
+	}
+	for _, key := range keys {
+		if a, ok := config.Auths[key]; ok {
+			return a.credentials()
+		}
+	}
+	return "", "", nil
+}
+
+func isDockerHub(host string) bool {
+	for _, h := range dockerHubHosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+func (a dockerConfigAuth) credentials() (string, string, error) {
+	if a.Auth == "" {
+		return a.Username, a.Password, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid auth in docker config: %v", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Invalid auth in docker config, expected username:password")
+	}
+	return parts[0], parts[1], nil
+}
+
+// credentialHelperGet asks docker-credential-<helper> for the credentials
+// of serverURL, credentials the helper doesn't know are returned empty.
+func credentialHelperGet(helper, serverURL string) (string, string, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Helpers report unknown servers on stdout
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("docker-credential-%s failed: %v %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", fmt.Errorf("Invalid output of docker-credential-%s: %v", helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
@@ -0,0 +1,76 @@
+package dockerauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type DockerConfigSuite struct {
+	*util.TestSuite
+}
+
+func TestDockerConfigSuite(t *testing.T) {
+	suiteTester := &DockerConfigSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *DockerConfigSuite) writeConfig(config string) string {
+	path := filepath.Join(s.WorkingDir(), "config.json")
+	s.Require().NoError(ioutil.WriteFile(path, []byte(config), 0600))
+	return path
+}
+
+func (s *DockerConfigSuite) TestAuths() {
+	// dXNlcjpzM2NyM3Q= is user:s3cr3t
+	path := s.writeConfig(`{"auths":{
+		"quay.io":{"auth":"dXNlcjpzM2NyM3Q="},
+		"https://index.docker.io/v1/":{"username":"hubuser","password":"hubpass"}
+	}}`)
+
+	username, password, err := DockerConfigCredentials(path, "quay.io")
+	s.NoError(err)
+	s.Equal("user", username)
+	s.Equal("s3cr3t", password)
+
+	username, password, err = DockerConfigCredentials(path, "index.docker.io")
+	s.NoError(err)
+	s.Equal("hubuser", username)
+	s.Equal("hubpass", password)
+
+	username, password, err = DockerConfigCredentials(path, "registry.local:5000")
+	s.NoError(err)
+	s.Empty(username)
+	s.Empty(password)
+}
+
+func (s *DockerConfigSuite) TestMissingConfig() {
+	username, password, err := DockerConfigCredentials(filepath.Join(s.WorkingDir(), "missing.json"), "quay.io")
+	s.NoError(err)
+	s.Empty(username)
+	s.Empty(password)
+}
+
+func (s *DockerConfigSuite) TestCredentialHelper() {
+	helper := filepath.Join(s.WorkingDir(), "docker-credential-wercker")
+	script := "#!/bin/sh\nread server\n[ \"$server\" = registry.local:5000 ] || { echo credentials not found; exit 1; }\necho '{\"ServerURL\":\"registry.local:5000\",\"Username\":\"helper\",\"Secret\":\"t0k3n\"}'\n"
+	s.Require().NoError(ioutil.WriteFile(helper, []byte(script), 0755))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", s.WorkingDir()+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	path := s.writeConfig(`{"credHelpers":{"registry.local:5000":"wercker"}}`)
+	username, password, err := DockerConfigCredentials(path, "registry.local:5000")
+	s.NoError(err)
+	s.Equal("helper", username)
+	s.Equal("t0k3n", password)
+
+	path = s.writeConfig(`{"credsStore":"wercker"}`)
+	username, password, err = DockerConfigCredentials(path, "quay.io")
+	s.NoError(err)
+	s.Empty(username)
+	s.Empty(password)
+}
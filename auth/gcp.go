@@ -0,0 +1,145 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// GCPRegistryUsername is the username Google Container Registry and
+	// Artifact Registry expect together with an OAuth access token
+	GCPRegistryUsername = "oauth2accesstoken"
+
+	// DefaultGCPRegistry is used when no gcp-registry is configured
+	DefaultGCPRegistry = "gcr.io"
+
+	gcpTokenURL = "https://oauth2.googleapis.com/token"
+	gcpScope    = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// GCPTokenOptions configures exchanging a service account key for a
+// short-lived access token.
+type GCPTokenOptions struct {
+	// ServiceAccountKey is either the JSON key itself or the path to it
+	ServiceAccountKey string
+
+	// Client is used for the requests, defaults to http.DefaultClient
+	Client *http.Client
+
+	// now returns the current time, overridden in tests
+	now func() time.Time
+}
+
+type gcpServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// IsGCPRegistry reports whether host is Google Container Registry or
+// Artifact Registry, like gcr.io, eu.gcr.io or europe-docker.pkg.dev.
+func IsGCPRegistry(host string) bool {
+	host = strings.ToLower(host)
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+// GCPRegistryURL returns the v2 api url of a Google registry host, an
+// empty host defaults to DefaultGCPRegistry.
+func GCPRegistryURL(host string) *url.URL {
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	if host == "" {
+		host = DefaultGCPRegistry
+	}
+	return &url.URL{Scheme: "https", Host: host, Path: "/v2/"}
+}
+
+// GCPAccessToken signs a JWT with the service account key and exchanges it
+// for an access token (RFC 7523). The token can be used as the registry
+// password with GCPRegistryUsername.
+func GCPAccessToken(opts GCPTokenOptions) (string, error) {
+	key, err := readGCPServiceAccountKey(opts.ServiceAccountKey)
+	if err != nil {
+		return "", err
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+	tokenURL := key.TokenURI
+	if tokenURL == "" {
+		tokenURL = gcpTokenURL
+	}
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key.PrivateKey))
+	if err != nil {
+		return "", fmt.Errorf("Invalid private key in gcp-service-account-key: %v", err)
+	}
+	now := opts.now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   key.ClientEmail,
+		"scope": gcpScope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := opts.Client.PostForm(tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to request token from %s (%d)", tokenURL, resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("No access token returned by %s", tokenURL)
+	}
+	return token.AccessToken, nil
+}
+
+func readGCPServiceAccountKey(keyOrPath string) (*gcpServiceAccountKey, error) {
+	data := []byte(strings.TrimSpace(keyOrPath))
+	if len(data) == 0 {
+		return nil, errors.New("gcp-service-account-key is empty")
+	}
+	if data[0] != '{' {
+		var err error
+		data, err = ioutil.ReadFile(keyOrPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key := &gcpServiceAccountKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("Invalid gcp-service-account-key: %v", err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, errors.New("gcp-service-account-key requires client_email and private_key")
+	}
+	return key, nil
+}
@@ -0,0 +1,84 @@
+package dockerauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type GCPSuite struct {
+	*util.TestSuite
+}
+
+func TestGCPSuite(t *testing.T) {
+	suiteTester := &GCPSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *GCPSuite) TestIsGCPRegistry() {
+	s.True(IsGCPRegistry("gcr.io"))
+	s.True(IsGCPRegistry("eu.gcr.io"))
+	s.True(IsGCPRegistry("europe-west1-docker.pkg.dev"))
+	s.True(IsGCPRegistry("US.GCR.IO"))
+	s.False(IsGCPRegistry("quay.io"))
+	s.False(IsGCPRegistry("notgcr.io"))
+	s.False(IsGCPRegistry("docker.pkg.dev"))
+}
+
+func (s *GCPSuite) TestGCPRegistryURL() {
+	s.Equal("https://gcr.io/v2/", GCPRegistryURL("").String())
+	s.Equal("https://eu.gcr.io/v2/", GCPRegistryURL("eu.gcr.io").String())
+	s.Equal("https://us-docker.pkg.dev/v2/", GCPRegistryURL("https://us-docker.pkg.dev/v2").String())
+}
+
+func (s *GCPSuite) TestGCPAccessToken() {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	s.Require().NoError(err)
+
+	now := time.Unix(1500000000, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		claims := jwt.MapClaims{}
+		parser := &jwt.Parser{SkipClaimsValidation: true}
+		_, err := parser.ParseWithClaims(r.Form.Get("assertion"), claims, func(*jwt.Token) (interface{}, error) {
+			return &privateKey.PublicKey, nil
+		})
+		if err != nil || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || claims["iss"] != "pusher@project.iam.gserviceaccount.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"ya29.token","expires_in":3600}`)
+	}))
+	defer server.Close()
+
+	key, err := json.Marshal(gcpServiceAccountKey{
+		ClientEmail: "pusher@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})),
+		TokenURI:    server.URL,
+	})
+	s.Require().NoError(err)
+
+	token, err := GCPAccessToken(GCPTokenOptions{
+		ServiceAccountKey: string(key),
+		now:               func() time.Time { return now },
+	})
+	s.NoError(err)
+	s.Equal("ya29.token", token)
+
+	_, err = GCPAccessToken(GCPTokenOptions{ServiceAccountKey: `{"client_email":"pusher@project.iam.gserviceaccount.com"}`})
+	s.Error(err)
+
+	_, err = GCPAccessToken(GCPTokenOptions{ServiceAccountKey: "/does/not/exist.json"})
+	s.Error(err)
+}
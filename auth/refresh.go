@@ -0,0 +1,99 @@
+package dockerauth
+
+import (
+	"sync"
+
+	"github.com/wercker/docker-check-access"
+)
+
+// Refresher is implemented by authenticators whose credentials are short
+// lived tokens that can be fetched again, like the ones of AWS and Azure.
+type Refresher interface {
+	// Refresh fetches new credentials, Username and Password return them
+	// afterwards
+	Refresh() error
+}
+
+// HasExpiringCredentials reports whether opts use a cloud registry whose
+// tokens expire, the authenticator may need a refresh during long pushes.
+func HasExpiringCredentials(opts CheckAccessOptions) bool {
+	return opts.AwsSecretKey != "" || opts.AzureClientSecret != "" || opts.GCPServiceAccountKey != ""
+}
+
+// RefreshingAuthenticator wraps an authenticator with expiring credentials
+// and replaces it with a freshly created one on Refresh.
+type RefreshingAuthenticator struct {
+	mu            sync.Mutex
+	authenticator auth.Authenticator
+	opts          CheckAccessOptions
+	repository    string
+	scope         auth.Scope
+
+	// newAuthenticator creates the wrapped authenticator, overridden in tests
+	newAuthenticator func(CheckAccessOptions) (auth.Authenticator, error)
+}
+
+// NewRefreshingAuthenticator wraps authenticator, which was created from
+// opts.
+func NewRefreshingAuthenticator(authenticator auth.Authenticator, opts CheckAccessOptions) *RefreshingAuthenticator {
+	return &RefreshingAuthenticator{
+		authenticator:    authenticator,
+		opts:             opts,
+		newAuthenticator: GetRegistryAuthenticator,
+	}
+}
+
+func (r *RefreshingAuthenticator) current() auth.Authenticator {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.authenticator
+}
+
+// CheckAccess checks access with the wrapped authenticator, the repository
+// and scope are checked again after a refresh.
+func (r *RefreshingAuthenticator) CheckAccess(repository string, scope auth.Scope) (bool, error) {
+	r.mu.Lock()
+	r.repository = repository
+	r.scope = scope
+	r.mu.Unlock()
+	return r.current().CheckAccess(repository, scope)
+}
+
+// Repository returns the repository name of the wrapped authenticator
+func (r *RefreshingAuthenticator) Repository(repository string) string {
+	return r.current().Repository(repository)
+}
+
+// Username returns the username of the wrapped authenticator
+func (r *RefreshingAuthenticator) Username() string {
+	return r.current().Username()
+}
+
+// Password returns the password of the wrapped authenticator
+func (r *RefreshingAuthenticator) Password() string {
+	return r.current().Password()
+}
+
+// Refresh creates a new authenticator from the original options and checks
+// access with it, which fetches a new token. The current credentials are
+// kept if that fails.
+func (r *RefreshingAuthenticator) Refresh() error {
+	r.mu.Lock()
+	repository, scope := r.repository, r.scope
+	r.mu.Unlock()
+
+	authenticator, err := r.newAuthenticator(r.opts)
+	if err != nil {
+		return err
+	}
+	if repository != "" {
+		if _, err := authenticator.CheckAccess(repository, scope); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.authenticator = authenticator
+	r.mu.Unlock()
+	return nil
+}
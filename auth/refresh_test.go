@@ -0,0 +1,77 @@
+package dockerauth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/docker-check-access"
+	"github.com/wercker/wercker/util"
+)
+
+type RefreshSuite struct {
+	*util.TestSuite
+}
+
+func TestRefreshSuite(t *testing.T) {
+	suiteTester := &RefreshSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// tokenAuthenticator mocks an authenticator that fetches its token when
+// access is checked
+type tokenAuthenticator struct {
+	token   string
+	checked string
+}
+
+func (a *tokenAuthenticator) CheckAccess(repository string, scope auth.Scope) (bool, error) {
+	a.checked = repository
+	return true, nil
+}
+
+func (a *tokenAuthenticator) Repository(repository string) string {
+	return repository
+}
+
+func (a *tokenAuthenticator) Username() string {
+	return "AWS"
+}
+
+func (a *tokenAuthenticator) Password() string {
+	return a.token
+}
+
+func (s *RefreshSuite) TestHasExpiringCredentials() {
+	s.True(HasExpiringCredentials(CheckAccessOptions{AwsSecretKey: "secret"}))
+	s.True(HasExpiringCredentials(CheckAccessOptions{AzureClientSecret: "secret"}))
+	s.False(HasExpiringCredentials(CheckAccessOptions{Username: "user", Password: "secret"}))
+}
+
+func (s *RefreshSuite) TestRefresh() {
+	created := []*tokenAuthenticator{}
+	r := NewRefreshingAuthenticator(&tokenAuthenticator{token: "old"}, CheckAccessOptions{AwsSecretKey: "secret"})
+	r.newAuthenticator = func(opts CheckAccessOptions) (auth.Authenticator, error) {
+		s.Equal("secret", opts.AwsSecretKey)
+		a := &tokenAuthenticator{token: "new"}
+		created = append(created, a)
+		return a, nil
+	}
+
+	_, err := r.CheckAccess("12345.dkr.ecr.us-east-1.amazonaws.com/app", auth.Push)
+	s.NoError(err)
+	s.Equal("old", r.Password())
+
+	s.NoError(r.Refresh())
+	s.Equal("new", r.Password())
+	s.Equal("AWS", r.Username())
+	s.Len(created, 1)
+	s.Equal("12345.dkr.ecr.us-east-1.amazonaws.com/app", created[0].checked)
+
+	// Failed refreshes keep the current credentials
+	r.newAuthenticator = func(opts CheckAccessOptions) (auth.Authenticator, error) {
+		return nil, errors.New("no token")
+	}
+	s.Error(r.Refresh())
+	s.Equal("new", r.Password())
+}
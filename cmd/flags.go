@@ -102,6 +102,17 @@ var (
 			(~/.aws/config, AWS_SECRET_ACCESS_KEY, etc), or from the --aws-secret-key and
 			--aws-access-key flags. It will upload to a bucket defined by --s3-bucket in
 			the region named by --aws-region`},
+		cli.StringFlag{Name: "artifact-store", Value: "",
+			Usage: `Store artifacts and containers in the given store, s3 or local.
+			s3 is the same as --store-s3, local stores them in the working dir
+			or in --artifact-store-path.`},
+		cli.StringFlag{Name: "artifact-store-path", Value: "", Usage: "Directory of the local artifact store."},
+		cli.StringFlag{Name: "artifact-visibility", Value: "private",
+			Usage: `Who can read artifacts uploaded to s3, private or public.
+			Public artifacts are world-readable.`},
+		cli.Float64Flag{Name: "artifact-share-ttl", Value: 0,
+			Usage: `Minutes the read-only URL logged for every uploaded artifact
+			stays valid, no URL is created if it is 0. Only s3 supports it.`},
 	}
 
 	// These flags affect our local execution environment
@@ -111,6 +122,9 @@ var (
 		cli.BoolFlag{Name: "no-colors", Usage: "Wercker output will not use colors (does not apply to step output)."},
 		cli.BoolFlag{Name: "debug", Usage: "Print additional debug information."},
 		cli.BoolFlag{Name: "journal", Usage: "Send logs to systemd-journald. Suppresses stdout logging."},
+		cli.StringFlag{Name: "proxy", Value: "",
+			Usage: `HTTP(S) proxy for the connections to docker, registries and s3.
+			Overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY, which are used if it isn't set.`},
 	}
 
 	// These flags are advanced dev settings
@@ -162,6 +176,13 @@ var (
 		cli.StringFlag{Name: "aws-access-key", Value: "", Usage: "Access key id. Used for artifact storage."},
 		cli.StringFlag{Name: "s3-bucket", Value: "wercker-development", Usage: "Bucket for artifact storage."},
 		cli.StringFlag{Name: "aws-region", Value: "us-east-1", Usage: "AWS region to use for artifact storage."},
+		cli.StringFlag{Name: "s3-endpoint", Value: "", Usage: "URL of an S3 compatible service to use for artifact storage instead of AWS.", EnvVar: "WERCKER_S3_ENDPOINT"},
+		cli.IntFlag{Name: "s3-part-size", Value: core.DefaultS3PartSize,
+			Usage: `Size in MB of the parts of uploads to s3, at least 5.
+			Larger artifacts are uploaded in parts, every part is retried on its own.`},
+		cli.IntFlag{Name: "s3-upload-concurrency", Value: core.DefaultS3UploadConcurrency, Usage: "Number of parts of an upload to s3 that are uploaded at once."},
+		cli.StringFlag{Name: "s3-sse-kms-key-id", Value: "", Usage: "KMS key id to encrypt artifacts in s3 with.", EnvVar: "WERCKER_S3_SSE_KMS_KEY_ID"},
+		cli.StringFlag{Name: "s3-sse-customer-key", Value: "", Usage: "Base64 encoded 256 bit key to encrypt artifacts in s3 with.", EnvVar: "WERCKER_S3_SSE_CUSTOMER_KEY"},
 	}
 
 	// Wercker Reporter settings
@@ -1045,6 +1045,10 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 	if err != nil {
 		return nil, soft.Exit(err)
 	}
+	err = core.RequireArtifactStore(options)
+	if err != nil {
+		return nil, soft.Exit(err)
+	}
 
 	// Make sure that "include-file" is read from the config file before copying code
 	r.GetConfig()
@@ -1289,9 +1293,9 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 					})
 				}
 
-				if options.ShouldStoreS3 {
+				if options.ArtifactStore != "" {
 					artificer := dockerlocal.NewArtificer(options, dockerOptions)
-					err = artificer.Upload(artifact)
+					err = artificer.Upload(cmdCtx, artifact)
 					if err != nil {
 						sr.Message = err.Error()
 						e.Emit(core.Logs, &core.LogsArgs{
@@ -1301,7 +1305,7 @@ func executePipeline(cmdCtx context.Context, options *core.PipelineOptions, dock
 					}
 				}
 
-				sr.PackageURL = artifact.URL()
+				sr.PackageURL = core.ArtifactURL(options, artifact)
 			} else {
 				e.Emit(core.Logs, &core.LogsArgs{
 					Logs: "No artifacts found\n",
@@ -421,7 +421,7 @@ func (p *Runner) StartStep(ctx *RunnerShared, step core.Step, order int) *util.F
 		r := result.(*StepResult)
 		artifactURL := ""
 		if r.Artifact != nil {
-			artifactURL = r.Artifact.URL()
+			artifactURL = core.ArtifactURL(p.options, r.Artifact)
 		}
 		p.emitter.Emit(core.BuildStepFinished, &core.BuildStepFinishedArgs{
 			Box:                 ctx.box,
@@ -721,9 +721,9 @@ func (p *Runner) RunStep(shared *RunnerShared, step core.Step, order int) (*Step
 			return sr, err
 		}
 
-		if artifact != nil && p.options.ShouldStoreS3 {
+		if artifact != nil && p.options.ArtifactStore != "" {
 			artificer := dockerlocal.NewArtificer(p.options, p.dockerOptions)
-			err = artificer.Upload(artifact)
+			err = artificer.Upload(shared.sessionCtx, artifact)
 			if err != nil {
 				return sr, err
 			}
@@ -36,6 +36,9 @@ type Artifact struct {
 	Key           string
 	ContentType   string
 	Meta          map[string]*string
+	// ShareURL gives read access to the uploaded artifact until it expires,
+	// it is only set when artifacts are shared
+	ShareURL string
 }
 
 // URL returns the artifact's S3 url
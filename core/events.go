@@ -19,6 +19,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/chuckpreslar/emission"
 	"github.com/wercker/wercker/util"
@@ -49,6 +50,10 @@ const (
 	// FullPipelineFinished occurs when a pipeline finishes all it's steps,
 	// included after-steps.
 	FullPipelineFinished = "FullPipelineFinished"
+
+	// PushFinished is the event when a docker push step has pushed its
+	// tags, it summarizes what was published.
+	PushFinished = "PushFinished"
 )
 
 // BuildStartedArgs contains the args associated with the "BuildStarted" event.
@@ -73,6 +78,18 @@ type LogsArgs struct {
 	Logs    string
 	Stream  string
 	Hidden  bool
+	// Progress is set when the logs report the progress of a single layer
+	Progress *LayerProgress
+}
+
+// LayerProgress contains the progress of a single layer of a docker push or
+// pull.
+type LayerProgress struct {
+	ID         string
+	Status     string
+	Current    int64
+	Total      int64
+	Percentage float64
 }
 
 // BuildStepsAddedArgs contains the args associated with the
@@ -121,6 +138,38 @@ type FullPipelineFinishedArgs struct {
 	AfterStepSuccessful bool
 }
 
+// PushFinishedArgs contains the args associated with the "PushFinished"
+// event.
+type PushFinishedArgs struct {
+	Options *PipelineOptions
+	Build   Pipeline
+	Order   int
+	Step    Step
+	Summary *PushSummary
+}
+
+// PushSummary describes the images a push step published.
+type PushSummary struct {
+	Repository string      `json:"repository"`
+	Tags       []PushedTag `json:"tags"`
+	// BytesPushed is the total size of the layers that were uploaded,
+	// layers the registry already had don't count
+	BytesPushed int64 `json:"bytesPushed"`
+	// LayersPushed is the number of layers that were uploaded and
+	// LayersExisting the number of layers the registry already had, over
+	// all tags
+	LayersPushed   int `json:"layersPushed"`
+	LayersExisting int `json:"layersExisting"`
+	// Duration of the push in nanoseconds
+	Duration time.Duration `json:"duration"`
+}
+
+// PushedTag is a tag and the digest it was pushed with
+type PushedTag struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
 // DebugHandler dumps events
 type DebugHandler struct {
 	logger *util.LogEntry
@@ -187,6 +236,7 @@ func (h *DebugHandler) ListenTo(e *NormalizedEmitter) {
 	e.AddListener(BuildStepStarted, h.Handler("BuildStepStarted"))
 	e.AddListener(BuildStepFinished, h.Handler("BuildStepFinished"))
 	e.AddListener(FullPipelineFinished, h.Handler("FullPipelineFinished"))
+	e.AddListener(PushFinished, h.Handler("PushFinished"))
 }
 
 // NormalizedEmitter wraps the emission.Emitter and is smart enough about
@@ -278,6 +328,22 @@ func (e *NormalizedEmitter) Emit(event interface{}, args interface{}) {
 			a.Options = e.options
 		}
 		e.Emitter.Emit(event, a)
+	// Add options, build, step, order
+	case PushFinished:
+		a := args.(*PushFinishedArgs)
+		if a.Options == nil {
+			a.Options = e.options
+		}
+		if a.Build == nil {
+			a.Build = e.build
+		}
+		if a.Step == nil {
+			a.Step = e.currentStep
+		}
+		if a.Order == 0 {
+			a.Order = e.currentOrder
+		}
+		e.Emitter.Emit(event, a)
 	// Just add the options
 	case FullPipelineFinished:
 		a := args.(*FullPipelineFinishedArgs)
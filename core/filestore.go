@@ -0,0 +1,257 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+// NewFileStore creates a FileStore storing files in baseDir
+func NewFileStore(baseDir string) *FileStore {
+	return &FileStore{
+		baseDir: baseDir,
+		logger:  util.RootLogger().WithField("Logger", "FileStore"),
+	}
+}
+
+// FileStore stores files in a directory on local disk, keys are paths
+// relative to it like the keys of the S3 store. Files are written to a
+// temporary file first, readers never see a partially stored file.
+type FileStore struct {
+	baseDir string
+	logger  *util.LogEntry
+}
+
+// Check checks that files can be written to baseDir
+func (s *FileStore) Check() error {
+	err := os.MkdirAll(s.baseDir, 0755)
+	if err == nil {
+		var tmp *os.File
+		tmp, err = ioutil.TempFile(s.baseDir, ".check-")
+		if err == nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf(`Artifacts can't be stored in the directory:
+	%s
+%v`, s.baseDir, err)
+	}
+	return nil
+}
+
+// StoreFromFile copies the file from args.Path to baseDir + args.Key.
+//
+// Deprecated: use StoreFromFileContext.
+func (s *FileStore) StoreFromFile(args *StoreFromFileArgs) (*StoreResult, error) {
+	return s.StoreFromFileContext(context.Background(), args)
+}
+
+// StoreFromFileContext copies the file from args.Path to baseDir +
+// args.Key. With SkipIfUnchanged the SHA256 of the file is kept in a
+// .sha256 file next to it.
+func (s *FileStore) StoreFromFileContext(ctx context.Context, args *StoreFromFileArgs) (*StoreResult, error) {
+	if err := ValidateStoreVisibility(args.Visibility); err != nil {
+		return nil, err
+	}
+	dst := filepath.Join(s.baseDir, filepath.FromSlash(args.Key))
+	fields := util.LogFields{
+		"Path": args.Path,
+		"Key":  args.Key,
+	}
+	result := &StoreResult{Location: dst}
+	if !args.SkipIfUnchanged {
+		s.logger.WithFields(fields).Info("Storing file")
+		if err := copyStoreFile(ctx, args.Path, dst); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	sum, err := fileSHA256(args.Path)
+	if err != nil {
+		return nil, err
+	}
+	sumPath := dst + ".sha256"
+	if stored, err := ioutil.ReadFile(sumPath); err == nil && strings.TrimSpace(string(stored)) == sum {
+		if _, err := os.Stat(dst); err == nil {
+			s.logger.WithFields(fields).Info("File unchanged, skipped")
+			result.Skipped = true
+			return result, nil
+		}
+	}
+	s.logger.WithFields(fields).Info("Storing file")
+	if err := copyStoreFile(ctx, args.Path, dst); err != nil {
+		return nil, err
+	}
+	if err := writeStoreFile(sumPath, strings.NewReader(sum+"\n")); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// StoreFromReader copies r to baseDir + key.
+func (s *FileStore) StoreFromReader(ctx context.Context, key string, r io.Reader, size int64) (*StoreResult, error) {
+	dst := filepath.Join(s.baseDir, filepath.FromSlash(key))
+	s.logger.WithFields(util.LogFields{
+		"Key":  key,
+		"Size": size,
+	}).Info("Storing stream")
+	if err := writeStoreFile(dst, &contextReader{ctx: ctx, r: &sizeReader{r: r, size: size}}); err != nil {
+		return nil, err
+	}
+	return &StoreResult{Location: dst}, nil
+}
+
+// Fetch copies the file at baseDir + args.Key to args.Path.
+//
+// Deprecated: use FetchContext.
+func (s *FileStore) Fetch(args *FetchArgs) error {
+	return s.FetchContext(context.Background(), args)
+}
+
+// FetchContext copies the file at baseDir + args.Key to args.Path. It fails
+// with a StoreNotFoundError if there is no such file.
+func (s *FileStore) FetchContext(ctx context.Context, args *FetchArgs) error {
+	src := filepath.Join(s.baseDir, filepath.FromSlash(args.Key))
+	fields := util.LogFields{
+		"Path": args.Path,
+		"Key":  args.Key,
+	}
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		s.logger.WithFields(fields).Info("File not found")
+		return &StoreNotFoundError{Key: args.Key}
+	}
+	s.logger.WithFields(fields).Info("Fetching file")
+	return copyStoreFile(ctx, src, args.Path)
+}
+
+// List returns the files in baseDir with keys that start with prefix, in
+// lexical order. Temporary files and the .sha256 files of stored files are
+// left out.
+func (s *FileStore) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.Walk(s.baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || isStoreTempFile(info.Name()) {
+			return nil
+		}
+		if strings.HasSuffix(path, ".sha256") {
+			if _, err := os.Stat(strings.TrimSuffix(path, ".sha256")); err == nil {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(s.baseDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Delete removes the file at baseDir + key and its .sha256 file
+func (s *FileStore) Delete(key string) error {
+	dst := filepath.Join(s.baseDir, filepath.FromSlash(key))
+	s.logger.WithField("Key", key).Info("Deleting file")
+	for _, path := range []string{dst, dst + ".sha256"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyStoreFile copies src to dst with writeStoreFile until ctx is done
+func copyStoreFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeStoreFile(dst, &contextReader{ctx: ctx, r: in})
+}
+
+// writeStoreFile writes r to dst through a temporary file next to dst that
+// is renamed once complete, so dst is never partially written.
+func writeStoreFile(dst string, r io.Reader) error {
+	tmp, err := createStoreTempFile(dst)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	return commitStoreFile(tmp, dst)
+}
+
+// createStoreTempFile creates the temporary file next to dst that dst is
+// written to, the caller removes it unless commitStoreFile renamed it.
+func createStoreTempFile(dst string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-")
+}
+
+// isStoreTempFile returns whether name is the name of a file created by
+// createStoreTempFile
+func isStoreTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-")
+}
+
+// commitStoreFile closes the complete temporary file tmp and renames it to
+// dst
+func commitStoreFile(tmp *os.File, dst string) error {
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
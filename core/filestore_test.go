@@ -0,0 +1,252 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+type FileStoreSuite struct {
+	*util.TestSuite
+}
+
+func TestFileStoreSuite(t *testing.T) {
+	suiteTester := &FileStoreSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *FileStoreSuite) TestStoreAndFetch() {
+	dir := s.WorkingDir()
+	src := filepath.Join(dir, "artifact.tar")
+	s.Require().NoError(ioutil.WriteFile(src, []byte("artifact"), 0644))
+
+	store := NewFileStore(filepath.Join(dir, "store"))
+	key := "project-artifacts/app/run/artifacts.tar"
+	result, err := store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: key})
+	s.NoError(err)
+	s.Equal(filepath.Join(dir, "store", "project-artifacts", "app", "run", "artifacts.tar"), result.Location)
+	s.False(result.Skipped)
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "store", "project-artifacts", "app", "run", "artifacts.tar"))
+	s.NoError(err)
+	s.Equal("artifact", string(stored))
+
+	dst := filepath.Join(dir, "fetched", "artifact.tar")
+	s.NoError(store.Fetch(&FetchArgs{Key: key, Path: dst}))
+	fetched, err := ioutil.ReadFile(dst)
+	s.NoError(err)
+	s.Equal("artifact", string(fetched))
+
+	err = store.Fetch(&FetchArgs{Key: "project-artifacts/app/missing", Path: dst})
+	s.True(IsStoreNotFound(err))
+	s.Equal("project-artifacts/app/missing not found in store", err.Error())
+
+	// Only the complete files are left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "fetched"))
+	s.NoError(err)
+	s.Len(files, 1)
+	files, err = ioutil.ReadDir(filepath.Join(dir, "store", "project-artifacts", "app", "run"))
+	s.NoError(err)
+	s.Len(files, 1)
+}
+
+func (s *FileStoreSuite) TestStoreReplacesFile() {
+	dir := s.WorkingDir()
+	src := filepath.Join(dir, "artifact.tar")
+	store := NewFileStore(filepath.Join(dir, "store"))
+
+	for _, content := range []string{"first build", "second"} {
+		s.Require().NoError(ioutil.WriteFile(src, []byte(content), 0644))
+		_, err := store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: "cache/cache.tar"})
+		s.NoError(err)
+		stored, err := ioutil.ReadFile(filepath.Join(dir, "store", "cache", "cache.tar"))
+		s.NoError(err)
+		s.Equal(content, string(stored))
+	}
+}
+
+func (s *FileStoreSuite) TestNewArtifactStore() {
+	options := &PipelineOptions{WorkingDir: s.WorkingDir()}
+	store, err := NewArtifactStore(options)
+	s.NoError(err)
+	s.Nil(store)
+
+	options.ArtifactStore = ArtifactStoreLocal
+	store, err = NewArtifactStore(options)
+	s.NoError(err)
+	s.IsType(&FileStore{}, store)
+
+	art := &Artifact{ApplicationID: "app", RunID: "run"}
+	s.Equal("file://"+filepath.Join(s.WorkingDir(), "artifact-store", "project-artifacts", "app", "run"), ArtifactURL(options, art))
+
+	options.ArtifactStoreDir = "/var/lib/wercker/artifacts"
+	s.Equal("file:///var/lib/wercker/artifacts/project-artifacts/app/run", ArtifactURL(options, art))
+
+	options.ArtifactStore = ArtifactStoreS3
+	options.AWSOptions = &AWSOptions{AWSRegion: "us-east-1"}
+	store, err = NewArtifactStore(options)
+	s.NoError(err)
+	s.IsType(&S3Store{}, store)
+
+	options.ArtifactStore = "ftp"
+	_, err = NewArtifactStore(options)
+	s.Error(err)
+}
+
+func (s *FileStoreSuite) TestSkipIfUnchanged() {
+	dir := s.WorkingDir()
+	src := filepath.Join(dir, "cache.tar")
+	dst := filepath.Join(dir, "store", "cache", "cache.tar")
+	store := NewFileStore(filepath.Join(dir, "store"))
+	args := &StoreFromFileArgs{Path: src, Key: "cache/cache.tar", SkipIfUnchanged: true}
+
+	s.Require().NoError(ioutil.WriteFile(src, []byte("cache"), 0644))
+	result, err := store.StoreFromFile(args)
+	s.NoError(err)
+	s.False(result.Skipped)
+	sum, err := ioutil.ReadFile(dst + ".sha256")
+	s.NoError(err)
+	s.Equal("5e1ecee06a7fc06f305ae5c12acfe7a7f67b8ece7af76932ed3afab00c3c6921\n", string(sum))
+
+	// The stored file isn't touched when the source didn't change
+	s.Require().NoError(ioutil.WriteFile(dst, []byte("marker"), 0644))
+	result, err = store.StoreFromFile(args)
+	s.NoError(err)
+	s.True(result.Skipped)
+	stored, _ := ioutil.ReadFile(dst)
+	s.Equal("marker", string(stored))
+
+	s.Require().NoError(ioutil.WriteFile(src, []byte("changed cache"), 0644))
+	_, err = store.StoreFromFile(args)
+	s.NoError(err)
+	stored, _ = ioutil.ReadFile(dst)
+	s.Equal("changed cache", string(stored))
+}
+
+func (s *FileStoreSuite) TestStoreVisibility() {
+	s.NoError(ValidateStoreVisibility(""))
+	s.NoError(ValidateStoreVisibility(StoreVisibilityPublic))
+	s.Error(ValidateStoreVisibility("world-readable"))
+
+	dir := s.WorkingDir()
+	src := filepath.Join(dir, "artifact.tar")
+	s.Require().NoError(ioutil.WriteFile(src, []byte("artifact"), 0644))
+	store := NewFileStore(filepath.Join(dir, "store"))
+	_, err := store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: "artifact.tar", Visibility: "world-readable"})
+	s.Error(err)
+	_, err = os.Stat(filepath.Join(dir, "store", "artifact.tar"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *FileStoreSuite) TestStoreCanceled() {
+	dir := s.WorkingDir()
+	src := filepath.Join(dir, "artifact.tar")
+	s.Require().NoError(ioutil.WriteFile(src, []byte("artifact"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store := NewFileStore(filepath.Join(dir, "store"))
+	_, err := store.StoreFromFileContext(ctx, &StoreFromFileArgs{Path: src, Key: "artifact.tar"})
+	s.Equal(context.Canceled, err)
+	_, err = os.Stat(filepath.Join(dir, "store", "artifact.tar"))
+	s.True(os.IsNotExist(err))
+
+	_, err = store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: "artifact.tar"})
+	s.Require().NoError(err)
+	dst := filepath.Join(dir, "fetched.tar")
+	err = store.FetchContext(ctx, &FetchArgs{Key: "artifact.tar", Path: dst})
+	s.Equal(context.Canceled, err)
+	_, err = os.Stat(dst)
+	s.True(os.IsNotExist(err))
+}
+
+func (s *FileStoreSuite) TestStoreFromReader() {
+	dir := s.WorkingDir()
+	store := NewFileStore(filepath.Join(dir, "store"))
+	var _ ReaderStore = store
+
+	result, err := store.StoreFromReader(context.Background(), "cache/stream.tar", strings.NewReader("stream"), 6)
+	s.Require().NoError(err)
+	stored, err := ioutil.ReadFile(result.Location)
+	s.Require().NoError(err)
+	s.Equal("stream", string(stored))
+
+	_, err = store.StoreFromReader(context.Background(), "cache/unknown.tar", strings.NewReader("unknown"), -1)
+	s.NoError(err)
+
+	// A stream with a different size isn't stored
+	_, err = store.StoreFromReader(context.Background(), "cache/short.tar", strings.NewReader("short"), 10)
+	s.Error(err)
+	_, err = store.StoreFromReader(context.Background(), "cache/long.tar", strings.NewReader("too long"), 3)
+	s.Error(err)
+	files, err := ioutil.ReadDir(filepath.Join(dir, "store", "cache"))
+	s.Require().NoError(err)
+	s.Len(files, 2)
+}
+
+func (s *FileStoreSuite) TestListAndDelete() {
+	dir := s.WorkingDir()
+	store := NewFileStore(filepath.Join(dir, "store"))
+	var _ Lister = store
+
+	objects, err := store.List("")
+	s.Require().NoError(err)
+	s.Empty(objects)
+
+	src := filepath.Join(dir, "artifact.tar")
+	s.Require().NoError(ioutil.WriteFile(src, []byte("artifact"), 0644))
+	for _, key := range []string{"cache/a.tar", "cache/b.tar", "artifacts/c.tar"} {
+		_, err := store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: key, SkipIfUnchanged: true})
+		s.Require().NoError(err)
+	}
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "store", "cache", ".d.tar.tmp-1"), []byte("partial"), 0644))
+
+	objects, err = store.List("cache/")
+	s.Require().NoError(err)
+	s.Require().Len(objects, 2)
+	s.Equal("cache/a.tar", objects[0].Key)
+	s.Equal(int64(8), objects[0].Size)
+	s.False(objects[0].LastModified.IsZero())
+	s.Equal("cache/b.tar", objects[1].Key)
+
+	s.NoError(store.Delete("cache/a.tar"))
+	s.NoError(store.Delete("cache/missing.tar"))
+	objects, err = store.List("cache/")
+	s.Require().NoError(err)
+	s.Len(objects, 1)
+	_, err = os.Stat(filepath.Join(dir, "store", "cache", "a.tar.sha256"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *FileStoreSuite) TestCheck() {
+	dir := s.WorkingDir()
+	var _ Checker = NewFileStore(dir)
+	s.NoError(NewFileStore(filepath.Join(dir, "store")).Check())
+	files, err := ioutil.ReadDir(filepath.Join(dir, "store"))
+	s.Require().NoError(err)
+	s.Empty(files)
+
+	// A file where the directory should be
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "file"), []byte("file"), 0644))
+	s.Error(NewFileStore(filepath.Join(dir, "file", "store")).Check())
+}
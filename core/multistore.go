@@ -0,0 +1,156 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	// StoreQuorumAll requires every store of a MultiStore to succeed
+	StoreQuorumAll = "all"
+	// StoreQuorumAny requires at least one store of a MultiStore to succeed
+	StoreQuorumAny = "any"
+)
+
+// NewMultiStore creates a MultiStore writing to stores, quorum is either
+// StoreQuorumAll or StoreQuorumAny.
+func NewMultiStore(quorum string, stores ...Store) *MultiStore {
+	return &MultiStore{
+		stores: stores,
+		quorum: quorum,
+		logger: util.RootLogger().WithField("Logger", "MultiStore"),
+	}
+}
+
+// MultiStore stores files in multiple stores at once, for example to write
+// artifacts to both the old and new store during a migration.
+type MultiStore struct {
+	stores []Store
+	quorum string
+	logger *util.LogEntry
+}
+
+// StoreFromFile stores the file in all stores.
+//
+// Deprecated: use StoreFromFileContext.
+func (m *MultiStore) StoreFromFile(args *StoreFromFileArgs) (*StoreResult, error) {
+	return m.StoreFromFileContext(context.Background(), args)
+}
+
+// StoreFromFileContext stores the file in all stores concurrently. It fails
+// if any store fails with StoreQuorumAll, or if all of them fail with
+// StoreQuorumAny. The result is the one of the first store that succeeded,
+// in the order the stores were given.
+func (m *MultiStore) StoreFromFileContext(ctx context.Context, args *StoreFromFileArgs) (*StoreResult, error) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.stores))
+	results := make([]*StoreResult, len(m.stores))
+	for i, store := range m.stores {
+		wg.Add(1)
+		go func(i int, store Store) {
+			defer wg.Done()
+			// Stores may change their args, give each one its own copy
+			storeArgs := *args
+			start := time.Now()
+			result, err := store.StoreFromFileContext(ctx, &storeArgs)
+			fields := util.LogFields{
+				"Store":    fmt.Sprintf("%T", store),
+				"Key":      args.Key,
+				"Duration": time.Since(start),
+			}
+			if err != nil {
+				m.logger.WithFields(fields).WithError(err).Warn("Unable to store file")
+				errs[i] = fmt.Errorf("%T: %v", store, err)
+				return
+			}
+			m.logger.WithFields(fields).Info("Stored file")
+			results[i] = result
+		}(i, store)
+	}
+	wg.Wait()
+
+	var result *StoreResult
+	failures := []error{}
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		} else if result == nil {
+			result = results[i]
+		}
+	}
+	if m.quorum == StoreQuorumAny && len(failures) < len(m.stores) {
+		return result, nil
+	}
+	if err := util.SqaushErrors(failures); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Fetch fetches the file from the first store that has it.
+//
+// Deprecated: use FetchContext.
+func (m *MultiStore) Fetch(args *FetchArgs) error {
+	return m.FetchContext(context.Background(), args)
+}
+
+// FetchContext fetches the file from the first store that has it, the
+// other stores aren't tried once ctx is done. It fails with a
+// StoreNotFoundError if none of the stores has the file.
+func (m *MultiStore) FetchContext(ctx context.Context, args *FetchArgs) error {
+	failures := []error{}
+	notFound := 0
+	for _, store := range m.stores {
+		storeArgs := *args
+		err := store.FetchContext(ctx, &storeArgs)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		m.logger.WithFields(util.LogFields{
+			"Store": fmt.Sprintf("%T", store),
+			"Key":   args.Key,
+		}).WithError(err).Warn("Unable to fetch file")
+		if IsStoreNotFound(err) {
+			notFound++
+		}
+		failures = append(failures, fmt.Errorf("%T: %v", store, err))
+	}
+	if len(failures) == 0 {
+		return fmt.Errorf("No store to fetch %s from", args.Key)
+	}
+	if notFound == len(failures) {
+		return &StoreNotFoundError{Key: args.Key}
+	}
+	return util.SqaushErrors(failures)
+}
+
+// ShareURL shares the file with the first store that can share files
+func (m *MultiStore) ShareURL(key string, ttl time.Duration, access string) (string, error) {
+	for _, store := range m.stores {
+		if sharer, ok := store.(Sharer); ok {
+			return sharer.ShareURL(key, ttl, access)
+		}
+	}
+	return "", fmt.Errorf("No store to share %s from", key)
+}
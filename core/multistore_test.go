@@ -0,0 +1,125 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+type MultiStoreSuite struct {
+	*util.TestSuite
+}
+
+func TestMultiStoreSuite(t *testing.T) {
+	suiteTester := &MultiStoreSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// fakeStore records the key it stored or fetched and fails with err
+type fakeStore struct {
+	key string
+	err error
+}
+
+func (f *fakeStore) StoreFromFile(args *StoreFromFileArgs) (*StoreResult, error) {
+	return f.StoreFromFileContext(context.Background(), args)
+}
+
+func (f *fakeStore) StoreFromFileContext(ctx context.Context, args *StoreFromFileArgs) (*StoreResult, error) {
+	f.key = args.Key
+	args.MaxTries = 5
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &StoreResult{Location: fmt.Sprintf("%p/%s", f, args.Key)}, nil
+}
+
+func (f *fakeStore) Fetch(args *FetchArgs) error {
+	return f.FetchContext(context.Background(), args)
+}
+
+func (f *fakeStore) FetchContext(ctx context.Context, args *FetchArgs) error {
+	f.key = args.Key
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return f.err
+}
+
+func (s *MultiStoreSuite) TestStoreAll() {
+	a, b := &fakeStore{}, &fakeStore{}
+	args := &StoreFromFileArgs{Path: "/tmp/artifact.tar", Key: "project-artifacts/app/run"}
+	result, err := NewMultiStore(StoreQuorumAll, a, b).StoreFromFile(args)
+	s.NoError(err)
+	s.Equal(fmt.Sprintf("%p/%s", a, args.Key), result.Location)
+	s.Equal(args.Key, a.key)
+	s.Equal(args.Key, b.key)
+	s.Equal(0, args.MaxTries)
+
+	b.err = errors.New("bucket not found")
+	_, err = NewMultiStore(StoreQuorumAll, a, b).StoreFromFile(args)
+	s.Error(err)
+	s.Contains(err.Error(), "bucket not found")
+}
+
+func (s *MultiStoreSuite) TestStoreAny() {
+	a, b := &fakeStore{err: errors.New("bucket not found")}, &fakeStore{}
+	result, err := NewMultiStore(StoreQuorumAny, a, b).StoreFromFile(&StoreFromFileArgs{Key: "key"})
+	s.NoError(err)
+	s.Equal(fmt.Sprintf("%p/key", b), result.Location)
+
+	b.err = errors.New("access denied")
+	_, err = NewMultiStore(StoreQuorumAny, a, b).StoreFromFile(&StoreFromFileArgs{Key: "key"})
+	s.Error(err)
+	s.Contains(err.Error(), "access denied")
+	s.Contains(err.Error(), "bucket not found")
+}
+
+func (s *MultiStoreSuite) TestFetch() {
+	a, b := &fakeStore{err: errors.New("no such key")}, &fakeStore{}
+	err := NewMultiStore(StoreQuorumAll, a, b).Fetch(&FetchArgs{Key: "key", Path: "/tmp/artifact.tar"})
+	s.NoError(err)
+	s.Equal("key", a.key)
+	s.Equal("key", b.key)
+
+	b.err = errors.New("access denied")
+	err = NewMultiStore(StoreQuorumAll, a, b).Fetch(&FetchArgs{Key: "key"})
+	s.Error(err)
+	s.Contains(err.Error(), "no such key")
+	s.Contains(err.Error(), "access denied")
+
+	// A file none of the stores has is not found
+	a, b = &fakeStore{err: &StoreNotFoundError{Key: "key"}}, &fakeStore{err: &StoreNotFoundError{Key: "key"}}
+	err = NewMultiStore(StoreQuorumAll, a, b).Fetch(&FetchArgs{Key: "key"})
+	s.True(IsStoreNotFound(err))
+	b.err = errors.New("access denied")
+	err = NewMultiStore(StoreQuorumAll, a, b).Fetch(&FetchArgs{Key: "key"})
+	s.False(IsStoreNotFound(err))
+
+	// A canceled fetch doesn't try the next store
+	a, b = &fakeStore{}, &fakeStore{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = NewMultiStore(StoreQuorumAll, a, b).FetchContext(ctx, &FetchArgs{Key: "key"})
+	s.Equal(context.Canceled, err)
+	s.Equal("key", a.key)
+	s.Equal("", b.key)
+}
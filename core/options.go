@@ -16,6 +16,7 @@ package core
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +27,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/pborman/uuid"
@@ -44,6 +46,8 @@ type GlobalOptions struct {
 	Journal         bool
 	Verbose         bool
 	ShowColors      bool
+	// Proxy all HTTP connections go through, see util.ProxyFunc
+	Proxy string
 
 	// Auth
 	AuthToken      string
@@ -80,6 +84,10 @@ func NewGlobalOptions(c util.Settings, e *util.Environment) (*GlobalOptions, err
 	// TODO(termie): switch negative flag
 	showColors, _ := c.GlobalBool("no-colors")
 	showColors = !showColors
+	proxy, _ := c.GlobalString("proxy")
+	if _, err := util.ProxyFunc(proxy); err != nil {
+		return nil, err
+	}
 
 	authTokenStore, _ := c.GlobalString("auth-token-store")
 	authTokenStore = util.ExpandHomePath(authTokenStore, e.Get("HOME"))
@@ -98,6 +106,7 @@ func NewGlobalOptions(c util.Settings, e *util.Environment) (*GlobalOptions, err
 		Journal:         journal,
 		Verbose:         verbose,
 		ShowColors:      showColors,
+		Proxy:           proxy,
 
 		AuthToken:      authToken,
 		AuthTokenStore: authTokenStore,
@@ -111,9 +120,35 @@ type AWSOptions struct {
 	AWSSecretAccessKey string
 	AWSRegion          string
 	S3Bucket           string
-	S3PartSize         int64
+	// S3Endpoint is the URL of an S3 compatible service to use instead of
+	// the AWS endpoint of the region, buckets are addressed in the path of
+	// its URLs
+	S3Endpoint string
+	// S3PartSize is the size of the parts of multipart uploads, smaller
+	// files are uploaded with a single request
+	S3PartSize int64
+	// S3UploadConcurrency is the number of parts that are uploaded at once
+	S3UploadConcurrency int
+	// S3SSEKMSKeyID is the KMS key uploads are encrypted with, uploads are
+	// encrypted with the S3 managed key (AES256) if neither it nor
+	// S3SSECustomerKey is set
+	S3SSEKMSKeyID string
+	// S3SSECustomerKey is the 256 bit key uploads are encrypted with by S3,
+	// downloads have to send the same key
+	S3SSECustomerKey string
 }
 
+const (
+	// DefaultS3PartSize is the part size of uploads in MB unless
+	// s3-part-size is set
+	DefaultS3PartSize = 100
+	// minS3PartSize is the smallest part size in MB S3 accepts
+	minS3PartSize = 5
+	// DefaultS3UploadConcurrency is the number of parts uploaded at once
+	// unless s3-upload-concurrency is set
+	DefaultS3UploadConcurrency = 5
+)
+
 // NewAWSOptions constructor
 func NewAWSOptions(c util.Settings, e *util.Environment, globalOpts *GlobalOptions) (*AWSOptions, error) {
 	awsAccessKeyID, _ := c.String("aws-access-key")
@@ -121,13 +156,53 @@ func NewAWSOptions(c util.Settings, e *util.Environment, globalOpts *GlobalOptio
 	awsSecretAccessKey, _ := c.String("aws-secret-key")
 	s3Bucket, _ := c.String("s3-bucket")
 
+	s3Endpoint, _ := c.String("s3-endpoint")
+	if s3Endpoint != "" {
+		u, err := url.Parse(s3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid s3-endpoint %q, expected an http or https URL", s3Endpoint)
+		}
+	}
+
+	s3PartSize, ok := c.Int("s3-part-size")
+	if !ok {
+		s3PartSize = DefaultS3PartSize
+	}
+	if s3PartSize < minS3PartSize {
+		return nil, fmt.Errorf("Invalid s3-part-size %d, expected at least %d MB", s3PartSize, minS3PartSize)
+	}
+	s3UploadConcurrency, ok := c.Int("s3-upload-concurrency")
+	if !ok {
+		s3UploadConcurrency = DefaultS3UploadConcurrency
+	}
+	if s3UploadConcurrency < 1 {
+		return nil, fmt.Errorf("Invalid s3-upload-concurrency %d, expected at least 1", s3UploadConcurrency)
+	}
+
+	s3SSEKMSKeyID, _ := c.String("s3-sse-kms-key-id")
+	s3SSECustomerKey, _ := c.String("s3-sse-customer-key")
+	if s3SSECustomerKey != "" {
+		if s3SSEKMSKeyID != "" {
+			return nil, fmt.Errorf("Only one of s3-sse-kms-key-id and s3-sse-customer-key can be set")
+		}
+		key, err := base64.StdEncoding.DecodeString(s3SSECustomerKey)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Invalid s3-sse-customer-key, expected a base64 encoded 256 bit key")
+		}
+		s3SSECustomerKey = string(key)
+	}
+
 	return &AWSOptions{
-		GlobalOptions:      globalOpts,
-		AWSAccessKeyID:     awsAccessKeyID,
-		AWSRegion:          awsRegion,
-		AWSSecretAccessKey: awsSecretAccessKey,
-		S3Bucket:           s3Bucket,
-		S3PartSize:         100 * 1024 * 1024, // 100 MB
+		GlobalOptions:       globalOpts,
+		AWSAccessKeyID:      awsAccessKeyID,
+		AWSRegion:           awsRegion,
+		AWSSecretAccessKey:  awsSecretAccessKey,
+		S3Bucket:            s3Bucket,
+		S3Endpoint:          s3Endpoint,
+		S3PartSize:          int64(s3PartSize) * 1024 * 1024,
+		S3UploadConcurrency: s3UploadConcurrency,
+		S3SSEKMSKeyID:       s3SSEKMSKeyID,
+		S3SSECustomerKey:    s3SSECustomerKey,
 	}, nil
 }
 
@@ -317,6 +392,18 @@ type PipelineOptions struct {
 	Tag           string
 	Message       string
 	ShouldStoreS3 bool
+	// ArtifactStore is the store artifacts are uploaded to, see
+	// NewArtifactStore. Empty if they aren't uploaded.
+	ArtifactStore string
+	// ArtifactStoreDir is the directory of the local artifact store, see
+	// ArtifactStorePath
+	ArtifactStoreDir string
+	// ArtifactVisibility is who can read uploaded artifacts, see
+	// StoreVisibilityPrivate
+	ArtifactVisibility string
+	// ArtifactShareTTL is how long the URL to share an uploaded artifact
+	// stays valid, no URL is created if it is 0
+	ArtifactShareTTL time.Duration
 
 	WorkingDir string
 
@@ -515,6 +602,26 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 	tag := guessTag(c, e)
 	message := guessMessage(c, e)
 	shouldStoreS3, _ := c.Bool("store-s3")
+	artifactStore, _ := c.String("artifact-store")
+	artifactStoreDir, _ := c.String("artifact-store-path")
+	if artifactStoreDir != "" {
+		artifactStoreDir, _ = filepath.Abs(artifactStoreDir)
+	}
+	if artifactStore == "" && shouldStoreS3 {
+		artifactStore = ArtifactStoreS3
+	}
+	switch artifactStore {
+	case "", ArtifactStoreS3, ArtifactStoreLocal:
+	default:
+		return nil, fmt.Errorf("Invalid artifact store %q, expected %s or %s", artifactStore, ArtifactStoreS3, ArtifactStoreLocal)
+	}
+	artifactVisibility, _ := c.String("artifact-visibility")
+	if err := ValidateStoreVisibility(artifactVisibility); err != nil {
+		return nil, err
+	}
+
+	artifactShareTTLFloat, _ := c.Float64("artifact-share-ttl")
+	artifactShareTTL := time.Duration(artifactShareTTLFloat * float64(time.Minute))
 
 	workingDir, _ := c.String("working-dir")
 	workingDir, _ = filepath.Abs(workingDir)
@@ -580,6 +687,11 @@ func NewPipelineOptions(c util.Settings, e *util.Environment) (*PipelineOptions,
 		Repository:    repository,
 		ShouldCommit:  shouldCommit,
 		ShouldStoreS3: shouldStoreS3,
+		ArtifactStore: artifactStore,
+
+		ArtifactStoreDir:   artifactStoreDir,
+		ArtifactVisibility: artifactVisibility,
+		ArtifactShareTTL:   artifactShareTTL,
 
 		WorkingDir: workingDir,
 
@@ -655,6 +767,15 @@ func (o *PipelineOptions) ReportPath(s ...string) string {
 	return path.Join(o.ReportRoot, path.Join(s...))
 }
 
+// ArtifactStorePath returns the directory of the local artifact store,
+// artifact-store in the working dir unless configured
+func (o *PipelineOptions) ArtifactStorePath() string {
+	if o.ArtifactStoreDir != "" {
+		return o.ArtifactStoreDir
+	}
+	return path.Join(o.WorkingDir, "artifact-store")
+}
+
 // ContainerPath returns the path where exported containers live
 func (o *PipelineOptions) ContainerPath() string {
 	return path.Join(o.WorkingDir, "containers")
@@ -670,6 +791,12 @@ func (o *PipelineOptions) CachePath() string {
 	return path.Join(o.WorkingDir, "cache")
 }
 
+// LayerCachePath returns the path for caching generated image layers between
+// builds, unlike CachePath it is not exposed to the pipeline
+func (o *PipelineOptions) LayerCachePath() string {
+	return path.Join(o.WorkingDir, "layer-cache")
+}
+
 // ProjectDownloadPath returns the path where downloaded projects live
 func (o *PipelineOptions) ProjectDownloadPath() string {
 	return path.Join(o.WorkingDir, "projects")
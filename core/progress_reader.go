@@ -0,0 +1,68 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultProgressInterval is how often store progress is reported
+const DefaultProgressInterval = time.Second
+
+// ProgressFunc is called with the number of bytes sent so far and the total
+// size of the file
+type ProgressFunc func(sent, total int64)
+
+// progressReader counts the bytes read from r and reports them to progress
+// at most once per interval, and once more when r is exhausted.
+type progressReader struct {
+	r        io.Reader
+	total    int64
+	progress ProgressFunc
+	interval time.Duration
+
+	mu       sync.Mutex
+	sent     int64
+	reported time.Time
+}
+
+func newProgressReader(r io.Reader, total int64, progress ProgressFunc) *progressReader {
+	return &progressReader{
+		r:        r,
+		total:    total,
+		progress: progress,
+		interval: DefaultProgressInterval,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+
+	p.mu.Lock()
+	p.sent += int64(n)
+	sent := p.sent
+	report := err == io.EOF || time.Since(p.reported) >= p.interval
+	if report {
+		p.reported = time.Now()
+	}
+	p.mu.Unlock()
+
+	if report {
+		p.progress(sent, p.total)
+	}
+	return n, err
+}
@@ -0,0 +1,62 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type ProgressReaderSuite struct {
+	*util.TestSuite
+}
+
+func TestProgressReaderSuite(t *testing.T) {
+	suiteTester := &ProgressReaderSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *ProgressReaderSuite) TestProgress() {
+	data := bytes.Repeat([]byte("x"), 100)
+	reports := [][2]int64{}
+	r := newProgressReader(iotest.OneByteReader(bytes.NewReader(data)), int64(len(data)), func(sent, total int64) {
+		reports = append(reports, [2]int64{sent, total})
+	})
+
+	read, err := ioutil.ReadAll(r)
+	s.NoError(err)
+	s.Equal(data, read)
+	// The first read is reported right away, then nothing until the end
+	// within the interval
+	s.Equal([][2]int64{{1, 100}, {100, 100}}, reports)
+}
+
+func (s *ProgressReaderSuite) TestProgressEveryRead() {
+	reports := 0
+	r := newProgressReader(iotest.OneByteReader(bytes.NewReader([]byte("abc"))), 3, func(sent, total int64) {
+		reports++
+	})
+	r.interval = 0
+
+	_, err := ioutil.ReadAll(r)
+	s.NoError(err)
+	// Three reads of a byte and the final read returning io.EOF
+	s.Equal(4, reports)
+}
@@ -15,13 +15,26 @@
 package core
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
 )
 
 // NewS3Store creates a new S3Store
@@ -37,6 +50,18 @@ func NewS3Store(options *AWSOptions) *S3Store {
 		conf = conf.WithCredentials(creds)
 	}
 	conf = conf.WithRegion(options.AWSRegion)
+	if options.S3Endpoint != "" {
+		logger.WithField("Endpoint", options.S3Endpoint).Info("Using S3 endpoint")
+		conf = conf.WithEndpoint(options.S3Endpoint).WithS3ForcePathStyle(true)
+	}
+	if options.GlobalOptions != nil && options.Proxy != "" {
+		transport, err := util.NewProxyTransport(options.Proxy)
+		if err != nil {
+			logger.WithError(err).Warn("Ignoring proxy")
+		} else {
+			conf = conf.WithHTTPClient(&http.Client{Transport: transport})
+		}
+	}
 	sess := session.New(conf)
 
 	return &S3Store{
@@ -51,13 +76,84 @@ type S3Store struct {
 	session *session.Session
 	logger  *util.LogEntry
 	options *AWSOptions
+
+	clientMutex sync.Mutex
+	s3Client    *s3.S3
+}
+
+// client returns the S3 client of the store. It is created on first use and
+// shared by all requests of the store, which may run concurrently.
+func (s *S3Store) client() *s3.S3 {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	if s.s3Client == nil {
+		s.s3Client = s3.New(s.session)
+	}
+	return s.s3Client
+}
+
+// Reset drops the client of the store and expires its credentials, the
+// next request creates a new client with fresh credentials. Requests in
+// flight finish with the old client.
+func (s *S3Store) Reset() {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	s.s3Client = nil
+	if s.session.Config.Credentials != nil {
+		s.session.Config.Credentials.Expire()
+	}
+}
+
+// Check checks that the bucket of the options exists and is accessible
+// with the credentials of the options
+func (s *S3Store) Check() error {
+	_, err := s.client().HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(s.options.S3Bucket),
+	})
+	if err == nil {
+		return nil
+	}
+	s.logger.WithField("Bucket", s.options.S3Bucket).WithError(err).Debug("Unable to access S3 bucket")
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoCredentialProviders" {
+		return fmt.Errorf(`No AWS credentials were found to store artifacts in S3.
+To specify credentials use the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+variables, or the --aws-access-key and --aws-secret-key command-line flags.`)
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusNotFound:
+			return fmt.Errorf(`The S3 bucket to store artifacts in doesn't exist:
+	%s
+To specify a different bucket use the --s3-bucket command-line flag.`, s.options.S3Bucket)
+		case http.StatusForbidden:
+			return fmt.Errorf(`The AWS credentials can't access the S3 bucket to store artifacts in:
+	%s
+Check the credentials and the policy of the bucket, or specify a different bucket
+with the --s3-bucket command-line flag.`, s.options.S3Bucket)
+		}
+	}
+	return fmt.Errorf("Unable to access the S3 bucket %s to store artifacts in: %v", s.options.S3Bucket, err)
 }
 
 // StoreFromFile copies the file from args.Path to options.Bucket + args.Key.
-func (s *S3Store) StoreFromFile(args *StoreFromFileArgs) error {
+//
+// Deprecated: use StoreFromFileContext.
+func (s *S3Store) StoreFromFile(args *StoreFromFileArgs) (*StoreResult, error) {
+	return s.StoreFromFileContext(context.Background(), args)
+}
+
+// StoreFromFileContext copies the file from args.Path to options.Bucket +
+// args.Key. The version of the AWS SDK can't cancel requests, instead the
+// parts of the upload fail to read the file once ctx is done, which aborts
+// the upload.
+func (s *S3Store) StoreFromFileContext(ctx context.Context, args *StoreFromFileArgs) (*StoreResult, error) {
 	if args.MaxTries == 0 {
 		args.MaxTries = 1
 	}
+	acl, err := s3ACL(args.Visibility)
+	if err != nil {
+		return nil, err
+	}
 
 	s.logger.WithFields(util.LogFields{
 		"Bucket":   s.options.S3Bucket,
@@ -65,30 +161,73 @@ func (s *S3Store) StoreFromFile(args *StoreFromFileArgs) error {
 		"Region":   s.options.AWSRegion,
 		"S3Key":    args.Key,
 		"MaxTries": args.MaxTries,
+		"ACL":      acl,
 	}).Info("Uploading file to S3")
 
+	meta := args.Meta
+	if args.SkipIfUnchanged {
+		sum, err := fileSHA256(args.Path)
+		if err != nil {
+			s.logger.WithField("Error", err).Error("Unable to hash input file")
+			return nil, err
+		}
+		if remote := s.headObject(args.Key, nil); remote != nil && remoteSHA256(remote) == sum {
+			result := s.storeResult(args.Key, remote)
+			result.Skipped = true
+			s.logger.WithFields(util.LogFields{
+				"Bucket":    s.options.S3Bucket,
+				"S3Key":     args.Key,
+				"Sha256":    sum,
+				"ETag":      result.ETag,
+				"VersionID": result.VersionID,
+			}).Info("File unchanged, skipped upload to S3")
+			return result, nil
+		}
+		// Don't change the meta data of the caller
+		meta = make(map[string]*string, len(args.Meta)+1)
+		for k, v := range args.Meta {
+			meta[k] = v
+		}
+		meta[s3SHA256Meta] = aws.String(sum)
+	}
+
 	file, err := os.Open(args.Path)
 	if err != nil {
 		s.logger.WithField("Error", err).Error("Unable to open input file")
-		return err
+		return nil, err
 	}
 	defer file.Close()
 
-	var outerErr error
-	uploadManager := s3manager.NewUploader(s.session, func(u *s3manager.Uploader) {
-		u.PartSize = s.options.S3PartSize
-	})
-	for try := 1; try <= args.MaxTries; try++ {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = uploadManager.Upload(&s3manager.UploadInput{
-			ACL:                  aws.String("private"),
-			Body:                 file,
-			Bucket:               aws.String(s.options.S3Bucket),
-			Key:                  aws.String(args.Key),
-			Metadata:             args.Meta,
-			ServerSideEncryption: aws.String("AES256"),
-		})
+	uploadManager := s.uploader()
+	var result *StoreResult
+	backoff := s3Backoff(args.MaxTries)
+	err = backoff.Retry(ctx, func(try int) error {
+		// Every try uploads the file from the start
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return util.Permanent(err)
+		}
+		etag := newS3ETag(s.partSize())
+		var body io.Reader = &contextReader{ctx: ctx, r: io.TeeReader(file, etag)}
+		if args.Progress != nil {
+			body = newProgressReader(body, info.Size(), args.Progress)
+		}
 
+		out, err := uploadManager.Upload(s.encryptUpload(&s3manager.UploadInput{
+			ACL:      aws.String(acl),
+			Body:     body,
+			Bucket:   aws.String(s.options.S3Bucket),
+			Key:      aws.String(args.Key),
+			Metadata: meta,
+		}))
+
+		if ctx.Err() != nil {
+			return util.Permanent(ctx.Err())
+		}
 		if err != nil {
 			s.logger.WithFields(util.LogFields{
 				"Bucket":   s.options.S3Bucket,
@@ -97,22 +236,627 @@ func (s *S3Store) StoreFromFile(args *StoreFromFileArgs) error {
 				"S3Key":    args.Key,
 				"Try":      try,
 				"MaxTries": args.MaxTries,
-			}).Error("Unable to upload file to S3")
-			outerErr = err
-			continue
+			}).WithError(err).Error("Unable to upload file to S3")
+			if !isS3Retryable(err) {
+				return util.Permanent(err)
+			}
+			return err
 		}
 
+		// The upload output has no ETag, it is read back from the version
+		// that was uploaded
+		head := s.headObject(args.Key, out.VersionID)
+		if err := s.verifyUpload(args.Key, etag, head); err != nil {
+			s.logger.WithFields(util.LogFields{
+				"S3Key":    args.Key,
+				"Try":      try,
+				"MaxTries": args.MaxTries,
+			}).WithError(err).Error("Uploaded file is corrupt")
+			return err
+		}
+		result = s.storeResult(args.Key, head)
+		result.Location = out.Location
+		s.logger.WithFields(util.LogFields{
+			"Bucket":    s.options.S3Bucket,
+			"Path":      args.Path,
+			"Region":    s.options.AWSRegion,
+			"S3Key":     args.Key,
+			"Try":       try,
+			"MaxTries":  args.MaxTries,
+			"ETag":      result.ETag,
+			"VersionID": result.VersionID,
+		}).Info("Uploading file to S3 complete")
+
+		return nil
+	}, func(try int, delay time.Duration, err error) {
 		s.logger.WithFields(util.LogFields{
-			"Bucket":   s.options.S3Bucket,
-			"Path":     args.Path,
-			"Region":   s.options.AWSRegion,
 			"S3Key":    args.Key,
 			"Try":      try,
 			"MaxTries": args.MaxTries,
-		}).Info("Uploading file to S3 complete")
+			"Delay":    delay,
+		}).Warn("Retrying upload to S3")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
 
+// StoreFromReader copies r to options.Bucket + key without staging it on
+// disk. The uploader reads r in parts, so a stream of unknown size is
+// uploaded like a file. A stream can't be read again, the SDK retries failed
+// parts but the upload as a whole isn't retried.
+func (s *S3Store) StoreFromReader(ctx context.Context, key string, r io.Reader, size int64) (*StoreResult, error) {
+	fields := util.LogFields{
+		"Bucket": s.options.S3Bucket,
+		"Region": s.options.AWSRegion,
+		"S3Key":  key,
+		"Size":   size,
+	}
+	s.logger.WithFields(fields).Info("Uploading stream to S3")
+
+	etag := newS3ETag(s.partSize())
+	out, err := s.uploader().Upload(s.encryptUpload(&s3manager.UploadInput{
+		ACL:    aws.String(s3.ObjectCannedACLPrivate),
+		Body:   &contextReader{ctx: ctx, r: io.TeeReader(&sizeReader{r: r, size: size}, etag)},
+		Bucket: aws.String(s.options.S3Bucket),
+		Key:    aws.String(key),
+	}))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		s.logger.WithFields(fields).WithError(err).Error("Unable to upload stream to S3")
+		return nil, err
+	}
+
+	head := s.headObject(key, out.VersionID)
+	if err := s.verifyUpload(key, etag, head); err != nil {
+		s.logger.WithFields(fields).WithError(err).Error("Uploaded stream is corrupt")
+		return nil, err
+	}
+	result := s.storeResult(key, head)
+	result.Location = out.Location
+	s.logger.WithFields(fields).WithField("ETag", result.ETag).Info("Uploading stream to S3 complete")
+	return result, nil
+}
+
+// encryptUpload sets the server side encryption of the options on input.
+// The SDK sends the MD5 of a customer key with it and copies the key to the
+// parts of multipart uploads.
+func (s *S3Store) encryptUpload(input *s3manager.UploadInput) *s3manager.UploadInput {
+	switch {
+	case s.options.S3SSEKMSKeyID != "":
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(s.options.S3SSEKMSKeyID)
+	case s.options.S3SSECustomerKey != "":
+		input.SSECustomerAlgorithm, input.SSECustomerKey = s.sseCustomerKey()
+	default:
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	}
+	return input
+}
+
+// sseCustomerKey returns the algorithm and key to send with requests for
+// objects encrypted with the customer key of the options, or nils if there
+// is none
+func (s *S3Store) sseCustomerKey() (*string, *string) {
+	if s.options.S3SSECustomerKey == "" {
+		return nil, nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(s.options.S3SSECustomerKey)
+}
+
+// verifyUpload compares the ETag of the uploaded object described by head
+// with the ETag computed while reading the upload. Objects encrypted with a
+// KMS or customer key have ETags that aren't MD5s and aren't verified.
+func (s *S3Store) verifyUpload(key string, etag *s3ETag, head *s3.HeadObjectOutput) error {
+	if s.options.S3SSEKMSKeyID != "" || s.options.S3SSECustomerKey != "" {
 		return nil
 	}
+	if head == nil || aws.StringValue(head.ETag) == "" {
+		s.logger.WithField("S3Key", key).Warn("Unable to verify upload to S3, the object has no ETag")
+		return nil
+	}
+	remote := strings.Trim(aws.StringValue(head.ETag), `"`)
+	if expected := etag.String(); remote != expected {
+		return fmt.Errorf("Uploaded %s is corrupt, S3 has ETag %s, expected %s", key, remote, expected)
+	}
+	return nil
+}
+
+// s3ETag computes the ETag S3 gives an object uploaded by the uploader in
+// parts of partSize. That is the MD5 of the content if it is smaller than a
+// part, or else the MD5 of the MD5s of the parts followed by the number of
+// parts, so every part is verified by it.
+type s3ETag struct {
+	partSize int64
+	part     hash.Hash
+	partLen  int64
+	parts    []byte
+	count    int
+}
+
+func newS3ETag(partSize int64) *s3ETag {
+	return &s3ETag{partSize: partSize, part: md5.New()}
+}
+
+func (e *s3ETag) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if rest := e.partSize - e.partLen; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		e.part.Write(chunk)
+		e.partLen += int64(len(chunk))
+		p = p[len(chunk):]
+		if e.partLen == e.partSize {
+			e.parts = e.part.Sum(e.parts)
+			e.count++
+			e.part.Reset()
+			e.partLen = 0
+		}
+	}
+	return n, nil
+}
+
+// String returns the ETag of the content written so far, without quotes
+func (e *s3ETag) String() string {
+	if e.count == 0 {
+		return hex.EncodeToString(e.part.Sum(nil))
+	}
+	parts, count := e.parts, e.count
+	if e.partLen > 0 {
+		parts = e.part.Sum(parts)
+		count++
+	}
+	sum := md5.Sum(parts)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), count)
+}
+
+// partSize returns the size of the parts of uploads
+func (s *S3Store) partSize() int64 {
+	if s.options.S3PartSize > 0 {
+		return s.options.S3PartSize
+	}
+	return s3manager.DefaultUploadPartSize
+}
+
+// uploader returns the uploader of the store. Files larger than
+// options.S3PartSize are uploaded in parts, options.S3UploadConcurrency of
+// them at once. The SDK retries a failed part on its own, the upload is only
+// started over once the retries of a part are used up.
+func (s *S3Store) uploader() *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(s.client(), func(u *s3manager.Uploader) {
+		u.PartSize = s.partSize()
+		if s.options.S3UploadConcurrency > 0 {
+			u.Concurrency = s.options.S3UploadConcurrency
+		}
+	})
+}
+
+// s3ACL returns the canned ACL of objects with visibility
+func s3ACL(visibility string) (string, error) {
+	if err := ValidateStoreVisibility(visibility); err != nil {
+		return "", err
+	}
+	if visibility == StoreVisibilityPublic {
+		return s3.ObjectCannedACLPublicRead, nil
+	}
+	return s3.ObjectCannedACLPrivate, nil
+}
+
+// List returns the objects in options.Bucket with keys that start with
+// prefix, all pages of the listing are read
+func (s *S3Store) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := s.client().ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(s.options.S3Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		s.logger.WithFields(util.LogFields{
+			"Bucket": s.options.S3Bucket,
+			"Prefix": prefix,
+		}).WithError(err).Error("Unable to list objects in S3")
+		return nil, err
+	}
+	return objects, nil
+}
+
+// Delete removes the object at key from options.Bucket
+func (s *S3Store) Delete(key string) error {
+	fields := util.LogFields{
+		"Bucket": s.options.S3Bucket,
+		"S3Key":  key,
+	}
+	s.logger.WithFields(fields).Info("Deleting object from S3")
+	_, err := s.client().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.options.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		s.logger.WithFields(fields).WithError(err).Error("Unable to delete object from S3")
+	}
+	return err
+}
+
+// s3MaxShareTTL is the longest S3 accepts for a pre-signed URL
+const s3MaxShareTTL = 7 * 24 * time.Hour
+
+// ShareURL returns a pre-signed URL of the object at key that expires after
+// ttl. A read URL is used with GET, a write URL with PUT.
+func (s *S3Store) ShareURL(key string, ttl time.Duration, access string) (string, error) {
+	if ttl <= 0 || ttl > s3MaxShareTTL {
+		return "", fmt.Errorf("Invalid share TTL %s, expected up to %s", ttl, s3MaxShareTTL)
+	}
+	if s.options.S3SSECustomerKey != "" {
+		return "", fmt.Errorf("Unable to share %s, it is encrypted with a customer key", key)
+	}
+	client := s.client()
+	var req *request.Request
+	switch access {
+	case "", StoreAccessRead:
+		req, _ = client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(s.options.S3Bucket),
+			Key:    aws.String(key),
+		})
+	case StoreAccessWrite:
+		req, _ = client.PutObjectRequest(&s3.PutObjectInput{
+			Bucket: aws.String(s.options.S3Bucket),
+			Key:    aws.String(key),
+		})
+	default:
+		return "", fmt.Errorf("Invalid share access %q, expected %s or %s", access, StoreAccessRead, StoreAccessWrite)
+	}
+	url, err := req.Presign(ttl)
+	if err != nil {
+		return "", fmt.Errorf("Unable to pre-sign %s: %v", key, err)
+	}
+	return url, nil
+}
+
+// s3RetryDelay is the delay before the first retry of an upload to S3
+var s3RetryDelay = time.Second
+
+// s3Backoff returns the backoff between the maxTries attempts of an upload
+func s3Backoff(maxTries int) *util.Backoff {
+	return &util.Backoff{
+		Base:        s3RetryDelay,
+		Max:         30 * time.Second,
+		Jitter:      0.2,
+		MaxAttempts: maxTries,
+	}
+}
+
+// s3SHA256Meta is the meta data key the SHA256 of uploaded files is
+// stored under, S3 returns meta data keys capitalized like this
+const s3SHA256Meta = "Sha256"
+
+// headObject returns the meta data of the object at key, of its version
+// versionID if that is set, or nil if it doesn't exist
+func (s *S3Store) headObject(key string, versionID *string) *s3.HeadObjectOutput {
+	sseAlgorithm, sseKey := s.sseCustomerKey()
+	out, err := s.client().HeadObject(&s3.HeadObjectInput{
+		Bucket:               aws.String(s.options.S3Bucket),
+		Key:                  aws.String(key),
+		VersionId:            versionID,
+		SSECustomerAlgorithm: sseAlgorithm,
+		SSECustomerKey:       sseKey,
+	})
+	if err != nil {
+		s.logger.WithField("S3Key", key).WithError(err).Debug("Unable to get object meta data")
+		return nil
+	}
+	return out
+}
+
+// storeResult returns the result for the object at key described by head,
+// which may be nil
+func (s *S3Store) storeResult(key string, head *s3.HeadObjectOutput) *StoreResult {
+	result := &StoreResult{
+		Location: fmt.Sprintf("s3://%s/%s", s.options.S3Bucket, key),
+	}
+	if head != nil {
+		result.ETag = aws.StringValue(head.ETag)
+		result.VersionID = aws.StringValue(head.VersionId)
+	}
+	return result
+}
+
+// remoteSHA256 returns the SHA256 stored in the meta data of head, or an
+// empty string if there is none
+func remoteSHA256(head *s3.HeadObjectOutput) string {
+	if sum, ok := head.Metadata[s3SHA256Meta]; ok && sum != nil {
+		return *sum
+	}
+	return ""
+}
+
+// s3FetchPartSize is the size of the ranges large objects are downloaded
+// in
+var s3FetchPartSize int64 = 16 * 1024 * 1024
+
+// s3FetchConcurrency is the number of ranges that are downloaded at once
+const s3FetchConcurrency = 5
+
+// Fetch copies the file at options.Bucket + args.Key to args.Path.
+//
+// Deprecated: use FetchContext.
+func (s *S3Store) Fetch(args *FetchArgs) error {
+	return s.FetchContext(context.Background(), args)
+}
+
+// FetchContext copies the file at options.Bucket + args.Key to args.Path,
+// the download is aborted and not retried once ctx is done. A missing object
+// fails with a StoreNotFoundError without retries. Objects
+// larger than a part are downloaded in ranges concurrently, every range is
+// retried on its own. The size of the file is checked against the size of
+// the object. Like the file store the download goes to a temporary file
+// that replaces args.Path once complete, a failed download leaves args.Path
+// as it was.
+func (s *S3Store) FetchContext(ctx context.Context, args *FetchArgs) error {
+	if args.MaxTries == 0 {
+		args.MaxTries = 1
+	}
+
+	fields := util.LogFields{
+		"Bucket":   s.options.S3Bucket,
+		"Path":     args.Path,
+		"Region":   s.options.AWSRegion,
+		"S3Key":    args.Key,
+		"MaxTries": args.MaxTries,
+	}
+	s.logger.WithFields(fields).Info("Downloading file from S3")
+
+	file, err := createStoreTempFile(args.Path)
+	if err != nil {
+		s.logger.WithField("Error", err).Error("Unable to create output file")
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	head := s.headObject(args.Key, nil)
+	if head == nil || aws.Int64Value(head.ContentLength) <= s3FetchPartSize {
+		// The GET reports why the object can't be read if HEAD failed
+		err = s.fetchObject(ctx, file, args, fields)
+	} else {
+		fields["Size"] = aws.Int64Value(head.ContentLength)
+		err = s.fetchRanges(ctx, file, args, head)
+	}
+	if IsStoreNotFound(err) {
+		s.logger.WithFields(fields).Info("File not found in S3")
+		return err
+	}
+	if err != nil {
+		s.logger.WithFields(fields).WithError(err).Error("Unable to download file from S3")
+		return err
+	}
+
+	if head != nil {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != aws.Int64Value(head.ContentLength) {
+			return fmt.Errorf("Downloaded %d bytes of %s, expected %d", info.Size(), args.Key, aws.Int64Value(head.ContentLength))
+		}
+	}
+	if err := commitStoreFile(file, args.Path); err != nil {
+		return err
+	}
+	s.logger.WithFields(fields).Info("Downloading file from S3 complete")
+	return nil
+}
+
+// fetchObject downloads the object at args.Key to file with a single GET
+func (s *S3Store) fetchObject(ctx context.Context, file *os.File, args *FetchArgs, fields util.LogFields) error {
+	client := s.client()
+	return s3Backoff(args.MaxTries).Retry(ctx, func(try int) error {
+		// Every try writes the file from the start
+		if err := file.Truncate(0); err != nil {
+			return util.Permanent(err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return util.Permanent(err)
+		}
+		sseAlgorithm, sseKey := s.sseCustomerKey()
+		out, err := getObject(ctx, client, &s3.GetObjectInput{
+			Bucket:               aws.String(s.options.S3Bucket),
+			Key:                  aws.String(args.Key),
+			SSECustomerAlgorithm: sseAlgorithm,
+			SSECustomerKey:       sseKey,
+		})
+		if ctx.Err() != nil {
+			return util.Permanent(ctx.Err())
+		}
+		if isS3NotFound(err) {
+			return util.Permanent(&StoreNotFoundError{Key: args.Key})
+		}
+		if err != nil && !isS3Retryable(err) {
+			return util.Permanent(err)
+		}
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		n, err := io.Copy(file, &contextReader{ctx: ctx, r: out.Body})
+		if ctx.Err() != nil {
+			return util.Permanent(ctx.Err())
+		}
+		if err != nil {
+			return err
+		}
+		if out.ContentLength != nil && n != *out.ContentLength {
+			return fmt.Errorf("Downloaded %d bytes of %s, expected %d", n, args.Key, *out.ContentLength)
+		}
+		return nil
+	}, func(try int, delay time.Duration, err error) {
+		s.logger.WithFields(fields).WithField("Try", try).WithError(err).Warn("Retrying download from S3")
+	})
+}
+
+// fetchRanges downloads the object described by head in ranges of
+// s3FetchPartSize concurrently, writing each at its offset in file. The
+// ranges are read from the version and ETag of head, so they can't come
+// from different uploads.
+func (s *S3Store) fetchRanges(ctx context.Context, file *os.File, args *FetchArgs, head *s3.HeadObjectOutput) error {
+	size := aws.Int64Value(head.ContentLength)
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+
+	client := s.client()
+	offsets := make(chan int64)
+	errs := make(chan error, s3FetchConcurrency)
+	done := make(chan struct{})
+	defer close(done)
+	var wg sync.WaitGroup
+	for i := 0; i < s3FetchConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				end := offset + s3FetchPartSize - 1
+				if end >= size {
+					end = size - 1
+				}
+				if err := s.fetchRange(ctx, client, file, args, head, offset, end); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(offsets)
+		for offset := int64(0); offset < size; offset += s3FetchPartSize {
+			select {
+			case offsets <- offset:
+			case <-done:
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// fetchRange downloads the bytes from start to end, inclusive, of the
+// object described by head to the same offsets in file
+func (s *S3Store) fetchRange(ctx context.Context, client *s3.S3, file *os.File, args *FetchArgs, head *s3.HeadObjectOutput, start, end int64) error {
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
+	sseAlgorithm, sseKey := s.sseCustomerKey()
+	return s3Backoff(args.MaxTries).Retry(ctx, func(try int) error {
+		out, err := getObject(ctx, client, &s3.GetObjectInput{
+			Bucket:               aws.String(s.options.S3Bucket),
+			Key:                  aws.String(args.Key),
+			Range:                aws.String(rangeHeader),
+			IfMatch:              head.ETag,
+			VersionId:            head.VersionId,
+			SSECustomerAlgorithm: sseAlgorithm,
+			SSECustomerKey:       sseKey,
+		})
+		if ctx.Err() != nil {
+			return util.Permanent(ctx.Err())
+		}
+		if err != nil && !isS3Retryable(err) {
+			return util.Permanent(err)
+		}
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		// Every try writes the range from its start
+		n, err := io.Copy(&offsetWriter{w: file, offset: start}, &contextReader{ctx: ctx, r: out.Body})
+		if ctx.Err() != nil {
+			return util.Permanent(ctx.Err())
+		}
+		if err != nil {
+			return err
+		}
+		if n != end-start+1 {
+			return fmt.Errorf("Downloaded %d bytes of range %s, expected %d", n, rangeHeader, end-start+1)
+		}
+		return nil
+	}, func(try int, delay time.Duration, err error) {
+		s.logger.WithFields(util.LogFields{
+			"S3Key": args.Key,
+			"Range": rangeHeader,
+			"Try":   try,
+		}).WithError(err).Warn("Retrying download of range from S3")
+	})
+}
+
+// isS3Retryable reports whether a request that failed with err may succeed
+// when it is sent again. S3 rejects requests it will never accept, like one
+// to a missing bucket or without access, with a client error other than a
+// timeout or throttling. Errors without a response, like a failed
+// connection, are retried.
+func isS3Retryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.Code() {
+		case "RequestTimeout", "SlowDown", "Throttling", "RequestLimitExceeded":
+			return true
+		}
+		status := reqErr.StatusCode()
+		return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.OrigErr() != nil {
+		// The uploader wraps the error of the part that failed
+		return isS3Retryable(awsErr.OrigErr())
+	}
+	return true
+}
+
+// isS3NotFound reports whether err means the object or its version doesn't
+// exist
+func isS3NotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// getObject sends the GET of input, it is canceled once ctx is done. The
+// version of the AWS SDK has no GetObjectWithContext, the HTTP request of
+// the SDK request is canceled instead.
+func getObject(ctx context.Context, client *s3.S3, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	req, out := client.GetObjectRequest(input)
+	req.HTTPRequest.Cancel = ctx.Done()
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// offsetWriter writes to w starting at offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
 
-	return outerErr
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
 }
@@ -0,0 +1,648 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+type S3StoreSuite struct {
+	*util.TestSuite
+}
+
+func TestS3StoreSuite(t *testing.T) {
+	suiteTester := &S3StoreSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *S3StoreSuite) TestShareURL() {
+	store := NewS3Store(&AWSOptions{
+		AWSAccessKeyID:     "AKIDEXAMPLE",
+		AWSSecretAccessKey: "secret",
+		AWSRegion:          "us-east-1",
+		S3Bucket:           "artifacts",
+	})
+
+	// Pre-signing happens locally, S3 isn't contacted
+	shared, err := store.ShareURL("project-artifacts/app/run/artifacts.tar", time.Hour, StoreAccessRead)
+	s.Require().NoError(err)
+	u, err := url.Parse(shared)
+	s.Require().NoError(err)
+	s.Contains(u.Host+u.Path, "artifacts")
+	s.Contains(u.Path, "project-artifacts/app/run/artifacts.tar")
+	s.Equal("3600", u.Query().Get("X-Amz-Expires"))
+	s.NotEmpty(u.Query().Get("X-Amz-Signature"))
+
+	_, err = store.ShareURL("key", 8*24*time.Hour, StoreAccessRead)
+	s.Error(err)
+	_, err = store.ShareURL("key", time.Hour, "admin")
+	s.Error(err)
+}
+
+func (s *S3StoreSuite) TestS3ACL() {
+	acl, err := s3ACL("")
+	s.NoError(err)
+	s.Equal("private", acl)
+	acl, err = s3ACL(StoreVisibilityPrivate)
+	s.NoError(err)
+	s.Equal("private", acl)
+	acl, err = s3ACL(StoreVisibilityPublic)
+	s.NoError(err)
+	s.Equal("public-read", acl)
+	_, err = s3ACL("world-readable")
+	s.Error(err)
+}
+
+// newTestS3Store returns an S3Store for the bucket artifacts of the fake S3
+// at endpoint
+func newTestS3Store(endpoint string) *S3Store {
+	conf := aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", "")).
+		WithRegion("us-east-1").
+		WithEndpoint(endpoint).
+		WithS3ForcePathStyle(true).
+		WithMaxRetries(0)
+	return &S3Store{
+		session: session.New(conf),
+		logger:  util.RootLogger().WithField("Logger", "S3Store"),
+		options: &AWSOptions{S3Bucket: "artifacts"},
+	}
+}
+
+// fakeS3 serves a single object with support for HEAD and Range requests.
+// The first GET of every range fails.
+type fakeS3 struct {
+	content []byte
+	mutex   sync.Mutex
+	ranges  map[string]int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		f.mutex.Lock()
+		f.ranges[r.Header.Get("Range")]++
+		first := f.ranges[r.Header.Get("Range")] == 1
+		f.mutex.Unlock()
+		if first {
+			http.Error(w, "flaky", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("ETag", `"etag"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.content))
+}
+
+func (s *S3StoreSuite) TestFetchRanges() {
+	defer func(partSize int64, delay time.Duration) {
+		s3FetchPartSize, s3RetryDelay = partSize, delay
+	}(s3FetchPartSize, s3RetryDelay)
+	s3FetchPartSize = 1000
+	s3RetryDelay = time.Millisecond
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	fake := &fakeS3{content: content, ranges: map[string]int{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store := newTestS3Store(server.URL)
+
+	path := filepath.Join(s.WorkingDir(), "cache.tar")
+	s.Require().NoError(store.Fetch(&FetchArgs{Key: "cache.tar", Path: path, MaxTries: 2}))
+	fetched, err := ioutil.ReadFile(path)
+	s.Require().NoError(err)
+	s.Equal(content, fetched)
+	// 16000 bytes in ranges of 1000, each retried once
+	s.Len(fake.ranges, 16)
+	s.Equal(2, fake.ranges["bytes=15000-15999"])
+}
+
+func (s *S3StoreSuite) TestFetchFailureKeepsFile() {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+
+	dir := s.WorkingDir()
+	path := filepath.Join(dir, "cache.tar")
+	s.Require().NoError(ioutil.WriteFile(path, []byte("previous cache"), 0644))
+
+	err := store.Fetch(&FetchArgs{Key: "missing.tar", Path: path, MaxTries: 3})
+	s.True(IsStoreNotFound(err), "%v", err)
+	fetched, err := ioutil.ReadFile(path)
+	s.Require().NoError(err)
+	s.Equal("previous cache", string(fetched))
+	files, err := ioutil.ReadDir(dir)
+	s.Require().NoError(err)
+	s.Len(files, 1)
+
+	// Nothing is created for a file that didn't exist
+	path = filepath.Join(dir, "new.tar")
+	s.Error(store.Fetch(&FetchArgs{Key: "missing.tar", Path: path}))
+	_, err = os.Stat(path)
+	s.True(os.IsNotExist(err))
+}
+
+func (s *S3StoreSuite) TestFetchCanceled() {
+	defer func(delay time.Duration) { s3RetryDelay = delay }(s3RetryDelay)
+	s3RetryDelay = time.Hour
+
+	fake := &fakeS3{content: []byte("artifact"), ranges: map[string]int{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+
+	// The first GET fails, the retry waits until the fetch is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	path := filepath.Join(s.WorkingDir(), "cache.tar")
+	err := store.FetchContext(ctx, &FetchArgs{Key: "cache.tar", Path: path, MaxTries: 3})
+	s.Equal(context.DeadlineExceeded, err)
+	_, err = os.Stat(path)
+	s.True(os.IsNotExist(err))
+}
+
+// fakeS3Uploads accepts single and multipart uploads of objects in memory.
+// With truncate set it drops the last byte of every upload like a corrupt
+// upload.
+// The first upload of every part in failParts fails.
+type fakeS3Uploads struct {
+	mutex     sync.Mutex
+	objects   map[string][]byte
+	parts     map[string][]byte
+	failParts map[string]bool
+	requests  []string
+	headers   []http.Header
+	etags     map[string]string
+	truncate  bool
+}
+
+func newFakeS3Uploads() *fakeS3Uploads {
+	return &fakeS3Uploads{
+		objects:   map[string][]byte{},
+		parts:     map[string][]byte{},
+		failParts: map[string]bool{},
+		etags:     map[string]string{},
+	}
+}
+
+func (f *fakeS3Uploads) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	query := r.URL.Query()
+	partNumber := query.Get("partNumber")
+	f.headers = append(f.headers, r.Header)
+	switch {
+	case r.Method == "POST" && query.Get("uploadId") == "":
+		f.requests = append(f.requests, "initiate")
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == "PUT" && partNumber != "":
+		f.requests = append(f.requests, "part "+partNumber)
+		body, _ := ioutil.ReadAll(r.Body)
+		if f.failParts[partNumber] {
+			delete(f.failParts, partNumber)
+			http.Error(w, "flaky", http.StatusInternalServerError)
+			return
+		}
+		body = f.received(body)
+		f.parts[partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == "POST":
+		f.requests = append(f.requests, "complete")
+		var object, sums []byte
+		for i := 1; i <= len(f.parts); i++ {
+			part := f.parts[strconv.Itoa(i)]
+			object = append(object, part...)
+			sum := md5.Sum(part)
+			sums = append(sums, sum[:]...)
+		}
+		f.objects[r.URL.Path] = object
+		f.etags[r.URL.Path] = fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(f.parts))
+		f.parts = map[string][]byte{}
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>`, f.etags[r.URL.Path])
+	case r.Method == "PUT":
+		f.requests = append(f.requests, "put")
+		body, _ := ioutil.ReadAll(r.Body)
+		body = f.received(body)
+		f.objects[r.URL.Path] = body
+		f.etags[r.URL.Path] = fmt.Sprintf(`"%x"`, md5.Sum(body))
+		w.Header().Set("ETag", f.etags[r.URL.Path])
+	case r.Method == "HEAD":
+		object, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		w.Header().Set("ETag", f.etags[r.URL.Path])
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// received returns the body of an upload as it is stored
+func (f *fakeS3Uploads) received(body []byte) []byte {
+	if f.truncate && len(body) > 0 {
+		return body[:len(body)-1]
+	}
+	return body
+}
+
+func (s *S3StoreSuite) TestStoreCorrupt() {
+	fake := newFakeS3Uploads()
+	fake.truncate = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+	store.options.S3PartSize = 5 * 1024 * 1024
+
+	dir := s.WorkingDir()
+	small := filepath.Join(dir, "small.tar")
+	s.Require().NoError(ioutil.WriteFile(small, []byte("small"), 0644))
+	_, err := store.StoreFromFile(&StoreFromFileArgs{Path: small, Key: "small.tar"})
+	s.Require().Error(err)
+	s.Contains(err.Error(), "small.tar is corrupt")
+
+	large := filepath.Join(dir, "large.tar")
+	s.Require().NoError(ioutil.WriteFile(large, bytes.Repeat([]byte("0123456789abcdef"), 400*1024), 0644))
+	_, err = store.StoreFromFile(&StoreFromFileArgs{Path: large, Key: "large.tar"})
+	s.Require().Error(err)
+	s.Contains(err.Error(), "large.tar is corrupt")
+
+	_, err = store.StoreFromReader(context.Background(), "stream.tar", bytes.NewBufferString("stream"), -1)
+	s.Error(err)
+
+	// Intact uploads pass
+	fake.truncate = false
+	_, err = store.StoreFromFile(&StoreFromFileArgs{Path: large, Key: "large.tar"})
+	s.NoError(err)
+	_, err = store.StoreFromFile(&StoreFromFileArgs{Path: small, Key: "small.tar"})
+	s.NoError(err)
+}
+
+func (s *S3StoreSuite) TestS3ETag() {
+	content := []byte("0123456789")
+	etag := newS3ETag(4)
+	etag.Write(content[:3])
+	etag.Write(content[3:])
+	first, second, third := md5.Sum(content[:4]), md5.Sum(content[4:8]), md5.Sum(content[8:])
+	sums := append(append(first[:], second[:]...), third[:]...)
+	s.Equal(fmt.Sprintf("%x-3", md5.Sum(sums)), etag.String())
+
+	etag = newS3ETag(16)
+	etag.Write(content)
+	s.Equal(fmt.Sprintf("%x", md5.Sum(content)), etag.String())
+}
+
+func (s *S3StoreSuite) TestStoreMultipart() {
+	fake := newFakeS3Uploads()
+	fake.failParts["2"] = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+	// Let the SDK retry the failed part
+	store.session.Config.WithMaxRetries(1)
+	store.options.S3PartSize = 5 * 1024 * 1024
+	store.options.S3UploadConcurrency = 2
+
+	dir := s.WorkingDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 700*1024)
+	src := filepath.Join(dir, "artifact.tar")
+	s.Require().NoError(ioutil.WriteFile(src, content, 0644))
+	_, err := store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: "artifact.tar"})
+	s.Require().NoError(err)
+	s.Equal(content, fake.objects["/artifacts/artifact.tar"])
+	// The failed part is uploaded again, not the whole file
+	s.Equal(1, countString(fake.requests, "initiate"))
+	s.Equal(2, countString(fake.requests, "part 2"))
+	s.Equal(1, countString(fake.requests, "part 1"))
+
+	// Files up to a part are uploaded with a single request
+	small := filepath.Join(dir, "small.tar")
+	s.Require().NoError(ioutil.WriteFile(small, []byte("small"), 0644))
+	_, err = store.StoreFromFile(&StoreFromFileArgs{Path: small, Key: "small.tar"})
+	s.Require().NoError(err)
+	s.Equal("small", string(fake.objects["/artifacts/small.tar"]))
+	s.Equal(1, countString(fake.requests, "put"))
+}
+
+func (s *S3StoreSuite) TestAWSOptionsPartSize() {
+	options, err := NewAWSOptions(util.NewCheapSettings(map[string]interface{}{}), util.NewEnvironment(), nil)
+	s.Require().NoError(err)
+	s.Equal(int64(DefaultS3PartSize*1024*1024), options.S3PartSize)
+	s.Equal(DefaultS3UploadConcurrency, options.S3UploadConcurrency)
+
+	options, err = NewAWSOptions(util.NewCheapSettings(map[string]interface{}{
+		"s3-part-size":          16,
+		"s3-upload-concurrency": 2,
+	}), util.NewEnvironment(), nil)
+	s.Require().NoError(err)
+	s.Equal(int64(16*1024*1024), options.S3PartSize)
+	s.Equal(2, options.S3UploadConcurrency)
+
+	_, err = NewAWSOptions(util.NewCheapSettings(map[string]interface{}{"s3-part-size": 1}), util.NewEnvironment(), nil)
+	s.Error(err)
+	_, err = NewAWSOptions(util.NewCheapSettings(map[string]interface{}{"s3-upload-concurrency": 0}), util.NewEnvironment(), nil)
+	s.Error(err)
+}
+
+// fakeS3Listing lists and deletes objects, two per page of a listing
+type fakeS3Listing struct {
+	mutex   sync.Mutex
+	objects map[string]string
+	pages   int
+}
+
+func (f *fakeS3Listing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.Method {
+	case "GET":
+		f.pages++
+		query := r.URL.Query()
+		keys := []string{}
+		for key := range f.objects {
+			if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("marker") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		truncated := len(keys) > 2
+		if truncated {
+			keys = keys[:2]
+		}
+		fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%t</IsTruncated>", truncated)
+		for _, key := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2017-01-02T15:04:05.000Z</LastModified></Contents>", key, len(f.objects[key]))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case "DELETE":
+		delete(f.objects, strings.TrimPrefix(r.URL.Path, "/artifacts/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (s *S3StoreSuite) TestListAndDelete() {
+	fake := &fakeS3Listing{objects: map[string]string{
+		"cache/a.tar":     "a",
+		"cache/b.tar":     "bb",
+		"cache/c.tar":     "ccc",
+		"artifacts/d.tar": "dddd",
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+	var _ Lister = store
+
+	objects, err := store.List("cache/")
+	s.Require().NoError(err)
+	s.Equal(2, fake.pages)
+	s.Equal([]ObjectInfo{
+		{Key: "cache/a.tar", Size: 1, LastModified: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Key: "cache/b.tar", Size: 2, LastModified: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Key: "cache/c.tar", Size: 3, LastModified: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)},
+	}, objects)
+
+	s.NoError(store.Delete("cache/b.tar"))
+	s.NotContains(fake.objects, "cache/b.tar")
+	objects, err = store.List("cache/")
+	s.Require().NoError(err)
+	s.Len(objects, 2)
+}
+
+func (s *S3StoreSuite) TestStoreEncryption() {
+	fake := newFakeS3Uploads()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+
+	_, err := store.StoreFromReader(context.Background(), "default.tar", bytes.NewBufferString("default"), -1)
+	s.Require().NoError(err)
+	s.Equal("AES256", fake.headers[0].Get("X-Amz-Server-Side-Encryption"))
+	s.Empty(fake.headers[0].Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+
+	fake.headers = nil
+	store.options.S3SSEKMSKeyID = "arn:aws:kms:us-east-1:123456789012:key/artifacts"
+	_, err = store.StoreFromReader(context.Background(), "kms.tar", bytes.NewBufferString("kms"), -1)
+	s.Require().NoError(err)
+	s.Equal("aws:kms", fake.headers[0].Get("X-Amz-Server-Side-Encryption"))
+	s.Equal("arn:aws:kms:us-east-1:123456789012:key/artifacts", fake.headers[0].Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+}
+
+func (s *S3StoreSuite) TestAWSOptionsEncryption() {
+	key := bytes.Repeat([]byte("k"), 32)
+	options, err := NewAWSOptions(util.NewCheapSettings(map[string]interface{}{
+		"s3-sse-customer-key": base64.StdEncoding.EncodeToString(key),
+	}), util.NewEnvironment(), nil)
+	s.Require().NoError(err)
+	s.Equal(string(key), options.S3SSECustomerKey)
+
+	// Objects encrypted with a customer key can't be fetched without it
+	store := &S3Store{options: options}
+	_, err = store.ShareURL("artifact.tar", time.Hour, StoreAccessRead)
+	s.Error(err)
+
+	_, err = NewAWSOptions(util.NewCheapSettings(map[string]interface{}{
+		"s3-sse-customer-key": base64.StdEncoding.EncodeToString(key[:16]),
+	}), util.NewEnvironment(), nil)
+	s.Error(err)
+	_, err = NewAWSOptions(util.NewCheapSettings(map[string]interface{}{
+		"s3-sse-customer-key": base64.StdEncoding.EncodeToString(key),
+		"s3-sse-kms-key-id":   "artifacts",
+	}), util.NewEnvironment(), nil)
+	s.Error(err)
+}
+
+func (s *S3StoreSuite) TestEndpoint() {
+	fake := newFakeS3Uploads()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	options, err := NewAWSOptions(util.NewCheapSettings(map[string]interface{}{
+		"aws-access-key": "AKIDEXAMPLE",
+		"aws-secret-key": "secret",
+		"aws-region":     "us-east-1",
+		"s3-bucket":      "artifacts",
+		"s3-endpoint":    server.URL,
+	}), util.NewEnvironment(), nil)
+	s.Require().NoError(err)
+	store := NewS3Store(options)
+
+	src := filepath.Join(s.WorkingDir(), "artifact.tar")
+	s.Require().NoError(ioutil.WriteFile(src, []byte("artifact"), 0644))
+	_, err = store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: "artifact.tar"})
+	s.Require().NoError(err)
+	s.Equal("artifact", string(fake.objects["/artifacts/artifact.tar"]))
+
+	for _, endpoint := range []string{"objects.internal:9000", "ftp://objects.internal", "http://"} {
+		_, err = NewAWSOptions(util.NewCheapSettings(map[string]interface{}{"s3-endpoint": endpoint}), util.NewEnvironment(), nil)
+		s.Error(err, endpoint)
+	}
+}
+
+func (s *S3StoreSuite) TestClientReused() {
+	store := newTestS3Store("http://127.0.0.1:1")
+	clients := make(chan interface{}, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(clients); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clients <- store.client()
+		}()
+	}
+	wg.Wait()
+	close(clients)
+	first := store.client()
+	for client := range clients {
+		s.True(client == first)
+	}
+
+	// A reset store creates a new client
+	store.Reset()
+	s.False(store.client() == first)
+	s.True(store.session.Config.Credentials.IsExpired())
+}
+
+func (s *S3StoreSuite) TestCheck() {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("HEAD", r.Method)
+		s.Equal("/artifacts", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+	var _ Checker = store
+
+	s.NoError(store.Check())
+
+	status = http.StatusNotFound
+	err := store.Check()
+	s.Require().Error(err)
+	s.Contains(err.Error(), "doesn't exist")
+
+	status = http.StatusForbidden
+	err = store.Check()
+	s.Require().Error(err)
+	s.Contains(err.Error(), "can't access")
+}
+
+// countString returns how often value is in values
+func countString(values []string, value string) int {
+	n := 0
+	for _, v := range values {
+		if v == value {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *S3StoreSuite) TestStoreRetries() {
+	defer func(delay time.Duration) { s3RetryDelay = delay }(s3RetryDelay)
+	s3RetryDelay = time.Millisecond
+
+	status := http.StatusServiceUnavailable
+	puts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts++
+			if puts == 1 {
+				w.WriteHeader(status)
+				fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, http.StatusText(status), http.StatusText(status))
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+
+	src := filepath.Join(s.WorkingDir(), "artifact.tar")
+	s.Require().NoError(ioutil.WriteFile(src, []byte("artifact"), 0644))
+	_, err := store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: "artifact.tar", MaxTries: 3})
+	s.NoError(err)
+	s.Equal(2, puts)
+
+	// A rejected upload isn't retried
+	status, puts = http.StatusForbidden, 0
+	_, err = store.StoreFromFile(&StoreFromFileArgs{Path: src, Key: "artifact.tar", MaxTries: 3})
+	s.Error(err)
+	s.Equal(1, puts)
+}
+
+func (s *S3StoreSuite) TestIsS3Retryable() {
+	s.True(isS3Retryable(errors.New("connection reset by peer")))
+	s.True(isS3Retryable(awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "")))
+	s.True(isS3Retryable(awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "")))
+	s.True(isS3Retryable(awserr.NewRequestFailure(awserr.New("RequestTimeout", "timeout", nil), 400, "")))
+	s.True(isS3Retryable(awserr.NewRequestFailure(awserr.New("TooManyRequests", "throttled", nil), 429, "")))
+	s.False(isS3Retryable(awserr.NewRequestFailure(awserr.New("NoSuchBucket", "no such bucket", nil), 404, "")))
+	s.False(isS3Retryable(awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "")))
+	s.False(isS3Retryable(awserr.NewRequestFailure(awserr.New("InvalidAccessKeyId", "invalid key", nil), 403, "")))
+
+	// The uploader wraps the error of a part
+	part := awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "")
+	s.False(isS3Retryable(awserr.New("MultipartUpload", "upload multipart failed", part)))
+}
+
+func (s *S3StoreSuite) TestStoreFromReader() {
+	fake := newFakeS3Uploads()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := newTestS3Store(server.URL)
+	store.options.S3PartSize = 5 * 1024 * 1024
+	var _ ReaderStore = store
+
+	// A stream of unknown size is uploaded in parts
+	content := bytes.Repeat([]byte("0123456789abcdef"), 400*1024)
+	_, err := store.StoreFromReader(context.Background(), "stream.tar", bytes.NewBuffer(content), -1)
+	s.Require().NoError(err)
+	s.Equal(content, fake.objects["/artifacts/stream.tar"])
+	s.Equal(1, countString(fake.requests, "complete"))
+
+	_, err = store.StoreFromReader(context.Background(), "small.tar", bytes.NewBufferString("small"), 5)
+	s.Require().NoError(err)
+	s.Equal("small", string(fake.objects["/artifacts/small.tar"]))
+
+	// A stream shorter than its size isn't stored
+	_, err = store.StoreFromReader(context.Background(), "short.tar", bytes.NewBufferString("short"), 10)
+	s.Error(err)
+	s.NotContains(fake.objects, "/artifacts/short.tar")
+}
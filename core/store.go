@@ -14,12 +14,139 @@
 
 package core
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// ArtifactStoreS3 stores artifacts in the S3 bucket of the AWS options
+	ArtifactStoreS3 = "s3"
+	// ArtifactStoreLocal stores artifacts in a directory on local disk
+	ArtifactStoreLocal = "local"
+)
+
+const (
+	// StoreVisibilityPrivate stores files only the owner of the store can
+	// read, the default
+	StoreVisibilityPrivate = "private"
+	// StoreVisibilityPublic stores files anyone can read, e.g. release
+	// binaries
+	StoreVisibilityPublic = "public"
+)
+
+// ValidateStoreVisibility checks that visibility is empty or a known store
+// visibility
+func ValidateStoreVisibility(visibility string) error {
+	switch visibility {
+	case "", StoreVisibilityPrivate, StoreVisibilityPublic:
+		return nil
+	}
+	return fmt.Errorf("Invalid store visibility %q, expected %s or %s", visibility, StoreVisibilityPrivate, StoreVisibilityPublic)
+}
 
 // Store is generic store interface
 type Store interface {
-	// StoreFromFile copies a file from local disk to the store
-	StoreFromFile(*StoreFromFileArgs) error
+	// StoreFromFile copies a file from local disk to the store.
+	//
+	// Deprecated: StoreFromFile can't be canceled, use StoreFromFileContext.
+	StoreFromFile(*StoreFromFileArgs) (*StoreResult, error)
+
+	// StoreFromFileContext copies a file from local disk to the store, the
+	// copy is aborted once ctx is done
+	StoreFromFileContext(context.Context, *StoreFromFileArgs) (*StoreResult, error)
+
+	// Fetch copies a file from the store to local disk.
+	//
+	// Deprecated: Fetch can't be canceled, use FetchContext.
+	Fetch(*FetchArgs) error
+
+	// FetchContext copies a file from the store to local disk, the copy is
+	// aborted once ctx is done
+	FetchContext(context.Context, *FetchArgs) error
+}
+
+// ReaderStore is implemented by stores that can store a stream without
+// staging it in a file on disk first
+type ReaderStore interface {
+	// StoreFromReader copies r to the store under key, the copy is aborted
+	// once ctx is done. size is the number of bytes r has, or -1 if it isn't
+	// known. A stream with a different number of bytes isn't stored.
+	StoreFromReader(ctx context.Context, key string, r io.Reader, size int64) (*StoreResult, error)
+}
+
+const (
+	// StoreAccessRead allows downloading a shared file, the default
+	StoreAccessRead = "read"
+	// StoreAccessWrite allows replacing a shared file
+	StoreAccessWrite = "write"
+)
+
+// Sharer is implemented by stores that can create URLs that give access to
+// a stored file without credentials until they expire
+type Sharer interface {
+	// ShareURL returns a URL that gives access to the file at key for ttl
+	ShareURL(key string, ttl time.Duration, access string) (string, error)
+}
+
+// ObjectInfo describes a stored file
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Lister is implemented by stores that can enumerate and remove stored
+// files, to prune old artifacts and caches
+type Lister interface {
+	// List returns the stored files with keys that start with prefix
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes the file at key, there being no such file isn't an error
+	Delete(key string) error
+}
+
+// NewArtifactStore returns the store configured for artifacts in options,
+// or nil if artifacts aren't stored.
+func NewArtifactStore(options *PipelineOptions) (Store, error) {
+	switch options.ArtifactStore {
+	case "":
+		return nil, nil
+	case ArtifactStoreS3:
+		return NewS3Store(options.AWSOptions), nil
+	case ArtifactStoreLocal:
+		return NewFileStore(options.ArtifactStorePath()), nil
+	default:
+		return nil, fmt.Errorf("Unknown artifact store %q, expected %s or %s", options.ArtifactStore, ArtifactStoreS3, ArtifactStoreLocal)
+	}
+}
+
+// Checker is implemented by stores that can check whether they are usable
+// with their configuration
+type Checker interface {
+	// Check returns an error that explains how to fix the configuration if
+	// the store is unusable
+	Check() error
+}
+
+// RequireArtifactStore checks that the artifact store configured in options
+// is usable, so a misconfigured store fails before the pipeline runs rather
+// than when its artifacts are stored.
+func RequireArtifactStore(options *PipelineOptions) error {
+	store, err := NewArtifactStore(options)
+	if err != nil {
+		return err
+	}
+	if checker, ok := store.(Checker); ok {
+		return checker.Check()
+	}
+	return nil
 }
 
 // StoreFromFileArgs are the args for storing a file
@@ -38,6 +165,120 @@ type StoreFromFileArgs struct {
 
 	// MaxTries is the maximum that a store should retry should the store fail.
 	MaxTries int
+
+	// Progress is called while the file is uploaded (optional)
+	Progress ProgressFunc
+
+	// SkipIfUnchanged skips the upload if the store already has a file with
+	// the same SHA256 under Key
+	SkipIfUnchanged bool
+
+	// Visibility is who can read the stored file, StoreVisibilityPrivate if
+	// empty. The local file store has no notion of it.
+	Visibility string
+}
+
+// StoreResult describes the stored file
+type StoreResult struct {
+	// Location is the URL or path of the stored file
+	Location string
+	// ETag of the stored object, empty if the store has none
+	ETag string
+	// VersionID of the stored object, empty if the store doesn't keep
+	// versions
+	VersionID string
+	// Skipped is true if SkipIfUnchanged skipped the upload, the result
+	// then describes the file that was already stored
+	Skipped bool
+}
+
+// ArtifactURL returns the url of art in the artifact store of options
+func ArtifactURL(options *PipelineOptions, art *Artifact) string {
+	if options.ArtifactStore == ArtifactStoreLocal {
+		return "file://" + path.Join(options.ArtifactStorePath(), art.RemotePath())
+	}
+	return art.URL()
+}
+
+// contextReader fails reads once ctx is done, which aborts copies by
+// clients that can't be given a context
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// sizeReader fails reads from r once it has more than size bytes, or ends
+// before size bytes. A negative size isn't checked.
+type sizeReader struct {
+	r    io.Reader
+	size int64
+	n    int64
+}
+
+func (s *sizeReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if s.size < 0 {
+		return n, err
+	}
+	s.n += int64(n)
+	if s.n > s.size {
+		return n, fmt.Errorf("Read more than the expected %d bytes", s.size)
+	}
+	if err == io.EOF && s.n < s.size {
+		return n, fmt.Errorf("Read %d bytes, expected %d", s.n, s.size)
+	}
+	return n, err
+}
+
+// fileSHA256 returns the hex encoded SHA256 of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// StoreNotFoundError is returned by Fetch when the store has no file under
+// Key, e.g. on a cache miss. Callers tell it apart from a failed fetch with
+// IsStoreNotFound.
+type StoreNotFoundError struct {
+	Key string
+}
+
+func (e *StoreNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found in store", e.Key)
+}
+
+// IsStoreNotFound reports whether err means the fetched file isn't stored
+func IsStoreNotFound(err error) bool {
+	_, ok := err.(*StoreNotFoundError)
+	return ok
+}
+
+// FetchArgs are the args for fetching a file
+type FetchArgs struct {
+	// Key of the file as stored in the store.
+	Key string
+
+	// Path to write the file to on local disk.
+	Path string
+
+	// MaxTries is the maximum that a store should retry should the store fail.
+	MaxTries int
 }
 
 // GenerateBaseKey generates the base key based on ApplicationID and either
@@ -15,6 +15,7 @@
 package dockerlocal
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -24,6 +25,7 @@ import (
 	"github.com/fsouza/go-dockerclient"
 	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
 )
 
 // Set upper limit that we can store
@@ -35,22 +37,21 @@ type Artificer struct {
 	dockerOptions *Options
 	logger        *util.LogEntry
 	store         core.Store
+	storeErr      error
 }
 
 // NewArtificer returns an Artificer
 func NewArtificer(options *core.PipelineOptions, dockerOptions *Options) *Artificer {
 	logger := util.RootLogger().WithField("Logger", "Artificer")
 
-	var store core.Store
-	if options.ShouldStoreS3 {
-		store = core.NewS3Store(options.AWSOptions)
-	}
+	store, err := core.NewArtifactStore(options)
 
 	return &Artificer{
 		options:       options,
 		dockerOptions: dockerOptions,
 		logger:        logger,
 		store:         store,
+		storeErr:      err,
 	}
 }
 
@@ -91,15 +92,64 @@ func (a *Artificer) Collect(artifact *core.Artifact) (*core.Artifact, error) {
 	return artifact, nil
 }
 
-// Upload an artifact to S3
-func (a *Artificer) Upload(artifact *core.Artifact) error {
-	return a.store.StoreFromFile(&core.StoreFromFileArgs{
+// Upload an artifact to the artifact store, the upload is aborted once ctx
+// is done
+func (a *Artificer) Upload(ctx context.Context, artifact *core.Artifact) error {
+	if a.storeErr != nil {
+		return a.storeErr
+	}
+	if a.store == nil {
+		return errors.New("No artifact store configured")
+	}
+	result, err := a.store.StoreFromFileContext(ctx, &core.StoreFromFileArgs{
 		Path:        artifact.HostTarPath,
 		Key:         artifact.RemotePath(),
 		ContentType: artifact.ContentType,
 		MaxTries:    3,
 		Meta:        artifact.Meta,
+		Visibility:  a.options.ArtifactVisibility,
+		Progress: func(sent, total int64) {
+			a.logger.WithFields(util.LogFields{
+				"Key":   artifact.RemotePath(),
+				"Sent":  sent,
+				"Total": total,
+			}).Debug("Uploading artifact")
+		},
 	})
+	if err != nil {
+		return err
+	}
+	a.logger.WithFields(util.LogFields{
+		"Key":       artifact.RemotePath(),
+		"Location":  result.Location,
+		"ETag":      result.ETag,
+		"VersionID": result.VersionID,
+	}).Debug("Uploaded artifact")
+	if a.options.ArtifactShareTTL > 0 {
+		a.shareArtifact(artifact)
+	}
+	return nil
+}
+
+// shareArtifact sets the ShareURL of the uploaded artifact to a read-only
+// URL, failing to create it doesn't fail the upload. The URL gives access to
+// anyone who has it so it isn't logged.
+func (a *Artificer) shareArtifact(artifact *core.Artifact) {
+	sharer, ok := a.store.(core.Sharer)
+	if !ok {
+		a.logger.Warnln("The artifact store can't share artifacts")
+		return
+	}
+	url, err := sharer.ShareURL(artifact.RemotePath(), a.options.ArtifactShareTTL, core.StoreAccessRead)
+	if err != nil {
+		a.logger.WithError(err).Warn("Unable to share artifact")
+		return
+	}
+	artifact.ShareURL = url
+	a.logger.WithFields(util.LogFields{
+		"Key":       artifact.RemotePath(),
+		"ExpiresIn": a.options.ArtifactShareTTL,
+	}).Infoln("Shared artifact")
 }
 
 // DockerFileCollector impl of FileCollector
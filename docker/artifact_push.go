@@ -0,0 +1,167 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+
+	"github.com/pborman/uuid"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+// DefaultArtifactMediaType is the media type of the file of an OCI artifact
+// if media-type isn't set, it is the default of oras as well
+const DefaultArtifactMediaType = "application/vnd.oci.image.layer.v1.tar"
+
+// DockerArtifactPushStep pushes a file that isn't a container image, like a
+// packaged Helm chart, to a registry as an OCI artifact. It uses the
+// registry and authentication options of the push step.
+type DockerArtifactPushStep struct {
+	*DockerPushStep
+
+	// file is the path of the file to push, on the host or in the guest
+	// root
+	file string
+	// artifactType is the media type of the config of the artifact, e.g.
+	// application/vnd.cncf.helm.config.v1+json
+	artifactType string
+	// mediaType is the media type of the file
+	mediaType string
+	// configFile is a file with the config of the artifact, an empty JSON
+	// object is pushed if it isn't set
+	configFile string
+}
+
+// NewDockerArtifactPushStep constructor
+func NewDockerArtifactPushStep(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *Options) (*DockerArtifactPushStep, error) {
+	name := "docker-artifact-push"
+	displayName := "docker artifact push"
+	if stepConfig.Name != "" {
+		displayName = stepConfig.Name
+	}
+
+	// Add a random number to the name to prevent collisions on disk
+	stepSafeID := fmt.Sprintf("%s-%s", name, uuid.NewRandom().String())
+
+	baseStep := core.NewBaseStep(core.BaseStepOptions{
+		DisplayName: displayName,
+		Env:         &util.Environment{},
+		ID:          name,
+		Name:        name,
+		Owner:       "wercker",
+		SafeID:      stepSafeID,
+		Version:     util.Version(),
+	})
+
+	dockerPushStep := &DockerPushStep{
+		BaseStep:      baseStep,
+		data:          stepConfig.Data,
+		dockerOptions: dockerOptions,
+		options:       options,
+		logger:        util.RootLogger().WithField("Logger", "DockerArtifactPushStep"),
+	}
+
+	return &DockerArtifactPushStep{DockerPushStep: dockerPushStep}, nil
+}
+
+// InitEnv parses the options of the push step and those of the artifact
+func (s *DockerArtifactPushStep) InitEnv(env *util.Environment) {
+	s.DockerPushStep.InitEnv(env)
+	s.configureArtifact(env)
+}
+
+func (s *DockerArtifactPushStep) configureArtifact(env *util.Environment) {
+	if file, ok := s.data["file"]; ok {
+		s.file = env.Interpolate(file)
+	}
+	if s.file == "" {
+		s.logger.Errorln("file is required to push an artifact")
+		s.configErr = fmt.Errorf("file is required to push an artifact")
+		return
+	}
+	if configFile, ok := s.data["config"]; ok {
+		s.configFile = env.Interpolate(configFile)
+	}
+
+	if artifactType, ok := s.data["artifact-type"]; ok {
+		s.artifactType = env.Interpolate(artifactType)
+	}
+	if s.artifactType == "" {
+		s.logger.Errorln("artifact-type is required to push an artifact")
+		s.configErr = fmt.Errorf("artifact-type is required to push an artifact")
+		return
+	}
+	if _, _, err := mime.ParseMediaType(s.artifactType); err != nil {
+		s.logger.Errorln("Invalid artifact-type:", s.artifactType)
+		s.configErr = fmt.Errorf("Invalid artifact-type %q: %v", s.artifactType, err)
+		return
+	}
+
+	s.mediaType = DefaultArtifactMediaType
+	if mediaType, ok := s.data["media-type"]; ok {
+		s.mediaType = env.Interpolate(mediaType)
+		if _, _, err := mime.ParseMediaType(s.mediaType); err != nil {
+			s.logger.Errorln("Invalid media-type:", s.mediaType)
+			s.configErr = fmt.Errorf("Invalid media-type %q: %v", s.mediaType, err)
+		}
+	}
+}
+
+// Execute writes the file as an OCI artifact and pushes it to the registry,
+// nothing is committed or loaded into the docker daemon.
+func (s *DockerArtifactPushStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
+	if s.configErr != nil {
+		return -1, s.configErr
+	}
+	if err := s.authorizeDevice(ctx); err != nil {
+		return -1, err
+	}
+
+	s.tags = s.buildTags()
+	if done, err := s.handleEmptyTags(); done {
+		if err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+
+	file := hostSourcePath(s.options, s.file)
+	info, err := os.Stat(file)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to read artifact file %s: %v", s.file, err)
+	}
+	if !info.Mode().IsRegular() {
+		return -1, fmt.Errorf("Artifact file %s is not a regular file", s.file)
+	}
+
+	config := []byte("{}")
+	if s.configFile != "" {
+		config, err = ioutil.ReadFile(hostSourcePath(s.options, s.configFile))
+		if err != nil {
+			return -1, fmt.Errorf("Unable to read artifact config %s: %v", s.configFile, err)
+		}
+	}
+
+	img, err := writeOCIArtifact(s.options.HostPath("oci-artifact"), s.artifactType, config, file, s.mediaType, s.tags)
+	if err != nil {
+		return -1, err
+	}
+	return s.pushOCILayout(ctx, sess, img)
+}
@@ -16,11 +16,14 @@ package dockerlocal
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
 )
 
@@ -154,3 +157,28 @@ func (s *ArtifactSuite) TestDockerFileCollectorMultiNotFound() {
 		s.Equal(err, util.ErrEmptyTarball)
 	}
 }
+
+// shareStore is a store that only shares files
+type shareStore struct {
+	core.Store
+}
+
+func (s *shareStore) ShareURL(key string, ttl time.Duration, access string) (string, error) {
+	return fmt.Sprintf("https://example.com/%s?access=%s&expires=%d&signature=s3cr3t", key, access, int(ttl.Seconds())), nil
+}
+
+func (s *ArtifactSuite) TestShareArtifact() {
+	artificer := &Artificer{
+		options: &core.PipelineOptions{ArtifactShareTTL: time.Hour},
+		logger:  util.RootLogger().WithField("Logger", "Test"),
+		store:   &shareStore{},
+	}
+	artifact := &core.Artifact{ApplicationID: "app", RunID: "run", RunStepID: "step"}
+	artificer.shareArtifact(artifact)
+	s.Equal("https://example.com/"+artifact.RemotePath()+"?access=read&expires=3600&signature=s3cr3t", artifact.ShareURL)
+
+	artifact = &core.Artifact{ApplicationID: "app", RunID: "run", RunStepID: "step"}
+	artificer.store = &core.FileStore{}
+	artificer.shareArtifact(artifact)
+	s.Empty(artifact.ShareURL)
+}
@@ -0,0 +1,350 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/image"
+	"github.com/docker/go-connections/nat"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/wercker/docker-check-access"
+	"github.com/wercker/wercker/auth"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+// scratchBaseImage is the image a scratch push builds on with base-image,
+// saved to the host with docker save
+type scratchBaseImage struct {
+	// dir is where the docker save tarball was extracted
+	dir string
+
+	// layers are the paths of the layer tarballs relative to dir, from the
+	// bottom up
+	layers []string
+
+	config *image.Image
+}
+
+// newPullAuthenticator creates the authenticator that checks pull access to
+// images of other registries than the one the step pushes to, overridden in
+// tests
+var newPullAuthenticator = dockerauth.GetRegistryAuthenticator
+
+// checkPullAccess makes sure name can be pulled before the pull is
+// attempted. Images of the registry the step pushes to are checked with the
+// credentials of the step, images of other registries anonymously, which
+// only works for public images. It returns the credentials to pull with.
+func (s *DockerPushStep) checkPullAccess(name string) (docker.AuthConfiguration, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return docker.AuthConfiguration{}, fmt.Errorf("Invalid image name %s: %v", name, err)
+	}
+	repository := reference.TrimNamed(named).String()
+	domain := reference.Domain(named)
+
+	if pushed, err := reference.ParseNormalizedNamed(s.repository); err == nil && reference.Domain(pushed) == domain && s.authenticator != nil {
+		check, err := s.authenticator.CheckAccess(repository, auth.Pull)
+		if err != nil || !check {
+			s.logger.Errorln("Not allowed to pull", name, "with the credentials of the step")
+			return docker.AuthConfiguration{}, fmt.Errorf("Not allowed to pull %s with the credentials of the step", name)
+		}
+		return docker.AuthConfiguration{
+			Username: s.authenticator.Username(),
+			Password: s.authenticator.Password(),
+		}, nil
+	}
+
+	// The docker hub is the default registry
+	opts := dockerauth.CheckAccessOptions{InsecureRegistry: s.insecureRegistry}
+	if domain != "docker.io" {
+		scheme := "https"
+		if s.insecureRegistry {
+			scheme = "http"
+		}
+		opts.Registry = (&url.URL{Scheme: scheme, Host: domain, Path: "/v2"}).String()
+	}
+	anonymous, err := newPullAuthenticator(opts)
+	if err != nil {
+		return docker.AuthConfiguration{}, err
+	}
+	check, err := anonymous.CheckAccess(repository, auth.Pull)
+	if err != nil || !check {
+		s.logger.Errorln("Not allowed to pull", name, "anonymously")
+		return docker.AuthConfiguration{}, fmt.Errorf("Not allowed to pull %s anonymously, only public images of other registries than %s can be used", name, s.repository)
+	}
+	return docker.AuthConfiguration{}, nil
+}
+
+// pullRetryDelay is the delay before the first retry of a rate limited
+// pull, it doubles for every following attempt up to pullRetryMaxDelay.
+var pullRetryDelay = 5 * time.Second
+
+const pullRetryMaxDelay = 2 * time.Minute
+
+// rateLimitPattern matches the errors of registries that rate limit pulls,
+// like the TOOMANYREQUESTS of the Docker Hub
+var rateLimitPattern = regexp.MustCompile(`(?i)toomanyrequests|too many requests|rate limit`)
+
+// retryAfterPattern finds the Retry-After in seconds of a rate limit error
+var retryAfterPattern = regexp.MustCompile(`(?i)retry-?after:?\s*(\d+)`)
+
+// rateLimitDelay reports whether err is a rate limit error, and the delay
+// its Retry-After asks for, zero if it has none
+func rateLimitDelay(err error) (time.Duration, bool) {
+	dockerErr, ok := err.(*docker.Error)
+	if !(ok && dockerErr.Status == http.StatusTooManyRequests) && !rateLimitPattern.MatchString(err.Error()) {
+		return 0, false
+	}
+	if m := retryAfterPattern.FindStringSubmatch(err.Error()); m != nil {
+		if seconds, err := strconv.Atoi(m[1]); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, true
+}
+
+// pullWithRetry calls pull, which writes the status stream of a pull to
+// its writer, until it succeeds. Only rate limited pulls are retried, up to
+// retries times, waiting at least the Retry-After of the registry. The
+// progress of the pull is emitted on e.
+func pullWithRetry(ctx context.Context, e *core.NormalizedEmitter, options *core.PipelineOptions, name string, retries int, pull func(w io.Writer) error) error {
+	backoff := &util.Backoff{
+		Base:        pullRetryDelay,
+		Max:         pullRetryMaxDelay,
+		Jitter:      0.2,
+		MaxAttempts: retries + 1,
+	}
+	return backoff.Retry(ctx, func(attempt int) error {
+		var buf bytes.Buffer
+		status, statusWriter := io.Pipe()
+		go emitDockerJSONStream(e, status, options, dockerStreamPull)
+		err := pull(io.MultiWriter(statusWriter, &buf))
+		statusWriter.Close()
+		// Once the pull started the daemon reports errors in the status
+		// stream
+		if err == nil {
+			err = imageLoadError(&buf)
+		}
+		if err == nil {
+			return nil
+		}
+		delay, limited := rateLimitDelay(err)
+		if !limited {
+			return util.Permanent(err)
+		}
+		return util.RetryAfter(err, delay)
+	}, func(attempt int, delay time.Duration, err error) {
+		e.Emit(core.Logs, &core.LogsArgs{
+			Logs: fmt.Sprintf("Pull of %s rate limited, retrying in %ds (attempt %d of %d)\n", name, int(delay.Seconds()+0.5), attempt, retries),
+		})
+	})
+}
+
+// pullScratchBaseImage pulls the base-image with the credentials of
+// authConfig, with the progress of the pull emitted on e, and extracts it
+// into dir. Rate limited pulls are retried up to pull-retry-count times.
+// When the step sets a platform, that platform of a multi-arch base image
+// is pulled instead of the one of the docker daemon.
+func (s *DockerPushStep) pullScratchBaseImage(ctx context.Context, client *DockerClient, e *core.NormalizedEmitter, authConfig docker.AuthConfiguration, dir string) (*scratchBaseImage, error) {
+	name := s.baseImage
+	repository, tag := docker.ParseRepositoryTag(name)
+	if tag == "" {
+		tag = "latest"
+	}
+
+	err := pullWithRetry(ctx, e, s.options, name, s.pullRetryCount, func(w io.Writer) error {
+		if s.platformSet {
+			return pullImagePlatform(ctx, s.clientOptions(), fmt.Sprintf("%s:%s", repository, tag), formatPlatform(s.os, s.architecture, s.variant), authConfig, w)
+		}
+		return client.PullImage(docker.PullImageOptions{
+			Repository:    repository,
+			Tag:           tag,
+			OutputStream:  w,
+			RawJSONStream: true,
+		}, authConfig)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to pull base-image %s: %v", name, err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(client.ExportImage(docker.ExportImageOptions{
+			Name:         fmt.Sprintf("%s:%s", repository, tag),
+			OutputStream: w,
+		}))
+	}()
+	if err := util.Untar(dir, r); err != nil {
+		r.CloseWithError(err)
+		return nil, fmt.Errorf("Unable to export base-image %s: %v", name, err)
+	}
+	base, err := loadScratchBaseImage(dir)
+	if err != nil {
+		return nil, err
+	}
+	if base.config.OS != s.os || base.config.Architecture != s.architecture {
+		s.logger.Warnln("base-image", name, "is", base.config.OS+"/"+base.config.Architecture, "but the image is", s.os+"/"+s.architecture, "set the platform to pull the matching image")
+	}
+	return base, nil
+}
+
+// pullImagePlatform pulls platform of ref with the official client, our
+// docker client can't select the platform of a multi-arch image. The JSON
+// status stream of the pull is written to w.
+func pullImagePlatform(ctx context.Context, options *Options, ref, platform string, authConfig docker.AuthConfiguration, w io.Writer) error {
+	officialClient, err := NewOfficialDockerClient(options)
+	if err != nil {
+		return err
+	}
+	registryAuth, err := json.Marshal(types.AuthConfig{
+		Username: authConfig.Username,
+		Password: authConfig.Password,
+	})
+	if err != nil {
+		return err
+	}
+	status, err := officialClient.ImagePull(ctx, ref, types.ImagePullOptions{
+		RegistryAuth: base64.URLEncoding.EncodeToString(registryAuth),
+		Platform:     platform,
+	})
+	if err != nil {
+		return err
+	}
+	defer status.Close()
+	_, err = io.Copy(w, status)
+	return err
+}
+
+// loadScratchBaseImage reads the manifest.json and image config of the
+// docker save tarball extracted in dir
+func loadScratchBaseImage(dir string) (*scratchBaseImage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var manifest []scratchManifestItem
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest) != 1 {
+		return nil, fmt.Errorf("Expected a single image in base-image, found %d", len(manifest))
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, manifest[0].Config))
+	if err != nil {
+		return nil, err
+	}
+	config, err := image.NewFromJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if config.RootFS == nil || len(config.RootFS.DiffIDs) != len(manifest[0].Layers) {
+		return nil, fmt.Errorf("base-image layers don't match its config")
+	}
+
+	return &scratchBaseImage{
+		dir:    dir,
+		layers: manifest[0].Layers,
+		config: config,
+	}, nil
+}
+
+// mergeConfig returns config with the settings of the base image it doesn't
+// set itself. Env is merged by key with the values of config winning. Like
+// a Dockerfile ENTRYPOINT, an entrypoint on the step also replaces the cmd
+// of the base image, as does a cmd that is explicitly set to be empty when
+// cmdSet is true.
+func (b *scratchBaseImage) mergeConfig(config *container.Config, cmdSet bool) *container.Config {
+	merged := *config
+	base := b.config.Config
+	if base == nil {
+		return &merged
+	}
+
+	merged.Env = mergeEnv(base.Env, config.Env)
+	if len(config.Entrypoint) == 0 {
+		merged.Entrypoint = base.Entrypoint
+		if !cmdSet {
+			merged.Cmd = base.Cmd
+		}
+	}
+	if merged.WorkingDir == "" {
+		merged.WorkingDir = base.WorkingDir
+	}
+	if merged.User == "" {
+		merged.User = base.User
+	}
+	if merged.Healthcheck == nil {
+		merged.Healthcheck = base.Healthcheck
+	}
+	if merged.StopTimeout == nil {
+		merged.StopTimeout = base.StopTimeout
+	}
+	if len(base.Volumes) > 0 {
+		merged.Volumes = map[string]struct{}{}
+		for volume := range base.Volumes {
+			merged.Volumes[volume] = struct{}{}
+		}
+		for volume := range config.Volumes {
+			merged.Volumes[volume] = struct{}{}
+		}
+	}
+	if len(base.ExposedPorts) > 0 {
+		merged.ExposedPorts = nat.PortSet{}
+		for port := range base.ExposedPorts {
+			merged.ExposedPorts[port] = struct{}{}
+		}
+		for port := range config.ExposedPorts {
+			merged.ExposedPorts[port] = struct{}{}
+		}
+	}
+	if len(base.Labels) > 0 {
+		merged.Labels = map[string]string{}
+		for k, v := range base.Labels {
+			merged.Labels[k] = v
+		}
+		for k, v := range config.Labels {
+			merged.Labels[k] = v
+		}
+	}
+	return &merged
+}
+
+// baseLayerPath is the path of the i-th base image layer in the scratch
+// tarball
+func baseLayerPath(i int) string {
+	return filepath.Join(fmt.Sprintf("base-%d", i), "layer.tar")
+}
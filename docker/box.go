@@ -550,7 +550,8 @@ func (b *DockerBox) Fetch(ctx context.Context, env *util.Environment) (*docker.I
 
 	// If user use Azure or AWS container registry we don't infer.
 	if b.config.Auth.AzureClientSecret == "" && b.config.Auth.AwsSecretKey == "" {
-		repository, registry, err := InferRegistryAndRepository(repo, b.config.Auth.Registry, b.options)
+		repository, registry, notes, err := InferRegistryAndRepositoryNotes(repo, b.config.Auth.Registry, b.options, b.config.Auth.InsecureRegistry, false)
+		LogRegistryNotes(b.logger, notes)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,176 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/wercker/wercker/core"
+	"golang.org/x/net/context"
+)
+
+// DefaultBuildCacheTag is the tag of the registry build cache of the
+// repository when a builder is set and build-cache-ref isn't
+const DefaultBuildCacheTag = "buildcache"
+
+// buildKitImage builds the dockerfile option with BuildKit on the host,
+// using the source directory of the pipeline container as the build
+// context. The image is tagged with the first tag of the step and loaded
+// into the docker daemon, its ID is returned.
+func (s *DockerPushStep) buildKitImage(ctx context.Context, client *DockerClient, containerID string) (string, error) {
+	artificer := NewArtificer(s.options, s.dockerOptions)
+	source, err := artificer.Collect(&core.Artifact{
+		ContainerID: containerID,
+		GuestPath:   s.options.GuestPath("source"),
+		HostPath:    s.options.HostPath("buildkit-source"),
+		HostTarPath: s.options.HostPath("buildkit-source.tar"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to collect the build context: %v", err)
+	}
+
+	configDir := s.options.HostPath("buildkit-docker-config")
+	if err := s.writeBuildKitDockerConfig(configDir); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(configDir)
+
+	tag := fmt.Sprintf("%s:%s", s.repository, s.tags[0])
+	cmd := exec.CommandContext(ctx, "docker", s.buildKitArgs(source.HostPath, tag)...)
+	cmd.Env = append(os.Environ(), s.buildKitEnv(configDir)...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	s.logger.WithField("Args", cmd.Args).Debug("Building image with BuildKit")
+	if err := cmd.Run(); err != nil {
+		s.logger.Errorln(output.String())
+		return "", fmt.Errorf("BuildKit failed to build %s: %v", s.dockerfile, err)
+	}
+	s.logger.Debugln(output.String())
+
+	image, err := client.InspectImage(tag)
+	if err != nil {
+		return "", fmt.Errorf("Unable to find the image BuildKit built: %v", err)
+	}
+	return image.ID, nil
+}
+
+// buildKitArgs returns the docker arguments to build the dockerfile in
+// contextDir as tag. Without a builder the default docker driver can't
+// export a registry cache, the cache is then inlined into the pushed image
+// and read back from the pushed tag.
+func (s *DockerPushStep) buildKitArgs(contextDir, tag string) []string {
+	args := []string{"buildx", "build", "--load",
+		"--file", filepath.Join(contextDir, s.dockerfile),
+		"--tag", tag,
+	}
+	if s.builder != "" {
+		args = append(args, "--builder", s.builder)
+	}
+
+	labels := make([]string, 0, len(s.labels))
+	for key := range s.labels {
+		labels = append(labels, key)
+	}
+	sort.Strings(labels)
+	for _, key := range labels {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", key, s.labels[key]))
+	}
+
+	if !s.dockerOptions.Local {
+		if s.builder == "" {
+			args = append(args, "--cache-from", "type=registry,ref="+tag, "--cache-to", "type=inline")
+		} else {
+			cacheRef := s.buildCacheRef
+			if cacheRef == "" {
+				cacheRef = fmt.Sprintf("%s:%s", s.repository, DefaultBuildCacheTag)
+			}
+			args = append(args, "--cache-from", "type=registry,ref="+cacheRef, "--cache-to", "type=registry,ref="+cacheRef+",mode=max")
+		}
+	}
+	return append(args, contextDir)
+}
+
+// buildKitEnv points docker at the daemon of the step and at the docker
+// config in configDir. The builders buildx knows about stay where they were
+// without it.
+func (s *DockerPushStep) buildKitEnv(configDir string) []string {
+	env := []string{
+		"DOCKER_BUILDKIT=1",
+		"DOCKER_HOST=" + s.dockerOptions.Host,
+		"DOCKER_CONFIG=" + configDir,
+	}
+	if s.dockerOptions.TLSVerify == "1" {
+		env = append(env, "DOCKER_TLS_VERIFY=1", "DOCKER_CERT_PATH="+s.dockerOptions.CertPath)
+	}
+	if os.Getenv("BUILDX_CONFIG") == "" {
+		dockerConfig := os.Getenv("DOCKER_CONFIG")
+		if dockerConfig == "" {
+			dockerConfig = filepath.Join(os.Getenv("HOME"), ".docker")
+		}
+		env = append(env, "BUILDX_CONFIG="+filepath.Join(dockerConfig, "buildx"))
+	}
+	return env
+}
+
+// writeBuildKitDockerConfig writes a docker config.json to dir with the
+// credentials of the step for the registry, which buildx uses to read and
+// write the build cache
+func (s *DockerPushStep) writeBuildKitDockerConfig(dir string) error {
+	return writeDockerConfig(dir, s.repository, s.authenticator.Username(), s.authenticator.Password())
+}
+
+// writeDockerConfig writes a docker config.json to dir with the credentials
+// for the registry of repository. Tools that read the docker config get the
+// credentials without them showing up in their arguments.
+func writeDockerConfig(dir, repository, username, password string) error {
+	auths := map[string]map[string]string{}
+	if username != "" {
+		registry := "https://index.docker.io/v1/"
+		if named, err := reference.ParseNormalizedNamed(repository); err == nil && reference.Domain(named) != "docker.io" {
+			registry = reference.Domain(named)
+		}
+		auths[registry] = map[string]string{
+			"auth": base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		}
+	}
+	config, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "config.json"), config, 0600)
+}
+
+// validateDockerfile checks that dockerfile is a path in the build context
+func validateDockerfile(dockerfile string) error {
+	clean := filepath.Clean(dockerfile)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("Invalid dockerfile %q, expected a path relative to the source directory", dockerfile)
+	}
+	return nil
+}
@@ -17,23 +17,33 @@ package dockerlocal
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
 	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/google/shlex"
 	digest "github.com/opencontainers/go-digest"
@@ -43,15 +53,75 @@ import (
 	"github.com/wercker/wercker/auth"
 	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
+	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/net/context"
 )
 
 const (
 	// DefaultDockerRegistryUsername is an arbitrary value. It is unused by callees,
-	// so the value can be anything so long as it's not empty.
+	// so the value can be anything so long as it's not empty. It is only used
+	// for the built-in registry when no username was set on the step; an
+	// explicitly set username (and password) takes precedence.
 	DefaultDockerRegistryUsername = "token"
-	DefaultDockerCommand          = `/bin/sh -c "if [ -e /bin/bash ]; then /bin/bash; else /bin/sh; fi"`
-	NoPushConfirmationInStatus    = "Docker push failed to complete. Please check logs for any error condition.."
+	// DefaultDockerCommand keeps the pipeline containers running, it isn't
+	// meant for pushed images and scratch images never get it
+	DefaultDockerCommand       = `/bin/sh -c "if [ -e /bin/bash ]; then /bin/bash; else /bin/sh; fi"`
+	NoPushConfirmationInStatus = "Docker push failed to complete. Please check logs for any error condition.."
+
+	// GitHubContainerRegistryDomain is the domain of repositories in the
+	// GitHub Container Registry, pushes to it can use a github-token
+	GitHubContainerRegistryDomain = "ghcr.io"
+	GitHubContainerRegistry       = "https://ghcr.io/v2/"
+
+	// DefaultPushRetryCount is how often a push is retried after a transient
+	// failure
+	DefaultPushRetryCount = 3
+
+	// DefaultPullRetryCount is how often a rate limited pull of a base image
+	// is retried
+	DefaultPullRetryCount = 3
+
+	// DefaultPushInactivityTimeout is how long a push may go without any
+	// output before it is aborted
+	DefaultPushInactivityTimeout = 5 * time.Minute
+
+	// DefaultPushConcurrency is the amount of tags that are pushed at the
+	// same time
+	DefaultPushConcurrency = 1
+
+	// ErrorModeFailFast stops at the first target that fails (default)
+	ErrorModeFailFast = "fail-fast"
+	// ErrorModeCollect attempts all targets and reports all failures at the end
+	ErrorModeCollect = "collect"
+
+	// AuthModeDevice obtains the registry password using the OAuth device flow
+	AuthModeDevice = "device"
+
+	// EmptyTagsFail fails the push when no tags are left to push (default)
+	EmptyTagsFail = "fail"
+	// EmptyTagsSkip skips the push, succeeding, when no tags are left to push
+	EmptyTagsSkip = "skip"
+
+	// EnvModeReplace uses only the env of the step for the image config
+	// (default). Committed images keep the env of the container as well,
+	// docker commit always merges it in.
+	EnvModeReplace = "replace"
+	// EnvModeMerge merges the env of the running container, without the
+	// variables wercker sets for the run (see isInternalEnv), with the env
+	// of the step
+	EnvModeMerge = "merge"
+
+	// PushStatusLogName is the file save-push-log writes the status stream
+	// of the docker daemon to
+	PushStatusLogName = "push-status.log"
+	// PushSummaryName is the file the summary of a push is written to, see
+	// core.PushSummary
+	PushSummaryName = "push-summary.json"
+
+	// PushByDigestTag is the tag images are pushed under with push-by-digest
+	// when no tags are configured. The docker daemon can only push tags, the
+	// image is meant to be referenced by its digest.
+	PushByDigestTag = "wercker-push-by-digest"
 )
 
 //TODO: The current fsouza/go-dockerclient does not contain structs for status messages emitted
@@ -166,180 +236,365 @@ func NewDockerScratchPushStep(stepConfig *core.StepConfig, options *core.Pipelin
 
 // Execute the scratch-n-push
 func (s *DockerScratchPushStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
+	if s.configErr != nil {
+		return -1, s.configErr
+	}
+	if err := s.authorizeDevice(ctx); err != nil {
+		return -1, err
+	}
+
 	// This is clearly only relevant to docker so we're going to dig into the
 	// transport internals a little bit to get the container ID
 	dt := sess.Transport().(*DockerTransport)
 	containerID := dt.containerID
 
-	_, err := s.CollectArtifact(containerID)
+	client, err := NewDockerClient(s.clientOptions())
 	if err != nil {
-		return -1, err
+		return 1, err
 	}
 
-	// layer.tar has an extra folder in it so we have to strip it :/
-	artifactReader, err := os.Open(s.options.HostPath("layer.tar"))
+	layers, err := s.buildScratchLayers(client, containerID)
+	defer layers.Close()
 	if err != nil {
 		return -1, err
 	}
-	defer artifactReader.Close()
 
-	layerFile, err := os.OpenFile(s.options.HostPath("real_layer.tar"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if s.baseImage != "" {
+		defer os.RemoveAll(s.options.HostPath("base-image"))
+	}
+	config, baseImage, err := s.buildScratchConfig(ctx, client, containerID)
 	if err != nil {
 		return -1, err
 	}
-	defer layerFile.Close()
 
-	digester := digest.Canonical.Digester()
-	mwriter := io.MultiWriter(layerFile, digester.Hash())
+	js, cached, err := s.buildScratchImageJSON(config, baseImage, layers, containerID)
+	if err != nil {
+		return -1, err
+	}
+	hash := sha256.New()
+	hash.Write(js)
+	layerID := hex.EncodeToString(hash.Sum(nil))
 
-	tr := tar.NewReader(artifactReader)
-	tw := tar.NewWriter(mwriter)
+	defer os.RemoveAll(s.options.HostPath("scratch"))
+	if err := s.writeScratchImage(layerID, js, baseImage, layers); err != nil {
+		return -1, err
+	}
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			// finished the tarball
-			break
+	s.tags = s.buildTags()
+	if done, err := s.handleEmptyTags(); done {
+		if err != nil {
+			return 1, err
 		}
+		return 0, nil
+	}
+
+	if s.format == ImageFormatOCI {
+		return s.pushOCI(ctx, sess, js, s.scratchLayerPaths(layerID, baseImage, layers))
+	}
+	if err := s.writeDockerSave(layerID, baseImage, layers); err != nil {
+		return -1, err
+	}
+	return s.pushDockerSave(ctx, sess, client, layerID, cached)
+}
 
+// buildScratchLayers writes the artifact of the container to the layers of
+// the scratch image. Every directory in layer-dirs gets its own layer below
+// the layer with the rest of the artifact. The returned layers need to be
+// closed, also when there is an error.
+func (s *DockerScratchPushStep) buildScratchLayers(client *DockerClient, containerID string) (*scratchLayers, error) {
+	layers := &scratchLayers{}
+	for i := range s.layerDirs {
+		layerFile, err := newScratchLayerFile(s.options.HostPath(fmt.Sprintf("real_layer_%d.tar", i)))
 		if err != nil {
-			return -1, err
+			return layers, err
 		}
+		layers.files = append(layers.files, layerFile)
+	}
+	mainLayer, err := newScratchLayerFile(s.options.HostPath("real_layer.tar"))
+	if err != nil {
+		return layers, err
+	}
+	layers.files = append(layers.files, mainLayer)
+	layers.main = mainLayer
 
-		// Skip the base dir
-		if hdr.Name == "./" {
-			continue
-		}
+	// The layers written from the artifact count against max-layer-size
+	// together
+	sizeLimit := &layerSizeLimit{limit: s.maxLayerSize}
+	writers := make([]io.Writer, len(layers.files))
+	for i, layerFile := range layers.files {
+		writers[i] = sizeLimit.Writer(layerFile.Writer())
+	}
+
+	extraFiles, err := resolveExtraFiles(s.options, s.extraFiles)
+	if err != nil {
+		return layers, err
+	}
+	layers.foreign, err = resolveForeignLayers(s.options, s.foreignLayers)
+	if err != nil {
+		return layers, err
+	}
 
-		if strings.HasPrefix(hdr.Name, "output/") {
-			hdr.Name = hdr.Name[len("output/"):]
-		} else if strings.HasPrefix(hdr.Name, "source/") {
-			hdr.Name = hdr.Name[len("source/"):]
+	var entries []int
+	if s.streamLayer {
+		// Get the output dir, if it is empty grab the source dir.
+		entries, err = s.streamArtifact(client, containerID, s.options.GuestPath("output"), writers, extraFiles)
+		if err == util.ErrEmptyTarball {
+			sizeLimit.Reset()
+			for i, layerFile := range layers.files {
+				if err = layerFile.Reset(); err != nil {
+					return layers, err
+				}
+				writers[i] = sizeLimit.Writer(layerFile.Writer())
+			}
+			entries, err = s.streamArtifact(client, containerID, s.options.BasePath(), writers, extraFiles)
+			if err == util.ErrEmptyTarball {
+				err = ErrEmptyScratchImage
+			}
+		}
+		if err != nil {
+			return layers, err
+		}
+	} else {
+		_, err = s.CollectArtifact(containerID)
+		if err != nil {
+			return layers, err
+		}
+		if err := s.checkLayerSize(s.options.HostPath("layer.tar")); err != nil {
+			return layers, err
+		}
+		// The layers take about as much space as the artifact
+		info, err := os.Stat(s.options.HostPath("layer.tar"))
+		if err != nil {
+			return layers, err
+		}
+		if err := s.checkDiskSpace(info.Size()); err != nil {
+			return layers, err
 		}
 
-		if len(hdr.Name) == 0 {
-			continue
+		// layer.tar has an extra folder in it so we have to strip it :/
+		artifactReader, err := os.Open(s.options.HostPath("layer.tar"))
+		if err != nil {
+			return layers, err
 		}
+		defer artifactReader.Close()
 
-		tw.WriteHeader(hdr)
-		_, err = io.Copy(tw, tr)
+		_, entries, err = writeScratchLayers(s.logger, artifactReader, writers, s.layerIndex, s.reproducibleTime, extraFiles)
 		if err != nil {
-			return -1, err
+			return layers, err
 		}
 	}
 
-	config := &container.Config{
-		Cmd:          s.cmd,
-		Entrypoint:   s.entrypoint,
-		Env:          s.env,
-		Hostname:     containerID[:16],
-		WorkingDir:   s.workingDir,
-		Volumes:      s.volumes,
-		ExposedPorts: tranformPorts(s.ports),
+	// Directories from layer-dirs that aren't in the artifact don't get a
+	// layer
+	for i := range s.layerDirs {
+		if entries[i] > 0 {
+			layers.split = append(layers.split, layers.files[i])
+		} else {
+			s.logger.WithField("Dir", s.layerDirs[i]).Debug("Skipping empty scratch layer")
+		}
 	}
+	return layers, nil
+}
 
-	// Make the JSON file we need
-	t := time.Now()
-	base := image.V1Image{
-		Architecture: "amd64",
-		Container:    containerID,
-		ContainerConfig: container.Config{
-			Hostname: containerID[:16],
-		},
-		DockerVersion: "1.10",
-		Created:       t,
-		OS:            "linux",
-		Config:        config,
+// buildScratchConfig returns the config of the scratch image. With
+// base-image the base image is pulled as well, the artifact is layered on top
+// of it instead of an empty file system.
+func (s *DockerScratchPushStep) buildScratchConfig(ctx context.Context, client *DockerClient, containerID string) (*container.Config, *scratchBaseImage, error) {
+	imageEnv, err := s.imageEnv(client, containerID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, hostname := s.scratchContainer(containerID)
+	config := s.scratchConfig(imageEnv, hostname)
+	if s.baseImage == "" {
+		return config, nil, nil
 	}
 
-	imageJSON := image.Image{
-		V1Image: base,
-		History: []image.History{image.History{Created: t}},
-		RootFS: &image.RootFS{
-			Type:    "layers",
-			DiffIDs: []layer.DiffID{layer.DiffID(digester.Digest())},
-		},
+	s.logger.WithField("BaseImage", s.baseImage).Debug("Pulling scratch base image")
+	authConfig, err := s.checkPullAccess(s.baseImage)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
+	baseImage, err := s.pullScratchBaseImage(ctx, client, e, authConfig, s.options.HostPath("base-image"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return baseImage.mergeConfig(config, s.cmdSet), baseImage, nil
+}
 
-	js, err := imageJSON.MarshalJSON()
+// scratchContainer returns the container ID and hostname in the image JSON.
+// The container ID differs for every run, reproducible images leave them
+// out.
+func (s *DockerScratchPushStep) scratchContainer(containerID string) (string, string) {
+	if s.reproducible {
+		return "", ""
+	}
+	return containerID, containerID[:16]
+}
+
+// buildScratchImageJSON returns the image JSON of the scratch image and
+// whether it came from the layer cache, which keeps the JSON of an earlier
+// push of the same layers and config.
+func (s *DockerScratchPushStep) buildScratchImageJSON(config *container.Config, baseImage *scratchBaseImage, layers *scratchLayers, containerID string) ([]byte, bool, error) {
+	diffIDs, err := layers.diffIDs(baseImage)
 	if err != nil {
-		return -1, err
+		return nil, false, err
 	}
 
-	hash := sha256.New()
-	hash.Write(js)
-	layerID := hex.EncodeToString(hash.Sum(nil))
+	var layerCache *ScratchLayerCache
+	var cacheKey string
+	if s.layerCache {
+		cacheDiffID := digest.Digest(layers.main.DiffID())
+		if len(diffIDs) > 1 {
+			cacheDiffID = digest.FromString(fmt.Sprint(diffIDs))
+		}
+		// The platform is part of the image JSON as well
+		if s.os != DefaultImageOS || s.architecture != DefaultImageArchitecture || s.variant != "" {
+			cacheDiffID = digest.FromString(fmt.Sprint(cacheDiffID, s.os, s.architecture, s.variant))
+		}
+		layerCache = NewScratchLayerCache(s.options.LayerCachePath())
+		cacheKey, err = layerCache.Key(cacheDiffID, config)
+		if err != nil {
+			return nil, false, err
+		}
+		if cachedJSON, ok := layerCache.Get(cacheKey); ok {
+			s.logger.WithField("Key", cacheKey).Debug("Scratch layer cache hit")
+			return cachedJSON, true, nil
+		}
+		s.logger.WithField("Key", cacheKey).Debug("Scratch layer cache miss")
+	}
 
-	err = os.MkdirAll(s.options.HostPath("scratch", layerID), 0755)
+	// Make the JSON file we need
+	t := time.Now()
+	if s.reproducible {
+		t = s.reproducibleTime
+	}
+	imageContainerID, hostname := s.scratchContainer(containerID)
+	js, err := s.scratchImageJSON(config, diffIDs, baseImage, imageContainerID, hostname, t)
 	if err != nil {
-		return -1, err
+		return nil, false, err
+	}
+
+	if layerCache != nil {
+		if err := layerCache.Put(cacheKey, js); err != nil {
+			s.logger.WithError(err).Warn("Unable to store scratch layer in cache")
+		}
+	}
+	return js, false, nil
+}
+
+// writeScratchImage moves the layers of the scratch image with layerID into
+// the scratch directory next to its VERSION and json files.
+func (s *DockerScratchPushStep) writeScratchImage(layerID string, js []byte, baseImage *scratchBaseImage, layers *scratchLayers) error {
+	err := os.MkdirAll(s.options.HostPath("scratch", layerID), 0755)
+	if err != nil {
+		return err
 	}
 
-	layerFile.Close()
+	layers.main.Close()
 
-	err = os.Rename(layerFile.Name(), s.options.HostPath("scratch", layerID, "layer.tar"))
+	err = os.Rename(layers.main.Name(), s.options.HostPath("scratch", layerID, "layer.tar"))
 	if err != nil {
-		return -1, err
+		return err
+	}
+	for i, splitLayer := range layers.split {
+		splitPath := s.options.HostPath("scratch", splitLayerPath(i))
+		if err := os.MkdirAll(filepath.Dir(splitPath), 0755); err != nil {
+			return err
+		}
+		splitLayer.Close()
+		if err := os.Rename(splitLayer.Name(), splitPath); err != nil {
+			return err
+		}
+	}
+	if baseImage != nil {
+		for i, baseLayer := range baseImage.layers {
+			basePath := s.options.HostPath("scratch", baseLayerPath(i))
+			if err := os.MkdirAll(filepath.Dir(basePath), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(filepath.Join(baseImage.dir, baseLayer), basePath); err != nil {
+				return err
+			}
+		}
 	}
-	defer os.RemoveAll(s.options.HostPath("scratch"))
 
 	// VERSION file
 	versionFile, err := os.OpenFile(s.options.HostPath("scratch", layerID, "VERSION"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return -1, err
+		return err
 	}
 	defer versionFile.Close()
 
 	_, err = versionFile.Write([]byte("1.0"))
 	if err != nil {
-		return -1, err
+		return err
 	}
 
 	err = versionFile.Sync()
 	if err != nil {
-		return -1, err
+		return err
 	}
 
 	// json file
 	jsonFile, err := os.OpenFile(s.options.HostPath("scratch", layerID, "json"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return -1, err
+		return err
 	}
 	defer jsonFile.Close()
 
 	_, err = jsonFile.Write(js)
 	if err != nil {
-		return -1, err
+		return err
 	}
 
-	err = jsonFile.Sync()
-	if err != nil {
-		return -1, err
+	return jsonFile.Sync()
+}
+
+// scratchLayerPaths returns the paths of the layers of the scratch image
+// with layerID in the scratch directory, from the bottom up.
+func (s *DockerScratchPushStep) scratchLayerPaths(layerID string, baseImage *scratchBaseImage, layers *scratchLayers) []string {
+	layerPaths := []string{}
+	if baseImage != nil {
+		for i := range baseImage.layers {
+			layerPaths = append(layerPaths, s.options.HostPath("scratch", baseLayerPath(i)))
+		}
 	}
+	for i := range layers.split {
+		layerPaths = append(layerPaths, s.options.HostPath("scratch", splitLayerPath(i)))
+	}
+	return append(layerPaths, s.options.HostPath("scratch", layerID, "layer.tar"))
+}
 
+// writeDockerSave adds the files docker load needs to the scratch directory,
+// which makes it a docker save tarball of the image with layerID and the
+// tags of the step.
+func (s *DockerScratchPushStep) writeDockerSave(layerID string, baseImage *scratchBaseImage, layers *scratchLayers) error {
 	// repositories file
 	repositoriesFile, err := os.OpenFile(s.options.HostPath("scratch", "repositories"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return -1, err
+		return err
 	}
 	defer repositoriesFile.Close()
 
 	_, err = repositoriesFile.Write([]byte(fmt.Sprintf(`{"%s":{`, s.authenticator.Repository(s.repository))))
 	if err != nil {
-		return -1, err
+		return err
 	}
 
-	s.tags = s.buildTags()
-
 	for i, tag := range s.tags {
 		_, err = repositoriesFile.Write([]byte(fmt.Sprintf(`"%s":"%s"`, tag, layerID)))
 		if err != nil {
-			return -1, err
+			return err
 		}
 		if i != len(s.tags)-1 {
 			_, err = repositoriesFile.Write([]byte{','})
 			if err != nil {
-				return -1, err
+				return err
 			}
 		}
 	}
@@ -347,27 +602,43 @@ func (s *DockerScratchPushStep) Execute(ctx context.Context, sess *core.Session)
 	_, err = repositoriesFile.Write([]byte{'}', '}'})
 	err = repositoriesFile.Sync()
 	if err != nil {
-		return -1, err
+		return err
 	}
 
-	// Build our output tarball and start writing to it
-	imageFile, err := os.Create(s.options.HostPath("scratch.tar"))
-	if err != nil {
-		return -1, err
+	// With foreign layers we need a manifest.json to declare the layer
+	// sources, docker load prefers it over the repositories file. It also
+	// lists the layers when there is more than one.
+	if baseImage == nil && len(layers.foreign) == 0 && len(layers.split) == 0 {
+		return nil
 	}
-	defer imageFile.Close()
-
-	err = util.TarPath(imageFile, s.options.HostPath("scratch"))
-	if err != nil {
-		return -1, err
+	for i, foreignLayer := range layers.foreign {
+		foreignPath := s.options.HostPath("scratch", foreignLayerPath(i))
+		if err := os.MkdirAll(filepath.Dir(foreignPath), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(foreignLayer.Path, foreignPath); err != nil {
+			return err
+		}
 	}
-	imageFile.Close()
 
-	client, err := NewDockerClient(s.dockerOptions)
+	baseLayers := 0
+	if baseImage != nil {
+		baseLayers = len(baseImage.layers)
+	}
+	repoTags := make([]string, len(s.tags))
+	for i, tag := range s.tags {
+		repoTags[i] = fmt.Sprintf("%s:%s", s.authenticator.Repository(s.repository), tag)
+	}
+	manifest, err := json.Marshal(scratchManifest(layerID, repoTags, baseLayers, layers.foreign, len(layers.split)))
 	if err != nil {
-		return 1, err
+		return err
 	}
+	return ioutil.WriteFile(s.options.HostPath("scratch", "manifest.json"), manifest, 0644)
+}
 
+// pushDockerSave loads the docker save tarball in the scratch directory and
+// pushes the image with layerID.
+func (s *DockerScratchPushStep) pushDockerSave(ctx context.Context, sess *core.Session, client *DockerClient, layerID string, cached bool) (int, error) {
 	// Check the auth
 	if !s.dockerOptions.Local {
 		check, err := s.authenticator.CheckAccess(s.repository, auth.Push)
@@ -385,7 +656,7 @@ func (s *DockerScratchPushStep) Execute(ctx context.Context, sess *core.Session)
 	}).Debug("Scratch push to registry")
 
 	// Okay, we can access it, do a docker load to import the image then push it
-	loadFile, err := os.Open(s.options.HostPath("scratch.tar"))
+	loadFile, err := s.scratchImageReader()
 	if err != nil {
 		return -1, err
 	}
@@ -396,93 +667,731 @@ func (s *DockerScratchPushStep) Execute(ctx context.Context, sess *core.Session)
 		return 1, err
 	}
 
-	err = client.LoadImage(docker.LoadImageOptions{InputStream: loadFile})
-	if err != nil {
-		return 1, err
+	if s.cleanupIntermediate {
+		defer s.cleanupIntermediateImages(client)
+	}
+	return s.loadAndPush(ctx, sess, client, e, loadFile, layerID, cached)
+}
+
+// loadAndPush loads the scratch image with layerID into the daemon and
+// pushes it. If the image came from the layer cache, loading is skipped when
+// the daemon still has the image, and tags that already point to the image
+// in the registry aren't pushed again.
+func (s *DockerScratchPushStep) loadAndPush(ctx context.Context, sess *core.Session, client *DockerClient, e *core.NormalizedEmitter, loadFile io.Reader, layerID string, cached bool) (int, error) {
+	loaded := false
+	if cached {
+		if _, err := client.InspectImage(layerID); err == nil {
+			s.logger.WithField("ImageID", layerID).Println("Scratch image unchanged, skipping docker load")
+			loaded = true
+		}
+	}
+	if !loaded {
+		if err := client.LoadImage(docker.LoadImageOptions{InputStream: loadFile}); err != nil {
+			return 1, err
+		}
+		s.createdImages = append(s.createdImages, layerID)
+	}
+
+	tags := s.tags
+	if cached && !s.dockerOptions.Local && !s.pushByDigest {
+		if image, err := client.InspectImage(layerID); err == nil {
+			pushed := s.registryTagsUpToDate(ctx, digest.Digest(image.ID))
+			s.tags = []string{}
+			for _, tag := range tags {
+				if dgst, ok := pushed[tag]; ok {
+					s.setDigest(tag, string(dgst))
+					e.Emit(core.Logs, &core.LogsArgs{
+						Logs: fmt.Sprintf("\n%s:%s is up to date, skipping push\n", s.repository, tag),
+					})
+					continue
+				}
+				s.tags = append(s.tags, tag)
+			}
+		}
 	}
 
-	return s.tagAndPush(layerID, e, client)
+	if len(s.tags) > 0 {
+		exitCode, err := s.tagAndPush(ctx, layerID, e, client)
+		s.tags = tags
+		if err != nil {
+			return exitCode, wrapPushError(s.loadedNotPushedError(client, layerID, err), err)
+		}
+	}
+	s.tags = tags
+	return s.finishPush(ctx, sess)
 }
 
-// CollectArtifact is copied from the build, we use this to get the layer
-// tarball that we'll include in the image tarball
-func (s *DockerScratchPushStep) CollectArtifact(containerID string) (*core.Artifact, error) {
-	artificer := NewArtificer(s.options, s.dockerOptions)
+// scratchImageJSON returns the image JSON of a scratch image with config and
+// the layers diffIDs, created at t. The layers of baseImage keep their
+// history.
+func (s *DockerScratchPushStep) scratchImageJSON(config *container.Config, diffIDs []layer.DiffID, baseImage *scratchBaseImage, containerID, hostname string, t time.Time) ([]byte, error) {
+	base := image.V1Image{
+		Architecture: s.architecture,
+		Container:    containerID,
+		ContainerConfig: container.Config{
+			Hostname: hostname,
+		},
+		DockerVersion: "1.10",
+		Created:       t,
+		OS:            s.os,
+		Config:        config,
+	}
 
-	// Ensure we have the host directory
+	history := []image.History{}
+	ownLayers := len(diffIDs)
+	if baseImage != nil {
+		history = append(history, baseImage.config.History...)
+		ownLayers -= len(baseImage.layers)
+	}
+	for i := 0; i < ownLayers; i++ {
+		history = append(history, image.History{Created: t})
+	}
 
-	artifact := &core.Artifact{
-		ContainerID:   containerID,
-		GuestPath:     s.options.GuestPath("output"),
-		HostPath:      s.options.HostPath("layer"),
-		HostTarPath:   s.options.HostPath("layer.tar"),
-		ApplicationID: s.options.ApplicationID,
-		RunID:         s.options.RunID,
-		Bucket:        s.options.S3Bucket,
+	imageJSON := image.Image{
+		V1Image: base,
+		History: history,
+		RootFS: &image.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
 	}
 
-	sourceArtifact := &core.Artifact{
-		ContainerID:   containerID,
-		GuestPath:     s.options.BasePath(),
-		HostPath:      s.options.HostPath("layer"),
-		HostTarPath:   s.options.HostPath("layer.tar"),
-		ApplicationID: s.options.ApplicationID,
-		RunID:         s.options.RunID,
-		Bucket:        s.options.S3Bucket,
+	js, err := imageJSON.MarshalJSON()
+	if err != nil || s.variant == "" {
+		return js, err
 	}
+	return addImageVariant(js, s.variant)
+}
 
-	// Get the output dir, if it is empty grab the source dir.
-	fullArtifact, err := artificer.Collect(artifact)
+// addImageVariant adds variant to the image JSON js, the image.V1Image we
+// vendor has no field for it.
+func addImageVariant(js []byte, variant string) ([]byte, error) {
+	var fields map[string]*json.RawMessage
+	if err := json.Unmarshal(js, &fields); err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(variant)
 	if err != nil {
-		if err == util.ErrEmptyTarball {
-			fullArtifact, err = artificer.Collect(sourceArtifact)
-			if err != nil {
-				return nil, err
-			}
-			return fullArtifact, nil
-		}
 		return nil, err
 	}
-
-	return fullArtifact, nil
+	raw := json.RawMessage(value)
+	fields["variant"] = &raw
+	return json.Marshal(fields)
 }
 
-// DockerPushStep needs to implemenet IStep
-type DockerPushStep struct {
-	*core.BaseStep
-	options       *core.PipelineOptions
-	dockerOptions *Options
-	data          map[string]string
-	email         string
-	env           []string
-	stopSignal    string
-	builtInPush   bool
-	labels        map[string]string
-	user          string
-	authServer    string
-	repository    string
-	author        string
-	message       string
-	tags          []string
-	ports         map[docker.Port]struct{}
-	volumes       map[string]struct{}
-	cmd           []string
-	entrypoint    []string
-	forceTags     bool
-	logger        *util.LogEntry
-	workingDir    string
-	authenticator auth.Authenticator
-	// image (if set) is the tag of an existing image, and obtained by prepending the build ID to the specified image-name property
-	// if image is set then this image is tagged and pushed (equivalent to "docker push")
-	// if image is not set then the pipeline container is committed, tagged and pushed (classic behaviour)
-	image string
+// scratchConfig returns the config of the scratch image before a base-image
+// is merged in. Unlike committed images it doesn't inherit the cmd of the
+// pipeline container, which needs a shell the image likely doesn't have.
+func (s *DockerScratchPushStep) scratchConfig(env []string, hostname string) *container.Config {
+	return &container.Config{
+		Cmd:          s.cmd,
+		Entrypoint:   s.entrypoint,
+		Env:          env,
+		Hostname:     hostname,
+		WorkingDir:   s.workingDir,
+		Volumes:      s.volumes,
+		ExposedPorts: tranformPorts(s.ports),
+		Healthcheck:  s.healthcheck,
+		StopTimeout:  s.stopTimeout,
+	}
 }
 
-// NewDockerPushStep is a special step for doing docker pushes
-func NewDockerPushStep(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *Options) (*DockerPushStep, error) {
-	name := "docker-push"
-	displayName := "docker push"
-	if stepConfig.Name != "" {
+// loadedNotPushedError returns err of the failed push of the loaded image
+// imageID, saying whether the image is kept. With docker-cleanup-image its
+// tags of the repository are removed, which removes the image unless it is
+// tagged elsewhere as well.
+func (s *DockerScratchPushStep) loadedNotPushedError(client *DockerClient, imageID string, err error) error {
+	if !s.dockerOptions.CleanupImage {
+		return fmt.Errorf("Loaded image %s but the push failed, the image is kept: %v", imageID, err)
+	}
+	image, inspectErr := client.InspectImage(imageID)
+	if inspectErr != nil {
+		// Removing the pushed tags already removed it
+		return fmt.Errorf("Loaded image %s but the push failed, the image was removed: %v", imageID, err)
+	}
+	taggedElsewhere := false
+	for _, tag := range imageTags(image.RepoTags) {
+		if !strings.HasPrefix(tag, s.repository+":") {
+			taggedElsewhere = true
+			continue
+		}
+		if removeErr := client.RemoveImage(tag); removeErr != nil {
+			s.logger.WithError(removeErr).WithField("imageName", tag).Warn("Failed to delete image")
+		}
+	}
+	if taggedElsewhere {
+		return fmt.Errorf("Loaded image %s but the push failed, the image is kept as it is tagged elsewhere: %v", imageID, err)
+	}
+	// Removing the last tag usually removes the image as well
+	if removeErr := client.RemoveImage(image.ID); removeErr != nil {
+		s.logger.WithError(removeErr).WithField("Image", image.ID).Debug("Loaded image already removed")
+	}
+	return fmt.Errorf("Loaded image %s but the push failed, the image was removed: %v", imageID, err)
+}
+
+// checkLayerSize fails if the collected artifact at path is larger than
+// max-layer-size, before any image is built from it.
+func (s *DockerScratchPushStep) checkLayerSize(path string) error {
+	if s.maxLayerSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > s.maxLayerSize {
+		s.logger.Errorln("Artifact of", units.BytesSize(float64(info.Size())), "exceeds max-layer-size")
+		return maxLayerSizeError(s.maxLayerSize)
+	}
+	return nil
+}
+
+// checkDiskSpace fails if writing size bytes to the host path of the run
+// leaves less than min-free-space
+func (s *DockerScratchPushStep) checkDiskSpace(size int64) error {
+	err := util.CheckDiskSpace(s.options.HostPath(), size, s.minFreeSpace)
+	if err != nil {
+		s.logger.Errorln(err)
+	}
+	return err
+}
+
+// scratchImageReader returns the tarball of the scratch directory for docker
+// load. It is built while the daemon reads it, or written to scratch.tar
+// first with stage-to-disk.
+func (s *DockerScratchPushStep) scratchImageReader() (io.ReadCloser, error) {
+	scratchDir := s.options.HostPath("scratch")
+	if !s.stageToDisk {
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(util.TarPath(w, scratchDir))
+		}()
+		return r, nil
+	}
+
+	size, err := util.DirSize(scratchDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDiskSpace(size); err != nil {
+		return nil, err
+	}
+	imageFile, err := os.Create(s.options.HostPath("scratch.tar"))
+	if err != nil {
+		return nil, err
+	}
+	if err := util.TarPath(imageFile, scratchDir); err != nil {
+		imageFile.Close()
+		return nil, err
+	}
+	if err := imageFile.Close(); err != nil {
+		return nil, err
+	}
+	return os.Open(s.options.HostPath("scratch.tar"))
+}
+
+// pushOCI writes the scratch image as an OCI image layout and pushes it to
+// the registry without going through the docker daemon.
+func (s *DockerScratchPushStep) pushOCI(ctx context.Context, sess *core.Session, config []byte, layerPaths []string) (int, error) {
+	img, err := writeOCILayout(s.options.HostPath("oci"), config, layerPaths, s.tags, s.compression, s.compressionLevel, s.annotations)
+	if err != nil {
+		return -1, err
+	}
+	return s.pushOCILayout(ctx, sess, img)
+}
+
+// pushOCILayout pushes the OCI image layout img to the registry for every
+// tag, with --docker-local it is only written to disk.
+func (s *DockerPushStep) pushOCILayout(ctx context.Context, sess *core.Session, img *ociImage) (int, error) {
+	if s.dockerOptions.Local {
+		s.logger.Println("Wrote OCI image layout to", img.dir)
+		return 0, nil
+	}
+
+	check, err := s.authenticator.CheckAccess(s.repository, auth.Push)
+	if !check || err != nil {
+		s.logger.Errorln("Not allowed to interact with this repository:", s.repository)
+		return -1, fmt.Errorf("Not allowed to interact with this repository: %s", s.repository)
+	}
+	s.repository = s.authenticator.Repository(s.repository)
+	s.logger.WithFields(util.LogFields{
+		"Repository": s.repository,
+		"Tags":       s.tags,
+		"Message":    s.message,
+	}).Debug("OCI push to registry")
+
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return 1, err
+	}
+
+	repo, err := newRegistryRepository(ctx, s.repository, s.authenticator.Username(), s.authenticator.Password(), s.registryTransport, s.insecureRegistry)
+	if err != nil {
+		s.logger.Errorln("Unable to connect to the registry:", err)
+		return 1, err
+	}
+	dgst, err := img.push(ctx, repo, s.tags)
+	if err != nil {
+		s.logger.Errorln("Failed to push:", err)
+		return 1, err
+	}
+	for _, tag := range s.tags {
+		s.setDigest(tag, string(dgst))
+		s.logger.Println("Pushed container:", s.repository, tag, ",Digest:", dgst)
+		e.Emit(core.Logs, &core.LogsArgs{
+			Logs: fmt.Sprintf("\nPushed %s:%s\n", s.repository, tag),
+		})
+	}
+	return s.finishPush(ctx, sess)
+}
+
+// streamArtifact downloads guestPath from the container and pipes it through
+// the same rewrite as the file based path straight into ws, without staging
+// layer.tar on disk. It returns the entries written to each layer, or
+// util.ErrEmptyTarball if there were no files to include.
+func (s *DockerScratchPushStep) streamArtifact(client *DockerClient, containerID, guestPath string, ws []io.Writer, extraFiles []ExtraFile) ([]int, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	opts := docker.DownloadFromContainerOptions{
+		OutputStream: pipeWriter,
+		Path:         guestPath,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		err := client.DownloadFromContainer(containerID, opts)
+		pipeWriter.CloseWithError(err)
+		errs <- err
+	}()
+
+	files, entries, err := writeScratchLayers(s.logger, pipeReader, ws, s.layerIndex, s.reproducibleTime, extraFiles)
+
+	// Eat the rest of the stream so the download can finish
+	io.Copy(ioutil.Discard, pipeReader)
+
+	if derr := <-errs; derr != nil {
+		if dockerErr, ok := derr.(*docker.Error); ok {
+			if dockerErr.Status == 500 && strings.HasPrefix(dockerErr.Message, "Could not find the file") {
+				return nil, util.ErrEmptyTarball
+			}
+		}
+		return nil, derr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if files == 0 {
+		return nil, util.ErrEmptyTarball
+	}
+
+	s.logger.WithFields(util.LogFields{
+		"GuestPath": guestPath,
+		"Files":     files,
+	}).Debug("Streamed artifact into scratch layer")
+	return entries, nil
+}
+
+// writeScratchLayer copies the collected artifact tarball from r to w,
+// stripping the output/ or source/ folder the artifact was collected from.
+// Entries that would end up outside of the layer are skipped. If modTime is
+// not zero it is used as the timestamp of every entry. It returns the number
+// of files (not directories) written.
+func writeScratchLayer(logger *util.LogEntry, r io.Reader, w io.Writer, modTime time.Time) (int, error) {
+	files, _, err := writeScratchLayers(logger, r, []io.Writer{w}, func(string) int { return 0 }, modTime, nil)
+	return files, err
+}
+
+// writeScratchLayers is writeScratchLayer for an artifact that is split over
+// multiple layers, layerIndex picks the writer in ws for the path of each
+// entry. It returns the total number of files and the number of entries
+// written to each layer. The extraFiles are added to the last layer after
+// the artifact, they don't count as files of the artifact.
+func writeScratchLayers(logger *util.LogEntry, r io.Reader, ws []io.Writer, layerIndex func(name string) int, modTime time.Time, extraFiles []ExtraFile) (int, []int, error) {
+	tr := tar.NewReader(r)
+	tws := make([]*tar.Writer, len(ws))
+	for i, w := range ws {
+		tws[i] = tar.NewWriter(w)
+	}
+
+	files := 0
+	entries := make([]int, len(ws))
+	skipped := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// finished the tarball
+			break
+		}
+
+		if err != nil {
+			return files, entries, err
+		}
+
+		// Skip the base dir
+		if hdr.Name == "./" {
+			continue
+		}
+
+		name, ok := scratchLayerPath(hdr.Name)
+		if !ok {
+			logger.WithField("Name", hdr.Name).Warnln("Skipping unsafe entry in scratch layer")
+			skipped++
+			continue
+		}
+		if name == "" {
+			skipped++
+			continue
+		}
+		i := layerIndex(name)
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+
+		// Hard links point to another entry of the layer, so their target
+		// gets the same treatment. Symlink targets are resolved inside the
+		// image and are kept as they are.
+		linkname := hdr.Linkname
+		if hdr.Typeflag == tar.TypeLink {
+			linkname, ok = scratchLayerPath(hdr.Linkname)
+			if !ok || linkname == "" {
+				logger.WithField("Name", hdr.Name).Warnln("Skipping unsafe hard link in scratch layer")
+				skipped++
+				continue
+			}
+		}
+
+		newHdr := &tar.Header{
+			Name:       name,
+			Linkname:   linkname,
+			Typeflag:   hdr.Typeflag,
+			Mode:       hdr.Mode,
+			Uid:        hdr.Uid,
+			Gid:        hdr.Gid,
+			Uname:      hdr.Uname,
+			Gname:      hdr.Gname,
+			Size:       hdr.Size,
+			ModTime:    hdr.ModTime,
+			AccessTime: hdr.AccessTime,
+			ChangeTime: hdr.ChangeTime,
+			Devmajor:   hdr.Devmajor,
+			Devminor:   hdr.Devminor,
+			Xattrs:     hdr.Xattrs,
+		}
+		if !modTime.IsZero() {
+			newHdr.ModTime = modTime
+			newHdr.AccessTime = time.Time{}
+			newHdr.ChangeTime = time.Time{}
+		}
+		err = tws[i].WriteHeader(newHdr)
+		if err != nil {
+			return files, entries, err
+		}
+		_, err = io.Copy(tws[i], tr)
+		if err != nil {
+			return files, entries, err
+		}
+		entries[i]++
+		if hdr.Typeflag != tar.TypeDir {
+			files++
+		}
+	}
+
+	if len(extraFiles) > 0 {
+		last := len(tws) - 1
+		if err := writeExtraFiles(tws[last], extraFiles, modTime); err != nil {
+			return files, entries, err
+		}
+		entries[last] += len(extraFiles)
+	}
+
+	logger.WithFields(util.LogFields{
+		"Written": entries,
+		"Skipped": skipped,
+	}).Debug("Wrote scratch layer")
+	return files, entries, nil
+}
+
+// layerIndex returns the index of the layer the entry with name goes to, the
+// layers of layerDirs come first and the rest of the artifact goes to the
+// last layer.
+func (s *DockerPushStep) layerIndex(name string) int {
+	top := strings.SplitN(name, "/", 2)[0]
+	for i, dir := range s.layerDirs {
+		if top == dir {
+			return i
+		}
+	}
+	return len(s.layerDirs)
+}
+
+// scratchLayerPath strips the output/ or source/ folder from name and cleans
+// the result. It returns false if the path would escape the layer.
+func scratchLayerPath(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "./")
+	if strings.HasPrefix(name, "output/") {
+		name = name[len("output/"):]
+	} else if strings.HasPrefix(name, "source/") {
+		name = name[len("source/"):]
+	}
+
+	// Absolute paths are made relative to the root of the layer
+	name = strings.TrimLeft(name, "/")
+	if name == "" {
+		return "", true
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+
+	name = path.Clean(name)
+	if name == "." {
+		return "", true
+	}
+	return name, true
+}
+
+// CollectArtifact is copied from the build, we use this to get the layer
+// tarball that we'll include in the image tarball
+func (s *DockerScratchPushStep) CollectArtifact(containerID string) (*core.Artifact, error) {
+	artificer := NewArtificer(s.options, s.dockerOptions)
+
+	// Ensure we have the host directory
+
+	artifact := &core.Artifact{
+		ContainerID:   containerID,
+		GuestPath:     s.options.GuestPath("output"),
+		HostPath:      s.options.HostPath("layer"),
+		HostTarPath:   s.options.HostPath("layer.tar"),
+		ApplicationID: s.options.ApplicationID,
+		RunID:         s.options.RunID,
+		Bucket:        s.options.S3Bucket,
+	}
+
+	sourceArtifact := &core.Artifact{
+		ContainerID:   containerID,
+		GuestPath:     s.options.BasePath(),
+		HostPath:      s.options.HostPath("layer"),
+		HostTarPath:   s.options.HostPath("layer.tar"),
+		ApplicationID: s.options.ApplicationID,
+		RunID:         s.options.RunID,
+		Bucket:        s.options.S3Bucket,
+	}
+
+	return collectScratchArtifact(artificer.Collect, artifact, sourceArtifact)
+}
+
+// ErrEmptyScratchImage is returned when neither the output nor the source
+// directory have any files to put in a scratch image
+var ErrEmptyScratchImage = errors.New("no files to include in scratch image, the output and source directories are both empty")
+
+// collectScratchArtifact collects the output dir, if it is empty it grabs
+// the source dir.
+func collectScratchArtifact(collect func(*core.Artifact) (*core.Artifact, error), output, source *core.Artifact) (*core.Artifact, error) {
+	fullArtifact, err := collect(output)
+	if err == util.ErrEmptyTarball {
+		fullArtifact, err = collect(source)
+		if err == util.ErrEmptyTarball {
+			return nil, ErrEmptyScratchImage
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fullArtifact, nil
+}
+
+// DockerPushStep needs to implemenet IStep
+type DockerPushStep struct {
+	*core.BaseStep
+	options       *core.PipelineOptions
+	dockerOptions *Options
+	data          map[string]string
+	email         string
+	env           []string
+	stopSignal    string
+	// stopTimeout is the number of seconds to wait for the container to
+	// stop before it is killed, nil leaves it to the runtime
+	stopTimeout *int
+	builtInPush bool
+	labels      map[string]string
+	user        string
+	authServer  string
+	repository  string
+	author      string
+	message     string
+	tags        []string
+	ports       map[docker.Port]struct{}
+	volumes     map[string]struct{}
+	// cmd of the pushed image. It takes precedence over the cmd of a
+	// base-image, which takes precedence over the cmd of the pipeline
+	// container for committed images. Scratch images don't have a cmd unless
+	// either sets one.
+	cmd []string
+	// cmdSet is true when the cmd option is set, to an empty value it
+	// leaves the image without a cmd
+	cmdSet     bool
+	entrypoint []string
+	forceTags  bool
+	// tagsConfigured is true if the tag property or tag-file gave at least
+	// one tag, defaults are only applied if they didn't
+	tagsConfigured bool
+	// noDefaultLatest and noDefaultGitTag leave latest and the
+	// <branch>-<commit> tag out of the default tags of built-in pushes
+	noDefaultLatest bool
+	noDefaultGitTag bool
+	// emptyTags is the policy when no tags are left to push, see EmptyTagsFail
+	emptyTags   string
+	streamLayer bool
+	// foreignLayers are referenced by URL in the manifest of scratch pushes
+	foreignLayers []ForeignLayer
+	// annotations are set on the manifest of scratch pushes with format
+	// oci
+	annotations map[string]string
+	layerCache  bool
+	// errorMode decides whether multi target operations stop at the first
+	// error, see ErrorModeFailFast
+	errorMode         string
+	retryCount        int
+	inactivityTimeout time.Duration
+	// pushTimeout limits the total duration of pushing a single tag, zero
+	// means no limit
+	pushTimeout time.Duration
+	// rawProgress only forwards the docker output, without the parsed
+	// progress of each layer
+	rawProgress     bool
+	pushConcurrency int
+	// emitMu serializes the output of tags that are pushed concurrently
+	emitMu sync.Mutex
+	// pushedBytes is the size of the layers uploaded by all tags
+	pushedBytes int64
+	// layersPushed and layersExisting count the layers uploaded by all tags
+	// and the layers the registry already had
+	layersPushed   int
+	layersExisting int
+	// reproducible scratch images use reproducibleTime for all timestamps
+	// and leave out the container ID, so the same artifact always results
+	// in the same layer and image digest
+	reproducible     bool
+	reproducibleTime time.Time
+	// layerDirs are the top level directories of the artifact that get a
+	// layer of their own
+	layerDirs    []string
+	healthcheck  *container.HealthConfig
+	architecture string
+	os           string
+	variant      string
+	// platformSet is true when the platform is set on the step, base images
+	// are pulled for it and committed images checked against it
+	platformSet bool
+	// format of scratch images, see ImageFormatDocker
+	format             string
+	noProvenanceLabels bool
+	// digests are the pushed image digests by tag
+	digests map[string]string
+	signer  ImageSigner
+	// notifyURL gets a PushNotification after a successful push, a failed
+	// notification only fails the step with notifyRequired
+	notifyURL      string
+	notifyRequired bool
+	// insecureRegistry talks to the registry over http without verifying
+	// TLS certificates
+	insecureRegistry bool
+	registryCACert   string
+	// registryTransport is used when wercker talks to the registry itself
+	registryTransport http.RoundTripper
+	// autherOpts are the options the authenticator was created with
+	autherOpts dockerauth.CheckAccessOptions
+	// deviceFlow is set with auth-mode device until the device flow has
+	// provided the registry password
+	deviceFlow *dockerauth.DeviceFlowOptions
+	// cleanupIntermediate removes the untagged images in createdImages
+	// once the step is done
+	cleanupIntermediate bool
+	createdImages       []string
+	// pauseOnCommit pauses the container while it is committed, nil uses
+	// the default of docker which pauses
+	pauseOnCommit *bool
+	// pushByDigest reports the pushed digest instead of defaulting to the
+	// latest tag when no tags are configured
+	pushByDigest bool
+	// baseImage is the image scratch pushes build on, empty for scratch
+	baseImage string
+	// pullRetryCount is how often a rate limited pull of the base image is
+	// retried
+	pullRetryCount int
+	// envMode decides how the step env combines with the env of the
+	// container, see EnvModeReplace
+	envMode string
+	// keepWerckerEnv keeps the variables wercker sets for the run in the
+	// env of committed images
+	keepWerckerEnv bool
+	// savePushLog keeps the status stream of every push attempt in
+	// PushStatusLogName
+	savePushLog bool
+	pushLogMu   sync.Mutex
+	// inlineCache reports whether pushed images carry inline build cache
+	inlineCache bool
+	// stageToDisk writes the scratch tarball to disk before loading it
+	// instead of streaming it to the daemon
+	stageToDisk bool
+	// compression of the layer blobs of format oci, see
+	// LayerCompressionNone. Docker loads uncompressed layers and compresses
+	// them itself on push, so it is a configuration error with format docker.
+	compression      string
+	compressionLevel int
+	// extraFiles are added to the artifact layer of scratch images
+	extraFiles []ExtraFile
+	// registryMirror is the host images of the Docker Hub are pulled from
+	registryMirror string
+	// maxLayerSize is the maximum size in bytes of the artifact in a
+	// scratch image, 0 if there is no limit
+	maxLayerSize int64
+	// minFreeSpace is the disk space in bytes that has to remain free after
+	// the scratch layers and tarball are written
+	minFreeSpace int64
+	// forceFresh adds FreshLabel with a random value so every commit gets a
+	// new image ID, even if nothing changed since the last one. The images
+	// don't share their config with earlier commits, so every run keeps a
+	// copy of the config and the tags it replaces become dangling images
+	// that take disk space until they are pruned.
+	forceFresh bool
+	// squash flattens the committed image into a single layer before it is
+	// pushed
+	squash bool
+	// dockerfile is built with BuildKit to get the pushed image instead of
+	// committing the container, relative to the source directory
+	dockerfile string
+	// builder is the buildx builder dockerfile is built with, the default
+	// builder of the daemon if it is empty
+	builder string
+	// buildCacheRef is the registry build cache of a builder, see
+	// DefaultBuildCacheTag
+	buildCacheRef string
+	// keepRepositoryCase only lowercases the registry host of the
+	// repository, for registries with case sensitive paths
+	keepRepositoryCase bool
+	// skipUnchangedCommit pushes the image of the pipeline container
+	// instead of committing it when its file system is unchanged
+	skipUnchangedCommit bool
+	logger              *util.LogEntry
+	workingDir          string
+	authenticator       auth.Authenticator
+	// configErr is set if the step could not be configured, it fails the step
+	// when executed
+	configErr error
+	// image (if set) is the tag of an existing image, and obtained from the image-name property with localImageName
+	// if image is set then this image is tagged and pushed (equivalent to "docker push")
+	// if image is not set then the pipeline container is committed, tagged and pushed (classic behaviour)
+	image string
+}
+
+// NewDockerPushStep is a special step for doing docker pushes
+func NewDockerPushStep(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *Options) (*DockerPushStep, error) {
+	name := "docker-push"
+	displayName := "docker push"
+	if stepConfig.Name != "" {
 		displayName = stepConfig.Name
 	}
 
@@ -520,14 +1429,82 @@ func (s *DockerPushStep) configure(env *util.Environment) {
 	if repository, ok := s.data["repository"]; ok {
 		s.repository = env.Interpolate(repository)
 	}
+	if keepCase, ok := s.data["keep-repository-case"]; ok {
+		s.keepRepositoryCase, _ = strconv.ParseBool(env.Interpolate(keepCase))
+	}
 
 	if tags, ok := s.data["tag"]; ok {
+		// Tags that interpolate to nothing are dropped, if that leaves no
+		// tags at all the defaults are used as if tag wasn't set. Build
+		// metadata placeholders are expanded after the environment.
 		splitTags := util.SplitSpaceOrComma(tags)
-		interpolatedTags := make([]string, len(splitTags))
-		for i, tag := range splitTags {
-			interpolatedTags[i] = env.Interpolate(tag)
+		interpolatedTags := make([]string, 0, len(splitTags))
+		now := time.Now()
+		for _, tag := range splitTags {
+			tag = expandTagPlaceholders(env.Interpolate(tag), s.options, now)
+			if tag = strings.TrimSpace(tag); tag != "" {
+				interpolatedTags = append(interpolatedTags, tag)
+			}
 		}
 		s.tags = interpolatedTags
+		s.tagsConfigured = len(interpolatedTags) > 0
+	}
+
+	if tagFile, ok := s.data["tag-file"]; ok {
+		tagFile = env.Interpolate(tagFile)
+		tagFileOptional := false
+		var optionalErr error
+		if optional, ok := s.data["tag-file-optional"]; ok {
+			optional = env.Interpolate(optional)
+			if tagFileOptional, optionalErr = strconv.ParseBool(optional); optionalErr != nil {
+				optionalErr = fmt.Errorf("Invalid value for tag-file-optional %q, expected true or false", optional)
+			}
+		}
+		fileTags, err := readTagFile(hostSourcePath(s.options, tagFile))
+		if optionalErr != nil {
+			s.logger.Errorln(optionalErr)
+			s.configErr = optionalErr
+		} else if os.IsNotExist(err) && tagFileOptional {
+			s.logger.Infoln("Skipping tag-file", tagFile, "that doesn't exist")
+		} else if err != nil {
+			s.logger.Errorln("Unable to read tag-file:", err)
+			s.configErr = fmt.Errorf("Unable to read tag-file %s: %v", tagFile, err)
+		} else if len(fileTags) > 0 {
+			s.tagsConfigured = true
+			s.tags = append(s.tags, fileTags...)
+		}
+	}
+
+	// Catch invalid names here rather than having the registry reject them
+	// halfway through the push
+	if err := validateRepository(s.repository); err != nil {
+		s.logger.Errorln(err)
+		s.configErr = err
+	}
+	for _, tag := range s.tags {
+		if err := validateTag(tag); err != nil {
+			s.logger.Errorln(err)
+			s.configErr = err
+			break
+		}
+	}
+
+	if noLatest, ok := s.data["no-default-latest"]; ok {
+		s.noDefaultLatest, _ = strconv.ParseBool(env.Interpolate(noLatest))
+	}
+	if noGitTag, ok := s.data["no-default-git-tag"]; ok {
+		s.noDefaultGitTag, _ = strconv.ParseBool(env.Interpolate(noGitTag))
+	}
+
+	s.emptyTags = EmptyTagsFail
+	if emptyTags, ok := s.data["empty-tags"]; ok {
+		switch emptyTags = env.Interpolate(emptyTags); emptyTags {
+		case EmptyTagsFail, EmptyTagsSkip:
+			s.emptyTags = emptyTags
+		default:
+			s.logger.Errorln("Invalid value for empty-tags:", emptyTags)
+			s.configErr = fmt.Errorf("Invalid value for empty-tags %q, expected %s or %s", emptyTags, EmptyTagsFail, EmptyTagsSkip)
+		}
 	}
 
 	if author, ok := s.data["author"]; ok {
@@ -568,21 +1545,22 @@ func (s *DockerPushStep) configure(env *util.Environment) {
 	}
 
 	if cmd, ok := s.data["cmd"]; ok {
-		parts, err := shlex.Split(cmd)
+		parts, err := s.splitArgs("cmd", cmd)
 		if err == nil {
 			s.cmd = parts
+			s.cmdSet = true
 		}
 	}
 
 	if entrypoint, ok := s.data["entrypoint"]; ok {
-		parts, err := shlex.Split(entrypoint)
+		parts, err := s.splitArgs("entrypoint", entrypoint)
 		if err == nil {
 			s.entrypoint = parts
 		}
 	}
 
 	if envi, ok := s.data["env"]; ok {
-		parsedEnv, err := shlex.Split(envi)
+		parsedEnv, err := s.splitArgs("env", envi)
 
 		if err == nil {
 			interpolatedEnv := make([]string, len(parsedEnv))
@@ -593,22 +1571,65 @@ func (s *DockerPushStep) configure(env *util.Environment) {
 		}
 	}
 
+	s.envMode = EnvModeReplace
+	if envMode, ok := s.data["env-mode"]; ok {
+		switch envMode = env.Interpolate(envMode); envMode {
+		case EnvModeReplace, EnvModeMerge:
+			s.envMode = envMode
+		default:
+			s.logger.Errorln("Invalid value for env-mode:", envMode)
+			s.configErr = fmt.Errorf("Invalid value for env-mode %q, expected %s or %s", envMode, EnvModeReplace, EnvModeMerge)
+		}
+	}
+
+	if keepWerckerEnv, ok := s.data["keep-wercker-env"]; ok {
+		k, err := strconv.ParseBool(keepWerckerEnv)
+		if err == nil {
+			s.keepWerckerEnv = k
+		}
+	}
+
 	if stopsignal, ok := s.data["stopsignal"]; ok {
 		s.stopSignal = env.Interpolate(stopsignal)
 	}
 
+	if stopTimeout, ok := s.data["stop-timeout"]; ok {
+		t, err := strconv.Atoi(env.Interpolate(stopTimeout))
+		if err != nil || t <= 0 {
+			s.logger.Errorln("Invalid stop-timeout:", stopTimeout)
+			s.configErr = fmt.Errorf("Invalid stop-timeout %q, expected a positive number of seconds", stopTimeout)
+		} else {
+			s.stopTimeout = &t
+		}
+	}
+
 	if labels, ok := s.data["labels"]; ok {
-		parsedLabels, err := shlex.Split(labels)
+		labelMap, err := parseLabels(s.logger, env, labels)
 		if err == nil {
-			labelMap := make(map[string]string)
-			for _, labelPair := range parsedLabels {
-				pair := strings.Split(labelPair, "=")
-				labelMap[env.Interpolate(pair[0])] = env.Interpolate(pair[1])
-			}
 			s.labels = labelMap
 		}
 	}
 
+	if noProvenanceLabels, ok := s.data["no-provenance-labels"]; ok {
+		npl, err := strconv.ParseBool(noProvenanceLabels)
+		if err == nil {
+			s.noProvenanceLabels = npl
+		}
+	}
+	if !s.noProvenanceLabels {
+		s.addProvenanceLabels()
+	}
+
+	if forceFresh, ok := s.data["force-fresh"]; ok {
+		s.forceFresh, _ = strconv.ParseBool(env.Interpolate(forceFresh))
+	}
+	if s.forceFresh {
+		if s.labels == nil {
+			s.labels = make(map[string]string)
+		}
+		s.labels[FreshLabel] = uuid.NewRandom().String()
+	}
+
 	if user, ok := s.data["user"]; ok {
 		s.user = env.Interpolate(user)
 	}
@@ -622,38 +1643,445 @@ func (s *DockerPushStep) configure(env *util.Environment) {
 		s.forceTags = true
 	}
 
-	if image, ok := s.data["image-name"]; ok {
-		s.image = s.options.RunID + env.Interpolate(image)
-	}
-}
-
-func (s *DockerPushStep) buildAutherOpts(env *util.Environment) dockerauth.CheckAccessOptions {
-	opts := dockerauth.CheckAccessOptions{}
-	if username, ok := s.data["username"]; ok {
-		opts.Username = env.Interpolate(username)
-	}
-	if password, ok := s.data["password"]; ok {
-		opts.Password = env.Interpolate(password)
-	}
-	if registry, ok := s.data["registry"]; ok {
-		opts.Registry = dockerauth.NormalizeRegistry(env.Interpolate(registry))
-	}
-	if awsAccessKey, ok := s.data["aws-access-key"]; ok {
-		opts.AwsAccessKey = env.Interpolate(awsAccessKey)
+	if pushByDigest, ok := s.data["push-by-digest"]; ok {
+		s.pushByDigest, _ = strconv.ParseBool(env.Interpolate(pushByDigest))
 	}
 
-	if awsSecretKey, ok := s.data["aws-secret-key"]; ok {
-		opts.AwsSecretKey = env.Interpolate(awsSecretKey)
+	if squash, ok := s.data["squash"]; ok {
+		s.squash, _ = strconv.ParseBool(env.Interpolate(squash))
 	}
 
-	if awsRegion, ok := s.data["aws-region"]; ok {
-		opts.AwsRegion = env.Interpolate(awsRegion)
+	if skipUnchanged, ok := s.data["skip-unchanged-commit"]; ok {
+		s.skipUnchangedCommit, _ = strconv.ParseBool(env.Interpolate(skipUnchanged))
 	}
 
-	if awsAuth, ok := s.data["aws-strict-auth"]; ok {
-		auth, err := strconv.ParseBool(awsAuth)
+	if pause, ok := s.data["pause-on-commit"]; ok {
+		p, err := strconv.ParseBool(env.Interpolate(pause))
 		if err == nil {
-			opts.AwsStrictAuth = auth
+			s.pauseOnCommit = &p
+		}
+	}
+
+	if cleanup, ok := s.data["cleanup-intermediate"]; ok {
+		s.cleanupIntermediate, _ = strconv.ParseBool(env.Interpolate(cleanup))
+	}
+
+	s.retryCount = DefaultPushRetryCount
+	if retryCount, ok := s.data["retry-count"]; ok {
+		rc, err := strconv.Atoi(env.Interpolate(retryCount))
+		if err == nil && rc >= 0 {
+			s.retryCount = rc
+		} else {
+			s.logger.Warnln("Invalid value for retry-count:", retryCount, "using", DefaultPushRetryCount)
+		}
+	}
+
+	s.inactivityTimeout = DefaultPushInactivityTimeout
+	if inactivityTimeout, ok := s.data["inactivity-timeout"]; ok {
+		d, err := time.ParseDuration(env.Interpolate(inactivityTimeout))
+		if err == nil && d > 0 {
+			s.inactivityTimeout = d
+		} else {
+			s.logger.Warnln("Invalid value for inactivity-timeout:", inactivityTimeout, "using", DefaultPushInactivityTimeout)
+		}
+	}
+
+	if pushTimeout, ok := s.data["push-timeout"]; ok {
+		d, err := time.ParseDuration(env.Interpolate(pushTimeout))
+		if err == nil && d >= 0 {
+			s.pushTimeout = d
+		} else {
+			s.logger.Warnln("Invalid value for push-timeout:", pushTimeout, "pushing without a timeout")
+		}
+	}
+
+	s.pushConcurrency = DefaultPushConcurrency
+	if pushConcurrency, ok := s.data["push-concurrency"]; ok {
+		pc, err := strconv.Atoi(env.Interpolate(pushConcurrency))
+		if err == nil && pc > 0 {
+			s.pushConcurrency = pc
+		} else {
+			s.logger.Warnln("Invalid value for push-concurrency:", pushConcurrency, "using", DefaultPushConcurrency)
+		}
+	}
+
+	s.errorMode = ErrorModeFailFast
+	if errorMode, ok := s.data["error-mode"]; ok {
+		switch errorMode = env.Interpolate(errorMode); errorMode {
+		case ErrorModeFailFast, ErrorModeCollect:
+			s.errorMode = errorMode
+		default:
+			s.logger.Errorln("Invalid value for error-mode:", errorMode)
+			s.configErr = fmt.Errorf("Invalid value for error-mode %q, expected %s or %s", errorMode, ErrorModeFailFast, ErrorModeCollect)
+		}
+	}
+
+	if inlineCache, ok := s.data["inline-cache"]; ok {
+		ic, err := strconv.ParseBool(inlineCache)
+		if err == nil {
+			s.inlineCache = ic
+		}
+	}
+
+	if savePushLog, ok := s.data["save-push-log"]; ok {
+		spl, err := strconv.ParseBool(savePushLog)
+		if err == nil {
+			s.savePushLog = spl
+		}
+	}
+
+	if rawProgress, ok := s.data["raw-progress"]; ok {
+		rp, err := strconv.ParseBool(rawProgress)
+		if err == nil {
+			s.rawProgress = rp
+		}
+	}
+
+	if streamLayer, ok := s.data["stream-layer"]; ok {
+		sl, err := strconv.ParseBool(streamLayer)
+		if err == nil {
+			s.streamLayer = sl
+		}
+	}
+
+	if stageToDisk, ok := s.data["stage-to-disk"]; ok {
+		std, err := strconv.ParseBool(stageToDisk)
+		if err == nil {
+			s.stageToDisk = std
+		}
+	}
+
+	if baseImage, ok := s.data["base-image"]; ok {
+		s.baseImage = strings.TrimSpace(env.Interpolate(baseImage))
+	}
+
+	s.pullRetryCount = DefaultPullRetryCount
+	if pullRetryCount, ok := s.data["pull-retry-count"]; ok {
+		rc, err := strconv.Atoi(env.Interpolate(pullRetryCount))
+		if err == nil && rc >= 0 {
+			s.pullRetryCount = rc
+		} else {
+			s.logger.Warnln("Invalid value for pull-retry-count:", pullRetryCount, "using", DefaultPullRetryCount)
+		}
+	}
+
+	if layerDirs, ok := s.data["layer-dirs"]; ok {
+		for _, dir := range util.SplitSpaceOrComma(env.Interpolate(layerDirs)) {
+			dir = strings.Trim(path.Clean(strings.TrimSpace(dir)), "/")
+			if dir == "" || dir == "." || dir == ".." || strings.Contains(dir, "/") {
+				s.logger.Warnln("Ignoring invalid layer-dirs entry:", dir, "only top level directories can be split into a layer")
+				continue
+			}
+			s.layerDirs = append(s.layerDirs, dir)
+		}
+	}
+
+	if reproducible, ok := s.data["reproducible"]; ok {
+		r, err := strconv.ParseBool(reproducible)
+		if err == nil {
+			s.reproducible = r
+		}
+	}
+	if s.reproducible {
+		// See https://reproducible-builds.org/specs/source-date-epoch/
+		s.reproducibleTime = time.Unix(0, 0).UTC()
+		if epoch := env.Get("SOURCE_DATE_EPOCH"); epoch != "" {
+			sec, err := strconv.ParseInt(epoch, 10, 64)
+			if err == nil {
+				s.reproducibleTime = time.Unix(sec, 0).UTC()
+			} else {
+				s.logger.Warnln("Invalid value for SOURCE_DATE_EPOCH:", epoch, "using", s.reproducibleTime)
+			}
+		}
+	}
+
+	if layerCache, ok := s.data["layer-cache"]; ok {
+		lc, err := strconv.ParseBool(layerCache)
+		if err == nil {
+			s.layerCache = lc
+		}
+	}
+
+	s.architecture = DefaultImageArchitecture
+	if architecture, ok := s.data["architecture"]; ok {
+		s.architecture = env.Interpolate(architecture)
+		s.platformSet = true
+	}
+	s.os = DefaultImageOS
+	if imageOS, ok := s.data["os"]; ok {
+		s.os = env.Interpolate(imageOS)
+		s.platformSet = true
+	}
+	if variant, ok := s.data["variant"]; ok {
+		s.variant = env.Interpolate(variant)
+		s.platformSet = true
+	}
+	if platform, ok := s.data["platform"]; ok {
+		if s.platformSet {
+			s.logger.Errorln("platform can't be combined with os, architecture or variant")
+			s.configErr = errors.New("platform can't be combined with os, architecture or variant")
+		} else if imageOS, architecture, variant, err := parsePlatform(env.Interpolate(platform)); err != nil {
+			s.logger.Errorln(err)
+			s.configErr = err
+		} else {
+			s.os, s.architecture, s.variant = imageOS, architecture, variant
+			s.platformSet = true
+		}
+	}
+	if err := validatePlatform(s.os, s.architecture); err != nil {
+		s.logger.Errorln("Invalid platform:", err)
+		s.configErr = err
+	}
+
+	healthcheck, err := parseHealthcheck(s.data, env)
+	if err != nil {
+		s.logger.Errorln("Invalid healthcheck:", err)
+		s.configErr = err
+	} else {
+		s.healthcheck = healthcheck
+	}
+
+	signer, err := NewImageSigner(env.Interpolate(s.data["sign"]), env.Interpolate(s.data["sign-key"]))
+	if err != nil {
+		s.logger.Errorln("Invalid signing configuration:", err)
+		s.configErr = err
+	} else {
+		s.signer = signer
+	}
+
+	if notifyURL, ok := s.data["notify-url"]; ok && notifyURL != "" {
+		u, err := parseNotifyURL(env.Interpolate(notifyURL))
+		if err != nil {
+			s.logger.Errorln(err)
+			s.configErr = err
+		} else {
+			s.notifyURL = u
+		}
+	}
+	if notifyRequired, ok := s.data["notify-required"]; ok {
+		s.notifyRequired, _ = strconv.ParseBool(env.Interpolate(notifyRequired))
+	}
+
+	if insecure, ok := s.data["insecure-registry"]; ok {
+		s.insecureRegistry, _ = strconv.ParseBool(env.Interpolate(insecure))
+	}
+	if caCert, ok := s.data["registry-ca-cert"]; ok {
+		s.registryCACert = env.Interpolate(caCert)
+	}
+	proxy := ""
+	if s.dockerOptions != nil {
+		proxy = s.dockerOptions.Proxy
+	}
+	rt, err := registryTransport(s.insecureRegistry, s.registryCACert, proxy)
+	if err != nil {
+		s.logger.Errorln("Invalid registry-ca-cert or proxy:", err)
+		s.configErr = err
+	} else {
+		s.registryTransport = rt
+	}
+	if s.insecureRegistry {
+		s.logger.Warnln("Using an insecure registry, the docker daemon must list it in its insecure-registries as well")
+	}
+
+	s.format = ImageFormatDocker
+	if format, ok := s.data["format"]; ok {
+		switch format = env.Interpolate(format); format {
+		case "":
+		case ImageFormatDocker, ImageFormatOCI:
+			s.format = format
+		default:
+			s.logger.Errorln("Invalid value for format:", format)
+			s.configErr = fmt.Errorf("Invalid value for format %q, expected %s or %s", format, ImageFormatDocker, ImageFormatOCI)
+		}
+	}
+
+	if mirror, ok := s.data["registry-mirror"]; ok {
+		host, err := parseRegistryMirror(env.Interpolate(mirror))
+		if err != nil {
+			s.logger.Errorln(err)
+			s.configErr = err
+		} else {
+			s.registryMirror = host
+			s.logger.Infoln("Pulling Docker Hub images through registry mirror", host)
+		}
+	}
+
+	if maxLayerSize, ok := s.data["max-layer-size"]; ok {
+		size, err := units.RAMInBytes(env.Interpolate(maxLayerSize))
+		if err != nil || size <= 0 {
+			s.logger.Errorln("Invalid max-layer-size:", maxLayerSize)
+			s.configErr = fmt.Errorf("Invalid max-layer-size %q, expected a size like 500m or 2g", maxLayerSize)
+		} else {
+			s.maxLayerSize = size
+		}
+	}
+
+	if minFreeSpace, ok := s.data["min-free-space"]; ok {
+		size, err := units.RAMInBytes(env.Interpolate(minFreeSpace))
+		if err != nil || size < 0 {
+			s.logger.Errorln("Invalid min-free-space:", minFreeSpace)
+			s.configErr = fmt.Errorf("Invalid min-free-space %q, expected a size like 500m or 2g", minFreeSpace)
+		} else {
+			s.minFreeSpace = size
+		}
+	}
+
+	s.compression = LayerCompressionNone
+	if compression, ok := s.data["compression"]; ok {
+		switch compression = env.Interpolate(compression); compression {
+		case LayerCompressionNone, LayerCompressionGzip:
+			s.compression = compression
+		default:
+			s.logger.Errorln("Invalid value for compression:", compression)
+			s.configErr = fmt.Errorf("Invalid value for compression %q, expected %s or %s", compression, LayerCompressionNone, LayerCompressionGzip)
+		}
+	}
+	if s.compression != LayerCompressionNone && s.format != ImageFormatOCI {
+		s.logger.Errorln("compression only applies to format", ImageFormatOCI)
+		s.configErr = fmt.Errorf("compression %s requires format %s", s.compression, ImageFormatOCI)
+	}
+	s.compressionLevel = gzip.DefaultCompression
+	if level, ok := s.data["compression-level"]; ok {
+		parsed, err := strconv.Atoi(env.Interpolate(level))
+		if err != nil || parsed < gzip.BestSpeed || parsed > gzip.BestCompression {
+			s.logger.Errorln("Invalid value for compression-level:", level)
+			s.configErr = fmt.Errorf("Invalid value for compression-level %q, expected %d to %d", level, gzip.BestSpeed, gzip.BestCompression)
+		} else {
+			s.compressionLevel = parsed
+		}
+	}
+
+	if foreignLayers, ok := s.data["foreign-layers"]; ok {
+		parsed, err := parseForeignLayers(env.Interpolate(foreignLayers))
+		if err != nil {
+			s.logger.Errorln("Invalid foreign-layers:", err)
+			s.configErr = err
+		} else {
+			s.foreignLayers = parsed
+		}
+	}
+	if extraFiles, ok := s.data["extra-files"]; ok {
+		parsed, err := parseExtraFiles(env.Interpolate(extraFiles))
+		if err != nil {
+			s.logger.Errorln("Invalid extra-files:", err)
+			s.configErr = err
+		} else {
+			s.extraFiles = parsed
+		}
+	}
+
+	if annotations, ok := s.data["annotations"]; ok {
+		parsed, err := parseAnnotations(s.logger, env, annotations)
+		if err != nil {
+			s.logger.Errorln("Invalid annotations:", err)
+			s.configErr = err
+		} else {
+			s.annotations = parsed
+		}
+	}
+
+	if len(s.foreignLayers) > 0 && s.format == ImageFormatOCI {
+		s.logger.Errorln("foreign-layers are not supported with format", ImageFormatOCI)
+		s.configErr = fmt.Errorf("foreign-layers are not supported with format %s", ImageFormatOCI)
+	}
+	if len(s.annotations) > 0 && s.format != ImageFormatOCI {
+		s.logger.Warnln("annotations only apply to scratch pushes with format", ImageFormatOCI)
+	}
+
+	if image, ok := s.data["image-name"]; ok {
+		s.image = localImageName(s.data, env, s.options.RunID, env.Interpolate(image))
+		s.logger.Infoln("Pushing local image", s.image)
+	}
+
+	if dockerfile, ok := s.data["dockerfile"]; ok {
+		s.dockerfile = env.Interpolate(dockerfile)
+		if err := validateDockerfile(s.dockerfile); err != nil {
+			s.logger.Errorln(err)
+			s.configErr = err
+		}
+		if s.image != "" {
+			s.logger.Errorln("dockerfile and image-name can't be used together")
+			s.configErr = fmt.Errorf("dockerfile and image-name can't be used together")
+		}
+	}
+	if builder, ok := s.data["builder"]; ok {
+		s.builder = env.Interpolate(builder)
+	}
+	if cacheRef, ok := s.data["build-cache-ref"]; ok {
+		s.buildCacheRef = env.Interpolate(cacheRef)
+		if s.builder == "" {
+			s.logger.Warnln("build-cache-ref needs a builder, the cache is inlined into the image instead")
+		}
+	}
+}
+
+// FreshLabel is set to a random value with force-fresh, which makes the
+// config and so the ID of a committed image unique
+const FreshLabel = "io.wercker.fresh"
+
+// addProvenanceLabels adds labels pointing back to the run and the commit the
+// image was built from, labels set on the step take precedence.
+func (s *DockerPushStep) addProvenanceLabels() {
+	labels := map[string]string{
+		"io.wercker.run-id": s.options.RunID,
+	}
+	if git := s.options.GitOptions; git != nil {
+		labels["org.opencontainers.image.revision"] = git.GitCommit
+		labels["io.wercker.git-branch"] = git.GitBranch
+		if git.GitDomain != "" && git.GitOwner != "" && git.GitRepository != "" {
+			labels["org.opencontainers.image.source"] = fmt.Sprintf("https://%s/%s/%s", git.GitDomain, git.GitOwner, git.GitRepository)
+		}
+	}
+
+	for key, value := range labels {
+		if value == "" {
+			continue
+		}
+		if s.labels == nil {
+			s.labels = make(map[string]string)
+		}
+		if _, ok := s.labels[key]; !ok {
+			s.labels[key] = value
+		}
+	}
+}
+
+// buildAutherOpts collects the registry credentials of the step and infers
+// the registry and repository to push to. A registry that can not be used
+// is returned as an error rather than ending the process.
+func (s *DockerPushStep) buildAutherOpts(env *util.Environment) (dockerauth.CheckAccessOptions, error) {
+	opts := dockerauth.CheckAccessOptions{}
+	if username, ok := s.data["username"]; ok {
+		opts.Username = env.Interpolate(username)
+	}
+	if password, ok := s.data["password"]; ok {
+		opts.Password = env.Interpolate(password)
+	}
+	opts.InsecureRegistry = s.insecureRegistry
+	opts.RegistryCACert = s.registryCACert
+	if registry, ok := s.data["registry"]; ok {
+		if opts.InsecureRegistry {
+			opts.Registry = dockerauth.NormalizeInsecureRegistry(env.Interpolate(registry))
+		} else {
+			opts.Registry = dockerauth.NormalizeRegistry(env.Interpolate(registry))
+		}
+	}
+	if awsAccessKey, ok := s.data["aws-access-key"]; ok {
+		opts.AwsAccessKey = env.Interpolate(awsAccessKey)
+	}
+
+	if awsSecretKey, ok := s.data["aws-secret-key"]; ok {
+		opts.AwsSecretKey = env.Interpolate(awsSecretKey)
+	}
+
+	if awsRegion, ok := s.data["aws-region"]; ok {
+		opts.AwsRegion = env.Interpolate(awsRegion)
+	}
+
+	if awsAuth, ok := s.data["aws-strict-auth"]; ok {
+		auth, err := strconv.ParseBool(awsAuth)
+		if err == nil {
+			opts.AwsStrictAuth = auth
 		}
 	}
 
@@ -661,6 +2089,30 @@ func (s *DockerPushStep) buildAutherOpts(env *util.Environment) dockerauth.Check
 		opts.AwsRegistryID = env.Interpolate(awsRegistryID)
 	}
 
+	// GitHub Container Registry takes a token as the password of the owner
+	// of the repository
+	if token, ok := s.data["github-token"]; ok {
+		if owner, ok := githubContainerRegistryOwner(s.repository); ok {
+			if opts.Username == "" {
+				opts.Username = owner
+			}
+			if opts.Password == "" {
+				opts.Password = env.Interpolate(token)
+			}
+			opts.Registry = GitHubContainerRegistry
+		} else {
+			s.logger.Warnln("Ignoring github-token, repository is not in", GitHubContainerRegistryDomain)
+		}
+	}
+
+	if gcpKey, ok := s.data["gcp-service-account-key"]; ok {
+		opts.GCPServiceAccountKey = env.Interpolate(gcpKey)
+	}
+
+	if gcpRegistry, ok := s.data["gcp-registry"]; ok {
+		opts.GCPRegistry = env.Interpolate(gcpRegistry)
+	}
+
 	if azureClient, ok := s.data["azure-client-id"]; ok {
 		opts.AzureClientID = env.Interpolate(azureClient)
 	}
@@ -689,24 +2141,98 @@ func (s *DockerPushStep) buildAutherOpts(env *util.Environment) dockerauth.Check
 		opts.AzureLoginServer = env.Interpolate(azureLoginServer)
 	}
 
-	// If user use Azure or AWS container registry we don't infer.
-	if opts.AzureClientSecret == "" && opts.AwsSecretKey == "" {
-		repository, registry, err := InferRegistryAndRepository(s.repository, opts.Registry, s.options)
+	if opts.AwsAccessKey != "" || opts.AwsSecretKey != "" {
+		opts = ecrAutherOpts(s.logger, opts, s.repository)
+	}
+
+	if err := dockerauth.ValidateCloudCredentials(opts); err != nil {
+		s.logger.Errorln(err)
+		return opts, err
+	}
+
+	// The device flow waits for the user, it is run by authorizeDevice once
+	// the step executes
+	if authMode, ok := s.data["auth-mode"]; ok && env.Interpolate(authMode) == AuthModeDevice {
+		s.deviceFlow = &dockerauth.DeviceFlowOptions{
+			DeviceAuthURL: env.Interpolate(s.data["device-auth-url"]),
+			TokenURL:      env.Interpolate(s.data["device-token-url"]),
+			ClientID:      env.Interpolate(s.data["device-client-id"]),
+			Scope:         env.Interpolate(s.data["device-scope"]),
+			Interactive:   isInteractive(),
+		}
+		if opts.Username == "" {
+			opts.Username = DefaultDockerRegistryUsername
+		}
+	}
+
+	// Google registries are always the registry of the service account key
+	if opts.GCPServiceAccountKey != "" {
+		repository, registry, err := inferGCPRegistryAndRepository(s.repository, opts.GCPRegistry)
+		if err != nil {
+			s.logger.Errorln("Invalid registry:", err)
+			return opts, err
+		}
+		s.repository = repository
+		opts.GCPRegistry = registry
+		opts.Registry = dockerauth.GCPRegistryURL(registry).String()
+	}
+
+	// If user use Azure, AWS or Google container registry we don't infer.
+	if opts.AzureClientSecret == "" && opts.AwsSecretKey == "" && opts.GCPServiceAccountKey == "" {
+		repository, registry, notes, err := InferRegistryAndRepositoryNotes(s.repository, opts.Registry, s.options, opts.InsecureRegistry, s.keepRepositoryCase)
+		LogRegistryNotes(s.logger, notes)
 		if err != nil {
-			s.logger.Panic(err)
+			s.logger.Errorln("Invalid registry:", err)
+			return opts, err
 		}
 		s.repository = repository
 		opts.Registry = registry
 	}
 
-	// Set user and password automatically if using wercker registry
+	// Set user and password automatically if using wercker registry, unless
+	// they were explicitly set on the step
 	if opts.Registry == s.options.WerckerContainerRegistry.String() {
-		opts.Username = DefaultDockerRegistryUsername
-		opts.Password = s.options.AuthToken
+		if opts.Username == "" {
+			opts.Username = DefaultDockerRegistryUsername
+		} else {
+			s.logger.Infoln("Using explicitly supplied username for the wercker registry:", opts.Username)
+		}
+		if opts.Password == "" {
+			opts.Password = s.options.AuthToken
+		} else {
+			s.logger.Infoln("Using explicitly supplied password instead of the authToken for the wercker registry")
+		}
 		s.builtInPush = true
 	}
 
-	return opts
+	// Fall back to the credentials docker itself would use, cloud
+	// registries authenticate with their own credentials
+	if opts.Username == "" && opts.Password == "" && !s.builtInPush && !dockerauth.HasExpiringCredentials(opts) {
+		host := dockerConfigHost(opts.Registry)
+		username, password, err := dockerauth.DockerConfigCredentials(dockerauth.DockerConfigPath(), host)
+		if err != nil {
+			s.logger.WithError(err).Warnln("Unable to read credentials for", host, "from the docker config")
+		} else if username != "" || password != "" {
+			s.logger.Infoln("Using credentials for", host, "from the docker config")
+			opts.Username = username
+			opts.Password = password
+		}
+	}
+
+	return opts, nil
+}
+
+// dockerConfigHost returns the host the credentials of registry are stored
+// under in the docker config, no registry is the docker hub.
+func dockerConfigHost(registry string) string {
+	if registry == "" {
+		return "index.docker.io"
+	}
+	u, err := url.Parse(registry)
+	if err != nil || u.Host == "" {
+		return registry
+	}
+	return u.Host
 }
 
 //InferRegistryAndRepository infers the registry and repository to be used from input registry and repository.
@@ -729,77 +2255,342 @@ func (s *DockerPushStep) buildAutherOpts(env *util.Environment) dockerauth.Check
 //           we assume that user wanted to use the registry host as specified in repository and change the registry to point
 //           to domain name present in repository. If domain names in both registry and repository are same - no changes are
 //           made.
-func InferRegistryAndRepository(repository string, registry string, pipelineOptions *core.PipelineOptions) (inferredRepository string, inferredRegistry string, err error) {
-	_logger := util.RootLogger().WithFields(util.LogFields{"Logger": "Docker"})
+// If insecure is set, inferred registry urls use http instead of https. The
+// wercker registry can not be used insecurely, ErrInsecureWerckerRegistry is
+// returned instead.
+//
+// InferRegistryAndRepository doesn't log, see InferRegistryAndRepositoryNotes
+// for the notes on how the registry and repository were inferred.
+func InferRegistryAndRepository(repository string, registry string, pipelineOptions *core.PipelineOptions, insecure bool) (inferredRepository string, inferredRegistry string, err error) {
+	inferredRepository, inferredRegistry, _, err = InferRegistryAndRepositoryNotes(repository, registry, pipelineOptions, insecure, false)
+	return inferredRepository, inferredRegistry, err
+}
+
+// RegistryNote explains a decision InferRegistryAndRepositoryNotes made, for
+// the caller to log. The values in Message are redacted.
+type RegistryNote struct {
+	// Warning is set when the input was ignored or likely a mistake
+	Warning bool
+	Message string
+}
+
+// LogRegistryNotes logs notes with logger
+func LogRegistryNotes(logger *util.LogEntry, notes []RegistryNote) {
+	for _, note := range notes {
+		if note.Warning {
+			logger.Warnln(note.Message)
+		} else {
+			logger.Infoln(note.Message)
+		}
+	}
+}
+
+// InferRegistryAndRepositoryNotes is InferRegistryAndRepository, which also
+// returns notes on how the registry and repository were inferred. The
+// repository is lowercased like docker requires, with keepPathCase only its
+// registry host is, for registries that are case sensitive.
+func InferRegistryAndRepositoryNotes(repository string, registry string, pipelineOptions *core.PipelineOptions, insecure bool, keepPathCase bool) (inferredRepository string, inferredRegistry string, notes []RegistryNote, err error) {
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
 	if repository == "" {
+		if insecure {
+			return "", "", nil, ErrInsecureWerckerRegistry
+		}
+		if pipelineOptions.WerckerContainerRegistry == nil {
+			return "", "", nil, errors.New("No repository specified and no wercker registry to push to")
+		}
 		inferredRepository = pipelineOptions.WerckerContainerRegistry.Host + "/" + pipelineOptions.ApplicationOwnerName + "/" + pipelineOptions.ApplicationName
 		inferredRegistry = pipelineOptions.WerckerContainerRegistry.String()
-		_logger.Infoln("No repository specified - using " + inferredRepository)
-		_logger.Infoln("username/password fields are ignored while using wcr.io registry, supplied authToken (if provided) will be used for authorization to wcr.io registry")
-		return inferredRepository, inferredRegistry, nil
+		notes = append(notes,
+			RegistryNote{Message: "No repository specified - using " + util.Redact(inferredRepository)},
+			RegistryNote{Message: "Unless username/password fields are set, supplied authToken (if provided) will be used for authorization to wcr.io registry"},
+		)
+		return inferredRepository, inferredRegistry, notes, nil
 	}
 	// Docker repositories must be lowercase
 	inferredRepository = strings.ToLower(repository)
 	inferredRegistry = registry
-	x, _ := reference.ParseNormalizedNamed(inferredRepository)
-	domainFromRepository := reference.Domain(x)
+	named, err := reference.ParseNormalizedNamed(inferredRepository)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Invalid repository %s: %v", util.Redact(inferredRepository), err)
+	}
+	domainFromRepository := reference.Domain(named)
+	if keepPathCase {
+		inferredRepository = repository
+		if strings.HasPrefix(strings.ToLower(repository), domainFromRepository+"/") {
+			inferredRepository = domainFromRepository + repository[len(domainFromRepository):]
+		}
+	} else if inferredRepository != repository {
+		notes = append(notes, RegistryNote{Warning: true, Message: "Repository " + util.Redact(repository) + " contains uppercase characters, using " + util.Redact(inferredRepository)})
+	}
 	registryInferredFromRepository := ""
 	if domainFromRepository != "docker.io" {
-		reg := &url.URL{Scheme: "https", Host: domainFromRepository, Path: "/v2"}
+		reg := &url.URL{Scheme: scheme, Host: domainFromRepository, Path: "/v2"}
 		registryInferredFromRepository = reg.String() + "/"
 	}
 
 	if len(strings.TrimSpace(inferredRegistry)) != 0 {
-		regsitryURLFromStepConfig, err := url.Parse(inferredRegistry)
+		regsitryURLFromStepConfig, err := parseRegistryURL(inferredRegistry, scheme)
 		if err != nil {
-			_logger.Errorln("Invalid registry url specified: ", err.Error)
-			if registryInferredFromRepository != "" {
-				_logger.Infoln("Using registry url inferred from repository: " + registryInferredFromRepository)
-				inferredRegistry = registryInferredFromRepository
-			} else {
-				_logger.Errorln("Please specify valid registry parameter.If you intended to use docker hub as registry, you may omit registry parameter")
-				return "", "", err
+			notes = append(notes, RegistryNote{Warning: true, Message: "Invalid registry url specified: " + util.Redact(err.Error())})
+			if registryInferredFromRepository == "" {
+				notes = append(notes, RegistryNote{Warning: true, Message: "Please specify valid registry parameter.If you intended to use docker hub as registry, you may omit registry parameter"})
+				return "", "", notes, util.RedactError(err)
 			}
-
+			notes = append(notes, RegistryNote{Message: "Using registry url inferred from repository: " + util.Redact(registryInferredFromRepository)})
+			inferredRegistry = registryInferredFromRepository
 		} else {
+			prefix := registryPathPrefix(regsitryURLFromStepConfig)
+			if prefix != "" {
+				regsitryURLFromStepConfig.Path = "/" + prefix + "/v2/"
+			}
+			inferredRegistry = regsitryURLFromStepConfig.String()
 			domainFromRegistryURL := regsitryURLFromStepConfig.Host
 			if len(strings.TrimSpace(domainFromRepository)) != 0 && domainFromRepository != "docker.io" {
-				if domainFromRegistryURL != domainFromRepository {
-					_logger.Infoln("Different registry hosts specified in repository: " + domainFromRepository + " and registry: " + domainFromRegistryURL)
+				registryScheme := regsitryURLFromStepConfig.Scheme
+				if canonicalRegistryHost(domainFromRegistryURL, registryScheme) != canonicalRegistryHost(domainFromRepository, registryScheme) {
 					inferredRegistry = registryInferredFromRepository
-					_logger.Infoln("Using registry inferred from repository: " + inferredRegistry)
+					notes = append(notes,
+						RegistryNote{Warning: true, Message: "Different registry hosts specified in repository: " + util.Redact(domainFromRepository) + " and registry: " + util.Redact(domainFromRegistryURL)},
+						RegistryNote{Message: "Using registry inferred from repository: " + util.Redact(inferredRegistry)},
+					)
 				}
 			} else {
+				// The path prefix of a registry like Harbor or Nexus is the
+				// first part of the name of its repositories
+				if prefix != "" && !strings.HasPrefix(inferredRepository, prefix+"/") {
+					inferredRepository = prefix + "/" + inferredRepository
+				}
 				inferredRepository = domainFromRegistryURL + "/" + inferredRepository
-				_logger.Infoln("Using repository inferred from registry: " + inferredRepository)
+				notes = append(notes, RegistryNote{Message: "Using repository inferred from registry: " + util.Redact(inferredRepository)})
 			}
-
 		}
 	} else {
 		inferredRegistry = registryInferredFromRepository
 	}
-	return inferredRepository, inferredRegistry, nil
+	if insecure && pipelineOptions.WerckerContainerRegistry != nil {
+		wcr := pipelineOptions.WerckerContainerRegistry
+		if u, err := url.Parse(inferredRegistry); err == nil && canonicalRegistryHost(u.Host, u.Scheme) == canonicalRegistryHost(wcr.Host, wcr.Scheme) {
+			return "", "", notes, ErrInsecureWerckerRegistry
+		}
+	}
+	return inferredRepository, inferredRegistry, notes, nil
 }
 
-// InitEnv parses our data into our config
-func (s *DockerPushStep) InitEnv(env *util.Environment) {
-	s.configure(env)
-	opts := s.buildAutherOpts(env)
-	auther, _ := dockerauth.GetRegistryAuthenticator(opts)
-	s.authenticator = auther
+// githubContainerRegistryOwner returns the owner of a repository in the
+// GitHub Container Registry, like wercker for ghcr.io/wercker/app.
+func githubContainerRegistryOwner(repository string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(strings.ToLower(repository))
+	if err != nil || reference.Domain(named) != GitHubContainerRegistryDomain {
+		return "", false
+	}
+	return strings.SplitN(reference.Path(named), "/", 2)[0], true
 }
 
-// Fetch NOP
-func (s *DockerPushStep) Fetch() (string, error) {
-	// nop
-	return "", nil
-}
+// ecrRegistryPattern matches the host of an Amazon ECR registry, which
+// contains the account ID and region of the registry
+var ecrRegistryPattern = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
 
-// Execute commits the current container and pushes it to the configured
-// registry
+// ecrRegistry returns the account ID and region of the ECR registry of
+// repository, false if it isn't in ECR.
+func ecrRegistry(repository string) (registryID, region string, ok bool) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return "", "", false
+	}
+	m := ecrRegistryPattern.FindStringSubmatch(reference.Domain(named))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// ecrAutherOpts returns opts for pushing to repository in ECR. An
+// authorization token is only valid for the registry of the account it was
+// requested for, so for cross-account pushes the registry ID and region
+// come from the repository unless they are set on the step.
+func ecrAutherOpts(logger *util.LogEntry, opts dockerauth.CheckAccessOptions, repository string) dockerauth.CheckAccessOptions {
+	registryID, region, ok := ecrRegistry(repository)
+	if !ok {
+		return opts
+	}
+	if opts.AwsRegistryID == "" {
+		opts.AwsRegistryID = registryID
+	} else if opts.AwsRegistryID != registryID {
+		logger.Warnln("aws-registry-id", opts.AwsRegistryID, "is not the account of", repository, "the push will probably fail")
+	}
+	if opts.AwsRegion == "" {
+		opts.AwsRegion = region
+	}
+	return opts
+}
+
+// inferGCPRegistryAndRepository returns the Google registry host to push to
+// and the repository prefixed with it. The host is taken from registry, the
+// domain of repository or defaults to gcr.io.
+func inferGCPRegistryAndRepository(repository string, registry string) (inferredRepository string, inferredRegistry string, err error) {
+	if repository == "" {
+		return "", "", errors.New("A repository is required with gcp-service-account-key")
+	}
+	inferredRepository = strings.ToLower(repository)
+	named, err := reference.ParseNormalizedNamed(inferredRepository)
+	if err != nil {
+		return "", "", err
+	}
+	domain := reference.Domain(named)
+	if domain == "docker.io" {
+		domain = ""
+	} else if !dockerauth.IsGCPRegistry(domain) {
+		return "", "", fmt.Errorf("Repository %s is not in a Google Container Registry or Artifact Registry", repository)
+	}
+
+	inferredRegistry = dockerauth.GCPRegistryURL(registry).Host
+	if registry == "" && domain != "" {
+		inferredRegistry = domain
+	}
+	if !dockerauth.IsGCPRegistry(inferredRegistry) {
+		return "", "", fmt.Errorf("gcp-registry %s is not a Google Container Registry or Artifact Registry host", inferredRegistry)
+	}
+	if domain == "" {
+		inferredRepository = inferredRegistry + "/" + inferredRepository
+	} else if domain != inferredRegistry {
+		return "", "", fmt.Errorf("Repository %s does not belong to gcp-registry %s", repository, inferredRegistry)
+	}
+	return inferredRepository, inferredRegistry, nil
+}
+
+// parseRegistryURL parses a registry url. Registries without a scheme, like
+// localhost:5000, use scheme.
+func parseRegistryURL(registry string, scheme string) (*url.URL, error) {
+	if !strings.Contains(registry, "://") {
+		registry = scheme + "://" + registry
+	}
+	return url.Parse(registry)
+}
+
+// registryPathPrefix returns the path a registry is served under without the
+// API version, like docker for https://registry.example.com:8443/docker/v2/
+func registryPathPrefix(registry *url.URL) string {
+	prefix := strings.Trim(registry.Path, "/")
+	if prefix == "v1" || prefix == "v2" {
+		return ""
+	}
+	prefix = strings.TrimSuffix(strings.TrimSuffix(prefix, "/v1"), "/v2")
+	return prefix
+}
+
+// canonicalRegistryHost strips the default port of scheme from host so that
+// quay.io and quay.io:443 are the same registry. Other ports are kept.
+func canonicalRegistryHost(host string, scheme string) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		return hostname
+	}
+	return host
+}
+
+// ErrInsecureWerckerRegistry is returned when insecure-registry is combined
+// with the wercker registry, which is only available over https
+var ErrInsecureWerckerRegistry = errors.New("insecure-registry can not be used with the wercker registry")
+
+// InitEnv parses our data into our config
+func (s *DockerPushStep) InitEnv(env *util.Environment) {
+	s.configure(env)
+	opts, err := s.buildAutherOpts(env)
+	if err != nil {
+		s.configErr = err
+		return
+	}
+	s.autherOpts = opts
+	s.authenticator, err = newRegistryAuthenticator(opts)
+	if err != nil {
+		s.configErr = err
+	}
+}
+
+// newRegistryAuthenticator returns the authenticator for opts, refreshing
+// expiring credentials
+func newRegistryAuthenticator(opts dockerauth.CheckAccessOptions) (auth.Authenticator, error) {
+	auther, err := dockerauth.GetRegistryAuthenticator(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to authenticate with %s: %v", opts.Registry, util.RedactError(err))
+	}
+	if dockerauth.HasExpiringCredentials(opts) {
+		auther = dockerauth.NewRefreshingAuthenticator(auther, opts)
+	}
+	return auther, nil
+}
+
+// isInteractive reports whether a user is around to complete the device
+// flow, overridden in tests
+var isInteractive = func() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd())) && terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// deviceFlowTimeout is the longest the device flow waits for the user to
+// authorize the push
+const deviceFlowTimeout = 15 * time.Minute
+
+// authorizeDevice runs the device flow of auth-mode device before the
+// registry is accessed and authenticates with the token it yields. The
+// verification URL and user code are shown in the step output. Nothing
+// happens if the device flow isn't used or has completed already.
+func (s *DockerPushStep) authorizeDevice(ctx context.Context) error {
+	if s.deviceFlow == nil || s.dockerOptions.Local {
+		return nil
+	}
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	flow := *s.deviceFlow
+	flow.Prompt = func(verificationURI, userCode string) {
+		e.Emit(core.Logs, &core.LogsArgs{
+			Logs: fmt.Sprintf("To authorize the push, open %s and enter the code: %s\n", verificationURI, userCode),
+		})
+	}
+	ctx, cancel := context.WithTimeout(ctx, deviceFlowTimeout)
+	defer cancel()
+	token, err := dockerauth.DeviceFlowToken(ctx, flow)
+	if err != nil {
+		err = util.RedactError(err)
+		s.logger.Errorln("Unable to authorize using the device flow:", err)
+		return err
+	}
+	s.autherOpts.Password = token
+	authenticator, err := newRegistryAuthenticator(s.autherOpts)
+	if err != nil {
+		s.logger.Errorln(err)
+		return err
+	}
+	s.authenticator = authenticator
+	s.deviceFlow = nil
+	return nil
+}
+
+// Fetch NOP
+func (s *DockerPushStep) Fetch() (string, error) {
+	// nop
+	return "", nil
+}
+
+// Execute commits the current container and pushes it to the configured
+// registry
 func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
+	if s.configErr != nil {
+		return -1, s.configErr
+	}
+	if err := s.authorizeDevice(ctx); err != nil {
+		return -1, err
+	}
+
 	// TODO(termie): could probably re-use the tansport's client
-	client, err := NewDockerClient(s.dockerOptions)
+	client, err := NewDockerClient(s.clientOptions())
 	if err != nil {
 		return 1, err
 	}
@@ -820,6 +2611,12 @@ func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int,
 	containerID := dt.containerID
 
 	s.tags = s.buildTags()
+	if done, err := s.handleEmptyTags(); done {
+		if err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
 
 	if !s.dockerOptions.Local {
 		check, err := s.authenticator.CheckAccess(s.repository, auth.Push)
@@ -834,36 +2631,67 @@ func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int,
 	s.repository = s.authenticator.Repository(s.repository)
 	s.logger.Debugln("Init env:", s.data)
 
-	config := docker.Config{
-		Cmd:          s.cmd,
-		Entrypoint:   s.entrypoint,
-		WorkingDir:   s.workingDir,
-		User:         s.user,
-		Env:          s.env,
-		StopSignal:   s.stopSignal,
-		Labels:       s.labels,
-		ExposedPorts: s.ports,
-		Volumes:      s.volumes,
+	if s.image != "" {
+		if err := s.checkImageExists(client); err != nil {
+			return -1, err
+		}
+	}
+
+	imageEnv, err := s.imageEnv(client, containerID, s.image == "")
+	if err != nil {
+		return -1, err
 	}
 
 	var imageID = s.image
+	// skip-unchanged-commit pushes the image of the container as it is when
+	// the pipeline didn't change its file system
+	if imageID == "" && s.dockerfile == "" && s.skipUnchangedCommit {
+		imageID, err = s.unchangedContainerImage(client, containerID)
+		if err != nil {
+			return -1, err
+		}
+	}
 	// if image is specified then it is assumed to be the name or ID of an existing image
-	// if image is not specified then create a new image by committing the pipeline container
-	if imageID == "" {
-		commitOpts := docker.CommitContainerOptions{
-			Container:  containerID,
-			Repository: s.repository,
-			Author:     s.author,
-			Message:    s.message,
-			Run:        &config,
-			Tag:        s.tags[0],
+	// if dockerfile is specified then the image is built from it
+	// otherwise create a new image by committing the pipeline container
+	if s.dockerfile != "" {
+		if err := ctx.Err(); err != nil {
+			return -1, s.pushCanceledError(err)
+		}
+		if s.cleanupIntermediate {
+			defer s.cleanupIntermediateImages(client)
+		}
+		imageID, err = s.buildKitImage(ctx, client, containerID)
+		if err != nil {
+			return -1, err
+		}
+		s.createdImages = append(s.createdImages, imageID)
+		if s.dockerOptions.CleanupImage {
+			defer cleanupImage(s.logger, client, s.repository, s.tags[0])
+		}
+		if s.squash {
+			s.logger.Warnln("squash only applies to committed images, pushing", imageID, "as it is")
+		}
+	} else if imageID == "" {
+		if err := ctx.Err(); err != nil {
+			return -1, s.pushCanceledError(err)
+		}
+		// Docker pauses the container while it is committed by default
+		pause := true
+		if s.pauseOnCommit != nil {
+			pause = *s.pauseOnCommit
 		}
 
+		// Registered before the cleanup of the tag, so it runs after it
+		if s.cleanupIntermediate {
+			defer s.cleanupIntermediateImages(client)
+		}
 		s.logger.Debugln("Commit container:", containerID)
-		i, err := client.CommitContainer(commitOpts)
+		i, err := s.commitContainer(ctx, containerID, imageEnv, pause)
 		if err != nil {
 			return -1, err
 		}
+		s.createdImages = append(s.createdImages, i.ID)
 
 		if s.dockerOptions.CleanupImage {
 			defer cleanupImage(s.logger, client, s.repository, s.tags[0])
@@ -871,102 +2699,981 @@ func (s *DockerPushStep) Execute(ctx context.Context, sess *core.Session) (int,
 
 		s.logger.WithField("Image", i).Debug("Commit completed")
 		imageID = i.ID
+
+		if s.squash {
+			imageID, err = s.squashImage(ctx, containerID, imageID)
+			if err != nil {
+				return -1, err
+			}
+			s.createdImages = append(s.createdImages, imageID)
+		}
+	} else if s.squash {
+		s.logger.Warnln("squash only applies to committed images, pushing", imageID, "as it is")
+	}
+	exitCode, err := s.tagAndPush(ctx, imageID, e, client)
+	if err != nil {
+		return exitCode, err
+	}
+	s.reportInlineCache(ctx, e, s.image == "" && s.dockerfile == "")
+	return s.finishPush(ctx, sess)
+}
+
+// unchangedContainerImage returns the image of the container if its file
+// system has no changes, an empty string otherwise. The image is pushed as
+// it is, without the config of the step.
+func (s *DockerPushStep) unchangedContainerImage(client *DockerClient, containerID string) (string, error) {
+	changes, err := client.ContainerChanges(containerID)
+	if err != nil {
+		return "", fmt.Errorf("Unable to list the changes of container %s: %v", containerID, err)
+	}
+	if len(changes) > 0 {
+		s.logger.WithField("Changes", len(changes)).Debug("Container changed, committing it")
+		return "", nil
+	}
+	c, err := client.InspectContainer(containerID)
+	if err != nil {
+		return "", err
+	}
+	s.logger.Infoln("Container", containerID, "has no file system changes, skipping the commit and pushing its image", c.Image, "without the image config of the step")
+	return c.Image, nil
+}
+
+// checkImageExists makes sure the image of image-name exists before it is
+// tagged and pushed
+func (s *DockerPushStep) checkImageExists(client *DockerClient) error {
+	_, err := client.InspectImage(s.image)
+	if err == docker.ErrNoSuchImage {
+		s.logger.Errorln("Image", s.image, "not found")
+		return fmt.Errorf("Image %s not found, did an earlier step build it?", s.image)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to inspect image %s: %v", s.image, err)
+	}
+	return nil
+}
+
+// localImageName returns the name of the local image of image-name, which
+// docker-build and docker-push share. By default the run ID is prepended to
+// name directly, e.g. 1234abcdmyimage. run-id-separator is put in between,
+// e.g. 1234abcd-myimage with "-", and no-run-id-prefix uses name as it is,
+// e.g. for an image that wasn't built by the pipeline. Both steps have to
+// be given the same options to refer to the same image.
+func localImageName(data map[string]string, env *util.Environment, runID, name string) string {
+	if noPrefix, ok := data["no-run-id-prefix"]; ok {
+		if b, _ := strconv.ParseBool(env.Interpolate(noPrefix)); b {
+			return name
+		}
+	}
+	separator := ""
+	if sep, ok := data["run-id-separator"]; ok {
+		separator = env.Interpolate(sep)
+	}
+	return runID + separator + name
+}
+
+// parseLabels parses key=value pairs that are split like a shell would, so
+// values with spaces can be quoted: label="a=b c". Everything after the
+// first "=" is the value, pairs without "=" are skipped.
+func parseLabels(logger *util.LogEntry, env *util.Environment, labels string) (map[string]string, error) {
+	parsedLabels, err := shlex.Split(labels)
+	if err != nil {
+		return nil, err
+	}
+	labelMap := make(map[string]string)
+	for _, labelPair := range parsedLabels {
+		pair := strings.SplitN(labelPair, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			logger.Warnln("Ignoring label without a key=value pair:", labelPair)
+			continue
+		}
+		labelMap[env.Interpolate(pair[0])] = env.Interpolate(pair[1])
 	}
-	return s.tagAndPush(imageID, e, client)
+	return labelMap, nil
+}
+
+// splitArgs splits the value of the option name into its arguments. Like
+// the exec form of a Dockerfile, a JSON array of strings is used as is,
+// anything else is split like a shell would.
+func (s *DockerPushStep) splitArgs(name, value string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var parts []string
+		if err := json.Unmarshal([]byte(value), &parts); err == nil {
+			return parts, nil
+		}
+		s.logger.Warnln("Value of", name, "is not a JSON array of strings, splitting it like a shell instead")
+	}
+	return shlex.Split(value)
+}
+
+// clientOptions are the docker options for the clients of the step, with the
+// registry mirror of the step
+func (s *DockerPushStep) clientOptions() *Options {
+	if s.registryMirror == "" || s.dockerOptions == nil {
+		return s.dockerOptions
+	}
+	opts := *s.dockerOptions
+	opts.RegistryMirror = s.registryMirror
+	return &opts
+}
+
+// commitChanges returns the Dockerfile instructions applied to the committed
+// image. A commit keeps the cmd of the pipeline container when the config
+// has none, an explicitly empty cmd has to clear it.
+func (s *DockerPushStep) commitChanges() []string {
+	if s.cmdSet && len(s.cmd) == 0 && len(s.entrypoint) == 0 {
+		return []string{"CMD []"}
+	}
+	return nil
+}
+
+// commitContainer commits the container with the config of the step and env
+// and pauses it during the commit or not. The commit options of our docker
+// client have no pause setting nor a context to cancel the commit with, so
+// this uses the official client.
+func (s *DockerPushStep) commitContainer(ctx context.Context, containerID string, env []string, pause bool) (*docker.Image, error) {
+	officialClient, err := NewOfficialDockerClient(s.clientOptions())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := officialClient.ContainerCommit(ctx, containerID, types.ContainerCommitOptions{
+		Reference: fmt.Sprintf("%s:%s", s.repository, s.tags[0]),
+		Comment:   s.message,
+		Author:    s.author,
+		Pause:     pause,
+		Changes:   s.commitChanges(),
+		Config: &container.Config{
+			Cmd:          s.cmd,
+			Entrypoint:   s.entrypoint,
+			WorkingDir:   s.workingDir,
+			User:         s.user,
+			Env:          env,
+			StopSignal:   s.stopSignal,
+			StopTimeout:  s.stopTimeout,
+			Labels:       s.labels,
+			ExposedPorts: tranformPorts(s.ports),
+			Volumes:      s.volumes,
+			Healthcheck:  s.healthcheck,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.platformSet {
+		inspect, _, err := officialClient.ImageInspectWithRaw(ctx, resp.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkCommittedPlatform(inspect); err != nil {
+			return nil, err
+		}
+	}
+	return &docker.Image{ID: resp.ID}, nil
+}
+
+// checkCommittedPlatform makes sure the committed image is of the platform
+// of the step. A commit keeps the platform of the image the pipeline
+// container runs, which for a multi-arch box is the one of the docker
+// daemon.
+func (s *DockerPushStep) checkCommittedPlatform(inspect types.ImageInspect) error {
+	// The inspect response of the docker API version we use has no variant
+	if inspect.Os != s.os || inspect.Architecture != s.architecture {
+		committed := formatPlatform(inspect.Os, inspect.Architecture, "")
+		s.logger.Errorln("Committed image is", committed, "instead of", formatPlatform(s.os, s.architecture, s.variant))
+		return fmt.Errorf("Committed image %s is %s but the platform of the step is %s, use a box of that platform", inspect.ID, committed, formatPlatform(s.os, s.architecture, s.variant))
+	}
+	return nil
+}
+
+// imageEnv returns the env for the image config. With EnvModeMerge it is
+// the env of the container, without the variables wercker sets for the
+// run, merged with the step env, which wins for keys set in both.
+//
+// docker commit merges in the container env for every key the config
+// doesn't set, so for commits the variables wercker sets are set to empty
+// values instead, their values don't end up in the image. keep-wercker-env
+// keeps them.
+func (s *DockerPushStep) imageEnv(client *DockerClient, containerID string, commit bool) ([]string, error) {
+	if s.envMode != EnvModeMerge && (!commit || s.keepWerckerEnv) {
+		return s.env, nil
+	}
+	c, err := client.InspectContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if c.Config == nil {
+		return s.env, nil
+	}
+
+	var blanked, containerEnv []string
+	for _, kv := range c.Config.Env {
+		key := envKey(kv)
+		if !s.keepWerckerEnv && isInternalEnv(key) {
+			if commit {
+				blanked = append(blanked, key+"=")
+			}
+			continue
+		}
+		containerEnv = append(containerEnv, kv)
+	}
+	if s.envMode != EnvModeMerge {
+		containerEnv = nil
+	}
+	if len(blanked) > 0 {
+		s.logger.WithField("Keys", blanked).Debug("Clearing wercker env in committed image")
+	}
+	return mergeEnv(append(blanked, containerEnv...), s.env), nil
 }
 
 func (s *DockerPushStep) buildTags() []string {
+	if len(s.tags) == 0 && s.tagsConfigured {
+		// Tags were configured but none are left, leave it to the
+		// empty-tags policy
+		return s.tags
+	}
+	if len(s.tags) == 0 && s.pushByDigest {
+		s.tags = []string{PushByDigestTag}
+		return s.tags
+	}
 	if len(s.tags) == 0 && !s.builtInPush {
 		s.tags = []string{"latest"}
 	} else if len(s.tags) == 0 && s.builtInPush {
-		gitTag := fmt.Sprintf("%s-%s", s.options.GitBranch, s.options.GitCommit)
-		s.tags = []string{"latest", gitTag}
+		// Without either default the empty-tags policy applies
+		s.tags = []string{}
+		if !s.noDefaultLatest {
+			s.tags = append(s.tags, "latest")
+		}
+		if !s.noDefaultGitTag {
+			s.tags = append(s.tags, fmt.Sprintf("%s-%s", s.options.GitBranch, s.options.GitCommit))
+		}
 	}
+	s.tags = s.uniqueTags(s.tags)
 	return s.tags
 }
 
-func (s *DockerPushStep) tagAndPush(imageID string, e *core.NormalizedEmitter, client *DockerClient) (int, error) {
+// readTagFile reads the tags in the file at path, one per line. Blank lines
+// are skipped.
+func readTagFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if tag := strings.TrimSpace(line); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// uniqueTags drops repeated tags, keeping the first occurrence. Tags are
+// case sensitive.
+func (s *DockerPushStep) uniqueTags(tags []string) []string {
+	unique := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if util.ContainsString(unique, tag) {
+			s.logger.Debugln("Dropping duplicate tag:", tag)
+			continue
+		}
+		unique = append(unique, tag)
+	}
+	return unique
+}
+
+// validTag is the grammar docker uses for tags
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// validateTag checks that tag can be used as a docker tag
+func validateTag(tag string) error {
+	if !validTag.MatchString(tag) {
+		return fmt.Errorf("Invalid tag %q: tags can contain up to 128 letters, digits, underscores, periods and dashes, and can't start with a period or dash", tag)
+	}
+	return nil
+}
+
+// validateRepository checks that repository is a valid repository name
+// without a tag or digest. An empty repository is valid since it defaults to
+// the wercker registry.
+func validateRepository(repository string) error {
+	if repository == "" {
+		return nil
+	}
+	// Repositories are lowercased when the registry is inferred
+	named, err := reference.ParseNormalizedNamed(strings.ToLower(repository))
+	if err != nil {
+		return fmt.Errorf("Invalid repository %q: %v", repository, err)
+	}
+	if !reference.IsNameOnly(named) {
+		return fmt.Errorf("Invalid repository %q: use the tag property for tags instead of adding them to the repository", repository)
+	}
+	return nil
+}
+
+// handleEmptyTags applies the empty-tags policy if there are no tags left to
+// push. It returns true if there is nothing to push, along with an error if
+// the policy is to fail.
+func (s *DockerPushStep) handleEmptyTags() (bool, error) {
+	if len(s.tags) != 0 {
+		return false, nil
+	}
+	if s.emptyTags == EmptyTagsSkip {
+		s.logger.Warnln("No tags left to push to", s.repository, "skipping push (empty-tags:", EmptyTagsSkip+")")
+		return true, nil
+	}
+	s.logger.Errorln("No tags left to push to", s.repository, "failing push (empty-tags:", EmptyTagsFail+")")
+	return true, fmt.Errorf("No tags left to push to %s, set empty-tags to %q to skip the push instead", s.repository, EmptyTagsSkip)
+}
+
+// tagAndPush tags imageID with the tags of the step and pushes them. Once ctx
+// is done no further tags are pushed and the push in flight is aborted.
+func (s *DockerPushStep) tagAndPush(ctx context.Context, imageID string, e *core.NormalizedEmitter, client *DockerClient) (int, error) {
+	if done, err := s.handleEmptyTags(); done {
+		if err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	defer s.emitPushSummary(e, time.Now())
+
 	// Create a pipe since we want a io.Reader but Docker expects a io.Writer
 	r, w := io.Pipe()
 	// emitStatusses in a different go routine
-	go EmitStatus(e, r, s.options)
+	if s.rawProgress {
+		go EmitStatus(e, r, s.options)
+	} else {
+		go emitDockerJSONStream(e, r, s.options, dockerStreamPush)
+	}
 	defer w.Close()
-	for _, tag := range s.tags {
-		tagOpts := docker.TagImageOptions{
-			Repo:  s.repository,
-			Tag:   tag,
-			Force: s.forceTags,
+
+	if s.pushConcurrency > 1 && len(s.tags) > 1 {
+		failures, firstErr := s.pushTagsConcurrently(ctx, imageID, w, e, client)
+		if err := ctx.Err(); err != nil {
+			return 1, s.pushCanceledError(err)
 		}
-		err := client.TagImage(imageID, tagOpts)
-		s.logger.Println("Pushing image for tag ", tag)
-		if err != nil {
-			s.logger.Errorln("Failed to push:", err)
-			return 1, err
+		if firstErr != nil && s.errorMode != ErrorModeCollect {
+			return 1, firstErr
 		}
-		inactivityDuration := 5 * time.Minute
-		buf := new(bytes.Buffer)
-		mw := io.MultiWriter(w, buf)
-		pushOpts := docker.PushImageOptions{
-			Name:              s.repository,
-			OutputStream:      mw,
-			RawJSONStream:     true,
-			Tag:               tag,
-			InactivityTimeout: inactivityDuration,
+		return s.pushResult(failures)
+	}
+
+	// In collect mode we carry on with the remaining tags and report all
+	// failures at the end
+	failures := []error{}
+	for _, tag := range s.tags {
+		if err := ctx.Err(); err != nil {
+			return 1, s.pushCanceledError(err)
 		}
 		if s.dockerOptions.CleanupImage {
 			defer cleanupImage(s.logger, client, s.repository, tag)
 		}
-		if !s.dockerOptions.Local {
-			auth := docker.AuthConfiguration{
-				Username: s.authenticator.Username(),
-				Password: s.authenticator.Password(),
-				Email:    s.email,
-			}
-			err := client.PushImage(pushOpts, auth)
-			if err != nil {
-				s.logger.Errorln("Failed to push:", err)
+		err := s.pushTag(ctx, imageID, tag, w, e, client)
+		if err != nil {
+			if s.errorMode != ErrorModeCollect {
 				return 1, err
 			}
-			statusMessages := make([]PushStatus, 0)
-			dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
-			for {
-				var status PushStatus
-				if err := dec.Decode(&status); err == io.EOF {
-					break
-				} else if err != nil {
-					s.logger.Errorln("Failed to parse status outputs from docker push:", err)
-					break
-				}
-				statusMessages = append(statusMessages, status)
-			}
-			isContainerPushed := false
-			for _, statusMessage := range statusMessages {
-				if len(strings.TrimSpace(statusMessage.Error)) != 0 {
-					errorMessageToDisplay := statusMessage.Error
-					if statusMessage.ErrorDetail != nil {
-						errorMessageToDisplay = fmt.Sprintf("Code: %s, Message: %s", statusMessage.ErrorDetail.Code, statusMessage.ErrorDetail.Message)
+			failures = append(failures, wrapPushError(fmt.Errorf("%s: %v", tag, err), err))
+		}
+	}
+	return s.pushResult(failures)
+}
+
+// pushResult returns the exit code and aggregated error for the failed
+// tags in failures. The error is of the kind of the first failure.
+func (s *DockerPushStep) pushResult(failures []error) (int, error) {
+	if len(failures) > 0 {
+		s.logger.Errorln("Failed to push", len(failures), "of", len(s.tags), "tags")
+		err := fmt.Errorf("Failed to push %d of %d tags: %v", len(failures), len(s.tags), util.SqaushErrors(failures))
+		if kind := PushErrorKind(failures[0]); kind != nil {
+			return 1, &PushError{Kind: kind, message: err.Error()}
+		}
+		return 1, err
+	}
+	return 0, nil
+}
+
+// pushTagsConcurrently pushes the tags using s.pushConcurrency workers. It
+// returns the errors of all failed tags and the first error that occurred.
+// Once a tag failed no new pushes are started unless the error mode is
+// collect.
+func (s *DockerPushStep) pushTagsConcurrently(ctx context.Context, imageID string, w io.Writer, e *core.NormalizedEmitter, client *DockerClient) ([]error, error) {
+	var mu sync.Mutex
+	var firstErr error
+	failures := []error{}
+
+	tags := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < s.pushConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tag := range tags {
+				// Only pass complete lines to w, so the output of different
+				// tags isn't mixed within a single status message
+				lw := &lineWriter{w: w, mu: &s.emitMu}
+				err := s.pushTag(ctx, imageID, tag, lw, e, client)
+				lw.Flush()
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
 					}
-					s.logger.Errorln("Failed to push:", errorMessageToDisplay)
-					return 1, errors.New(errorMessageToDisplay)
+					failures = append(failures, wrapPushError(fmt.Errorf("%s: %v", tag, err), err))
+					mu.Unlock()
 				}
-				if statusMessage.Aux != nil && statusMessage.Aux.Tag == tag {
-					s.logger.Println("Pushed container:", s.repository, tag, ",Digest:", statusMessage.Aux.Digest)
-					e.Emit(core.Logs, &core.LogsArgs{
-						Logs: fmt.Sprintf("\nPushed %s:%s\n", s.repository, tag),
-					})
-					isContainerPushed = true
+			}
+		}()
+	}
+
+	for _, tag := range s.tags {
+		mu.Lock()
+		stop := firstErr != nil && s.errorMode != ErrorModeCollect
+		mu.Unlock()
+		if ctx.Err() != nil {
+			stop = true
+		}
+		if stop {
+			break
+		}
+		if s.dockerOptions.CleanupImage {
+			defer cleanupImage(s.logger, client, s.repository, tag)
+		}
+		tags <- tag
+	}
+	close(tags)
+	wg.Wait()
+	return failures, firstErr
+}
+
+// lineWriter buffers writes until a full line is available, which is then
+// written to w while holding mu.
+type lineWriter struct {
+	w   io.Writer
+	mu  *sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.buf.Write(p)
+	if i := bytes.LastIndexByte(l.buf.Bytes(), '\n'); i >= 0 {
+		l.mu.Lock()
+		_, err := l.w.Write(l.buf.Next(i + 1))
+		l.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any remaining partial line to w.
+func (l *lineWriter) Flush() error {
+	if l.buf.Len() == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(l.buf.Next(l.buf.Len()))
+	return err
+}
+
+// pushTag tags imageID with tag and pushes it, the raw push status is
+// written to w.
+func (s *DockerPushStep) pushTag(ctx context.Context, imageID, tag string, w io.Writer, e *core.NormalizedEmitter, client *DockerClient) error {
+	tagOpts := docker.TagImageOptions{
+		Repo:  s.repository,
+		Tag:   tag,
+		Force: s.forceTags,
+	}
+	err := client.TagImage(imageID, tagOpts)
+	s.logger.Println("Pushing image for tag ", tag)
+	if err != nil {
+		s.logger.Errorln("Failed to push:", err)
+		return newPushError(ErrPushFailed, tag, err)
+	}
+	if s.dockerOptions.Local {
+		return nil
+	}
+
+	if s.pushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.pushTimeout)
+		defer cancel()
+	}
+
+	refreshed := false
+	backoff := s.pushBackoff()
+	err = backoff.Retry(ctx, func(attempt int) error {
+		retry, err := s.pushImage(ctx, tag, w, e, client)
+		// Tokens of cloud registries can expire during long pushes, get new
+		// credentials and try once more
+		if PushErrorKind(err) == ErrPushUnauthorized && !refreshed {
+			if refresher, ok := s.authenticator.(dockerauth.Refresher); ok {
+				refreshed = true
+				s.logger.Infoln("Push of tag", tag, "was unauthorized, refreshing credentials")
+				if rerr := refresher.Refresh(); rerr != nil {
+					s.logger.WithError(rerr).Errorln("Unable to refresh credentials")
+					return util.Permanent(err)
 				}
+				retry, err = s.pushImage(ctx, tag, w, e, client)
+			}
+		}
+		if err != nil && !retry {
+			return util.Permanent(err)
+		}
+		return err
+	}, func(attempt int, delay time.Duration, err error) {
+		s.logger.WithError(err).Warnln("Push of tag", tag, "failed, retrying in", delay, "attempt", attempt, "of", s.retryCount)
+	})
+	if err != nil && err == ctx.Err() {
+		return s.pushContextError(ctx, tag)
+	}
+	return err
+}
+
+// pushBackoff returns the backoff between the attempts to push a tag, a push
+// is retried retryCount times.
+func (s *DockerPushStep) pushBackoff() *util.Backoff {
+	return &util.Backoff{
+		Base:        pushRetryDelay,
+		Max:         pushRetryMaxDelay,
+		Jitter:      0.2,
+		MaxAttempts: s.retryCount + 1,
+	}
+}
+
+// pushContextError is returned when ctx is done while tag is pushed, either
+// because the push-timeout expired or because the build was canceled.
+func (s *DockerPushStep) pushContextError(ctx context.Context, tag string) error {
+	if ctx.Err() == context.DeadlineExceeded && s.pushTimeout > 0 {
+		return s.pushTimeoutError(tag)
+	}
+	return s.pushCanceledError(ctx.Err())
+}
+
+// pushCanceledError is returned when the build is canceled during the push.
+func (s *DockerPushStep) pushCanceledError(err error) error {
+	s.logger.Errorln("Push to", s.repository, "canceled:", err)
+	return newPushError(ErrPushCanceled, "", fmt.Errorf("Push to %s canceled: %v", s.repository, err))
+}
+
+// pushTimeoutError is returned when pushing tag took longer than the
+// push-timeout.
+func (s *DockerPushStep) pushTimeoutError(tag string) error {
+	s.logger.Errorln("Push of tag", tag, "timed out after", s.pushTimeout)
+	return newPushError(ErrPushCanceled, tag, fmt.Errorf("Push of %s:%s timed out after %s", s.repository, tag, s.pushTimeout))
+}
+
+// ctxWriter fails all writes once its context is done, this makes the docker
+// client stop reading the push output and abort the push. The push can't be
+// stopped otherwise and keeps writing, reads of what was written hold mu.
+type ctxWriter struct {
+	mu  sync.Mutex
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *ctxWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// pushRetryDelay is the delay before the first retry of a push, it doubles
+// for every following attempt up to pushRetryMaxDelay.
+var pushRetryDelay = 2 * time.Second
+
+const pushRetryMaxDelay = time.Minute
+
+// pushImage does a single push attempt of tag. The returned bool is true if
+// the push failed in a way that is worth retrying.
+func (s *DockerPushStep) pushImage(ctx context.Context, tag string, w io.Writer, e *core.NormalizedEmitter, client *DockerClient) (bool, error) {
+	// Use a fresh buffer for every attempt so only the status messages of
+	// this attempt are checked
+	buf := new(bytes.Buffer)
+	out := &ctxWriter{ctx: ctx, w: io.MultiWriter(w, buf)}
+	if s.savePushLog {
+		defer func() {
+			// A canceled push can still be writing to buf
+			out.mu.Lock()
+			defer out.mu.Unlock()
+			s.writePushLog(tag, buf)
+		}()
+	}
+	pushOpts := docker.PushImageOptions{
+		Name:              s.repository,
+		OutputStream:      out,
+		RawJSONStream:     true,
+		Tag:               tag,
+		InactivityTimeout: s.inactivityTimeout,
+	}
+	auth := docker.AuthConfiguration{
+		Username: s.authenticator.Username(),
+		Password: s.authenticator.Password(),
+		Email:    s.email,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.PushImage(pushOpts, auth)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return false, s.pushContextError(ctx, tag)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, s.pushContextError(ctx, tag)
+		}
+		s.logger.Errorln("Failed to push:", util.Redact(err.Error()))
+		// Errors returned by the docker daemon itself are only retried
+		// when they are server errors, anything else is a network error
+		kind := classifyPushClientError(err)
+		return kind == ErrPushNetwork, newPushError(kind, tag, util.RedactError(err))
+	}
+	statusMessages := make([]PushStatus, 0)
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for {
+		var status PushStatus
+		if err := dec.Decode(&status); err == io.EOF {
+			break
+		} else if err != nil {
+			s.logger.Errorln("Failed to parse status outputs from docker push:", err)
+			break
+		}
+		statusMessages = append(statusMessages, status)
+	}
+	pushedDigest, isContainerPushed := "", false
+	for _, statusMessage := range statusMessages {
+		if len(strings.TrimSpace(statusMessage.Error)) != 0 {
+			errorMessageToDisplay := statusMessage.Error
+			retry := false
+			if statusMessage.ErrorDetail != nil {
+				errorMessageToDisplay = fmt.Sprintf("Code: %s, Message: %s", statusMessage.ErrorDetail.Code, statusMessage.ErrorDetail.Message)
+				retry = isServerErrorCode(statusMessage.ErrorDetail.Code)
 			}
-			if !isContainerPushed {
-				s.logger.Errorln("Failed to push tag:", tag, "Please check log messages")
-				return 1, errors.New(NoPushConfirmationInStatus)
+			// Registry errors can include signed urls and tokens
+			errorMessageToDisplay = util.Redact(errorMessageToDisplay)
+			s.logger.Errorln("Failed to push:", errorMessageToDisplay)
+			return retry, newPushError(classifyPushStatus(statusMessage), tag, errors.New(errorMessageToDisplay))
+		}
+		if digest, ok := pushConfirmation(statusMessage, tag); ok {
+			// The status line and aux message report the same digest
+			if pushedDigest == "" {
+				pushedDigest = digest
 			}
+			isContainerPushed = true
+		}
+	}
+	if !isContainerPushed {
+		s.logger.Errorln("Failed to push tag:", tag, "Please check log messages")
+		return false, newPushError(ErrPushUnconfirmed, tag, errors.New(NoPushConfirmationInStatus))
+	}
+	layersPushed, layersExisting := pushedLayers(statusMessages)
+	s.logger.Println("Pushed container:", s.repository, tag, ",Digest:", pushedDigest, ",Layers:", layerSummary(layersPushed, layersExisting))
+	pushed := fmt.Sprintf("%s:%s", s.repository, tag)
+	if tag == PushByDigestTag {
+		pushed = fmt.Sprintf("%s@%s", s.repository, pushedDigest)
+	}
+	if layersPushed+layersExisting > 0 {
+		pushed = fmt.Sprintf("%s (%s)", pushed, layerSummary(layersPushed, layersExisting))
+	}
+	s.emitMu.Lock()
+	s.setDigest(tag, pushedDigest)
+	s.pushedBytes += pushedBytes(statusMessages)
+	s.layersPushed += layersPushed
+	s.layersExisting += layersExisting
+	e.Emit(core.Logs, &core.LogsArgs{
+		Logs: fmt.Sprintf("\nPushed %s\n", pushed),
+	})
+	s.emitMu.Unlock()
+	return false, nil
+}
 
+// pushedBytes sums the sizes of the layers uploaded during a push. Docker
+// reports the size of a layer with the progress of its upload, layers the
+// registry already has have no progress.
+func pushedBytes(statusMessages []PushStatus) int64 {
+	sizes := map[string]int64{}
+	for _, status := range statusMessages {
+		if status.ID == "" || status.ProgressDetail == nil {
+			continue
 		}
+		if status.ProgressDetail.Total > sizes[status.ID] {
+			sizes[status.ID] = status.ProgressDetail.Total
+		}
+	}
+	total := int64(0)
+	for _, size := range sizes {
+		total += size
+	}
+	return total
+}
+
+// pushedLayers counts the layers docker uploaded during a push and the
+// layers the registry already had, by the last status of every layer ID.
+// Layers mounted from another repository of the registry weren't uploaded
+// either and count as existing.
+func pushedLayers(statusMessages []PushStatus) (int, int) {
+	layers := map[string]string{}
+	for _, status := range statusMessages {
+		if status.ID == "" {
+			continue
+		}
+		switch {
+		case status.Status == "Pushed":
+			layers[status.ID] = "pushed"
+		case status.Status == "Layer already exists", strings.HasPrefix(status.Status, "Mounted from"):
+			layers[status.ID] = "existing"
+		}
+	}
+	pushed, existing := 0, 0
+	for _, state := range layers {
+		if state == "pushed" {
+			pushed++
+		} else {
+			existing++
+		}
+	}
+	return pushed, existing
+}
+
+// layerSummary describes how many layers of a push were uploaded
+func layerSummary(pushed, existing int) string {
+	return fmt.Sprintf("pushed %d of %d layers; %d already existed", pushed, pushed+existing, existing)
+}
+
+// pushSummary describes the tags pushed since start
+func (s *DockerPushStep) pushSummary(start time.Time) *core.PushSummary {
+	s.emitMu.Lock()
+	defer s.emitMu.Unlock()
+
+	summary := &core.PushSummary{
+		Repository:     s.repository,
+		Tags:           []core.PushedTag{},
+		BytesPushed:    s.pushedBytes,
+		LayersPushed:   s.layersPushed,
+		LayersExisting: s.layersExisting,
+		Duration:       time.Since(start),
+	}
+	for _, tag := range s.tags {
+		if dgst, ok := s.digests[tag]; ok {
+			summary.Tags = append(summary.Tags, core.PushedTag{Tag: tag, Digest: dgst})
+		}
+	}
+	return summary
+}
+
+// emitPushSummary emits the PushFinished event for the tags pushed since
+// start and keeps the summary with the reports of the run. Tags that failed
+// to push are left out.
+func (s *DockerPushStep) emitPushSummary(e *core.NormalizedEmitter, start time.Time) {
+	if s.dockerOptions.Local {
+		return
+	}
+	summary := s.pushSummary(start)
+	s.logger.Println("Push to", s.repository, "finished,", layerSummary(summary.LayersPushed, summary.LayersExisting))
+	e.Emit(core.PushFinished, &core.PushFinishedArgs{Summary: summary})
+	s.writePushSummary(summary)
+}
+
+// writePushSummary writes summary to PushSummaryName next to the push log.
+// Runs without a directory on the host only emit the summary. Failing to
+// write it doesn't fail the push.
+func (s *DockerPushStep) writePushSummary(summary *core.PushSummary) {
+	if _, err := os.Stat(s.options.HostPath()); err != nil {
+		return
+	}
+	summaryPath := s.options.HostPath("reports", s.SafeID(), PushSummaryName)
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(summaryPath), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(summaryPath, data, 0644)
+	}
+	if err != nil {
+		s.logger.WithError(err).Warnln("Unable to save push summary")
+	}
+}
+
+// pushStatusDigest matches the status docker reports once the manifest of
+// a tag is pushed, "<tag>: digest: sha256:<hex> size: <bytes>"
+var pushStatusDigest = regexp.MustCompile(`^(?:(\S+): )?digest: (sha256:[a-f0-9]{64}) size: \d+$`)
+
+// pushConfirmation checks if status confirms the push of tag and returns
+// the pushed digest. Some registries leave the tag out of the aux message,
+// or only report it once for a manifest with several tags, so an aux
+// message with a digest but without a tag confirms the push as well, as
+// does the digest status line.
+func pushConfirmation(status PushStatus, tag string) (string, bool) {
+	if status.Aux != nil {
+		if status.Aux.Tag == tag || (status.Aux.Tag == "" && status.Aux.Digest != "") {
+			return status.Aux.Digest, true
+		}
+	}
+	if m := pushStatusDigest.FindStringSubmatch(strings.TrimSpace(status.Status)); m != nil {
+		if m[1] == "" || m[1] == tag {
+			return m[2], true
+		}
+	}
+	return "", false
+}
+
+// pushLogPath is where save-push-log writes the status stream. The report
+// root is a path in the container while the push happens on the host, so
+// the log is kept with the other files of the run on the host.
+func (s *DockerPushStep) pushLogPath() string {
+	return s.options.HostPath("reports", s.SafeID(), PushStatusLogName)
+}
+
+// writePushLog appends the raw status stream of a push attempt of tag to
+// the push log. Failing to write it doesn't fail the push.
+func (s *DockerPushStep) writePushLog(tag string, status *bytes.Buffer) {
+	s.pushLogMu.Lock()
+	defer s.pushLogMu.Unlock()
+
+	logPath := s.pushLogPath()
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		s.logger.WithError(err).Warnln("Unable to save push status log")
+		return
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		s.logger.WithError(err).Warnln("Unable to save push status log")
+		return
+	}
+	defer f.Close()
+
+	data := util.Redact(status.String())
+	if !strings.HasSuffix(data, "\n") {
+		data += "\n"
+	}
+	if _, err := f.WriteString(data); err != nil {
+		s.logger.WithError(err).Warnln("Unable to save push status log")
+		return
+	}
+	s.logger.WithField("Path", logPath).Infoln("Saved push status of tag", tag)
+}
+
+// isUnauthorizedStatus checks if a push status reports rejected credentials
+func isUnauthorizedStatus(status PushStatus) bool {
+	message := status.Error
+	if status.ErrorDetail != nil {
+		if status.ErrorDetail.Code == "401" {
+			return true
+		}
+		message = status.ErrorDetail.Message
+	}
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(message)), "unauthorized")
+}
+
+// isServerErrorCode checks if code, as found in the errorDetail of a push
+// status, is a http 5xx status code.
+func isServerErrorCode(code string) bool {
+	status, err := strconv.Atoi(code)
+	if err != nil {
+		return false
+	}
+	return status >= 500 && status < 600
+}
+
+// setDigest records the digest the image was pushed with for tag
+func (s *DockerPushStep) setDigest(tag, dgst string) {
+	if s.digests == nil {
+		s.digests = make(map[string]string)
+	}
+	s.digests[tag] = dgst
+}
+
+// digestEnv returns the environment variables with the pushed digests.
+// WERCKER_DOCKER_PUSH_DIGEST_<TAG> and WERCKER_DOCKER_PUSH_REFERENCE_<TAG>
+// are set for every tag, and without the suffix for the first tag. Images
+// pushed by digest only get the variables without suffix.
+func (s *DockerPushStep) digestEnv() *util.Environment {
+	env := util.NewEnvironment()
+	for _, tag := range s.tags {
+		dgst, ok := s.digests[tag]
+		if !ok {
+			continue
+		}
+		ref := fmt.Sprintf("%s@%s", s.repository, dgst)
+		if env.Get("WERCKER_DOCKER_PUSH_DIGEST") == "" {
+			env.Add("WERCKER_DOCKER_PUSH_DIGEST", dgst)
+			env.Add("WERCKER_DOCKER_PUSH_REFERENCE", ref)
+		}
+		if tag == PushByDigestTag {
+			continue
+		}
+		suffix := strings.ToUpper(envNameUnsafe.ReplaceAllString(tag, "_"))
+		env.Add("WERCKER_DOCKER_PUSH_DIGEST_"+suffix, dgst)
+		env.Add("WERCKER_DOCKER_PUSH_REFERENCE_"+suffix, ref)
+	}
+	return env
+}
+
+// envNameUnsafe matches the characters of a tag that can't be used in an
+// environment variable name
+var envNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// finishPush runs once all tags are pushed, it signs the pushed images,
+// exports their digests and sends the push notification.
+func (s *DockerPushStep) finishPush(ctx context.Context, sess *core.Session) (int, error) {
+	if err := s.signDigests(ctx); err != nil {
+		return 1, err
+	}
+	s.exportDigests(ctx, sess)
+	if err := s.notify(ctx); err != nil {
+		if s.notifyRequired {
+			s.logger.Errorln(err)
+			return 1, err
+		}
+		s.logger.Warnln(err)
 	}
 	return 0, nil
 }
 
+// signDigests signs every pushed digest once with the configured signer
+func (s *DockerPushStep) signDigests(ctx context.Context) error {
+	if s.signer == nil {
+		return nil
+	}
+	signed := make(map[string]bool)
+	for _, tag := range s.tags {
+		dgst, ok := s.digests[tag]
+		if !ok || signed[dgst] {
+			continue
+		}
+		ref := fmt.Sprintf("%s@%s", s.repository, dgst)
+		s.logger.Println("Signing", ref)
+		if err := s.signer.Sign(ctx, ref, s.authenticator.Username(), s.authenticator.Password()); err != nil {
+			s.logger.Errorln("Failed to sign:", err)
+			return err
+		}
+		signed[dgst] = true
+	}
+	return nil
+}
+
+// exportDigests exports the pushed digests to the session so later steps can
+// use them. Failing to do so doesn't fail the push.
+func (s *DockerPushStep) exportDigests(ctx context.Context, sess *core.Session) {
+	env := s.digestEnv()
+	if len(env.Order) == 0 {
+		return
+	}
+	exit, _, err := sess.SendChecked(ctx, env.Export()...)
+	if err == nil && exit != 0 {
+		err = fmt.Errorf("exit code %d", exit)
+	}
+	if err != nil {
+		s.logger.WithError(err).Warnln("Unable to export the pushed digests")
+	}
+}
+
 func cleanupImage(logger *util.LogEntry, client *DockerClient, repository, tag string) {
 	imageName := fmt.Sprintf("%s:%s", repository, tag)
 	err := client.RemoveImage(imageName)
@@ -982,6 +3689,41 @@ func cleanupImage(logger *util.LogEntry, client *DockerClient, repository, tag s
 	}
 }
 
+// cleanupIntermediateImages removes the images created by the step that are
+// no longer tagged. Tagged images are kept, they are removed by cleanupImage
+// if the docker-cleanup-image option is set.
+func (s *DockerPushStep) cleanupIntermediateImages(client *DockerClient) {
+	for _, id := range s.createdImages {
+		image, err := client.InspectImage(id)
+		if err != nil {
+			s.logger.WithError(err).WithField("Image", id).Debug("Intermediate image already removed")
+			continue
+		}
+		if len(imageTags(image.RepoTags)) != 0 {
+			s.logger.WithField("Image", id).Debug("Keeping tagged image")
+			continue
+		}
+		if err := client.RemoveImage(image.ID); err != nil {
+			s.logger.WithError(err).WithField("Image", id).Warn("Failed to delete intermediate image")
+			continue
+		}
+		s.logger.Infoln("Removed intermediate image", image.ID)
+	}
+	s.createdImages = nil
+}
+
+// imageTags returns the tags of an image without the <none>:<none>
+// placeholder docker reports for untagged images.
+func imageTags(repoTags []string) []string {
+	tags := []string{}
+	for _, tag := range repoTags {
+		if tag != "<none>:<none>" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
 // CollectFile NOP
 func (s *DockerPushStep) CollectFile(a, b, c string, dst io.Writer) error {
 	return nil
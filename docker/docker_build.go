@@ -82,8 +82,9 @@ func NewDockerBuildStep(stepConfig *core.StepConfig, options *core.PipelineOptio
 func (s *DockerBuildStep) configure(env *util.Environment) {
 	if imagename, ok := s.data["image-name"]; ok {
 		// note that Execute() fails the step (naming the image-name property) if this is not set
-		// we don't let the user specify the tag directly, but prepend it with the build ID
-		s.tag = s.options.RunID + env.Interpolate(imagename)
+		// the tag is prefixed with the build ID unless no-run-id-prefix is set
+		s.tag = localImageName(s.data, env, s.options.RunID, env.Interpolate(imagename))
+		s.logger.Infoln("Building local image", s.tag)
 	}
 
 	if dockerfile, ok := s.data["dockerfile"]; ok {
@@ -91,13 +92,8 @@ func (s *DockerBuildStep) configure(env *util.Environment) {
 	}
 
 	if labelsProp, ok := s.data["labels"]; ok {
-		parsedLabels, err := shlex.Split(labelsProp)
+		labelMap, err := parseLabels(s.logger, env, labelsProp)
 		if err == nil {
-			labelMap := make(map[string]string)
-			for _, labelPair := range parsedLabels {
-				pair := strings.Split(labelPair, "=")
-				labelMap[env.Interpolate(pair[0])] = env.Interpolate(pair[1])
-			}
 			s.labels = labelMap
 		}
 	}
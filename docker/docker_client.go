@@ -16,9 +16,12 @@ package dockerlocal
 
 import (
 	"fmt"
+	"net/http"
 	"path"
+	"strings"
 
 	"github.com/docker/docker/client"
+	"github.com/wercker/wercker/util"
 )
 
 // NewOfficialDockerClient uses the official docker client to create a Client struct
@@ -26,6 +29,13 @@ import (
 func NewOfficialDockerClient(options *Options) (*client.Client, error) {
 	var dockerClient *client.Client
 	var err error
+	opts := []func(*client.Client) error{}
+	// The client configures the transport for the host, the proxy is set
+	// on it afterwards
+	transport := &http.Transport{}
+	if options.Proxy != "" {
+		opts = append(opts, client.WithHTTPClient(&http.Client{Transport: transport}))
+	}
 	if options.TLSVerify == "1" {
 		// We're using TLS, let's locate our certs and such
 		// boot2docker puts its certs at...
@@ -34,12 +44,32 @@ func NewOfficialDockerClient(options *Options) (*client.Client, error) {
 		cert := path.Join(dockerCertPath, fmt.Sprintf("cert.pem"))
 		ca := path.Join(dockerCertPath, fmt.Sprintf("ca.pem"))
 		key := path.Join(dockerCertPath, fmt.Sprintf("key.pem"))
-		dockerClient, err = client.NewClientWithOpts(client.WithHost(options.Host), client.WithTLSClientConfig(ca, cert, key), client.WithVersion("1.24"))
+		opts = append(opts, client.WithHost(options.Host), client.WithTLSClientConfig(ca, cert, key), client.WithVersion("1.24"))
 	} else {
-		dockerClient, err = client.NewClientWithOpts(client.WithHost(options.Host), client.WithVersion("1.24"))
+		opts = append(opts, client.WithHost(options.Host), client.WithVersion("1.24"))
 	}
+	dockerClient, err = client.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, err
 	}
+	if options.Proxy != "" {
+		if err := setDockerProxy(transport, options.Host, options.Proxy); err != nil {
+			return nil, err
+		}
+	}
 	return dockerClient, nil
 }
+
+// setDockerProxy makes the connections of transport to the docker host go
+// through proxy. Connections to a unix socket don't use a proxy.
+func setDockerProxy(transport *http.Transport, host, proxy string) error {
+	if strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "npipe://") {
+		return nil
+	}
+	proxyFunc, err := util.ProxyFunc(proxy)
+	if err != nil {
+		return err
+	}
+	transport.Proxy = proxyFunc
+	return nil
+}
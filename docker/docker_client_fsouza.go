@@ -17,11 +17,14 @@ package dockerlocal
 import (
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"strings"
 
+	"github.com/docker/distribution/reference"
 	dockersignal "github.com/docker/docker/pkg/signal"
 	"github.com/docker/docker/pkg/term"
 	"github.com/fsouza/go-dockerclient"
@@ -34,6 +37,9 @@ import (
 type DockerClient struct {
 	*docker.Client
 	logger *util.LogEntry
+	// mirror is the registry mirror images of the Docker Hub are pulled
+	// from, see Options.RegistryMirror
+	mirror string
 }
 
 // NewDockerClient based on options and env
@@ -67,7 +73,71 @@ func NewDockerClient(options *Options) (*DockerClient, error) {
 			return nil, err
 		}
 	}
-	return &DockerClient{Client: client, logger: logger}, nil
+	if transport, ok := client.HTTPClient.Transport.(*http.Transport); ok && options.Proxy != "" {
+		if err := setDockerProxy(transport, dockerHost, options.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	return &DockerClient{Client: client, logger: logger, mirror: options.RegistryMirror}, nil
+}
+
+// PullImage pulls an image like docker.Client.PullImage. With a registry
+// mirror, images of the Docker Hub are pulled from the mirror and tagged
+// with their original name. If the mirror can't provide the image it is
+// pulled from the Docker Hub.
+func (c *DockerClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	mirrored, ok := mirrorRepository(c.mirror, opts.Repository)
+	if !ok || strings.Contains(opts.Tag, ":") {
+		return c.Client.PullImage(opts, auth)
+	}
+	tag := opts.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	c.logger.WithField("Mirror", c.mirror).Debugln("Pulling", opts.Repository, "through registry mirror")
+	mirrorOpts := opts
+	mirrorOpts.Repository = mirrored
+	mirrorOpts.Tag = tag
+	err := c.Client.PullImage(mirrorOpts, docker.AuthConfiguration{})
+	if err == nil {
+		err = c.TagImage(fmt.Sprintf("%s:%s", mirrored, tag), docker.TagImageOptions{
+			Repo:  opts.Repository,
+			Tag:   tag,
+			Force: true,
+		})
+	}
+	if err != nil {
+		c.logger.WithError(err).Warnln("Unable to pull", opts.Repository, "through registry mirror", c.mirror, "pulling it from the Docker Hub")
+		return c.Client.PullImage(opts, auth)
+	}
+	return nil
+}
+
+// mirrorRepository returns the name of repository on mirror, only images of
+// the Docker Hub are mirrored.
+func mirrorRepository(mirror, repository string) (string, bool) {
+	if mirror == "" {
+		return "", false
+	}
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil || reference.Domain(named) != "docker.io" {
+		return "", false
+	}
+	return mirror + "/" + reference.Path(named), true
+}
+
+// parseRegistryMirror validates the registry-mirror option, an http(s) url
+// of a registry without a path, and returns its host.
+func parseRegistryMirror(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("Invalid registry-mirror %q, expected a url like https://mirror.example.com", mirror)
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return "", fmt.Errorf("Invalid registry-mirror %q, the mirror of the Docker Hub can't have a path", mirror)
+	}
+	return u.Host, nil
 }
 
 // RunAndAttach gives us a raw connection to a newly run container
@@ -0,0 +1,959 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	docker "github.com/fsouza/go-dockerclient"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/docker-check-access"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+type ScratchPushSuite struct {
+	*util.TestSuite
+}
+
+func TestScratchPushSuite(t *testing.T) {
+	suiteTester := &ScratchPushSuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+type scratchTestEntry struct {
+	hdr  *tar.Header
+	body string
+}
+
+// scratchTestTarball builds an in-memory tarball the way the artificer
+// collects it from the container
+func scratchTestTarball(entries []scratchTestEntry) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		entry.hdr.Size = int64(len(entry.body))
+		tw.WriteHeader(entry.hdr)
+		tw.Write([]byte(entry.body))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func scratchTestOutput() []byte {
+	return scratchTestTarball([]scratchTestEntry{
+		{&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "output/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "output/bin/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "output/bin/app", Typeflag: tar.TypeReg, Mode: 0755}, "#!/bin/app"},
+		{&tar.Header{Name: "output/README", Typeflag: tar.TypeReg, Mode: 0644}, "hello"},
+	})
+}
+
+func scratchTestLogger() *util.LogEntry {
+	return util.NewLogger().WithFields(util.LogFields{
+		"Logger": "Test",
+	})
+}
+
+// scratchTestLayer reads back the headers written to a scratch layer
+func scratchTestLayer(layer []byte) []*tar.Header {
+	hdrs := []*tar.Header{}
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		hdrs = append(hdrs, hdr)
+	}
+	return hdrs
+}
+
+// TestStreamedLayerMatchesFileLayer tests that streaming the artifact through
+// a pipe produces the same layer as rewriting the layer.tar from disk
+func (s *ScratchPushSuite) TestStreamedLayerMatchesFileLayer() {
+	tarball := scratchTestOutput()
+
+	// File based path
+	layerPath := filepath.Join(s.WorkingDir(), "layer.tar")
+	err := ioutil.WriteFile(layerPath, tarball, 0644)
+	s.Nil(err)
+	artifactReader, err := os.Open(layerPath)
+	s.Nil(err)
+	defer artifactReader.Close()
+
+	fileLayer := new(bytes.Buffer)
+	fileDigester := digest.Canonical.Digester()
+	fileFiles, err := writeScratchLayer(scratchTestLogger(), artifactReader, io.MultiWriter(fileLayer, fileDigester.Hash()), time.Time{})
+	s.Nil(err)
+
+	// Streamed path
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.Write(tarball)
+		pipeWriter.Close()
+	}()
+	streamLayer := new(bytes.Buffer)
+	streamDigester := digest.Canonical.Digester()
+	streamFiles, err := writeScratchLayer(scratchTestLogger(), pipeReader, io.MultiWriter(streamLayer, streamDigester.Hash()), time.Time{})
+	s.Nil(err)
+
+	s.Equal(2, fileFiles)
+	s.Equal(fileFiles, streamFiles)
+	s.Equal(fileLayer.Bytes(), streamLayer.Bytes())
+	s.Equal(fileDigester.Digest(), streamDigester.Digest())
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(streamLayer.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	s.Equal([]string{"bin/", "bin/app", "README"}, names)
+}
+
+// TestScratchLayerUnsafeEntries tests that entries escaping the layer are
+// skipped while symlinks, modes and ownership are kept
+func (s *ScratchPushSuite) TestScratchLayerUnsafeEntries() {
+	tarball := scratchTestTarball([]scratchTestEntry{
+		{&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "output/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "output/bin/app", Typeflag: tar.TypeReg, Mode: 0750, Uid: 1000, Gid: 1000}, "#!/bin/app"},
+		{&tar.Header{Name: "output/app", Typeflag: tar.TypeSymlink, Linkname: "../usr/bin/app", Mode: 0777}, ""},
+		{&tar.Header{Name: "output/../escape", Typeflag: tar.TypeReg, Mode: 0644}, "gotcha"},
+		{&tar.Header{Name: "output/bin/../../escape", Typeflag: tar.TypeReg, Mode: 0644}, "gotcha"},
+		{&tar.Header{Name: "output/hard", Typeflag: tar.TypeLink, Linkname: "output/../escape"}, ""},
+		{&tar.Header{Name: "/etc/motd", Typeflag: tar.TypeReg, Mode: 0644}, "hi"},
+	})
+
+	layer := new(bytes.Buffer)
+	files, err := writeScratchLayer(scratchTestLogger(), bytes.NewReader(tarball), layer, time.Time{})
+	s.Nil(err)
+	s.Equal(3, files)
+
+	hdrs := scratchTestLayer(layer.Bytes())
+	s.Equal(3, len(hdrs))
+	s.Equal("bin/app", hdrs[0].Name)
+	s.Equal(int64(0750), hdrs[0].Mode)
+	s.Equal(1000, hdrs[0].Uid)
+	s.Equal(1000, hdrs[0].Gid)
+	s.Equal("app", hdrs[1].Name)
+	s.Equal(byte(tar.TypeSymlink), hdrs[1].Typeflag)
+	s.Equal("../usr/bin/app", hdrs[1].Linkname)
+	s.Equal("etc/motd", hdrs[2].Name)
+}
+
+// TestReproducibleScratchLayer tests that the layer digest doesn't depend on
+// the timestamps of the artifact when a fixed timestamp is used
+func (s *ScratchPushSuite) TestReproducibleScratchLayer() {
+	build := func(mtime time.Time) []byte {
+		return scratchTestTarball([]scratchTestEntry{
+			{&tar.Header{Name: "output/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}, ""},
+			{&tar.Header{Name: "output/app", Typeflag: tar.TypeReg, Mode: 0755, ModTime: mtime}, "#!/bin/app"},
+		})
+	}
+	first := build(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC))
+	second := build(time.Date(2019, 6, 7, 8, 9, 10, 0, time.UTC))
+
+	digestOf := func(tarball []byte, modTime time.Time) digest.Digest {
+		digester := digest.Canonical.Digester()
+		_, err := writeScratchLayer(scratchTestLogger(), bytes.NewReader(tarball), digester.Hash(), modTime)
+		s.Nil(err)
+		return digester.Digest()
+	}
+
+	s.NotEqual(digestOf(first, time.Time{}), digestOf(second, time.Time{}))
+	epoch := time.Unix(1500000000, 0).UTC()
+	s.Equal(digestOf(first, epoch), digestOf(second, epoch))
+}
+
+// TestReproducibleSourceDateEpoch tests that SOURCE_DATE_EPOCH sets the
+// timestamp of reproducible images
+func (s *ScratchPushSuite) TestReproducibleSourceDateEpoch() {
+	step := builtInPushStep(map[string]string{"reproducible": "true"})
+	step.configure(&util.Environment{})
+	s.True(step.reproducible)
+	s.Equal(time.Unix(0, 0).UTC(), step.reproducibleTime)
+
+	env := util.NewEnvironment()
+	env.Add("SOURCE_DATE_EPOCH", "1500000000")
+	step = builtInPushStep(map[string]string{"reproducible": "true"})
+	step.configure(env)
+	s.Equal(time.Unix(1500000000, 0).UTC(), step.reproducibleTime)
+
+	step = builtInPushStep(map[string]string{})
+	step.configure(env)
+	s.False(step.reproducible)
+	s.True(step.reproducibleTime.IsZero())
+}
+
+// TestScratchLayerCache tests hits and misses of the scratch layer cache
+func (s *ScratchPushSuite) TestScratchLayerCache() {
+	cache := NewScratchLayerCache(filepath.Join(s.WorkingDir(), "layer-cache"))
+	config := &container.Config{
+		Cmd:      []string{"/bin/app"},
+		Hostname: "0123456789abcdef",
+	}
+	diffID := digest.FromBytes(scratchTestOutput())
+
+	key, err := cache.Key(diffID, config)
+	s.Nil(err)
+
+	_, ok := cache.Get(key)
+	s.False(ok, "empty cache should miss")
+
+	s.Nil(cache.Put(key, []byte(`{"id":"cached"}`)))
+	js, ok := cache.Get(key)
+	s.True(ok, "stored entry should hit")
+	s.Equal(`{"id":"cached"}`, string(js))
+
+	// The hostname changes every build and must not invalidate the cache
+	otherHost := *config
+	otherHost.Hostname = "fedcba9876543210"
+	sameKey, err := cache.Key(diffID, &otherHost)
+	s.Nil(err)
+	s.Equal(key, sameKey)
+
+	// Changed content invalidates
+	changedContent, err := cache.Key(digest.FromString("changed"), config)
+	s.Nil(err)
+	s.NotEqual(key, changedContent)
+	_, ok = cache.Get(changedContent)
+	s.False(ok, "changed content should miss")
+
+	// Changed config invalidates
+	otherCmd := *config
+	otherCmd.Cmd = []string{"/bin/other"}
+	changedConfig, err := cache.Key(diffID, &otherCmd)
+	s.Nil(err)
+	s.NotEqual(key, changedConfig)
+}
+
+// TestRegistryTagsUpToDate tests that only tags whose manifest has the
+// config of the cached image are skipped
+func (s *ScratchPushSuite) TestRegistryTagsUpToDate() {
+	configDigest := digest.FromString("config")
+	manifest := func(config digest.Digest) []byte {
+		return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":6,"digest":%q},"layers":[]}`, schema2.MediaTypeManifest, config))
+	}
+	manifests := map[string][]byte{
+		"current": manifest(configDigest),
+		"stale":   manifest(digest.FromString("other config")),
+	}
+	for _, m := range []string{"current", "stale"} {
+		manifests[digest.FromBytes(manifests[m]).String()] = manifests[m]
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimPrefix(r.URL.Path, "/v2/team/app/manifests/")
+		body, ok := manifests[ref]
+		if r.URL.Path == "/v2/" {
+			return
+		} else if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", schema2.MediaTypeManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(body).String())
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	step := builtInPushStep(map[string]string{"repository": host + "/team/app", "insecure-registry": "true"})
+	step.configure(util.NewEnvironment())
+	s.Require().NoError(step.configErr)
+	step.authenticator = &auth.DockerAuth{}
+	step.tags = []string{"current", "stale", "missing"}
+
+	upToDate := step.registryTagsUpToDate(context.Background(), configDigest)
+	s.Equal(map[string]digest.Digest{"current": digest.FromBytes(manifests["current"])}, upToDate)
+}
+
+// TestForeignLayerManifest tests that foreign layers are declared as layer
+// sources with the foreign media type in the manifest
+func (s *ScratchPushSuite) TestForeignLayerManifest() {
+	layerPath := filepath.Join(s.WorkingDir(), "base.tar")
+	s.Nil(ioutil.WriteFile(layerPath, scratchTestOutput(), 0644))
+
+	blobDigest := digest.FromString("compressed base layer")
+	foreignLayers, err := parseForeignLayers(fmt.Sprintf(`[{"path":%q,"urls":["https://go.microsoft.com/fwlink/?linkid=837858"],"digest":%q,"size":1234}]`, layerPath, blobDigest))
+	s.Nil(err)
+	s.Len(foreignLayers, 1)
+	s.Nil(foreignLayers[0].loadDiffID())
+
+	manifest := scratchManifest("abcdef", []string{"quay.io/wercker/app:latest"}, 0, foreignLayers, 0)
+	s.Len(manifest, 1)
+	s.Equal(filepath.Join("abcdef", "json"), manifest[0].Config)
+	s.Equal([]string{"quay.io/wercker/app:latest"}, manifest[0].RepoTags)
+	s.Equal([]string{foreignLayerPath(0), filepath.Join("abcdef", "layer.tar")}, manifest[0].Layers)
+
+	source, ok := manifest[0].LayerSources[layer.DiffID(digest.FromBytes(scratchTestOutput()))]
+	s.True(ok, "foreign layer should be keyed by its DiffID")
+	s.Equal("application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", source.MediaType)
+	s.Equal(blobDigest, source.Digest)
+	s.Equal(int64(1234), source.Size)
+	s.Equal([]string{"https://go.microsoft.com/fwlink/?linkid=837858"}, source.URLs)
+}
+
+// TestSplitScratchLayers tests that directories from layer-dirs are written
+// to their own layer and listed in the manifest below the artifact layer
+func (s *ScratchPushSuite) TestSplitScratchLayers() {
+	step := builtInPushStep(map[string]string{"layer-dirs": "vendor, missing ../up"})
+	step.configure(&util.Environment{})
+	s.Equal([]string{"vendor", "missing"}, step.layerDirs)
+
+	tarball := scratchTestTarball([]scratchTestEntry{
+		{&tar.Header{Name: "output/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "output/vendor/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{&tar.Header{Name: "output/vendor/lib.so", Typeflag: tar.TypeReg, Mode: 0644}, "lib"},
+		{&tar.Header{Name: "output/vendored", Typeflag: tar.TypeReg, Mode: 0644}, "not vendor"},
+		{&tar.Header{Name: "output/bin/app", Typeflag: tar.TypeReg, Mode: 0755}, "#!/bin/app"},
+	})
+
+	layers := []*bytes.Buffer{new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)}
+	files, entries, err := writeScratchLayers(scratchTestLogger(), bytes.NewReader(tarball), []io.Writer{layers[0], layers[1], layers[2]}, step.layerIndex, time.Time{}, nil)
+	s.Nil(err)
+	s.Equal(3, files)
+	s.Equal([]int{2, 0, 2}, entries)
+
+	names := func(layer []byte) []string {
+		names := []string{}
+		for _, hdr := range scratchTestLayer(layer) {
+			names = append(names, hdr.Name)
+		}
+		return names
+	}
+	s.Equal([]string{"vendor/", "vendor/lib.so"}, names(layers[0].Bytes()))
+	s.Equal([]string{"vendored", "bin/app"}, names(layers[2].Bytes()))
+
+	manifest := scratchManifest("abcdef", []string{"quay.io/wercker/app:latest"}, 0, nil, 1)
+	s.Equal([]string{splitLayerPath(0), filepath.Join("abcdef", "layer.tar")}, manifest[0].Layers)
+}
+
+// TestExtraFiles tests that extra-files are validated, resolved from the
+// guest root and added to the artifact layer
+func (s *ScratchPushSuite) TestExtraFiles() {
+	invalid := []string{
+		`not json`,
+		`[{"destination":"/etc/ca.pem"}]`,
+		`[{"source":"/ca.pem","destination":"/"}]`,
+		`[{"source":"/ca.pem","destination":"/etc/ca.pem","mode":"0999"}]`,
+	}
+	for _, value := range invalid {
+		_, err := parseExtraFiles(value)
+		s.Error(err, value)
+	}
+
+	options := &core.PipelineOptions{
+		GuestRoot:  "/pipeline",
+		WorkingDir: s.WorkingDir(),
+		RunID:      "run",
+	}
+	s.Nil(os.MkdirAll(options.HostPath("source"), 0755))
+	s.Nil(ioutil.WriteFile(options.HostPath("source", "VERSION"), []byte("1.0"), 0600))
+	caPath := filepath.Join(s.WorkingDir(), "ca.pem")
+	s.Nil(ioutil.WriteFile(caPath, []byte("cert"), 0600))
+
+	step := builtInPushStep(map[string]string{
+		"extra-files": `[{"source":"$CA","destination":"../etc/ssl/ca.pem","mode":"0644"},{"source":"/pipeline/source/VERSION","destination":"/VERSION"}]`,
+	})
+	step.configure(util.NewEnvironment("CA=" + caPath))
+	s.Nil(step.configErr)
+	s.Len(step.extraFiles, 2)
+
+	extraFiles, err := resolveExtraFiles(options, step.extraFiles)
+	s.Nil(err)
+	s.Equal(options.HostPath("source", "VERSION"), extraFiles[1].Source)
+
+	_, err = resolveExtraFiles(options, []ExtraFile{{Source: "/pipeline/source/missing", Destination: "/missing"}})
+	s.Error(err)
+	s.Contains(err.Error(), "/pipeline/source/missing")
+
+	buf := new(bytes.Buffer)
+	files, entries, err := writeScratchLayers(scratchTestLogger(), bytes.NewReader(scratchTestOutput()), []io.Writer{buf}, func(string) int { return 0 }, time.Time{}, extraFiles)
+	s.Nil(err)
+	s.Equal(2, files)
+	s.Equal([]int{5}, entries)
+
+	hdrs := scratchTestLayer(buf.Bytes())
+	s.Len(hdrs, 5)
+	s.Equal("etc/ssl/ca.pem", hdrs[3].Name)
+	s.Equal(int64(0644), hdrs[3].Mode)
+	s.Equal("VERSION", hdrs[4].Name)
+	s.Equal(int64(0600), hdrs[4].Mode)
+	s.Equal(int64(3), hdrs[4].Size)
+}
+
+// TestMaxLayerSize tests that artifacts larger than max-layer-size fail
+// the scratch push
+func (s *ScratchPushSuite) TestMaxLayerSize() {
+	// Streamed artifacts fail while they are written
+	limit := &layerSizeLimit{limit: 1024}
+	_, _, err := writeScratchLayers(scratchTestLogger(), bytes.NewReader(scratchTestOutput()), []io.Writer{limit.Writer(new(bytes.Buffer))}, func(string) int { return 0 }, time.Time{}, nil)
+	s.Error(err)
+	s.Contains(err.Error(), "max-layer-size of 1KiB")
+	limit.Reset()
+	limit.limit = 1 << 20
+	_, _, err = writeScratchLayers(scratchTestLogger(), bytes.NewReader(scratchTestOutput()), []io.Writer{limit.Writer(new(bytes.Buffer))}, func(string) int { return 0 }, time.Time{}, nil)
+	s.NoError(err)
+
+	// Collected artifacts are checked before they are rewritten
+	layerPath := filepath.Join(s.WorkingDir(), "layer.tar")
+	s.Nil(ioutil.WriteFile(layerPath, scratchTestOutput(), 0644))
+	scratchStep := &DockerScratchPushStep{DockerPushStep: &DockerPushStep{maxLayerSize: 1024, logger: scratchTestLogger()}}
+	s.Error(scratchStep.checkLayerSize(layerPath))
+	scratchStep.maxLayerSize = 0
+	s.NoError(scratchStep.checkLayerSize(layerPath))
+}
+
+// TestScratchConfigure tests the options of the scratch push and the values
+// that fail the configuration
+func (s *ScratchPushSuite) TestScratchConfigure() {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		invalid     bool
+		errContains string
+		check       func(step *DockerPushStep)
+	}{
+		{name: "default platform", data: map[string]string{}, check: func(step *DockerPushStep) {
+			s.Equal("linux", step.os)
+			s.Equal("amd64", step.architecture)
+			s.Equal("", step.variant)
+			s.False(step.platformSet)
+		}},
+		{name: "architecture", data: map[string]string{"architecture": "arm64", "variant": "v8"}, check: func(step *DockerPushStep) {
+			s.Equal("arm64", step.architecture)
+			s.Equal("v8", step.variant)
+		}},
+		{name: "unknown architecture", data: map[string]string{"architecture": "amd46"}, invalid: true, errContains: `Unknown architecture "amd46"`},
+		{name: "unknown os", data: map[string]string{"os": "linus"}, invalid: true, errContains: `Unknown os "linus"`},
+		{name: "no compression", data: map[string]string{}, check: func(step *DockerPushStep) {
+			s.Equal(LayerCompressionNone, step.compression)
+			s.Equal(gzip.DefaultCompression, step.compressionLevel)
+		}},
+		{name: "gzip", data: map[string]string{"format": ImageFormatOCI, "compression": "gzip", "compression-level": "1"}, check: func(step *DockerPushStep) {
+			s.Equal(LayerCompressionGzip, step.compression)
+			s.Equal(gzip.BestSpeed, step.compressionLevel)
+		}},
+		{name: "compression none", data: map[string]string{"compression": "none"}, check: func(step *DockerPushStep) {
+			s.Equal(LayerCompressionNone, step.compression)
+		}},
+		{name: "zstd", data: map[string]string{"format": ImageFormatOCI, "compression": "zstd"}, invalid: true},
+		{name: "compression-level out of range", data: map[string]string{"format": ImageFormatOCI, "compression": "gzip", "compression-level": "12"}, invalid: true},
+		{name: "compression-level not a number", data: map[string]string{"format": ImageFormatOCI, "compression": "gzip", "compression-level": "fast"}, invalid: true},
+		// docker compresses the layers it loads itself
+		{name: "gzip without format", data: map[string]string{"compression": "gzip"}, invalid: true},
+		{name: "gzip docker format", data: map[string]string{"format": ImageFormatDocker, "compression": "gzip"}, invalid: true},
+		{name: "max-layer-size", data: map[string]string{"max-layer-size": "1k"}, check: func(step *DockerPushStep) {
+			s.Equal(int64(1024), step.maxLayerSize)
+		}},
+		{name: "max-layer-size invalid", data: map[string]string{"max-layer-size": "lots"}, invalid: true},
+		{name: "platform", data: map[string]string{"platform": "linux/arm64/v8"}, check: func(step *DockerPushStep) {
+			s.True(step.platformSet)
+			s.Equal("linux", step.os)
+			s.Equal("arm64", step.architecture)
+			s.Equal("v8", step.variant)
+		}},
+		{name: "platform without os", data: map[string]string{"platform": "arm64"}, invalid: true},
+		{name: "platform and architecture", data: map[string]string{"platform": "linux/arm64", "architecture": "arm64"}, invalid: true},
+	}
+	for _, test := range tests {
+		step := builtInPushStep(test.data)
+		step.configure(util.NewEnvironment())
+		if test.invalid {
+			if s.Error(step.configErr, test.name) {
+				s.Contains(step.configErr.Error(), test.errContains, test.name)
+			}
+		} else {
+			s.NoError(step.configErr, test.name)
+		}
+		if test.check != nil {
+			test.check(step)
+		}
+	}
+}
+
+// TestScratchImageJSONPlatform tests that the platform of the step ends up in
+// the generated image JSON
+func (s *ScratchPushSuite) TestScratchImageJSONPlatform() {
+	imageJSON := func(data map[string]string) map[string]interface{} {
+		step := builtInPushStep(data)
+		step.configure(util.NewEnvironment())
+		s.Require().NoError(step.configErr)
+		scratch := &DockerScratchPushStep{DockerPushStep: step}
+		diffIDs := []layer.DiffID{layer.DiffID(digest.FromString("layer"))}
+		js, err := scratch.scratchImageJSON(scratch.scratchConfig(nil, ""), diffIDs, nil, "", "", time.Unix(0, 0))
+		s.Require().NoError(err)
+
+		// Docker still reads it
+		img, err := image.NewFromJSON(js)
+		s.Require().NoError(err)
+		s.Equal(diffIDs, img.RootFS.DiffIDs)
+
+		fields := map[string]interface{}{}
+		s.Require().NoError(json.Unmarshal(js, &fields))
+		return fields
+	}
+
+	fields := imageJSON(map[string]string{"platform": "linux/arm/v7"})
+	s.Equal("arm", fields["architecture"])
+	s.Equal("linux", fields["os"])
+	s.Equal("v7", fields["variant"])
+
+	fields = imageJSON(map[string]string{})
+	s.Equal("amd64", fields["architecture"])
+	s.Equal("linux", fields["os"])
+	s.NotContains(fields, "variant")
+}
+
+// TestPlatformOption tests the check of the platform of committed images
+func (s *ScratchPushSuite) TestPlatformOption() {
+	step := builtInPushStep(map[string]string{"platform": "linux/arm64/v8"})
+	step.configure(util.NewEnvironment())
+	s.Require().NoError(step.configErr)
+	s.Equal("linux/arm64/v8", formatPlatform(step.os, step.architecture, step.variant))
+
+	s.NoError(step.checkCommittedPlatform(types.ImageInspect{ID: "sha256:abc", Os: "linux", Architecture: "arm64"}))
+	err := step.checkCommittedPlatform(types.ImageInspect{ID: "sha256:abc", Os: "linux", Architecture: "amd64"})
+	s.Error(err)
+	s.Contains(err.Error(), "is linux/amd64 but the platform of the step is linux/arm64/v8")
+}
+
+// TestOCILayout tests the OCI image layout written for format oci
+func (s *ScratchPushSuite) TestOCILayout() {
+	layerPath := filepath.Join(s.WorkingDir(), "layer.tar")
+	s.Nil(ioutil.WriteFile(layerPath, scratchTestOutput(), 0644))
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+
+	dir := filepath.Join(s.WorkingDir(), "oci")
+	img, err := writeOCILayout(dir, config, []string{layerPath}, []string{"latest", "v1"}, LayerCompressionNone, gzip.DefaultCompression, map[string]string{v1.AnnotationTitle: "app"})
+	s.Nil(err)
+
+	layout, err := ioutil.ReadFile(filepath.Join(dir, "oci-layout"))
+	s.Nil(err)
+	s.JSONEq(`{"imageLayoutVersion":"1.0.0"}`, string(layout))
+
+	var index v1.Index
+	indexJSON, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	s.Nil(err)
+	s.Nil(json.Unmarshal(indexJSON, &index))
+	s.Len(index.Manifests, 2)
+	s.Equal("latest", index.Manifests[0].Annotations[v1.AnnotationRefName])
+	s.Equal("v1", index.Manifests[1].Annotations[v1.AnnotationRefName])
+	s.Equal(v1.MediaTypeImageManifest, index.Manifests[0].MediaType)
+
+	manifestJSON, err := ioutil.ReadFile(img.blobPath(index.Manifests[0].Digest))
+	s.Nil(err)
+	s.Equal(img.manifest.payload, manifestJSON)
+	var manifest ociManifest
+	s.Nil(json.Unmarshal(manifestJSON, &manifest))
+	s.Equal(2, manifest.SchemaVersion)
+	s.Equal(v1.MediaTypeImageManifest, manifest.MediaType)
+	s.Equal(digest.FromBytes(config), manifest.Config.Digest)
+	s.Equal(map[string]string{v1.AnnotationTitle: "app"}, manifest.Annotations)
+	s.Len(manifest.Layers, 1)
+	s.Equal(v1.MediaTypeImageLayer, manifest.Layers[0].MediaType)
+	s.Equal(digest.FromBytes(scratchTestOutput()), manifest.Layers[0].Digest)
+
+	layerBlob, err := ioutil.ReadFile(img.blobPath(manifest.Layers[0].Digest))
+	s.Nil(err)
+	s.Equal(scratchTestOutput(), layerBlob)
+	s.Len(img.manifest.References(), 2)
+}
+
+// TestOCILayoutGzip tests that gzip compressed layers keep the diff id of
+// the uncompressed layer while the blob has its own digest
+func (s *ScratchPushSuite) TestOCILayoutGzip() {
+	layerPath := filepath.Join(s.WorkingDir(), "layer.tar")
+	s.Nil(ioutil.WriteFile(layerPath, scratchTestOutput(), 0644))
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+
+	dir := filepath.Join(s.WorkingDir(), "oci-gzip")
+	img, err := writeOCILayout(dir, config, []string{layerPath}, []string{"latest"}, LayerCompressionGzip, gzip.BestCompression, nil)
+	s.Nil(err)
+
+	var manifest ociManifest
+	s.Nil(json.Unmarshal(img.manifest.payload, &manifest))
+	s.Len(manifest.Layers, 1)
+	s.Equal(v1.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+	s.NotEqual(digest.FromBytes(scratchTestOutput()), manifest.Layers[0].Digest)
+
+	layerBlob, err := ioutil.ReadFile(img.blobPath(manifest.Layers[0].Digest))
+	s.Nil(err)
+	s.Equal(manifest.Layers[0].Digest, digest.FromBytes(layerBlob))
+	s.Equal(manifest.Layers[0].Size, int64(len(layerBlob)))
+	gz, err := gzip.NewReader(bytes.NewReader(layerBlob))
+	s.Require().Nil(err)
+	uncompressed, err := ioutil.ReadAll(gz)
+	s.Nil(err)
+	s.Equal(scratchTestOutput(), uncompressed)
+
+}
+
+// TestParseForeignLayersValidation tests that invalid foreign layers are
+// rejected
+func (s *ScratchPushSuite) TestParseForeignLayersValidation() {
+	blobDigest := digest.FromString("blob")
+	invalid := []string{
+		`not json`,
+		fmt.Sprintf(`[{"urls":["https://example.com/layer"],"digest":%q,"size":1}]`, blobDigest),
+		fmt.Sprintf(`[{"path":"/layer.tar","urls":[],"digest":%q,"size":1}]`, blobDigest),
+		fmt.Sprintf(`[{"path":"/layer.tar","urls":["ftp://example.com/layer"],"digest":%q,"size":1}]`, blobDigest),
+		`[{"path":"/layer.tar","urls":["https://example.com/layer"],"digest":"sha256:nothex","size":1}]`,
+		fmt.Sprintf(`[{"path":"/layer.tar","urls":["https://example.com/layer"],"digest":%q,"size":0}]`, blobDigest),
+	}
+	for _, value := range invalid {
+		_, err := parseForeignLayers(value)
+		s.NotNil(err, value)
+	}
+}
+
+// TestResolveForeignLayers tests that foreign layer paths are resolved like
+// the sources of extra-files, relative paths against the source directory
+func (s *ScratchPushSuite) TestResolveForeignLayers() {
+	options := &core.PipelineOptions{
+		GuestRoot:  "/pipeline",
+		WorkingDir: s.WorkingDir(),
+		RunID:      "run",
+		SourceDir:  "app",
+	}
+	s.Nil(os.MkdirAll(options.HostPath("source", "app", "layers"), 0755))
+	s.Nil(ioutil.WriteFile(options.HostPath("source", "app", "layers", "base.tar"), []byte("layer"), 0600))
+	hostPath := filepath.Join(s.WorkingDir(), "host.tar")
+	s.Nil(ioutil.WriteFile(hostPath, []byte("layer"), 0600))
+
+	foreignLayers, err := parseForeignLayers(fmt.Sprintf(`[
+		{"path":"layers/base.tar","urls":["https://example.com/base"],"digest":%q,"size":1},
+		{"path":"/pipeline/source/app/layers/base.tar","urls":["https://example.com/base"],"digest":%q,"size":1},
+		{"path":%q,"urls":["https://example.com/host"],"digest":%q,"size":1}
+	]`, digest.FromString("base"), digest.FromString("base"), hostPath, digest.FromString("host")))
+	s.Require().NoError(err)
+
+	resolved, err := resolveForeignLayers(options, foreignLayers)
+	s.Require().NoError(err)
+	s.Equal(options.HostPath("source", "app", "layers", "base.tar"), resolved[0].Path)
+	s.Equal(options.HostPath("source", "app", "layers", "base.tar"), resolved[1].Path)
+	s.Equal(hostPath, resolved[2].Path)
+	s.Equal("layers/base.tar", foreignLayers[0].Path)
+
+	_, err = resolveForeignLayers(options, []ForeignLayer{{Path: "missing.tar"}})
+	s.Error(err)
+	s.Contains(err.Error(), "missing.tar")
+}
+
+func (s *ScratchPushSuite) TestCollectScratchArtifactEmpty() {
+	output := &core.Artifact{GuestPath: "/pipeline/output"}
+	source := &core.Artifact{GuestPath: "/pipeline/source"}
+
+	// Empty output falls back to the source
+	collected := []string{}
+	artifact, err := collectScratchArtifact(func(a *core.Artifact) (*core.Artifact, error) {
+		collected = append(collected, a.GuestPath)
+		if a == output {
+			return nil, util.ErrEmptyTarball
+		}
+		return a, nil
+	}, output, source)
+	s.NoError(err)
+	s.Equal(source, artifact)
+	s.Equal([]string{"/pipeline/output", "/pipeline/source"}, collected)
+
+	// Empty output and source fail with a descriptive error
+	_, err = collectScratchArtifact(func(a *core.Artifact) (*core.Artifact, error) {
+		return nil, util.ErrEmptyTarball
+	}, output, source)
+	s.Equal(ErrEmptyScratchImage, err)
+}
+
+// TestScratchBaseImage tests loading a saved base image and layering on it
+func (s *ScratchPushSuite) TestScratchBaseImage() {
+	dir := s.WorkingDir()
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "manifest.json"), []byte(`[{"Config":"abc.json","RepoTags":["alpine:3.7"],"Layers":["l1/layer.tar"]}]`), 0644))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "abc.json"), []byte(`{
+		"architecture": "amd64",
+		"os": "linux",
+		"config": {
+			"Env": ["PATH=/usr/bin:/bin", "LANG=C"],
+			"Entrypoint": ["/docker-entrypoint.sh"],
+			"Cmd": ["/bin/sh"],
+			"WorkingDir": "/srv"
+		},
+		"rootfs": {"type": "layers", "diff_ids": ["sha256:e7d92cdc71feacf90708cb59182d0df1b911f8ae022d29e8e95d75ca6a99776a"]},
+		"history": [{"created_by": "ADD rootfs.tar.gz /"}]
+	}`), 0644))
+
+	base, err := loadScratchBaseImage(dir)
+	s.Require().NoError(err)
+	s.Equal([]string{"l1/layer.tar"}, base.layers)
+	s.Len(base.config.History, 1)
+
+	// The base fills in what the step doesn't set
+	merged := base.mergeConfig(&container.Config{Env: []string{"LANG=en_US.UTF-8", "APP=1"}}, false)
+	s.Equal([]string{"PATH=/usr/bin:/bin", "LANG=en_US.UTF-8", "APP=1"}, []string(merged.Env))
+	s.Equal([]string{"/docker-entrypoint.sh"}, []string(merged.Entrypoint))
+	s.Equal([]string{"/bin/sh"}, []string(merged.Cmd))
+	s.Equal("/srv", merged.WorkingDir)
+
+	// An entrypoint on the step replaces the cmd of the base as well
+	merged = base.mergeConfig(&container.Config{Entrypoint: []string{"/app"}, WorkingDir: "/"}, false)
+	s.Equal([]string{"/app"}, []string(merged.Entrypoint))
+	s.Len(merged.Cmd, 0)
+	s.Equal("/", merged.WorkingDir)
+
+	// So does a cmd that is explicitly empty
+	merged = base.mergeConfig(&container.Config{}, true)
+	s.Equal([]string{"/docker-entrypoint.sh"}, []string(merged.Entrypoint))
+	s.Len(merged.Cmd, 0)
+
+	manifest := scratchManifest("abcdef", []string{"quay.io/wercker/app:latest"}, 1, nil, 0)
+	s.Equal([]string{baseLayerPath(0), filepath.Join("abcdef", "layer.tar")}, manifest[0].Layers)
+}
+
+// TestScratchCmd tests that scratch images only get the cmd the step sets,
+// never the shell the pipeline container runs
+func (s *ScratchPushSuite) TestScratchCmd() {
+	newStep := func(data map[string]string) *DockerScratchPushStep {
+		step := builtInPushStep(data)
+		step.configure(util.NewEnvironment())
+		return &DockerScratchPushStep{DockerPushStep: step}
+	}
+
+	step := newStep(map[string]string{})
+	config := step.scratchConfig(nil, "")
+	s.Len(config.Cmd, 0)
+	s.Len(config.Entrypoint, 0)
+	s.False(step.cmdSet)
+	s.Nil(step.commitChanges())
+
+	step = newStep(map[string]string{"cmd": `["/app", "serve"]`})
+	s.Equal([]string{"/app", "serve"}, []string(step.scratchConfig(nil, "").Cmd))
+	s.Nil(step.commitChanges())
+
+	// An empty cmd clears the cmd a commit would inherit from the pipeline
+	// container
+	step = newStep(map[string]string{"cmd": ""})
+	s.True(step.cmdSet)
+	s.Len(step.scratchConfig(nil, "").Cmd, 0)
+	s.Equal([]string{"CMD []"}, step.commitChanges())
+}
+
+// TestPullWithRetry tests that only rate limited base image pulls are
+// retried
+func (s *ScratchPushSuite) TestPullWithRetry() {
+	defer func(d time.Duration) { pullRetryDelay = d }(pullRetryDelay)
+	pullRetryDelay = time.Millisecond
+	options := &core.PipelineOptions{}
+	e := core.NewNormalizedEmitter()
+	retried := []string{}
+	e.AddListener(core.Logs, func(args *core.LogsArgs) {
+		if strings.Contains(args.Logs, "rate limited") {
+			retried = append(retried, args.Logs)
+		}
+	})
+	rateLimited := `{"errorDetail":{"message":"toomanyrequests: You have reached your pull rate limit."},"error":"toomanyrequests: You have reached your pull rate limit."}`
+
+	// The daemon reports the rate limit in the status stream
+	attempts := 0
+	err := pullWithRetry(context.Background(), e, options, "alpine:3.7", 3, func(w io.Writer) error {
+		attempts++
+		if attempts == 1 {
+			io.WriteString(w, rateLimited)
+			return nil
+		}
+		io.WriteString(w, `{"status":"Status: Downloaded newer image for alpine:3.7"}`)
+		return nil
+	})
+	s.NoError(err)
+	s.Equal(2, attempts)
+	s.Require().Len(retried, 1)
+	s.Contains(retried[0], "Pull of alpine:3.7 rate limited, retrying in")
+
+	// Other errors aren't retried
+	attempts = 0
+	err = pullWithRetry(context.Background(), e, options, "alpine:3.7", 3, func(w io.Writer) error {
+		attempts++
+		return &docker.Error{Status: 404, Message: "manifest unknown"}
+	})
+	s.Error(err)
+	s.Equal(1, attempts)
+
+	// The last rate limit error is returned once the retries are used up
+	attempts = 0
+	err = pullWithRetry(context.Background(), e, options, "alpine:3.7", 2, func(w io.Writer) error {
+		attempts++
+		io.WriteString(w, rateLimited)
+		return nil
+	})
+	s.Error(err)
+	s.Contains(err.Error(), "toomanyrequests")
+	s.Equal(3, attempts)
+
+	delay, limited := rateLimitDelay(&docker.Error{Status: 429, Message: "Retry-After: 30"})
+	s.True(limited)
+	s.Equal(30*time.Second, delay)
+	_, limited = rateLimitDelay(errors.New("connection reset by peer"))
+	s.False(limited)
+}
+
+// TestScratchImageReader tests that streaming and staging the scratch
+// tarball produce the same contents
+func (s *ScratchPushSuite) TestScratchImageReader() {
+	options := &core.PipelineOptions{WorkingDir: s.WorkingDir(), RunID: "run"}
+	s.Require().NoError(os.MkdirAll(options.HostPath("scratch", "abcdef"), 0755))
+	s.Require().NoError(ioutil.WriteFile(options.HostPath("scratch", "repositories"), []byte(`{}`), 0644))
+	s.Require().NoError(ioutil.WriteFile(options.HostPath("scratch", "abcdef", "layer.tar"), []byte("layer"), 0644))
+
+	names := func(stageToDisk bool) []string {
+		step := &DockerScratchPushStep{DockerPushStep: &DockerPushStep{options: options, stageToDisk: stageToDisk}}
+		r, err := step.scratchImageReader()
+		s.Require().NoError(err)
+		defer r.Close()
+		names := []string{}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			s.Require().NoError(err)
+			names = append(names, hdr.Name)
+		}
+		return names
+	}
+
+	streamed := names(false)
+	s.Contains(streamed, "abcdef/layer.tar")
+	s.Contains(streamed, "repositories")
+	_, err := os.Stat(options.HostPath("scratch.tar"))
+	s.True(os.IsNotExist(err))
+
+	s.Equal(streamed, names(true))
+	_, err = os.Stat(options.HostPath("scratch.tar"))
+	s.NoError(err)
+}
+
+func (s *ScratchPushSuite) TestSquashedImage() {
+	dir, err := ioutil.TempDir("", "squash")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := &container.Config{
+		Env:        []string{"PATH=/usr/bin", "APP=web"},
+		Cmd:        []string{"serve"},
+		Entrypoint: []string{"/app"},
+		Labels:     map[string]string{"io.wercker.run-id": "run-1234"},
+		StopSignal: "SIGTERM",
+	}
+	inspect := types.ImageInspect{
+		ID:           "sha256:committed",
+		Created:      "2018-05-01T12:00:00.123456789Z",
+		Author:       "wercker",
+		Config:       config,
+		Architecture: "amd64",
+		Os:           "linux",
+	}
+	layerPath := filepath.Join(dir, "squash.tar")
+	s.Require().NoError(ioutil.WriteFile(layerPath, scratchTestOutput(), 0644))
+	diffID := layer.DiffID(digest.FromBytes(scratchTestOutput()))
+
+	js, err := squashedImageJSON(inspect, diffID)
+	s.Require().NoError(err)
+	img, err := image.NewFromJSON(js)
+	s.Require().NoError(err)
+	s.Equal(config, img.Config)
+	s.Equal([]layer.DiffID{diffID}, img.RootFS.DiffIDs)
+	s.Len(img.History, 1)
+	s.Equal("amd64", img.Architecture)
+
+	buf := new(bytes.Buffer)
+	s.Require().NoError(writeSquashedImage(buf, js, layerPath, "wcr.io/wercker/app:latest"))
+	id := digest.FromBytes(js).Hex()
+	files := map[string][]byte{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		s.Require().NoError(err)
+		content, err := ioutil.ReadAll(tr)
+		s.Require().NoError(err)
+		files[hdr.Name] = content
+	}
+	s.Equal(js, files[id+".json"])
+	s.Equal(scratchTestOutput(), files[id+"/layer.tar"])
+	var manifest []scratchManifestItem
+	s.Require().NoError(json.Unmarshal(files["manifest.json"], &manifest))
+	s.Require().Len(manifest, 1)
+	s.Equal([]string{"wcr.io/wercker/app:latest"}, manifest[0].RepoTags)
+	s.Equal([]string{id + "/layer.tar"}, manifest[0].Layers)
+
+	_, err = squashedImageJSON(types.ImageInspect{Created: "yesterday"}, diffID)
+	s.Error(err)
+}
+
+// TestLoadedNotPushed tests that an image that was loaded but couldn't be
+// pushed is removed with docker-cleanup-image
+func (s *ScratchPushSuite) TestLoadedNotPushed() {
+	pushErr := errors.New("denied")
+	step := &DockerScratchPushStep{DockerPushStep: &DockerPushStep{
+		repository:    "wercker/app",
+		dockerOptions: &Options{},
+		logger:        scratchTestLogger(),
+	}}
+	api := newFakeDockerAPI()
+	api.images["loaded"] = &docker.Image{ID: "loaded", RepoTags: []string{"wercker/app:latest"}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := fakeDockerClient(server)
+	s.EqualError(step.loadedNotPushedError(client, "loaded", pushErr), "Loaded image loaded but the push failed, the image is kept: denied")
+	s.Empty(api.removed)
+
+	step.dockerOptions.CleanupImage = true
+	s.EqualError(step.loadedNotPushedError(client, "loaded", pushErr), "Loaded image loaded but the push failed, the image was removed: denied")
+	s.Equal([]string{"wercker/app:latest", "loaded"}, api.removed)
+
+	api.removed = nil
+	s.EqualError(step.loadedNotPushedError(client, "missing", pushErr), "Loaded image missing but the push failed, the image was removed: denied")
+	s.Empty(api.removed)
+}
@@ -48,3 +48,37 @@ func (s *DockerSuite) TestGenerateDockerID() {
 	// The ID needs to be 256 bits
 	s.Equal(256, len(b)*8)
 }
+
+func (s *DockerSuite) TestRegistryMirror() {
+	mirrored, ok := mirrorRepository("mirror.example.com", "alpine")
+	s.True(ok)
+	s.Equal("mirror.example.com/library/alpine", mirrored)
+
+	mirrored, ok = mirrorRepository("mirror.example.com", "docker.io/wercker/app")
+	s.True(ok)
+	s.Equal("mirror.example.com/wercker/app", mirrored)
+
+	_, ok = mirrorRepository("mirror.example.com", "quay.io/wercker/app")
+	s.False(ok)
+	_, ok = mirrorRepository("", "alpine")
+	s.False(ok)
+
+	host, err := parseRegistryMirror("https://mirror.example.com:5000/")
+	s.NoError(err)
+	s.Equal("mirror.example.com:5000", host)
+	for _, invalid := range []string{"mirror.example.com", "ftp://mirror.example.com", "https://mirror.example.com/v2/library"} {
+		_, err := parseRegistryMirror(invalid)
+		s.Error(err, invalid)
+	}
+
+	step := builtInPushStep(map[string]string{"registry-mirror": "https://mirror.example.com"})
+	step.configure(util.NewEnvironment())
+	s.NoError(step.configErr)
+	step.dockerOptions = &Options{Host: "unix:///var/run/docker.sock"}
+	s.Equal("mirror.example.com", step.clientOptions().RegistryMirror)
+	s.Equal("", step.dockerOptions.RegistryMirror)
+
+	step = builtInPushStep(map[string]string{"registry-mirror": "mirror.example.com"})
+	step.configure(util.NewEnvironment())
+	s.Error(step.configErr)
+}
@@ -15,6 +15,8 @@
 package dockerlocal
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 
@@ -26,20 +28,84 @@ import (
 // EmitStatus emits the json message on r
 func EmitStatus(e *core.NormalizedEmitter, r io.Reader, options *core.PipelineOptions) {
 	s := NewJSONMessageProcessor()
-	dec := json.NewDecoder(r)
+	decodeJSONMessages(r, func(m *jsonmessage.JSONMessage) {
+		line := util.Redact(s.ProcessJSONMessage(m))
+		e.Emit(core.Logs, &core.LogsArgs{
+			Logs:   line,
+			Stream: "docker",
+		})
+	})
+}
+
+// decodeJSONMessages calls handle with every json message on r. The daemon
+// writes a message per line, a line that doesn't parse is logged and skipped
+// so the rest of the stream is still emitted and the writer never blocks.
+// Messages split across multiple writes are handled.
+func decodeJSONMessages(r io.Reader, handle func(*jsonmessage.JSONMessage)) {
+	br := bufio.NewReader(r)
 	for {
-		var m jsonmessage.JSONMessage
-		if err := dec.Decode(&m); err == io.EOF {
+		line, readErr := br.ReadBytes('\n')
+		dec := json.NewDecoder(bytes.NewReader(line))
+		for {
+			var m jsonmessage.JSONMessage
+			if err := dec.Decode(&m); err == io.EOF {
+				break
+			} else if err != nil {
+				util.RootLogger().Errorln("Unable to parse docker message:", err)
+				break
+			}
+			handle(&m)
+		}
+
+		if readErr != nil {
 			// Once the EOF is reached the function will stop
-			break
-		} else if err != nil {
-			util.RootLogger().Panic(err)
+			if readErr != io.EOF {
+				util.RootLogger().Errorln("Unable to read docker messages:", readErr)
+			}
+			return
 		}
+	}
+}
 
-		line := s.ProcessJSONMessage(&m)
+// dockerStreamKind is the operation a JSON stream of the docker daemon
+// reports on
+type dockerStreamKind string
+
+const (
+	dockerStreamPush dockerStreamKind = "push"
+	dockerStreamPull dockerStreamKind = "pull"
+)
+
+// emitDockerJSONStream emits the json messages of the push or pull on r
+// with the parsed progress of the layer the message is about.
+func emitDockerJSONStream(e *core.NormalizedEmitter, r io.Reader, options *core.PipelineOptions, kind dockerStreamKind) {
+	s := newPushMessageProcessor()
+	if kind == dockerStreamPull {
+		s = newPullMessageProcessor()
+	}
+	decodeJSONMessages(r, func(m *jsonmessage.JSONMessage) {
 		e.Emit(core.Logs, &core.LogsArgs{
-			Logs:   line,
-			Stream: "docker",
+			Logs:     util.Redact(s.ProcessJSONMessage(m)),
+			Stream:   "docker",
+			Progress: layerProgress(m),
 		})
+	})
+}
+
+// layerProgress returns the progress reported in m, or nil if m doesn't
+// report progress for a layer.
+func layerProgress(m *jsonmessage.JSONMessage) *core.LayerProgress {
+	if m.ID == "" || m.Progress == nil {
+		return nil
+	}
+	p := &core.LayerProgress{
+		ID:      m.ID,
+		Status:  m.Status,
+		Current: m.Progress.Current,
+		Total:   m.Progress.Total,
+	}
+	if p.Total > 0 {
+		p.Percentage = float64(p.Current) / float64(p.Total) * 100
 	}
+	return p
 }
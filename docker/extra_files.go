@@ -0,0 +1,146 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wercker/wercker/core"
+)
+
+// ExtraFile is a file that is added to a scratch image next to the
+// artifact. Source is a path on the host or, below the guest root, a path in
+// the container of a directory wercker mounts from the host.
+type ExtraFile struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Mode is the octal file mode in the image, the mode of Source if empty
+	Mode string `json:"mode"`
+
+	mode os.FileMode
+}
+
+// name is the path of the file in the layer, it can't escape the root of the
+// image
+func (e ExtraFile) name() string {
+	return strings.TrimPrefix(path.Clean("/"+e.Destination), "/")
+}
+
+// parseExtraFiles parses and validates the extra-files property, a JSON
+// array of ExtraFile objects.
+func parseExtraFiles(value string) ([]ExtraFile, error) {
+	var extraFiles []ExtraFile
+	if err := json.Unmarshal([]byte(value), &extraFiles); err != nil {
+		return nil, fmt.Errorf("extra-files must be a JSON array of {source, destination, mode} objects: %v", err)
+	}
+
+	for i := range extraFiles {
+		extraFile := &extraFiles[i]
+		if extraFile.Source == "" {
+			return nil, fmt.Errorf("extra-files[%d]: source is required", i)
+		}
+		if extraFile.name() == "" {
+			return nil, fmt.Errorf("extra-files[%d]: invalid destination %q", i, extraFile.Destination)
+		}
+		if extraFile.Mode != "" {
+			mode, err := strconv.ParseUint(extraFile.Mode, 8, 32)
+			if err != nil || mode > 07777 {
+				return nil, fmt.Errorf("extra-files[%d]: invalid mode %q, expected an octal mode like 0644", i, extraFile.Mode)
+			}
+			extraFile.mode = os.FileMode(mode)
+		}
+	}
+	return extraFiles, nil
+}
+
+// resolveExtraFiles maps the sources in the guest root to the host and checks
+// that every source is a regular file.
+func resolveExtraFiles(options *core.PipelineOptions, extraFiles []ExtraFile) ([]ExtraFile, error) {
+	resolved := make([]ExtraFile, len(extraFiles))
+	for i, extraFile := range extraFiles {
+		source := hostSourcePath(options, extraFile.Source)
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, fmt.Errorf("extra-files: unable to read %s: %v", extraFile.Source, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("extra-files: %s is not a regular file", extraFile.Source)
+		}
+		extraFile.Source = source
+		if extraFile.Mode == "" {
+			extraFile.mode = info.Mode().Perm()
+		}
+		resolved[i] = extraFile
+	}
+	return resolved, nil
+}
+
+// hostSourcePath maps source to the host if it is below the guest root,
+// wercker mounts the directories there from the run directory on the host.
+// Other paths are already on the host.
+func hostSourcePath(options *core.PipelineOptions, source string) string {
+	if rel, err := filepath.Rel(options.GuestRoot, source); err == nil && options.GuestRoot != "" && !strings.HasPrefix(rel, "..") {
+		return options.HostPath(rel)
+	}
+	return source
+}
+
+// writeExtraFiles appends extraFiles to the layer tw writes, if modTime is
+// not zero it is used as their timestamp.
+func writeExtraFiles(tw *tar.Writer, extraFiles []ExtraFile, modTime time.Time) error {
+	for _, extraFile := range extraFiles {
+		if err := writeExtraFile(tw, extraFile, modTime); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+func writeExtraFile(tw *tar.Writer, extraFile ExtraFile, modTime time.Time) error {
+	f, err := os.Open(extraFile.Source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		modTime = info.ModTime()
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:     extraFile.name(),
+		Typeflag: tar.TypeReg,
+		Mode:     int64(extraFile.mode),
+		Size:     info.Size(),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
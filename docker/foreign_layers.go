@@ -0,0 +1,184 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/layer"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/wercker/wercker/core"
+)
+
+// ForeignLayer is a layer which the pushed manifest references by URL instead
+// of uploading it to the registry, e.g. a non-distributable Windows base
+// layer. Path points to the uncompressed layer tarball on the host, which
+// docker load still needs, while URLs, Digest and Size describe the
+// compressed blob as it is served from the URLs.
+type ForeignLayer struct {
+	Path   string        `json:"path"`
+	URLs   []string      `json:"urls"`
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+
+	// diffID is the digest of the uncompressed layer at Path
+	diffID digest.Digest
+}
+
+// scratchManifestItem is an entry in the manifest.json of a docker save
+// tarball. Unlike the legacy repositories layout it lets us declare the
+// source of each layer.
+type scratchManifestItem struct {
+	Config       string
+	RepoTags     []string
+	Layers       []string
+	LayerSources map[layer.DiffID]distribution.Descriptor `json:",omitempty"`
+}
+
+// parseForeignLayers parses and validates the foreign-layers property, a JSON
+// array of ForeignLayer objects.
+func parseForeignLayers(value string) ([]ForeignLayer, error) {
+	var foreignLayers []ForeignLayer
+	if err := json.Unmarshal([]byte(value), &foreignLayers); err != nil {
+		return nil, fmt.Errorf("foreign-layers must be a JSON array of {path, urls, digest, size} objects: %v", err)
+	}
+
+	for i, foreignLayer := range foreignLayers {
+		if foreignLayer.Path == "" {
+			return nil, fmt.Errorf("foreign-layers[%d]: path is required", i)
+		}
+		if len(foreignLayer.URLs) == 0 {
+			return nil, fmt.Errorf("foreign-layers[%d]: at least one url is required", i)
+		}
+		for _, rawURL := range foreignLayer.URLs {
+			u, err := url.Parse(rawURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("foreign-layers[%d]: invalid url %q, expected an absolute http(s) url", i, rawURL)
+			}
+		}
+		if err := foreignLayer.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("foreign-layers[%d]: invalid digest %q: %v", i, foreignLayer.Digest, err)
+		}
+		if foreignLayer.Size <= 0 {
+			return nil, fmt.Errorf("foreign-layers[%d]: size must be positive", i)
+		}
+	}
+	return foreignLayers, nil
+}
+
+// resolveForeignLayers maps the paths of the foreign layers to the host the
+// same way as the sources of extra-files, a relative path is relative to the
+// source directory of the pipeline.
+func resolveForeignLayers(options *core.PipelineOptions, foreignLayers []ForeignLayer) ([]ForeignLayer, error) {
+	resolved := make([]ForeignLayer, len(foreignLayers))
+	for i, foreignLayer := range foreignLayers {
+		layerPath := foreignLayer.Path
+		if !filepath.IsAbs(layerPath) {
+			layerPath = filepath.Join(options.SourcePath(), layerPath)
+		}
+		layerPath = hostSourcePath(options, layerPath)
+		info, err := os.Stat(layerPath)
+		if err != nil {
+			return nil, fmt.Errorf("foreign-layers: unable to read %s: %v", foreignLayer.Path, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("foreign-layers: %s is not a regular file", foreignLayer.Path)
+		}
+		foreignLayer.Path = layerPath
+		resolved[i] = foreignLayer
+	}
+	return resolved, nil
+}
+
+// loadDiffID computes the DiffID of the layer from the tarball at Path
+func (f *ForeignLayer) loadDiffID() error {
+	layerFile, err := os.Open(f.Path)
+	if err != nil {
+		return fmt.Errorf("Unable to read foreign layer: %v", err)
+	}
+	defer layerFile.Close()
+
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), layerFile); err != nil {
+		return err
+	}
+	f.diffID = digester.Digest()
+	return nil
+}
+
+// descriptor returns the distribution descriptor for the foreign layer
+func (f *ForeignLayer) descriptor() distribution.Descriptor {
+	return distribution.Descriptor{
+		MediaType: schema2.MediaTypeForeignLayer,
+		Size:      f.Size,
+		Digest:    f.Digest,
+		URLs:      f.URLs,
+	}
+}
+
+// foreignLayerPath is the path of the i-th foreign layer in the scratch tarball
+func foreignLayerPath(i int) string {
+	return filepath.Join(fmt.Sprintf("foreign-%d", i), "layer.tar")
+}
+
+// scratchManifest builds the manifest.json for a scratch image made up of the
+// baseLayers layers of the base image, the foreign layers, the splitLayers
+// layers split off from the artifact and the layer with layerID.
+func scratchManifest(layerID string, repoTags []string, baseLayers int, foreignLayers []ForeignLayer, splitLayers int) []scratchManifestItem {
+	item := scratchManifestItem{
+		Config:       filepath.Join(layerID, "json"),
+		RepoTags:     repoTags,
+		LayerSources: make(map[layer.DiffID]distribution.Descriptor),
+	}
+	for i := 0; i < baseLayers; i++ {
+		item.Layers = append(item.Layers, baseLayerPath(i))
+	}
+	for i, foreignLayer := range foreignLayers {
+		item.Layers = append(item.Layers, foreignLayerPath(i))
+		item.LayerSources[layer.DiffID(foreignLayer.diffID)] = foreignLayer.descriptor()
+	}
+	for i := 0; i < splitLayers; i++ {
+		item.Layers = append(item.Layers, splitLayerPath(i))
+	}
+	item.Layers = append(item.Layers, filepath.Join(layerID, "layer.tar"))
+	return []scratchManifestItem{item}
+}
+
+// copyFile copies the file at src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,80 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/wercker/wercker/util"
+)
+
+// parseHealthcheck builds the healthcheck of the image from the healthcheck
+// properties of the step. The healthcheck property is the command, which is
+// run with the shell like the shell form of HEALTHCHECK in a Dockerfile, or
+// NONE to disable a healthcheck inherited from the base image. It returns
+// nil if no healthcheck is configured.
+func parseHealthcheck(data map[string]string, env *util.Environment) (*container.HealthConfig, error) {
+	test, ok := data["healthcheck"]
+	if !ok {
+		return nil, nil
+	}
+	test = strings.TrimSpace(env.Interpolate(test))
+	if test == "" {
+		return nil, fmt.Errorf("healthcheck must not be empty")
+	}
+
+	healthcheck := &container.HealthConfig{}
+	if test == "NONE" {
+		healthcheck.Test = []string{"NONE"}
+		return healthcheck, nil
+	}
+	healthcheck.Test = []string{"CMD-SHELL", test}
+
+	durations := []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"healthcheck-interval", &healthcheck.Interval},
+		{"healthcheck-timeout", &healthcheck.Timeout},
+		{"healthcheck-start-period", &healthcheck.StartPeriod},
+	}
+	for _, d := range durations {
+		value, ok := data[d.key]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(env.Interpolate(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a duration like 30s or 1m: %v", d.key, err)
+		}
+		if parsed < 0 {
+			return nil, fmt.Errorf("%s must not be negative", d.key)
+		}
+		*d.dst = parsed
+	}
+
+	if retries, ok := data["healthcheck-retries"]; ok {
+		parsed, err := strconv.Atoi(env.Interpolate(retries))
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("healthcheck-retries must be a positive number: %s", retries)
+		}
+		healthcheck.Retries = parsed
+	}
+	return healthcheck, nil
+}
@@ -0,0 +1,63 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import "strings"
+
+// internalEnv are the variables wercker sets for the pipeline, they describe
+// the run and not the image and may hold secrets, so they are left out of
+// pushed images
+var internalEnv = []string{"BUILD", "DEPLOY", "CI"}
+
+// internalEnvPrefix marks the variables wercker sets for the run, like
+// WERCKER_RUN_ID and WERCKER_GIT_COMMIT
+const internalEnvPrefix = "WERCKER_"
+
+// envKey returns the name of a KEY=value variable
+func envKey(kv string) string {
+	return strings.SplitN(kv, "=", 2)[0]
+}
+
+// isInternalEnv reports whether key is a variable wercker sets for the run
+func isInternalEnv(key string) bool {
+	for _, internal := range internalEnv {
+		if key == internal {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, internalEnvPrefix)
+}
+
+// mergeEnv merges the KEY=value lists base and override, keeping the order
+// of base and appending the keys only in override
+func mergeEnv(base, override []string) []string {
+	if len(base) == 0 {
+		return override
+	}
+	merged := make([]string, 0, len(base)+len(override))
+	index := map[string]int{}
+	for _, list := range [][]string{base, override} {
+		for _, kv := range list {
+			key := envKey(kv)
+			if i, ok := index[key]; ok {
+				merged[i] = kv
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,109 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/wercker/wercker/core"
+	"golang.org/x/net/context"
+)
+
+// InlineCacheConfigKey is the key BuildKit stores the inline build cache
+// metadata under in the image config, `--cache-from` reads it from there
+const InlineCacheConfigKey = "moby.buildkit.cache.v0"
+
+// hasInlineCache reports whether the image config has inline build cache
+// metadata
+func hasInlineCache(config []byte) (bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(config, &fields); err != nil {
+		return false, err
+	}
+	_, ok := fields[InlineCacheConfigKey]
+	return ok, nil
+}
+
+// pushedInlineCache fetches the config of the pushed manifest dgst from repo
+// and checks it for inline build cache metadata
+func pushedInlineCache(ctx context.Context, repo distribution.Repository, dgst digest.Digest) (bool, error) {
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return false, err
+	}
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return false, err
+	}
+	deserialized, ok := manifest.(*schema2.DeserializedManifest)
+	if !ok {
+		return false, fmt.Errorf("Unsupported manifest type %T", manifest)
+	}
+	config, err := repo.Blobs(ctx).Get(ctx, deserialized.Config.Digest)
+	if err != nil {
+		return false, err
+	}
+	return hasInlineCache(config)
+}
+
+// reportInlineCache tells whether the pushed images carry inline build
+// cache metadata. The metadata is written by BuildKit builds, committed
+// containers never have it. Nothing here fails the push.
+func (s *DockerPushStep) reportInlineCache(ctx context.Context, e *core.NormalizedEmitter, committed bool) {
+	if !s.inlineCache || s.dockerOptions.Local {
+		return
+	}
+	report := func(msg string) {
+		e.Emit(core.Logs, &core.LogsArgs{
+			Logs: fmt.Sprintf("%s\n", msg),
+		})
+	}
+	if committed {
+		s.logger.Warnln("inline-cache: committed containers have no build cache")
+		report("Inline build cache not embedded: only images built with BuildKit and BUILDKIT_INLINE_CACHE=1 carry it, push such an image with the image option")
+		return
+	}
+
+	repo, err := newRegistryRepository(ctx, s.repository, s.authenticator.Username(), s.authenticator.Password(), s.registryTransport, s.insecureRegistry)
+	if err != nil {
+		s.logger.WithError(err).Warnln("inline-cache: unable to connect to the registry")
+		report("Unable to check the pushed image for inline build cache")
+		return
+	}
+	checked := make(map[string]bool)
+	for _, tag := range s.tags {
+		dgst, ok := s.digests[tag]
+		if !ok || checked[dgst] {
+			continue
+		}
+		checked[dgst] = true
+		ref := fmt.Sprintf("%s@%s", s.repository, dgst)
+		embedded, err := pushedInlineCache(ctx, repo, digest.Digest(dgst))
+		switch {
+		case err != nil:
+			s.logger.WithError(err).Warnln("inline-cache: unable to check", ref)
+			report(fmt.Sprintf("Unable to check %s for inline build cache", ref))
+		case embedded:
+			report(fmt.Sprintf("Inline build cache embedded in %s, use it with --cache-from", ref))
+		default:
+			s.logger.Warnln("inline-cache: no inline build cache in", ref)
+			report(fmt.Sprintf("Inline build cache not embedded in %s: build the image with BuildKit and BUILDKIT_INLINE_CACHE=1", ref))
+		}
+	}
+}
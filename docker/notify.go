@@ -0,0 +1,126 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// notifyTimeout limits a single request to the notify-url
+const notifyTimeout = 10 * time.Second
+
+// notifyRetryDelay is the delay before the notification is sent again after
+// it failed, it is sent at most twice
+var notifyRetryDelay = 2 * time.Second
+
+// PushNotification is the JSON payload posted to the notify-url after a push
+type PushNotification struct {
+	Repository string           `json:"repository"`
+	Tags       []core.PushedTag `json:"tags"`
+	RunID      string           `json:"runId"`
+}
+
+// parseNotifyURL validates the notify-url option, an http(s) url
+func parseNotifyURL(notifyURL string) (string, error) {
+	u, err := url.Parse(notifyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("Invalid notify-url, expected an http or https url")
+	}
+	return u.String(), nil
+}
+
+// notification returns the payload describing the pushed tags
+func (s *DockerPushStep) notification() *PushNotification {
+	n := &PushNotification{
+		Repository: s.repository,
+		Tags:       []core.PushedTag{},
+		RunID:      s.options.RunID,
+	}
+	for _, tag := range s.tags {
+		if dgst, ok := s.digests[tag]; ok {
+			n.Tags = append(n.Tags, core.PushedTag{Tag: tag, Digest: dgst})
+		}
+	}
+	return n
+}
+
+// notify posts the notification of the push to the notify-url, retrying
+// once if the request fails or the webhook responds with a server error.
+// The url is left out of errors as webhook urls often embed a token.
+func (s *DockerPushStep) notify(ctx context.Context) error {
+	if s.notifyURL == "" || s.dockerOptions.Local {
+		return nil
+	}
+	body, err := json.Marshal(s.notification())
+	if err != nil {
+		return err
+	}
+	client := &http.Client{}
+	if s.dockerOptions.Proxy != "" {
+		transport, err := util.NewProxyTransport(s.dockerOptions.Proxy)
+		if err != nil {
+			return err
+		}
+		client.Transport = transport
+	}
+
+	backoff := &util.Backoff{Base: notifyRetryDelay, MaxAttempts: 2}
+	err = backoff.Retry(ctx, func(attempt int) error {
+		return s.postNotification(ctx, client, body)
+	}, func(attempt int, delay time.Duration, err error) {
+		s.logger.WithError(err).Warnln("Push notification failed, retrying in", delay)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to send the push notification: %v", err)
+	}
+	s.logger.Debugln("Sent push notification for", s.repository)
+	return nil
+}
+
+// postNotification does a single attempt to post body to the notify-url
+func (s *DockerPushStep) postNotification(ctx context.Context, client *http.Client, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", s.notifyURL, bytes.NewReader(body))
+	if err != nil {
+		return util.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ctxhttp.Do(ctx, client, req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return util.Permanent(fmt.Errorf("webhook responded with %s", resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ImageFormatDocker pushes scratch images by loading a docker save
+	// tarball into the daemon (default)
+	ImageFormatDocker = "docker"
+	// ImageFormatOCI writes scratch images as an OCI image layout and pushes
+	// it straight to the registry
+	ImageFormatOCI = "oci"
+
+	// LayerCompressionNone leaves scratch layers uncompressed (default)
+	LayerCompressionNone = "none"
+	// LayerCompressionGzip compresses the layers of scratch images with
+	// format oci with gzip
+	LayerCompressionGzip = "gzip"
+)
+
+// ociManifest is an OCI image manifest that can be pushed with the
+// distribution client.
+type ociManifest struct {
+	specs.Versioned
+	MediaType string          `json:"mediaType"`
+	Config    v1.Descriptor   `json:"config"`
+	Layers    []v1.Descriptor `json:"layers"`
+	// Annotations of the manifest, unlike labels they aren't part of the
+	// image config
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	payload []byte
+}
+
+// References implements distribution.Manifest
+func (m *ociManifest) References() []distribution.Descriptor {
+	refs := []distribution.Descriptor{ociDescriptor(m.Config)}
+	for _, l := range m.Layers {
+		refs = append(refs, ociDescriptor(l))
+	}
+	return refs
+}
+
+// Payload implements distribution.Manifest
+func (m *ociManifest) Payload() (string, []byte, error) {
+	return v1.MediaTypeImageManifest, m.payload, nil
+}
+
+func ociDescriptor(d v1.Descriptor) distribution.Descriptor {
+	return distribution.Descriptor{
+		MediaType: d.MediaType,
+		Digest:    d.Digest,
+		Size:      d.Size,
+	}
+}
+
+func init() {
+	// Let the distribution client accept and parse OCI manifests, it only
+	// knows the docker manifests. Registering fails if a newer client knows
+	// them already, which is fine.
+	distribution.RegisterManifestSchema(v1.MediaTypeImageManifest, unmarshalOCIManifest)
+	distribution.RegisterManifestSchema(v1.MediaTypeImageIndex, unmarshalOCIIndex)
+}
+
+// unmarshalOCIManifest parses a manifest pulled from a registry, keeping its
+// payload so it can be pushed unchanged
+func unmarshalOCIManifest(p []byte) (distribution.Manifest, distribution.Descriptor, error) {
+	m := &ociManifest{payload: p}
+	if err := json.Unmarshal(p, m); err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	return m, distribution.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+	}, nil
+}
+
+// ociIndex is an OCI image index pulled from a registry, e.g. a multi-arch
+// image
+type ociIndex struct {
+	specs.Versioned
+	Manifests []v1.Descriptor `json:"manifests"`
+
+	payload []byte
+}
+
+// References implements distribution.Manifest, the manifests of the index
+func (i *ociIndex) References() []distribution.Descriptor {
+	refs := []distribution.Descriptor{}
+	for _, m := range i.Manifests {
+		refs = append(refs, ociDescriptor(m))
+	}
+	return refs
+}
+
+// Payload implements distribution.Manifest
+func (i *ociIndex) Payload() (string, []byte, error) {
+	return v1.MediaTypeImageIndex, i.payload, nil
+}
+
+func unmarshalOCIIndex(p []byte) (distribution.Manifest, distribution.Descriptor, error) {
+	i := &ociIndex{payload: p}
+	if err := json.Unmarshal(p, i); err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	return i, distribution.Descriptor{
+		MediaType: v1.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(p),
+		Size:      int64(len(p)),
+	}, nil
+}
+
+// annotationKeyPattern matches the reverse domain notation the OCI spec
+// asks annotation keys to use, e.g. org.opencontainers.image.created
+var annotationKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9]+([._-][a-zA-Z0-9]+)*$`)
+
+// parseAnnotations parses the annotations option, key=value pairs like
+// labels, and checks that the keys are valid
+func parseAnnotations(logger *util.LogEntry, env *util.Environment, annotations string) (map[string]string, error) {
+	parsed, err := parseLabels(logger, env, annotations)
+	if err != nil {
+		return nil, err
+	}
+	for key := range parsed {
+		if !annotationKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("Invalid annotation key %q, expected reverse domain notation like org.opencontainers.image.title", key)
+		}
+	}
+	return parsed, nil
+}
+
+// ociImage is a scratch image or artifact written as an OCI image layout
+type ociImage struct {
+	dir      string
+	manifest *ociManifest
+}
+
+// writeOCILayout writes an OCI image layout to dir for the image with the
+// config and the uncompressed layer tarballs at layerPaths, bottom layer
+// first. Every tag is added to the index. With LayerCompressionGzip the
+// layer blobs are compressed with gzip at level, the diff ids in the config
+// remain those of the uncompressed layers. annotations are set on the
+// manifest.
+func writeOCILayout(dir string, config []byte, layerPaths []string, tags []string, compression string, level int, annotations map[string]string) (*ociImage, error) {
+	img, err := newOCILayout(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	configDesc, err := img.writeBlob(v1.MediaTypeImageConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &ociManifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   v1.MediaTypeImageManifest,
+		Config:      configDesc,
+		Layers:      []v1.Descriptor{},
+		Annotations: annotations,
+	}
+	for _, layerPath := range layerPaths {
+		var layerDesc v1.Descriptor
+		if compression == LayerCompressionGzip {
+			layerDesc, err = img.copyGzipBlob(v1.MediaTypeImageLayerGzip, layerPath, level)
+		} else {
+			layerDesc, err = img.copyBlob(v1.MediaTypeImageLayer, layerPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, layerDesc)
+	}
+	return img, img.writeManifest(manifest, tags)
+}
+
+// writeOCIArtifact writes an OCI image layout to dir for an artifact that
+// isn't a container image, like a Helm chart. The file at path is the single
+// layer of the artifact with mediaType, the config has artifactType as its
+// media type. Every tag is added to the index.
+func writeOCIArtifact(dir, artifactType string, config []byte, path, mediaType string, tags []string) (*ociImage, error) {
+	img, err := newOCILayout(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	configDesc, err := img.writeBlob(artifactType, config)
+	if err != nil {
+		return nil, err
+	}
+	fileDesc, err := img.copyBlob(mediaType, path)
+	if err != nil {
+		return nil, err
+	}
+	// Clients like oras name the file after the title when pulling it
+	fileDesc.Annotations = map[string]string{v1.AnnotationTitle: filepath.Base(path)}
+	manifest := &ociManifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []v1.Descriptor{fileDesc},
+	}
+	return img, img.writeManifest(manifest, tags)
+}
+
+// newOCILayout creates an empty OCI image layout in dir, anything that was
+// in dir before is removed.
+func newOCILayout(dir string) (*ociImage, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", string(digest.Canonical)), 0755); err != nil {
+		return nil, err
+	}
+
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, v1.ImageLayoutFile), layout, 0644); err != nil {
+		return nil, err
+	}
+	return &ociImage{dir: dir}, nil
+}
+
+// writeManifest writes manifest to the layout and adds it to the index for
+// every tag.
+func (img *ociImage) writeManifest(manifest *ociManifest, tags []string) error {
+	var err error
+	manifest.payload, err = json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc, err := img.writeBlob(v1.MediaTypeImageManifest, manifest.payload)
+	if err != nil {
+		return err
+	}
+	img.manifest = manifest
+
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []v1.Descriptor{},
+	}
+	for _, tag := range tags {
+		desc := manifestDesc
+		desc.Annotations = map[string]string{v1.AnnotationRefName: tag}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(img.dir, "index.json"), indexJSON, 0644)
+}
+
+// blobPath is the path of the blob with dgst in the layout
+func (img *ociImage) blobPath(dgst digest.Digest) string {
+	return filepath.Join(img.dir, "blobs", string(dgst.Algorithm()), dgst.Hex())
+}
+
+func (img *ociImage) writeBlob(mediaType string, content []byte) (v1.Descriptor, error) {
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	return desc, ioutil.WriteFile(img.blobPath(desc.Digest), content, 0644)
+}
+
+func (img *ociImage) copyBlob(mediaType, path string) (v1.Descriptor, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(img.dir, "blobs"), "blob")
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), in)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digester.Digest(),
+		Size:      size,
+	}
+	tmp.Close()
+	return desc, os.Rename(tmp.Name(), img.blobPath(desc.Digest))
+}
+
+// copyGzipBlob copies the file at path into the layout compressed with gzip
+// at level, the descriptor is the one of the compressed blob
+func (img *ociImage) copyGzipBlob(mediaType, path string, level int) (v1.Descriptor, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Join(img.dir, "blobs"), "blob")
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	gz, err := gzip.NewWriterLevel(io.MultiWriter(tmp, digester.Hash(), counter), level)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return v1.Descriptor{}, err
+	}
+	if _, err := io.Copy(gz, in); err != nil {
+		os.Remove(tmp.Name())
+		return v1.Descriptor{}, err
+	}
+	if err := gz.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digester.Digest(),
+		Size:      counter.n,
+	}
+	tmp.Close()
+	return desc, os.Rename(tmp.Name(), img.blobPath(desc.Digest))
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// push uploads the blobs the registry doesn't have yet and then the
+// manifest for every tag. It returns the digest of the manifest.
+func (img *ociImage) push(ctx context.Context, repo distribution.Repository, tags []string) (digest.Digest, error) {
+	blobs := repo.Blobs(ctx)
+	for _, desc := range append([]v1.Descriptor{img.manifest.Config}, img.manifest.Layers...) {
+		if _, err := blobs.Stat(ctx, desc.Digest); err == nil {
+			continue
+		} else if err != distribution.ErrBlobUnknown {
+			return "", err
+		}
+		if err := img.pushBlob(ctx, blobs, desc); err != nil {
+			return "", fmt.Errorf("Unable to push blob %s: %v", desc.Digest, err)
+		}
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return "", err
+	}
+	var dgst digest.Digest
+	for _, tag := range tags {
+		dgst, err = manifests.Put(ctx, img.manifest, distribution.WithTag(tag))
+		if err != nil {
+			return "", fmt.Errorf("Unable to push manifest for tag %s: %v", tag, err)
+		}
+	}
+	return dgst, nil
+}
+
+func (img *ociImage) pushBlob(ctx context.Context, blobs distribution.BlobStore, desc v1.Descriptor) error {
+	f, err := os.Open(img.blobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := blobs.Create(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Cancel(ctx)
+		return err
+	}
+	_, err = w.Commit(ctx, ociDescriptor(desc))
+	return err
+}
+
+// registryCredentials provides the step credentials to the distribution
+// client
+type registryCredentials struct {
+	username string
+	password string
+}
+
+func (c *registryCredentials) Basic(*url.URL) (string, string) {
+	return c.username, c.password
+}
+
+func (c *registryCredentials) RefreshToken(*url.URL, string) string {
+	return ""
+}
+
+func (c *registryCredentials) SetRefreshToken(*url.URL, string, string) {
+}
+
+// newRegistryRepository connects to the registry of repository, a full
+// repository name like quay.io/wercker/app, and authorizes push and pull
+// access. Requests go through rt, and insecure registries are addressed over
+// http.
+func newRegistryRepository(ctx context.Context, repository, username, password string, rt http.RoundTripper, insecure bool) (distribution.Repository, error) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return nil, err
+	}
+	domain := reference.Domain(named)
+	if domain == "docker.io" {
+		domain = "registry-1.docker.io"
+	}
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	baseURL := (&url.URL{Scheme: scheme, Host: domain}).String()
+
+	// Find out how the registry wants us to authenticate
+	manager := challenge.NewSimpleManager()
+	resp, err := (&http.Client{Transport: rt}).Get(baseURL + "/v2/")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if err := manager.AddResponse(resp); err != nil {
+		return nil, err
+	}
+
+	path := reference.Path(named)
+	creds := &registryCredentials{username: username, password: password}
+	authorizer := auth.NewAuthorizer(manager,
+		auth.NewTokenHandler(rt, creds, path, "pull", "push"),
+		auth.NewBasicHandler(creds))
+
+	name, err := reference.WithName(path)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewRepository(ctx, name, baseURL, transport.NewTransport(rt, authorizer))
+}
@@ -37,6 +37,13 @@ type Options struct {
 	MemorySwap        int64
 	KernelMemory      int64
 	CleanupImage      bool
+	// RegistryMirror is the host of a pull-through cache of the Docker Hub,
+	// images of the Docker Hub are pulled through it. Pushes are not
+	// affected.
+	RegistryMirror string
+	// Proxy the connections to a docker host over tcp and to registries
+	// go through, the proxy env vars are used if it is empty
+	Proxy string
 }
 
 func guessAndUpdateDockerOptions(opts *Options, e *util.Environment) {
@@ -121,6 +128,7 @@ func NewOptions(c util.Settings, e *util.Environment) (*Options, error) {
 	dockerMemorySwap, _ := c.Int("docker-memory-swap")
 	dockerKernelMemory, _ := c.Int("docker-kernel-memory")
 	dockerCleanupImage, _ := c.Bool("docker-cleanup-image")
+	proxy, _ := c.GlobalString("proxy")
 
 	speculativeOptions := &Options{
 		Host:              dockerHost,
@@ -135,6 +143,7 @@ func NewOptions(c util.Settings, e *util.Environment) (*Options, error) {
 		MemorySwap:        int64(dockerMemorySwap) * 1024 * 1024,
 		KernelMemory:      int64(dockerKernelMemory) * 1024 * 1024,
 		CleanupImage:      dockerCleanupImage,
+		Proxy:             proxy,
 	}
 
 	// We're going to try out a few settings and set DockerHost if
@@ -0,0 +1,77 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wercker/wercker/util"
+)
+
+const (
+	// DefaultImageArchitecture is the architecture of scratch images
+	// unless the step sets one
+	DefaultImageArchitecture = "amd64"
+	// DefaultImageOS is the os of scratch images unless the step sets one
+	DefaultImageOS = "linux"
+)
+
+// knownOS are the GOOS values an image can be built for
+var knownOS = []string{
+	"android", "darwin", "dragonfly", "freebsd", "linux", "netbsd",
+	"openbsd", "plan9", "solaris", "windows",
+}
+
+// knownArchitectures are the GOARCH values an image can be built for
+var knownArchitectures = []string{
+	"386", "amd64", "arm", "arm64", "mips", "mips64", "mips64le",
+	"mipsle", "ppc64", "ppc64le", "s390x",
+}
+
+// validatePlatform checks os and architecture against the values known to
+// Go and docker.
+func validatePlatform(os, architecture string) error {
+	if !util.ContainsString(knownOS, os) {
+		return fmt.Errorf("Unknown os %q, expected one of: %s", os, strings.Join(knownOS, ", "))
+	}
+	if !util.ContainsString(knownArchitectures, architecture) {
+		return fmt.Errorf("Unknown architecture %q, expected one of: %s", architecture, strings.Join(knownArchitectures, ", "))
+	}
+	return nil
+}
+
+// parsePlatform splits a platform like linux/arm64/v8 into its os,
+// architecture and optional variant
+func parsePlatform(platform string) (os, architecture, variant string, err error) {
+	parts := strings.Split(strings.TrimSpace(platform), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("Invalid platform %q, expected os/architecture or os/architecture/variant", platform)
+	}
+	if len(parts) == 3 {
+		variant = parts[2]
+	}
+	return parts[0], parts[1], variant, nil
+}
+
+// formatPlatform returns the platform of os, architecture and variant like
+// docker expects it, e.g. linux/arm64/v8
+func formatPlatform(os, architecture, variant string) string {
+	platform := os + "/" + architecture
+	if variant != "" {
+		platform += "/" + variant
+	}
+	return platform
+}
@@ -0,0 +1,389 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pborman/uuid"
+	"github.com/wercker/docker-check-access"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+// DockerPromoteStep copies an image that was pushed before to another
+// repository, e.g. from a staging to a production registry. The manifest is
+// copied unchanged so the digest stays the same, and the blobs are streamed
+// between the registries or mounted if both repositories are on the same
+// registry. Nothing is pulled into the docker daemon.
+//
+// The destination uses the registry and authentication options of the push
+// step. The source uses the same options prefixed with source-, e.g.
+// source-username, or the credentials of the destination if it has none and
+// is on the same registry.
+type DockerPromoteStep struct {
+	*DockerPushStep
+
+	// source is the image to promote, with a tag or a digest
+	source string
+	// sourceRepository is the repository of source without tag or digest
+	sourceRepository string
+	// sourceTag and sourceDigest are the image of sourceRepository to copy,
+	// the digest wins if both are set
+	sourceTag    string
+	sourceDigest digest.Digest
+	// sourceStep has the registry and credentials of the source, it is nil
+	// if those of the destination are used
+	sourceStep *DockerPushStep
+}
+
+// NewDockerPromoteStep constructor
+func NewDockerPromoteStep(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *Options) (*DockerPromoteStep, error) {
+	name := "docker-promote"
+	displayName := "docker promote"
+	if stepConfig.Name != "" {
+		displayName = stepConfig.Name
+	}
+
+	// Add a random number to the name to prevent collisions on disk
+	stepSafeID := fmt.Sprintf("%s-%s", name, uuid.NewRandom().String())
+
+	baseStep := core.NewBaseStep(core.BaseStepOptions{
+		DisplayName: displayName,
+		Env:         &util.Environment{},
+		ID:          name,
+		Name:        name,
+		Owner:       "wercker",
+		SafeID:      stepSafeID,
+		Version:     util.Version(),
+	})
+
+	dockerPushStep := &DockerPushStep{
+		BaseStep:      baseStep,
+		data:          stepConfig.Data,
+		dockerOptions: dockerOptions,
+		options:       options,
+		logger:        util.RootLogger().WithField("Logger", "DockerPromoteStep"),
+	}
+
+	return &DockerPromoteStep{DockerPushStep: dockerPushStep}, nil
+}
+
+// InitEnv parses the options of the push step for the destination and those
+// of the source
+func (s *DockerPromoteStep) InitEnv(env *util.Environment) {
+	s.DockerPushStep.InitEnv(env)
+	if s.configErr == nil {
+		s.configurePromote(env)
+	}
+}
+
+func (s *DockerPromoteStep) configurePromote(env *util.Environment) {
+	if source, ok := s.data["source"]; ok {
+		s.source = env.Interpolate(source)
+	}
+	if s.source == "" {
+		s.logger.Errorln("source is required to promote an image")
+		s.configErr = fmt.Errorf("source is required to promote an image")
+		return
+	}
+	named, err := reference.ParseNormalizedNamed(s.source)
+	if err != nil {
+		s.logger.Errorln("Invalid source:", s.source)
+		s.configErr = fmt.Errorf("Invalid source %q: %v", s.source, err)
+		return
+	}
+	s.sourceRepository = reference.TrimNamed(named).String()
+	if digested, ok := named.(reference.Digested); ok {
+		s.sourceDigest = digested.Digest()
+	} else {
+		s.sourceTag = reference.TagNameOnly(named).(reference.Tagged).Tag()
+	}
+
+	// The destination keeps the tag of the source unless tags are set
+	if !s.tagsConfigured && s.sourceTag != "" {
+		s.tags = []string{s.sourceTag}
+	}
+
+	sourceData := map[string]string{"repository": reference.FamiliarName(reference.TrimNamed(named))}
+	for key, value := range s.data {
+		if strings.HasPrefix(key, "source-") {
+			sourceData[strings.TrimPrefix(key, "source-")] = value
+		}
+	}
+	if len(sourceData) == 1 && sameRegistry(s.sourceRepository, s.repository) {
+		return
+	}
+	s.sourceStep = &DockerPushStep{
+		BaseStep:      s.BaseStep,
+		data:          sourceData,
+		dockerOptions: s.dockerOptions,
+		options:       s.options,
+		logger:        s.logger.WithField("Source", s.source),
+	}
+	s.sourceStep.InitEnv(env)
+	if s.sourceStep.configErr != nil {
+		s.configErr = fmt.Errorf("Invalid source options: %v", s.sourceStep.configErr)
+		return
+	}
+	s.sourceRepository = s.sourceStep.repository
+}
+
+// sameRegistry reports whether the repositories a and b are on the same
+// registry
+func sameRegistry(a, b string) bool {
+	namedA, err := reference.ParseNormalizedNamed(a)
+	if err != nil {
+		return false
+	}
+	namedB, err := reference.ParseNormalizedNamed(b)
+	if err != nil {
+		return false
+	}
+	return reference.Domain(namedA) == reference.Domain(namedB)
+}
+
+// Execute copies the source image to every tag of the destination
+// repository, with --docker-local nothing is copied.
+func (s *DockerPromoteStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
+	if s.configErr != nil {
+		return -1, s.configErr
+	}
+
+	s.tags = s.buildTags()
+	if done, err := s.handleEmptyTags(); done {
+		if err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	if s.dockerOptions.Local {
+		s.logger.Println("Skipping promotion of", s.source, "in local mode")
+		return 0, nil
+	}
+
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return 1, err
+	}
+
+	for _, step := range []*DockerPushStep{s.DockerPushStep, s.sourceStep} {
+		if step == nil {
+			continue
+		}
+		if err := step.authorizeDevice(ctx); err != nil {
+			return -1, err
+		}
+	}
+
+	check, err := s.authenticator.CheckAccess(s.repository, auth.Push)
+	if !check || err != nil {
+		s.logger.Errorln("Not allowed to interact with this repository:", s.repository)
+		return -1, fmt.Errorf("Not allowed to interact with this repository: %s", s.repository)
+	}
+	s.repository = s.authenticator.Repository(s.repository)
+
+	source := s.DockerPushStep
+	if s.sourceStep != nil {
+		source = s.sourceStep
+	}
+	check, err = source.authenticator.CheckAccess(s.sourceRepository, auth.Pull)
+	if !check || err != nil {
+		s.logger.Errorln("Not allowed to pull from this repository:", s.sourceRepository)
+		return -1, fmt.Errorf("Not allowed to pull from this repository: %s", s.sourceRepository)
+	}
+	s.sourceRepository = source.authenticator.Repository(s.sourceRepository)
+
+	srcRepo, err := newRegistryRepository(ctx, s.sourceRepository, source.authenticator.Username(), source.authenticator.Password(), source.registryTransport, source.insecureRegistry)
+	if err != nil {
+		s.logger.Errorln("Unable to connect to the source registry:", err)
+		return 1, err
+	}
+	dstRepo, err := newRegistryRepository(ctx, s.repository, s.authenticator.Username(), s.authenticator.Password(), s.registryTransport, s.insecureRegistry)
+	if err != nil {
+		s.logger.Errorln("Unable to connect to the registry:", err)
+		return 1, err
+	}
+
+	dgst := s.sourceDigest
+	if dgst == "" {
+		desc, err := srcRepo.Tags(ctx).Get(ctx, s.sourceTag)
+		if err != nil {
+			s.logger.Errorln("Unable to resolve", s.source, err)
+			return 1, fmt.Errorf("Unable to resolve %s: %v", s.source, err)
+		}
+		dgst = desc.Digest
+	}
+	s.logger.WithFields(util.LogFields{
+		"Source":     s.source,
+		"Digest":     dgst,
+		"Repository": s.repository,
+		"Tags":       s.tags,
+	}).Debug("Promoting image")
+
+	copier := &imageCopier{src: srcRepo, dst: dstRepo, e: e, copied: make(map[digest.Digest]bool)}
+	if sameRegistry(s.sourceRepository, s.repository) {
+		copier.mountFrom = srcRepo.Named()
+	}
+	m, err := copier.copyReferences(ctx, dgst)
+	if err != nil {
+		s.logger.Errorln("Failed to promote:", err)
+		return 1, err
+	}
+
+	manifests, err := dstRepo.Manifests(ctx)
+	if err != nil {
+		return 1, err
+	}
+	for _, tag := range s.tags {
+		pushed, err := manifests.Put(ctx, m, distribution.WithTag(tag))
+		if err != nil {
+			s.logger.Errorln("Failed to promote:", err)
+			return 1, fmt.Errorf("Unable to push manifest for tag %s: %v", tag, err)
+		}
+		if pushed != dgst {
+			return 1, fmt.Errorf("Promoted %s as %s:%s with digest %s instead of %s", s.source, s.repository, tag, pushed, dgst)
+		}
+		s.setDigest(tag, string(dgst))
+		s.logger.Println("Promoted", s.source, "to", s.repository, tag, ",Digest:", dgst)
+		e.Emit(core.Logs, &core.LogsArgs{
+			Logs: fmt.Sprintf("\nPromoted %s to %s:%s\n", s.source, s.repository, tag),
+		})
+	}
+	return s.finishPush(ctx, sess)
+}
+
+// imageCopier copies what manifests reference from one repository to
+// another
+type imageCopier struct {
+	src distribution.Repository
+	dst distribution.Repository
+	// mountFrom is the name of src on its registry if blobs can be mounted
+	// from it, i.e. if src and dst are on the same registry
+	mountFrom reference.Named
+	e         *core.NormalizedEmitter
+	copied    map[digest.Digest]bool
+}
+
+// copyReferences copies the blobs of the manifest with dgst to dst, and for
+// manifest lists the manifests of every platform with their blobs. It
+// returns the manifest, which is left for the caller to push.
+func (c *imageCopier) copyReferences(ctx context.Context, dgst digest.Digest) (distribution.Manifest, error) {
+	manifests, err := c.src.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get manifest %s: %v", dgst, err)
+	}
+
+	switch m.(type) {
+	case *manifestlist.DeserializedManifestList, *ociIndex:
+		dstManifests, err := c.dst.Manifests(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range m.References() {
+			platformManifest, err := c.copyReferences(ctx, desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := dstManifests.Put(ctx, platformManifest); err != nil {
+				return nil, fmt.Errorf("Unable to push manifest %s: %v", desc.Digest, err)
+			}
+		}
+	default:
+		for _, desc := range m.References() {
+			if err := c.copyBlob(ctx, desc); err != nil {
+				return nil, fmt.Errorf("Unable to copy blob %s: %v", desc.Digest, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+// copyBlob copies a blob unless dst has it already. Foreign layers are left
+// out, registries don't store them.
+func (c *imageCopier) copyBlob(ctx context.Context, desc distribution.Descriptor) error {
+	if desc.MediaType == schema2.MediaTypeForeignLayer || desc.MediaType == v1.MediaTypeImageLayerNonDistributable {
+		return nil
+	}
+	if c.copied[desc.Digest] {
+		return nil
+	}
+	blobs := c.dst.Blobs(ctx)
+	if _, err := blobs.Stat(ctx, desc.Digest); err == nil {
+		c.copied[desc.Digest] = true
+		c.emitStatus(desc.Digest, "Layer already exists")
+		return nil
+	} else if err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	options := []distribution.BlobCreateOption{}
+	if c.mountFrom != nil {
+		if canonical, err := reference.WithDigest(c.mountFrom, desc.Digest); err == nil {
+			options = append(options, client.WithMountFrom(canonical))
+		}
+	}
+	w, err := blobs.Create(ctx, options...)
+	if _, ok := err.(distribution.ErrBlobMounted); ok {
+		c.copied[desc.Digest] = true
+		c.emitStatus(desc.Digest, "Mounted from "+c.mountFrom.Name())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r, err := c.src.Blobs(ctx).Open(ctx, desc.Digest)
+	if err != nil {
+		w.Cancel(ctx)
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		w.Cancel(ctx)
+		return err
+	}
+	if _, err := w.Commit(ctx, desc); err != nil {
+		return err
+	}
+	c.copied[desc.Digest] = true
+	c.emitStatus(desc.Digest, "Pushed")
+	return nil
+}
+
+// emitStatus emits a status line for a blob like docker push does
+func (c *imageCopier) emitStatus(dgst digest.Digest, status string) {
+	id := dgst.Hex()
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	c.e.Emit(core.Logs, &core.LogsArgs{
+		Logs: fmt.Sprintf("%s: %s\n", id, status),
+	})
+}
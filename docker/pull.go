@@ -0,0 +1,184 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/docker/distribution/reference"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/pborman/uuid"
+	"github.com/wercker/docker-check-access"
+	"github.com/wercker/wercker/core"
+	"github.com/wercker/wercker/util"
+	"golang.org/x/net/context"
+)
+
+// DockerPullStep pulls an image into the docker daemon, for instance an
+// image pushed by an earlier pipeline. It uses the registry and
+// authentication options of the push step and can tag the pulled image
+// under a local name.
+type DockerPullStep struct {
+	*DockerPushStep
+
+	// tag is the single tag of the repository that is pulled
+	tag string
+	// localRepository and localTag are the name the pulled image is tagged
+	// as, if local-name is set
+	localRepository string
+	localTag        string
+}
+
+// NewDockerPullStep constructor
+func NewDockerPullStep(stepConfig *core.StepConfig, options *core.PipelineOptions, dockerOptions *Options) (*DockerPullStep, error) {
+	name := "docker-pull"
+	displayName := "docker pull"
+	if stepConfig.Name != "" {
+		displayName = stepConfig.Name
+	}
+
+	// Add a random number to the name to prevent collisions on disk
+	stepSafeID := fmt.Sprintf("%s-%s", name, uuid.NewRandom().String())
+
+	baseStep := core.NewBaseStep(core.BaseStepOptions{
+		DisplayName: displayName,
+		Env:         &util.Environment{},
+		ID:          name,
+		Name:        name,
+		Owner:       "wercker",
+		SafeID:      stepSafeID,
+		Version:     util.Version(),
+	})
+
+	dockerPushStep := &DockerPushStep{
+		BaseStep:      baseStep,
+		data:          stepConfig.Data,
+		dockerOptions: dockerOptions,
+		options:       options,
+		logger:        util.RootLogger().WithField("Logger", "DockerPullStep"),
+	}
+
+	return &DockerPullStep{DockerPushStep: dockerPushStep}, nil
+}
+
+// InitEnv parses the options of the push step and those of the pull
+func (s *DockerPullStep) InitEnv(env *util.Environment) {
+	s.DockerPushStep.InitEnv(env)
+	s.configurePull(env)
+}
+
+func (s *DockerPullStep) configurePull(env *util.Environment) {
+	tags := s.buildTags()
+	if len(tags) != 1 {
+		s.logger.Errorln("Exactly one tag can be pulled, got:", tags)
+		s.configErr = fmt.Errorf("Exactly one tag can be pulled, got %d", len(tags))
+		return
+	}
+	s.tag = tags[0]
+
+	if localName, ok := s.data["local-name"]; ok {
+		localName = env.Interpolate(localName)
+		named, err := reference.ParseNormalizedNamed(localName)
+		if err != nil {
+			s.logger.Errorln("Invalid local-name:", localName)
+			s.configErr = fmt.Errorf("Invalid local-name %q: %v", localName, err)
+			return
+		}
+		if _, ok := named.(reference.Digested); ok {
+			s.logger.Errorln("Invalid local-name:", localName)
+			s.configErr = fmt.Errorf("Invalid local-name %q: a digest can't be used as a local name", localName)
+			return
+		}
+		named = reference.TagNameOnly(named)
+		s.localRepository = reference.FamiliarName(named)
+		s.localTag = named.(reference.Tagged).Tag()
+	}
+}
+
+// Execute pulls the image from the registry and tags it under the
+// local-name. In local mode the image isn't pulled, it has to exist in the
+// daemon already.
+func (s *DockerPullStep) Execute(ctx context.Context, sess *core.Session) (int, error) {
+	if s.configErr != nil {
+		return -1, s.configErr
+	}
+	if err := s.authorizeDevice(ctx); err != nil {
+		return -1, err
+	}
+
+	client, err := NewDockerClient(s.clientOptions())
+	if err != nil {
+		return 1, err
+	}
+	e, err := core.EmitterFromContext(ctx)
+	if err != nil {
+		return 1, err
+	}
+
+	if !s.dockerOptions.Local {
+		check, err := s.authenticator.CheckAccess(s.repository, auth.Pull)
+		if err != nil {
+			s.logger.Errorln("Error interacting with this repository:", s.repository, err)
+			return -1, fmt.Errorf("Error interacting with this repository: %s %v", s.repository, err)
+		}
+		if !check {
+			return -1, fmt.Errorf("Not allowed to pull from this repository: %s", s.repository)
+		}
+	}
+	s.repository = s.authenticator.Repository(s.repository)
+	name := fmt.Sprintf("%s:%s", s.repository, s.tag)
+
+	if !s.dockerOptions.Local {
+		authConfig := docker.AuthConfiguration{
+			Username: s.authenticator.Username(),
+			Password: s.authenticator.Password(),
+			Email:    s.email,
+		}
+		err = pullWithRetry(ctx, e, s.options, name, s.pullRetryCount, func(w io.Writer) error {
+			if s.platformSet {
+				return pullImagePlatform(ctx, s.clientOptions(), name, formatPlatform(s.os, s.architecture, s.variant), authConfig, w)
+			}
+			return client.PullImage(docker.PullImageOptions{
+				Repository:    s.repository,
+				Tag:           s.tag,
+				OutputStream:  w,
+				RawJSONStream: true,
+			}, authConfig)
+		})
+		if err != nil {
+			return -1, fmt.Errorf("Unable to pull %s: %v", name, err)
+		}
+	}
+
+	image, err := client.InspectImage(name)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to inspect pulled image %s: %v", name, err)
+	}
+	s.logger.Println("Pulled", name, image.ID)
+
+	if s.localRepository != "" {
+		err = client.TagImage(image.ID, docker.TagImageOptions{
+			Repo:  s.localRepository,
+			Tag:   s.localTag,
+			Force: true,
+		})
+		if err != nil {
+			return -1, fmt.Errorf("Unable to tag %s as %s:%s: %v", name, s.localRepository, s.localTag, err)
+		}
+		s.logger.Println("Tagged", name, "as", s.localRepository+":"+s.localTag)
+	}
+	return 0, nil
+}
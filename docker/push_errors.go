@@ -0,0 +1,128 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"errors"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// The kinds of push failures, see PushErrorKind
+var (
+	// ErrPushUnauthorized means the registry rejected the credentials
+	ErrPushUnauthorized = errors.New("push unauthorized")
+	// ErrPushDenied means the credentials are valid but not allowed to push
+	// to the repository, or a quota or rate limit of the registry was hit
+	ErrPushDenied = errors.New("push denied")
+	// ErrPushNetwork means the registry couldn't be reached or failed with
+	// a server error, pushing again later may work
+	ErrPushNetwork = errors.New("push network error")
+	// ErrPushUnconfirmed means docker finished the push without reporting
+	// the pushed digest
+	ErrPushUnconfirmed = errors.New("push unconfirmed")
+	// ErrPushCanceled means the build was canceled or the push-timeout
+	// expired
+	ErrPushCanceled = errors.New("push canceled")
+	// ErrPushFailed is every other push failure, like an image the registry
+	// rejects or a failure of the docker daemon
+	ErrPushFailed = errors.New("push failed")
+)
+
+// PushError is returned by a failed push. Its message is meant for humans,
+// Kind for deciding what to do about the failure.
+type PushError struct {
+	// Kind is one of the ErrPush errors
+	Kind error
+	// Tag is the tag that failed to push, empty if the error covers
+	// several tags
+	Tag     string
+	message string
+}
+
+func (e *PushError) Error() string {
+	return e.message
+}
+
+// newPushError returns a PushError of kind for tag with the message of err
+func newPushError(kind error, tag string, err error) *PushError {
+	return &PushError{Kind: kind, Tag: tag, message: err.Error()}
+}
+
+// wrapPushError returns err with the kind and tag of cause, if cause is a
+// PushError. It keeps the kind of a push failure when its message is
+// extended.
+func wrapPushError(err, cause error) error {
+	if pushErr, ok := cause.(*PushError); ok {
+		return &PushError{Kind: pushErr.Kind, Tag: pushErr.Tag, message: err.Error()}
+	}
+	return err
+}
+
+// PushErrorKind returns the kind of a push failure, one of the ErrPush
+// errors, or nil if err isn't a PushError.
+func PushErrorKind(err error) error {
+	if pushErr, ok := err.(*PushError); ok {
+		return pushErr.Kind
+	}
+	return nil
+}
+
+// classifyPushStatus returns the kind of the error a push status reports.
+// The code of the errorDetail is either the http status code of the
+// registry response or one of the error codes of the registry API.
+func classifyPushStatus(status PushStatus) error {
+	if isUnauthorizedStatus(status) {
+		return ErrPushUnauthorized
+	}
+	message := status.Error
+	code := ""
+	if status.ErrorDetail != nil {
+		message = status.ErrorDetail.Message
+		code = strings.ToUpper(status.ErrorDetail.Code)
+	}
+	if isServerErrorCode(code) {
+		return ErrPushNetwork
+	}
+	switch code {
+	case "403", "429", "DENIED", "TOOMANYREQUESTS":
+		return ErrPushDenied
+	}
+	message = strings.ToLower(strings.TrimSpace(message))
+	if strings.HasPrefix(message, "denied") || strings.HasPrefix(message, "toomanyrequests") || strings.Contains(message, "quota") {
+		return ErrPushDenied
+	}
+	return ErrPushFailed
+}
+
+// classifyPushClientError returns the kind of an error of the docker client
+// during a push. The errors of the daemon itself have an http status code,
+// anything else didn't get a response.
+func classifyPushClientError(err error) error {
+	dockerErr, ok := err.(*docker.Error)
+	if !ok {
+		return ErrPushNetwork
+	}
+	switch {
+	case dockerErr.Status >= 500:
+		return ErrPushNetwork
+	case dockerErr.Status == 401:
+		return ErrPushUnauthorized
+	case dockerErr.Status == 403:
+		return ErrPushDenied
+	}
+	return ErrPushFailed
+}
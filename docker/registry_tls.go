@@ -0,0 +1,62 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/wercker/wercker/util"
+)
+
+// registryTransport returns the transport used when wercker talks to a
+// registry itself. insecure skips TLS verification, and caCert is the path
+// to a PEM bundle that is trusted in addition to the system roots. proxy
+// overrides the proxy env vars, see util.ProxyFunc.
+func registryTransport(insecure bool, caCert, proxy string) (http.RoundTripper, error) {
+	if !insecure && caCert == "" && proxy == "" {
+		return http.DefaultTransport, nil
+	}
+
+	transport, err := util.NewProxyTransport(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if !insecure && caCert == "" {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,68 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/util"
+)
+
+type ProxySuite struct {
+	*util.TestSuite
+}
+
+func TestProxySuite(t *testing.T) {
+	suiteTester := &ProxySuite{&util.TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *ProxySuite) TestRegistryTransportProxy() {
+	req, err := http.NewRequest("GET", "https://registry.example.com/v2/", nil)
+	s.Require().NoError(err)
+
+	rt, err := registryTransport(true, "", "proxy.example.com:3128")
+	s.Require().NoError(err)
+	transport, ok := rt.(*http.Transport)
+	s.Require().True(ok)
+	s.True(transport.TLSClientConfig.InsecureSkipVerify)
+	proxyURL, err := transport.Proxy(req)
+	s.NoError(err)
+	s.Equal("http://proxy.example.com:3128", proxyURL.String())
+
+	rt, err = registryTransport(false, "", "")
+	s.NoError(err)
+	s.Equal(http.DefaultTransport, rt)
+}
+
+func (s *ProxySuite) TestDockerClientProxy() {
+	req, err := http.NewRequest("GET", "http://127.0.0.1:2375/version", nil)
+	s.Require().NoError(err)
+
+	client, err := NewDockerClient(&Options{Host: "tcp://127.0.0.1:2375", Proxy: "proxy.example.com:3128"})
+	s.Require().NoError(err)
+	transport, ok := client.HTTPClient.Transport.(*http.Transport)
+	s.Require().True(ok)
+	proxyURL, err := transport.Proxy(req)
+	s.NoError(err)
+	s.Equal("http://proxy.example.com:3128", proxyURL.String())
+
+	// There is no proxy between wercker and a local docker daemon
+	transport = &http.Transport{}
+	s.NoError(setDockerProxy(transport, "unix:///var/run/docker.sock", "proxy.example.com:3128"))
+	s.Nil(transport.Proxy)
+}
@@ -0,0 +1,131 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/api/types/container"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+// ScratchLayerCache remembers the image JSON generated for a scratch layer,
+// keyed by the content hash of the layer and the image config. Reusing it
+// for unchanged content yields the same layer ID and image as the previous
+// push, so the image doesn't have to be loaded again if the daemon still has
+// it, and tags that point to it in the registry aren't pushed again.
+type ScratchLayerCache struct {
+	path string
+}
+
+// NewScratchLayerCache creates a ScratchLayerCache storing entries in path
+func NewScratchLayerCache(path string) *ScratchLayerCache {
+	return &ScratchLayerCache{path: path}
+}
+
+// Key computes the cache key for a layer with the given DiffID and config.
+// The hostname is ignored since it is derived from the pipeline container.
+func (c *ScratchLayerCache) Key(diffID digest.Digest, config *container.Config) (string, error) {
+	keyConfig := container.Config{}
+	if config != nil {
+		keyConfig = *config
+	}
+	keyConfig.Hostname = ""
+
+	js, err := json.Marshal(keyConfig)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(diffID))
+	hash.Write(js)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Get returns the image JSON cached for key, ok is false on a cache miss
+func (c *ScratchLayerCache) Get(key string) (js []byte, ok bool) {
+	js, err := ioutil.ReadFile(filepath.Join(c.path, key, "json"))
+	if err != nil {
+		return nil, false
+	}
+	return js, true
+}
+
+// Put stores the image JSON for key
+func (c *ScratchLayerCache) Put(key string, js []byte) error {
+	if err := os.MkdirAll(filepath.Join(c.path, key), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a partial entry is never read
+	tmp := filepath.Join(c.path, key, "json.tmp")
+	if err := ioutil.WriteFile(tmp, js, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.path, key, "json"))
+}
+
+// registryTagsUpToDate returns the tags of the step whose manifest in the
+// registry already has the image config with configDigest, with the
+// digests of their manifests. Tags that can't be checked are left out, they
+// are pushed as usual.
+func (s *DockerPushStep) registryTagsUpToDate(ctx context.Context, configDigest digest.Digest) map[string]digest.Digest {
+	upToDate := map[string]digest.Digest{}
+	repo, err := newRegistryRepository(ctx, s.repository, s.authenticator.Username(), s.authenticator.Password(), s.registryTransport, s.insecureRegistry)
+	if err != nil {
+		s.logger.WithError(err).Debug("Unable to check the pushed tags")
+		return upToDate
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		s.logger.WithError(err).Debug("Unable to check the pushed tags")
+		return upToDate
+	}
+	for _, tag := range s.tags {
+		desc, err := repo.Tags(ctx).Get(ctx, tag)
+		if err != nil {
+			continue
+		}
+		m, err := manifests.Get(ctx, desc.Digest)
+		if err != nil {
+			continue
+		}
+		if manifestConfigDigest(m) == configDigest {
+			upToDate[tag] = desc.Digest
+		}
+	}
+	return upToDate
+}
+
+// manifestConfigDigest returns the digest of the image config of m, or an
+// empty digest for manifests without one
+func manifestConfigDigest(m distribution.Manifest) digest.Digest {
+	switch m := m.(type) {
+	case *schema2.DeserializedManifest:
+		return m.Config.Digest
+	case *ociManifest:
+		return m.Config.Digest
+	}
+	return ""
+}
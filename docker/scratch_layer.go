@@ -0,0 +1,148 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/layer"
+	units "github.com/docker/go-units"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// scratchLayerFile is a layer tarball of a scratch image that is being
+// written to disk, it keeps track of the DiffID while it is written.
+type scratchLayerFile struct {
+	*os.File
+	digester digest.Digester
+}
+
+// newScratchLayerFile creates (or truncates) the layer tarball at path
+func newScratchLayerFile(path string) (*scratchLayerFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &scratchLayerFile{File: f, digester: digest.Canonical.Digester()}, nil
+}
+
+// Writer returns the writer for the contents of the layer
+func (l *scratchLayerFile) Writer() io.Writer {
+	return io.MultiWriter(l.File, l.digester.Hash())
+}
+
+// Reset throws away everything written so far, Writer needs to be called
+// again afterwards.
+func (l *scratchLayerFile) Reset() error {
+	if err := l.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.digester = digest.Canonical.Digester()
+	return nil
+}
+
+// DiffID is the digest of the layer contents written so far
+func (l *scratchLayerFile) DiffID() layer.DiffID {
+	return layer.DiffID(l.digester.Digest())
+}
+
+// scratchLayers are the layers of a scratch image written from the artifact
+type scratchLayers struct {
+	// files are the layers of layer-dirs followed by main
+	files []*scratchLayerFile
+	// main is the layer with the rest of the artifact
+	main *scratchLayerFile
+	// split are the layers of layer-dirs that aren't empty
+	split []*scratchLayerFile
+	// foreign are the foreign layers with their paths on the host
+	foreign []ForeignLayer
+}
+
+// diffIDs returns the DiffIDs of the image from the bottom up, the base and
+// foreign layers go below the layers of the artifact.
+func (l *scratchLayers) diffIDs(baseImage *scratchBaseImage) ([]layer.DiffID, error) {
+	diffIDs := []layer.DiffID{}
+	if baseImage != nil {
+		diffIDs = append(diffIDs, baseImage.config.RootFS.DiffIDs...)
+	}
+	for i := range l.foreign {
+		if err := l.foreign[i].loadDiffID(); err != nil {
+			return nil, err
+		}
+		diffIDs = append(diffIDs, layer.DiffID(l.foreign[i].diffID))
+	}
+	for _, splitLayer := range l.split {
+		diffIDs = append(diffIDs, splitLayer.DiffID())
+	}
+	return append(diffIDs, l.main.DiffID()), nil
+}
+
+// Close closes the layer files
+func (l *scratchLayers) Close() {
+	for _, layerFile := range l.files {
+		layerFile.Close()
+	}
+}
+
+// splitLayerPath is the path of the i-th layer split off from the artifact
+// in the scratch tarball
+func splitLayerPath(i int) string {
+	return filepath.Join(fmt.Sprintf("split-%d", i), "layer.tar")
+}
+
+// layerSizeLimit fails the writes to its writers once they have written
+// more than limit bytes together. A limit of 0 doesn't limit the size.
+type layerSizeLimit struct {
+	limit   int64
+	written int64
+}
+
+// Writer returns a writer to w that counts against the limit
+func (l *layerSizeLimit) Writer(w io.Writer) io.Writer {
+	if l.limit <= 0 {
+		return w
+	}
+	return &limitedLayerWriter{w: w, limit: l}
+}
+
+// Reset starts counting from 0 again
+func (l *layerSizeLimit) Reset() {
+	l.written = 0
+}
+
+type limitedLayerWriter struct {
+	w     io.Writer
+	limit *layerSizeLimit
+}
+
+func (w *limitedLayerWriter) Write(p []byte) (int, error) {
+	w.limit.written += int64(len(p))
+	if w.limit.written > w.limit.limit {
+		return 0, maxLayerSizeError(w.limit.limit)
+	}
+	return w.w.Write(p)
+}
+
+// maxLayerSizeError is returned when the artifact of a scratch image is
+// larger than max-layer-size
+func maxLayerSizeError(limit int64) error {
+	return fmt.Errorf("The artifact is larger than the max-layer-size of %s, make sure no build caches or other unneeded files are in the output directory", units.BytesSize(float64(limit)))
+}
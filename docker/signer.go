@@ -0,0 +1,93 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// SignerCosign signs pushed images with cosign
+	SignerCosign = "cosign"
+)
+
+// ImageSigner signs an image after it has been pushed. reference is the
+// immutable repository@digest reference of the pushed image, username and
+// password are the registry credentials used for the push.
+type ImageSigner interface {
+	Sign(ctx context.Context, reference, username, password string) error
+}
+
+// NewImageSigner returns the signer for the sign property, or nil if images
+// shouldn't be signed.
+func NewImageSigner(kind, key string) (ImageSigner, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case SignerCosign:
+		if key == "" {
+			return nil, fmt.Errorf("sign-key is required to sign with %s", SignerCosign)
+		}
+		return &CosignSigner{Key: key}, nil
+	default:
+		return nil, fmt.Errorf("Unknown signer %q, supported signers: %s", kind, SignerCosign)
+	}
+}
+
+// CosignSigner signs images by running the cosign binary on the host
+type CosignSigner struct {
+	// Key is passed to cosign --key, e.g. a file, a KMS URI or
+	// env://COSIGN_KEY
+	Key string
+}
+
+// args returns the cosign arguments to sign reference
+func (c *CosignSigner) args(reference string) []string {
+	return []string{"sign", "--yes", "--key", c.Key, reference}
+}
+
+// Sign implements ImageSigner. The registry credentials are passed in a
+// temporary docker config, other users of the host can read the arguments
+// of cosign.
+func (c *CosignSigner) Sign(ctx context.Context, reference, username, password string) error {
+	cmd := exec.CommandContext(ctx, "cosign", c.args(reference)...)
+	cmd.Env = os.Environ()
+	if username != "" {
+		configDir, err := ioutil.TempDir("", "cosign-docker-config")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(configDir)
+		repository := strings.SplitN(reference, "@", 2)[0]
+		if err := writeDockerConfig(configDir, repository, username, password); err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, "DOCKER_CONFIG="+configDir)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cosign failed to sign %s: %v: %s", reference, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/image"
+	"github.com/docker/docker/layer"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+// squashImage flattens the image committed from containerID into a single
+// layer with the file system of the container. The config of the committed
+// image, including what it inherited from the base image, is kept. The
+// squashed image gets the first tag of the step and its ID is returned.
+func (s *DockerPushStep) squashImage(ctx context.Context, containerID, imageID string) (string, error) {
+	officialClient, err := NewOfficialDockerClient(s.clientOptions())
+	if err != nil {
+		return "", err
+	}
+	inspect, _, err := officialClient.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		return "", err
+	}
+
+	layerPath := s.options.HostPath("squash.tar")
+	layerFile, err := newScratchLayerFile(layerPath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(layerPath)
+	defer layerFile.Close()
+
+	export, err := officialClient.ContainerExport(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("Unable to export container %s: %v", containerID, err)
+	}
+	_, err = io.Copy(layerFile.Writer(), export)
+	export.Close()
+	if err != nil {
+		return "", fmt.Errorf("Unable to export container %s: %v", containerID, err)
+	}
+
+	js, err := squashedImageJSON(inspect, layerFile.DiffID())
+	if err != nil {
+		return "", err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeSquashedImage(w, js, layerPath, fmt.Sprintf("%s:%s", s.repository, s.tags[0])))
+	}()
+	resp, err := officialClient.ImageLoad(ctx, r, true)
+	if err != nil {
+		r.CloseWithError(err)
+		return "", fmt.Errorf("Unable to load squashed image: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := imageLoadError(resp.Body); err != nil {
+		return "", fmt.Errorf("Unable to load squashed image: %v", err)
+	}
+
+	squashedID := digest.FromBytes(js).String()
+	s.logger.WithField("Image", squashedID).Debug("Squash completed")
+	return squashedID, nil
+}
+
+// squashedImageJSON returns the config of the image inspect describes with
+// diffID as its only layer
+func squashedImageJSON(inspect types.ImageInspect, diffID layer.DiffID) ([]byte, error) {
+	created, err := time.Parse(time.RFC3339Nano, inspect.Created)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid creation time of image %s: %v", inspect.ID, err)
+	}
+	img := image.Image{
+		V1Image: image.V1Image{
+			Comment:       inspect.Comment,
+			Created:       created,
+			Container:     inspect.Container,
+			DockerVersion: inspect.DockerVersion,
+			Author:        inspect.Author,
+			Config:        inspect.Config,
+			Architecture:  inspect.Architecture,
+			OS:            inspect.Os,
+		},
+		History: []image.History{{
+			Created: created,
+			Author:  inspect.Author,
+			Comment: "squashed by wercker",
+		}},
+		RootFS: &image.RootFS{
+			Type:    "layers",
+			DiffIDs: []layer.DiffID{diffID},
+		},
+	}
+	if inspect.ContainerConfig != nil {
+		img.ContainerConfig = *inspect.ContainerConfig
+	}
+	return img.MarshalJSON()
+}
+
+// writeSquashedImage writes a docker save tarball of the image with config
+// js and the single layer at layerPath to w, tagged with repoTag
+func writeSquashedImage(w io.Writer, js []byte, layerPath, repoTag string) error {
+	id := digest.FromBytes(js).Hex()
+	manifest, err := json.Marshal([]scratchManifestItem{{
+		Config:   id + ".json",
+		RepoTags: []string{repoTag},
+		Layers:   []string{id + "/layer.tar"},
+	}})
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, "manifest.json", manifest); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, id+".json", js); err != nil {
+		return err
+	}
+
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     id + "/layer.tar",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     info.Size(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(content)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+// imageLoadError returns the first error in the JSON messages docker load
+// responds with, or of the status stream of a pull
+func imageLoadError(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var status PushStatus
+		if err := dec.Decode(&status); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if status.ErrorDetail != nil && status.ErrorDetail.Message != "" {
+			return errors.New(status.ErrorDetail.Message)
+		}
+		if status.Error != "" {
+			return errors.New(status.Error)
+		}
+	}
+}
@@ -32,11 +32,38 @@ func NewJSONMessageProcessor() *JSONMessageProcessor {
 	return s
 }
 
+// newPullMessageProcessor creates a JSONMessageProcessor for the output of
+// a pull, which reports the state of every layer before its download starts.
+func newPullMessageProcessor() *JSONMessageProcessor {
+	s := NewJSONMessageProcessor()
+	s.layerStates = map[string]bool{
+		"Pulling fs layer":   true,
+		"Waiting":            true,
+		"Verifying Checksum": true,
+	}
+	return s
+}
+
+// newPushMessageProcessor creates a JSONMessageProcessor for the output of
+// a push, where a layer the registry already has is done without progress.
+func newPushMessageProcessor() *JSONMessageProcessor {
+	s := NewJSONMessageProcessor()
+	s.doneStates = map[string]bool{
+		"Already exists": true,
+	}
+	return s
+}
+
 // A JSONMessageProcessor will process JSONMessages and generate logs.
 type JSONMessageProcessor struct {
 	lastProgressLength int
 	message            *jsonmessage.JSONMessage
 	progressMessages   map[string]*jsonmessage.JSONMessage
+	// layerStates are statuses without progress that are shown with the
+	// progress of their layer instead of on a line of their own
+	layerStates map[string]bool
+	// doneStates are statuses that end the progress of their layer
+	doneStates map[string]bool
 }
 
 // ProcessJSONMessage will take JSONMessage m and generate logs based on the
@@ -46,6 +73,16 @@ func (s *JSONMessageProcessor) ProcessJSONMessage(m *jsonmessage.JSONMessage) st
 		return m.Stream
 	}
 
+	if m.ID != "" && s.layerStates[m.Status] {
+		s.progressMessages[m.ID] = m
+		return s.getOutput()
+	}
+	if s.doneStates[m.Status] {
+		delete(s.progressMessages, m.ID)
+		s.message = m
+		return s.getOutput()
+	}
+
 	switch m.Status {
 	case "Extracting":
 		fallthrough
@@ -15,10 +15,13 @@
 package dockerlocal
 
 import (
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/stretchr/testify/suite"
+	"github.com/wercker/wercker/core"
 	"github.com/wercker/wercker/util"
 )
 
@@ -283,3 +286,102 @@ func (s *StatusHandlerSuite) TestFormatDiskUnitBytes() {
 		s.Equal(actual, step.expected)
 	}
 }
+
+func (s *StatusHandlerSuite) TestEmitPushStreamSplitMessages() {
+	stream := `{"status":"Pushing","id":"a1b2c3d4e5f6","progressDetail":{"current":512,"total":2048}}` +
+		`{"status":"Preparing","id":"0f9e8d7c6b5a"}` +
+		`{"status":"Pushed","id":"a1b2c3d4e5f6","progressDetail":{}}`
+
+	progress := []*core.LayerProgress{}
+	e := core.NewNormalizedEmitter()
+	e.AddListener(core.Logs, func(args *core.LogsArgs) {
+		progress = append(progress, args.Progress)
+	})
+
+	// Reading a single byte at a time splits every message across reads
+	emitDockerJSONStream(e, iotest.OneByteReader(strings.NewReader(stream)), nil, dockerStreamPush)
+
+	s.Equal(3, len(progress))
+	s.Equal(&core.LayerProgress{
+		ID:         "a1b2c3d4e5f6",
+		Status:     "Pushing",
+		Current:    512,
+		Total:      2048,
+		Percentage: 25,
+	}, progress[0])
+	s.Nil(progress[1])
+	s.Equal("a1b2c3d4e5f6", progress[2].ID)
+	s.Equal(float64(0), progress[2].Percentage)
+}
+
+func (s *StatusHandlerSuite) TestEmitStatusMalformedMessage() {
+	stream := `{"stream":"Step 1/2 : FROM scratch\n"}` + "\n" +
+		`{"stream": not json}` + "\n" +
+		`{"stream":"Step 2/2 : COPY . /\n"}` + "\n"
+
+	logs := []string{}
+	e := core.NewNormalizedEmitter()
+	e.AddListener(core.Logs, func(args *core.LogsArgs) {
+		logs = append(logs, args.Logs)
+	})
+
+	// The malformed message is skipped and the stream keeps going
+	EmitStatus(e, iotest.OneByteReader(strings.NewReader(stream)), nil)
+
+	s.Equal([]string{"Step 1/2 : FROM scratch\n", "Step 2/2 : COPY . /\n"}, logs)
+}
+
+func (s *StatusHandlerSuite) TestPullLayerStates() {
+	waiting := &jsonmessage.JSONMessage{Status: "Waiting", ID: "a1b2c3d4e5f6"}
+	s.Equal("Waiting: a1b2c3d4e5f6\n", NewJSONMessageProcessor().ProcessJSONMessage(waiting))
+
+	// Pulls show the state of a layer with its progress
+	pull := newPullMessageProcessor()
+	s.Equal("Waiting: a1b2c3d4e5f6", pull.ProcessJSONMessage(waiting))
+}
+
+func (s *StatusHandlerSuite) TestPushAlreadyExists() {
+	pushing := &jsonmessage.JSONMessage{Status: "Pushing", ID: "a1b2c3d4e5f6"}
+	exists := &jsonmessage.JSONMessage{Status: "Already exists", ID: "a1b2c3d4e5f6"}
+
+	// A push ends the progress of the layer
+	push := newPushMessageProcessor()
+	s.Equal("Pushing: a1b2c3d4e5f6", push.ProcessJSONMessage(pushing))
+	s.Equal("\rAlready exists: a1b2c3d4e5f6\n", push.ProcessJSONMessage(exists))
+
+	// Other streams keep their progress
+	status := NewJSONMessageProcessor()
+	s.Equal("Pushing: a1b2c3d4e5f6", status.ProcessJSONMessage(pushing))
+	s.Equal("\rAlready exists: a1b2c3d4e5f6\nPushing: a1b2c3d4e5f6", status.ProcessJSONMessage(exists))
+}
+
+func (s *StatusHandlerSuite) TestEmitPullStream() {
+	stream := `{"status":"Pulling from library/alpine","id":"3.7"}` +
+		`{"status":"Pulling fs layer","id":"ff3a5c916c92"}` +
+		`{"status":"Downloading","id":"ff3a5c916c92","progressDetail":{"current":1024,"total":4096}}` +
+		`{"status":"Extracting","id":"ff3a5c916c92","progressDetail":{"current":4096,"total":4096}}` +
+		`{"status":"Pull complete","id":"ff3a5c916c92","progressDetail":{}}`
+
+	logs := []string{}
+	progress := []*core.LayerProgress{}
+	e := core.NewNormalizedEmitter()
+	e.AddListener(core.Logs, func(args *core.LogsArgs) {
+		logs = append(logs, args.Logs)
+		progress = append(progress, args.Progress)
+	})
+	emitDockerJSONStream(e, iotest.OneByteReader(strings.NewReader(stream)), nil, dockerStreamPull)
+
+	s.Equal(5, len(logs))
+	s.Equal("Pulling from library/alpine: 3.7\n", logs[0])
+	s.Equal("Pulling fs layer: ff3a5c916c92", logs[1])
+	s.Nil(progress[1])
+	s.Equal(&core.LayerProgress{
+		ID:         "ff3a5c916c92",
+		Status:     "Downloading",
+		Current:    1024,
+		Total:      4096,
+		Percentage: 25,
+	}, progress[2])
+	s.Equal("Extracting", progress[3].Status)
+	s.Equal(float64(100), progress[3].Percentage)
+}
@@ -32,6 +32,15 @@ func NewStep(config *core.StepConfig, options *core.PipelineOptions, dockerOptio
 	if config.ID == "internal/docker-scratch-push" {
 		return NewDockerScratchPushStep(config, options, dockerOptions)
 	}
+	if config.ID == "internal/docker-artifact-push" {
+		return NewDockerArtifactPushStep(config, options, dockerOptions)
+	}
+	if config.ID == "internal/docker-pull" {
+		return NewDockerPullStep(config, options, dockerOptions)
+	}
+	if config.ID == "internal/docker-promote" {
+		return NewDockerPromoteStep(config, options, dockerOptions)
+	}
 	if config.ID == "internal/docker-build" {
 		return NewDockerBuildStep(config, options, dockerOptions)
 	}
@@ -0,0 +1,73 @@
+//   Copyright © 2018, Oracle and/or its affiliates.  All rights reserved.
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dockerlocal
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/wercker/wercker/core"
+)
+
+// DefaultTagDateLayout is used for {date} placeholders without a layout
+const DefaultTagDateLayout = "20060102"
+
+// tagPlaceholder matches the build metadata placeholders that can be used in
+// tags: {commit}, {shortcommit}, {branch}, {buildid} and {date} or
+// {date:<go time layout>}
+var tagPlaceholder = regexp.MustCompile(`\{(commit|shortcommit|branch|buildid|date(:[^}]*)?)\}`)
+
+// tagUnsafe matches the characters that are not allowed in tags
+var tagUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// expandTagPlaceholders replaces the placeholders in tag with the metadata of
+// the build in options. The values are sanitized to valid tag characters, so
+// a branch like feature/foo becomes feature-foo.
+func expandTagPlaceholders(tag string, options *core.PipelineOptions, now time.Time) string {
+	return tagPlaceholder.ReplaceAllStringFunc(tag, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		var value string
+		switch {
+		case name == "commit":
+			value = gitCommit(options)
+		case name == "shortcommit":
+			value = gitCommit(options)
+			if len(value) > 7 {
+				value = value[:7]
+			}
+		case name == "branch":
+			if options.GitOptions != nil {
+				value = options.GitBranch
+			}
+		case name == "buildid":
+			value = options.RunID
+		case strings.HasPrefix(name, "date"):
+			layout := strings.TrimPrefix(strings.TrimPrefix(name, "date"), ":")
+			if layout == "" {
+				layout = DefaultTagDateLayout
+			}
+			value = now.UTC().Format(layout)
+		}
+		return tagUnsafe.ReplaceAllString(value, "-")
+	})
+}
+
+func gitCommit(options *core.PipelineOptions) string {
+	if options.GitOptions == nil {
+		return ""
+	}
+	return options.GitCommit
+}
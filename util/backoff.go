@@ -0,0 +1,160 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Backoff computes the delays between the attempts of an operation that is
+// retried. The delay starts at Base and is multiplied by Factor after every
+// attempt, up to Max.
+type Backoff struct {
+	// Base is the delay before the first retry
+	Base time.Duration
+	// Max caps the delay, 0 means no cap
+	Max time.Duration
+	// Factor the delay grows by, 2 if it is not set
+	Factor float64
+	// Jitter randomizes every delay by up to this fraction of it, e.g. 0.2
+	// for +/- 20%, so retries of concurrent operations spread out
+	Jitter float64
+	// MaxAttempts is the number of attempts Retry makes including the
+	// first, 0 means no limit
+	MaxAttempts int
+
+	// After waits for a delay, time.After if it is nil. Tests replace it
+	// with a fake clock.
+	After func(time.Duration) <-chan time.Time
+	// Random returns a number in [0, 1) for the jitter, rand.Float64 if it
+	// is nil
+	Random func() float64
+
+	attempt int
+}
+
+// Next returns the delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+	factor := b.Factor
+	if factor == 0 {
+		factor = 2
+	}
+	delay := float64(b.Base)
+	for i := 0; i < b.attempt; i++ {
+		delay *= factor
+		if b.Max > 0 && delay >= float64(b.Max) {
+			break
+		}
+	}
+	b.attempt++
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		random := b.Random
+		if random == nil {
+			random = rand.Float64
+		}
+		delay += delay * b.Jitter * (2*random() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Reset starts the delays over at Base.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// permanentError stops Retry
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string {
+	return p.err.Error()
+}
+
+// Permanent wraps err so Retry returns it without retrying.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// retryAfterError asks Retry to wait at least delay
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (r *retryAfterError) Error() string {
+	return r.err.Error()
+}
+
+// RetryAfter wraps err so Retry waits at least delay before the next
+// attempt, e.g. the Retry-After of a rate limited request.
+func RetryAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err, delay}
+}
+
+// Retry calls fn until it succeeds, returns an error wrapped with Permanent
+// or MaxAttempts is reached, waiting Next between the attempts, or longer for
+// an error wrapped with RetryAfter. The last error of fn is returned, or the
+// error of ctx if it is done while waiting. onRetry is called before every
+// wait if it is not nil.
+func (b *Backoff) Retry(ctx context.Context, fn func(attempt int) error, onRetry func(attempt int, delay time.Duration, err error)) error {
+	after := b.After
+	if after == nil {
+		after = time.After
+	}
+	b.Reset()
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+		if p, ok := err.(*permanentError); ok {
+			return p.err
+		}
+		var minDelay time.Duration
+		if r, ok := err.(*retryAfterError); ok {
+			err, minDelay = r.err, r.delay
+		}
+		if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+			return err
+		}
+
+		delay := b.Next()
+		if delay < minDelay {
+			delay = minDelay
+		}
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		select {
+		case <-after(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/context"
+)
+
+type BackoffSuite struct {
+	*TestSuite
+}
+
+func TestBackoffSuite(t *testing.T) {
+	suiteTester := &BackoffSuite{&TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+// fakeClock records the delays it is asked to wait for and returns
+// immediately
+type fakeClock struct {
+	waited []time.Duration
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waited = append(c.waited, d)
+	ch := make(chan time.Time, 1)
+	ch <- time.Time{}
+	return ch
+}
+
+func (s *BackoffSuite) TestNext() {
+	b := &Backoff{Base: time.Second, Max: 5 * time.Second}
+	s.Equal(time.Second, b.Next())
+	s.Equal(2*time.Second, b.Next())
+	s.Equal(4*time.Second, b.Next())
+	s.Equal(5*time.Second, b.Next())
+	s.Equal(5*time.Second, b.Next())
+
+	b.Reset()
+	s.Equal(time.Second, b.Next())
+
+	b = &Backoff{Base: time.Second, Factor: 3}
+	b.Next()
+	s.Equal(3*time.Second, b.Next())
+}
+
+func (s *BackoffSuite) TestNextJitter() {
+	random := 0.0
+	b := &Backoff{Base: 10 * time.Second, Jitter: 0.5, Random: func() float64 { return random }}
+	s.Equal(5*time.Second, b.Next())
+
+	b.Reset()
+	random = 0.75
+	s.Equal(12500*time.Millisecond, b.Next())
+}
+
+func (s *BackoffSuite) TestRetry() {
+	clock := &fakeClock{}
+	b := &Backoff{Base: time.Second, MaxAttempts: 3, After: clock.After}
+
+	attempts := 0
+	err := b.Retry(context.Background(), func(attempt int) error {
+		attempts = attempt
+		if attempt < 3 {
+			return errors.New("flaky")
+		}
+		return nil
+	}, nil)
+	s.NoError(err)
+	s.Equal(3, attempts)
+	s.Equal([]time.Duration{time.Second, 2 * time.Second}, clock.waited)
+
+	// The last error is returned once all attempts failed
+	clock.waited = nil
+	retried := 0
+	err = b.Retry(context.Background(), func(attempt int) error {
+		return errors.New("down")
+	}, func(attempt int, delay time.Duration, err error) {
+		retried++
+	})
+	s.EqualError(err, "down")
+	s.Equal(2, retried)
+	s.Len(clock.waited, 2)
+}
+
+func (s *BackoffSuite) TestRetryPermanent() {
+	clock := &fakeClock{}
+	b := &Backoff{Base: time.Second, After: clock.After}
+
+	attempts := 0
+	err := b.Retry(context.Background(), func(attempt int) error {
+		attempts++
+		return Permanent(errors.New("denied"))
+	}, nil)
+	s.EqualError(err, "denied")
+	s.Equal(1, attempts)
+	s.Empty(clock.waited)
+}
+
+func (s *BackoffSuite) TestRetryAfter() {
+	clock := &fakeClock{}
+	b := &Backoff{Base: time.Second, MaxAttempts: 3, After: clock.After}
+
+	err := b.Retry(context.Background(), func(attempt int) error {
+		return RetryAfter(errors.New("slow down"), 30*time.Second)
+	}, nil)
+	s.EqualError(err, "slow down")
+	s.Equal([]time.Duration{30 * time.Second, 30 * time.Second}, clock.waited)
+
+	// The backoff is used when it is longer than the requested delay
+	clock.waited = nil
+	b.Base = time.Minute
+	b.Retry(context.Background(), func(attempt int) error {
+		return RetryAfter(errors.New("slow down"), time.Second)
+	}, nil)
+	s.Equal([]time.Duration{time.Minute, 2 * time.Minute}, clock.waited)
+}
+
+func (s *BackoffSuite) TestRetryCancel() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := &Backoff{Base: time.Hour}
+
+	attempts := 0
+	err := b.Retry(ctx, func(attempt int) error {
+		attempts++
+		return errors.New("flaky")
+	}, nil)
+	s.Equal(context.Canceled, err)
+	s.Equal(1, attempts)
+}
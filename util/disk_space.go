@@ -0,0 +1,64 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// FreeDiskSpace returns the bytes available to unprivileged users on the
+// file system path is on
+func FreeDiskSpace(path string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// CheckDiskSpace fails if writing needed bytes to the file system of path
+// would leave less than reserve bytes free. It is meant to fail early,
+// before a large write runs out of space halfway.
+func CheckDiskSpace(path string, needed, reserve int64) error {
+	free, err := FreeDiskSpace(path)
+	if err != nil {
+		return fmt.Errorf("Unable to check the free disk space of %s: %v", path, err)
+	}
+	if needed+reserve > free {
+		neededSize, neededUnit := ConvertUnit(needed + reserve)
+		freeSize, freeUnit := ConvertUnit(free)
+		return fmt.Errorf("Insufficient disk space in %s: %d %s needed, %d %s available", path, neededSize, neededUnit, freeSize, freeUnit)
+	}
+	return nil
+}
+
+// DirSize returns the total size of the regular files below dir
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,56 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DiskSpaceSuite struct {
+	*TestSuite
+}
+
+func TestDiskSpaceSuite(t *testing.T) {
+	suiteTester := &DiskSpaceSuite{&TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *DiskSpaceSuite) TestCheckDiskSpace() {
+	dir := s.WorkingDir()
+	s.NoError(CheckDiskSpace(dir, 0, 0))
+
+	free, err := FreeDiskSpace(dir)
+	s.Require().NoError(err)
+	err = CheckDiskSpace(dir, free, 1024)
+	s.Require().Error(err)
+	s.Contains(err.Error(), "Insufficient disk space in "+dir)
+
+	s.Error(CheckDiskSpace(filepath.Join(dir, "missing"), 0, 0))
+}
+
+func (s *DiskSpaceSuite) TestDirSize() {
+	dir := filepath.Join(s.WorkingDir(), "size")
+	s.Require().NoError(os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, 100), 0644))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 50), 0644))
+	size, err := DirSize(dir)
+	s.NoError(err)
+	s.Equal(int64(150), size)
+}
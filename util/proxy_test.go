@@ -0,0 +1,51 @@
+//   Copyright 2016 Wercker Holding BV
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package util
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProxySuite struct {
+	*TestSuite
+}
+
+func TestProxySuite(t *testing.T) {
+	suiteTester := &ProxySuite{&TestSuite{}}
+	suite.Run(t, suiteTester)
+}
+
+func (s *ProxySuite) TestProxyTransport() {
+	req, err := http.NewRequest("GET", "https://registry.example.com/v2/", nil)
+	s.Require().NoError(err)
+
+	for _, proxy := range []string{"http://proxy.example.com:3128", "proxy.example.com:3128"} {
+		transport, err := NewProxyTransport(proxy)
+		s.Require().NoError(err)
+		proxyURL, err := transport.Proxy(req)
+		s.NoError(err)
+		s.Equal("http://proxy.example.com:3128", proxyURL.String())
+	}
+
+	transport, err := NewProxyTransport("")
+	s.Require().NoError(err)
+	s.NotNil(transport.Proxy)
+
+	_, err = ProxyFunc("http://")
+	s.Error(err)
+}